@@ -0,0 +1,815 @@
+// Copyright 2019 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"fmt"
+	"math/bits"
+	"os"
+	"sync"
+)
+
+// This file implements the Advanced Interrupt Architecture: the Incoming MSI
+// Controller (IMSIC), the Advanced Platform-Level Interrupt Controller (APLIC)
+// and the Smaia/Ssaia CSRs. See "The RISC-V Advanced Interrupt Architecture",
+// version 1.0.
+
+// IMSIC interrupt file registers.
+//
+// AIA; Chapter 3.5; Table 3.1
+const (
+	imsicSetEIPNumLE = 0x0
+	imsicSetEIPNumBE = 0x4
+
+	// IMSICFileSize is the size of the address space of an interrupt file.
+	IMSICFileSize = 0x1000
+)
+
+// Registers of an interrupt file accessed indirectly through
+// miselect/mireg and siselect/sireg.
+//
+// AIA; Chapter 2.3 and 3.8
+const (
+	iselIprioFirst  = 0x30
+	iselIprioLast   = 0x3F
+	iselEIDelivery  = 0x70
+	iselEIThreshold = 0x72
+	iselEIPFirst    = 0x80
+	iselEIPLast     = 0xBF
+	iselEIEFirst    = 0xC0
+	iselEIELast     = 0xFF
+)
+
+// IMSIC is the Incoming MSI Controller of a single hart. It has one interrupt
+// file for machine level and one for supervisor level. Each file implements the
+// Device interface; MSIs are delivered by writing the interrupt identity to the
+// file's seteipnum_le register.
+type IMSIC struct {
+	M, S *IMSICFile
+}
+
+// NewIMSIC returns an IMSIC with the given number of interrupt identities and
+// attaches it to the hart. ids must be one less than a multiple of 64, between
+// 63 and 2047.
+func NewIMSIC(vm *VM, ids int) *IMSIC {
+	if ids < 63 || ids > 2047 || (ids+1)%64 != 0 {
+		panic(fmt.Sprintf("invalid number of IMSIC interrupt identities: %d", ids))
+	}
+	im := &IMSIC{
+		M: &IMSICFile{vm: vm, mip: mipMEIP, pending: make([]uint64, (ids+1)/64), enabled: make([]uint64, (ids+1)/64)},
+		S: &IMSICFile{vm: vm, mip: mipSEIP, pending: make([]uint64, (ids+1)/64), enabled: make([]uint64, (ids+1)/64)},
+	}
+	vm.IMSIC = im
+	return im
+}
+
+// IMSICFile is an IMSIC interrupt file. It drives mip.MEIP or mip.SEIP of its
+// hart.
+type IMSICFile struct {
+	mu        sync.Mutex
+	vm        *VM
+	mip       uint64   // the mip bit driven by this file
+	delivery  uint64   // eidelivery
+	threshold uint64   // eithreshold
+	pending   []uint64 // eip registers
+	enabled   []uint64 // eie registers
+}
+
+// Load implements the Device interface. The seteipnum registers read as zero.
+func (f *IMSICFile) Load(offset uint64, size int) (uint64, error) {
+	if size != 4 || offset%4 != 0 {
+		return 0, fmt.Errorf("IMSIC: unsupported %d-byte load at offset %#x", size, offset)
+	}
+	return 0, nil
+}
+
+// Store implements the Device interface.
+func (f *IMSICFile) Store(offset uint64, size int, v uint64) error {
+	if size != 4 || offset%4 != 0 {
+		return fmt.Errorf("IMSIC: unsupported %d-byte store at offset %#x", size, offset)
+	}
+	switch offset {
+	case imsicSetEIPNumLE:
+		f.SetPending(int(uint32(v)))
+	case imsicSetEIPNumBE:
+		f.SetPending(int(bits.ReverseBytes32(uint32(v))))
+	}
+	return nil
+}
+
+// SetPending marks the interrupt identity as pending, as if an MSI was
+// received. Identities that aren't implemented are ignored.
+func (f *IMSICFile) SetPending(id int) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if id <= 0 || id >= 64*len(f.pending) {
+		return
+	}
+	f.pending[id/64] |= 1 << uint(id%64)
+	f.update()
+}
+
+// top returns the pending and enabled identity with the highest priority (the
+// lowest number) that isn't masked by eithreshold, or 0 if there's none.
+func (f *IMSICFile) top() uint64 {
+	for i := range f.pending {
+		p := f.pending[i] & f.enabled[i]
+		if p == 0 {
+			continue
+		}
+		id := uint64(64*i + bits.TrailingZeros64(p))
+		if f.threshold != 0 && id >= f.threshold {
+			return 0
+		}
+		return id
+	}
+	return 0
+}
+
+// update reflects the state of the interrupt file in the hart's mip CSR.
+func (f *IMSICFile) update() {
+	f.vm.setMIP(f.mip, f.delivery == 1 && f.top() != 0)
+}
+
+// topei returns the value of the mtopei/stopei CSR. If claim is set, the
+// reported interrupt is claimed (its pending bit is cleared).
+//
+// AIA; Chapter 3.9
+func (f *IMSICFile) topei(claim bool) uint64 {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	id := f.top()
+	if claim && id != 0 {
+		f.pending[id/64] &^= 1 << (id % 64)
+		f.update()
+	}
+	return id<<16 | id
+}
+
+// readIndirect returns the value of the register selected by miselect or
+// siselect.
+func (f *IMSICFile) readIndirect(sel uint64) (uint64, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	switch {
+	case sel >= iselIprioFirst && sel <= iselIprioLast:
+		// Priorities of major interrupts aren't configurable.
+		return 0, nil
+	case sel == iselEIDelivery:
+		return f.delivery, nil
+	case sel == iselEIThreshold:
+		return f.threshold, nil
+	case sel >= iselEIPFirst && sel <= iselEIPLast:
+		return f.word(f.pending, sel-iselEIPFirst)
+	case sel >= iselEIEFirst && sel <= iselEIELast:
+		return f.word(f.enabled, sel-iselEIEFirst)
+	}
+	return 0, fmt.Errorf("invalid indirect CSR select %#x", sel)
+}
+
+// writeIndirect sets the value of the register selected by miselect or
+// siselect.
+func (f *IMSICFile) writeIndirect(sel, v uint64) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	switch {
+	case sel >= iselIprioFirst && sel <= iselIprioLast:
+		return nil
+	case sel == iselEIDelivery:
+		f.delivery = v & 1
+	case sel == iselEIThreshold:
+		f.threshold = v & uint64(64*len(f.pending)-1)
+	case sel >= iselEIPFirst && sel <= iselEIPLast:
+		if err := f.setWord(f.pending, sel-iselEIPFirst, v); err != nil {
+			return err
+		}
+	case sel >= iselEIEFirst && sel <= iselEIELast:
+		if err := f.setWord(f.enabled, sel-iselEIEFirst, v); err != nil {
+			return err
+		}
+	default:
+		return fmt.Errorf("invalid indirect CSR select %#x", sel)
+	}
+	f.update()
+	return nil
+}
+
+// word returns the k-th 32-bit eip/eie register. On RV64 only the even
+// registers exist and each of them holds 64 bits.
+func (f *IMSICFile) word(regs []uint64, k uint64) (uint64, error) {
+	if k%2 != 0 {
+		return 0, fmt.Errorf("IMSIC register %d doesn't exist on RV64", k)
+	}
+	if int(k/2) >= len(regs) {
+		return 0, nil
+	}
+	return regs[k/2], nil
+}
+
+func (f *IMSICFile) setWord(regs []uint64, k, v uint64) error {
+	if k%2 != 0 {
+		return fmt.Errorf("IMSIC register %d doesn't exist on RV64", k)
+	}
+	if int(k/2) >= len(regs) {
+		return nil
+	}
+	if k == 0 {
+		v &^= 1 // identity 0 doesn't exist
+	}
+	regs[k/2] = v
+	return nil
+}
+
+// readAIA returns the value of an Smaia/Ssaia CSR.
+func (vm *VM) readAIA(csr uint64) (uint64, error) {
+	if vm.IMSIC == nil {
+		return 0, fmt.Errorf("CSR %#x requires an IMSIC", csr)
+	}
+	switch csr {
+	case csrMireg:
+		return vm.IMSIC.M.readIndirect(vm.CSR[csrMiselect])
+	case csrSireg:
+		return vm.IMSIC.S.readIndirect(vm.CSR[csrSiselect])
+	case csrMtopei:
+		return vm.IMSIC.M.topei(false), nil
+	case csrStopei:
+		return vm.IMSIC.S.topei(false), nil
+	}
+	panic(fmt.Sprintf("CSR %#x isn't an AIA CSR", csr))
+}
+
+// writeAIA sets the value of an Smaia/Ssaia CSR. Any write to mtopei or stopei
+// claims the reported interrupt.
+func (vm *VM) writeAIA(csr, v uint64) error {
+	if vm.IMSIC == nil {
+		return fmt.Errorf("CSR %#x requires an IMSIC", csr)
+	}
+	switch csr {
+	case csrMireg:
+		return vm.IMSIC.M.writeIndirect(vm.CSR[csrMiselect], v)
+	case csrSireg:
+		return vm.IMSIC.S.writeIndirect(vm.CSR[csrSiselect], v)
+	case csrMtopei:
+		vm.IMSIC.M.topei(true)
+		return nil
+	case csrStopei:
+		vm.IMSIC.S.topei(true)
+		return nil
+	}
+	panic(fmt.Sprintf("CSR %#x isn't an AIA CSR", csr))
+}
+
+// APLIC registers.
+//
+// AIA; Chapter 4.5; Table 4.1
+const (
+	aplicDomaincfg    = 0x0000
+	aplicSourcecfg    = 0x0004 // sourcecfg[1] to sourcecfg[1023]
+	aplicMmsiaddrcfg  = 0x1BC0
+	aplicMmsiaddrcfgh = 0x1BC4
+	aplicSmsiaddrcfg  = 0x1BC8
+	aplicSmsiaddrcfgh = 0x1BCC
+	aplicSetip        = 0x1C00
+	aplicSetipnum     = 0x1CDC
+	aplicInClrip      = 0x1D00
+	aplicClripnum     = 0x1DDC
+	aplicSetie        = 0x1E00
+	aplicSetienum     = 0x1EDC
+	aplicClrie        = 0x1F00
+	aplicClrienum     = 0x1FDC
+	aplicSetipnumLE   = 0x2000
+	aplicSetipnumBE   = 0x2004
+	aplicGenmsi       = 0x3000
+	aplicTarget       = 0x3004 // target[1] to target[1023]
+	aplicIDC          = 0x4000 // interrupt delivery control; 32 bytes per hart
+	aplicIDCLen       = 0x20
+
+	// Registers of an interrupt delivery control structure.
+	idcIdelivery  = 0x00
+	idcIforce     = 0x04
+	idcIthreshold = 0x08
+	idcTopi       = 0x18
+	idcClaimi     = 0x1C
+
+	// APLICSize is the size of the address space of an APLIC domain. It
+	// has room for the delivery control structures of 512 harts.
+	APLICSize = 0x8000
+)
+
+// Fields of APLIC registers.
+const (
+	domaincfgIE  = 1 << 8 // interrupt enable
+	domaincfgDM  = 1 << 2 // delivery mode: 0 - direct, 1 - MSI
+	domaincfgRO  = 0x80 << 24
+	sourcecfgD   = 1 << 10 // delegate
+	msiaddrcfghL = 1 << 31 // lock
+
+	smInactive = 0
+	smDetached = 1
+	smEdge1    = 4 // rising edge
+	smEdge0    = 5 // falling edge
+	smLevel1   = 6 // asserted when high
+	smLevel0   = 7 // asserted when low
+)
+
+// APLIC is an interrupt domain of an Advanced Platform-Level Interrupt
+// Controller. It implements the Device interface.
+//
+// In direct delivery mode the domain drives mip.MEIP (machine-level domains)
+// or mip.SEIP (supervisor-level domains) of the harts. In MSI delivery mode it
+// forwards interrupts as MSIs written to the harts' IMSICs.
+type APLIC struct {
+	mu        sync.Mutex
+	smode     bool  // supervisor-level domain
+	harts     []*VM // harts whose delivery control structures the domain has
+	parent    *APLIC
+	child     *APLIC
+	sources   int // number of sources, including the non-existent source 0
+	domaincfg uint32
+	sourcecfg []uint32
+	target    []uint32
+	input     []bool   // current level of the interrupt wires
+	delegated []uint32 // bitmap of sources delegated to this domain by the parent
+	pending   []uint32 // bitmap
+	enabled   []uint32 // bitmap
+	idcs      []aplicIDCState
+
+	// msiaddr holds mmsiaddrcfg, mmsiaddrcfgh, smsiaddrcfg and
+	// smsiaddrcfgh. Only the root domain uses them. They're protected by
+	// msiMu instead of mu, because child domains read them while holding
+	// their own lock.
+	msiMu   sync.Mutex
+	msiaddr [4]uint32
+}
+
+type aplicIDCState struct {
+	delivery, force, threshold uint32
+}
+
+// NewAPLIC returns an interrupt domain with sources 1 to n (inclusive)
+// delivering interrupts to the given harts. The domain is a root domain unless
+// it's passed to AddChild. MSIs are written to the devices on the bus of the
+// harts.
+func NewAPLIC(n int, smode bool, harts ...*VM) *APLIC {
+	if n < 1 || n > 1023 {
+		panic(fmt.Sprintf("the APLIC supports 1 to 1023 interrupt sources; got %d", n))
+	}
+	if len(harts) == 0 || len(harts) > (APLICSize-aplicIDC)/aplicIDCLen {
+		panic(fmt.Sprintf("unsupported number of harts for the APLIC: %d", len(harts)))
+	}
+	words := (n + 1 + 31) / 32
+	a := &APLIC{
+		smode:     smode,
+		harts:     harts,
+		sources:   n + 1,
+		sourcecfg: make([]uint32, n+1),
+		target:    make([]uint32, n+1),
+		input:     make([]bool, n+1),
+		delegated: make([]uint32, words),
+		pending:   make([]uint32, words),
+		enabled:   make([]uint32, words),
+		idcs:      make([]aplicIDCState, len(harts)),
+	}
+	for i := range a.delegated {
+		a.delegated[i] = ^uint32(0) // the root domain owns all sources
+	}
+	return a
+}
+
+// AddChild makes c the (only) child domain of a. Sources are delegated to the
+// child by writing sourcecfg.D in the parent domain.
+func (a *APLIC) AddChild(c *APLIC) {
+	if c.sources != a.sources {
+		panic("child APLIC domain must have the same number of sources as its parent")
+	}
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	a.child, c.parent = c, a
+	for i := range c.delegated {
+		c.delegated[i] = 0
+	}
+}
+
+// Line returns the interrupt line connected to the given source. Lines must be
+// obtained from the root domain.
+func (a *APLIC) Line(src int) InterruptLine {
+	if src <= 0 || src >= a.sources {
+		panic(fmt.Sprintf("APLIC interrupt source %d out of range [1, %d]", src, a.sources-1))
+	}
+	return aplicLine{a: a, src: src}
+}
+
+type aplicLine struct {
+	a   *APLIC
+	src int
+}
+
+func (l aplicLine) SetLevel(high bool) { l.a.SetLevel(l.src, high) }
+
+// SetLevel changes the level of the interrupt wire of the given source. The
+// wire is connected to all domains in the hierarchy.
+func (a *APLIC) SetLevel(src int, high bool) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if src <= 0 || src >= a.sources {
+		return
+	}
+	old := a.rectified(src)
+	a.input[src] = high
+	if a.active(src) {
+		switch a.mode(src) {
+		case smEdge1, smEdge0:
+			if !old && a.rectified(src) {
+				setBit(a.pending, src, true)
+			}
+		case smLevel1, smLevel0:
+			if a.msi() {
+				if !old && a.rectified(src) {
+					setBit(a.pending, src, true)
+				}
+				if !a.rectified(src) {
+					setBit(a.pending, src, false)
+				}
+			} else {
+				setBit(a.pending, src, a.rectified(src))
+			}
+		}
+		a.update()
+	}
+	if a.child != nil {
+		a.child.SetLevel(src, high)
+	}
+}
+
+func (a *APLIC) msi() bool { return a.domaincfg&domaincfgDM != 0 }
+
+func (a *APLIC) mode(src int) uint32 { return a.sourcecfg[src] & 0x7 }
+
+// active reports whether the source is active in this domain.
+func (a *APLIC) active(src int) bool {
+	return bit(a.delegated, src) && a.sourcecfg[src]&sourcecfgD == 0 && a.mode(src) != smInactive
+}
+
+// rectified returns the rectified input value of the source.
+//
+// AIA; Chapter 4.5.2
+func (a *APLIC) rectified(src int) bool {
+	switch a.mode(src) {
+	case smEdge1, smLevel1:
+		return a.input[src]
+	case smEdge0, smLevel0:
+		return !a.input[src]
+	}
+	return false
+}
+
+// setDelegated is called by the parent domain when delegation of the source to
+// this domain changes.
+func (a *APLIC) setDelegated(src int, v bool) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	setBit(a.delegated, src, v)
+	if !v {
+		a.setSourcecfg(src, 0)
+	}
+	a.update()
+}
+
+// setSourcecfg sets sourcecfg[src]. It must be called with a.mu held.
+func (a *APLIC) setSourcecfg(src int, v uint32) {
+	wasDelegated := a.sourcecfg[src]&sourcecfgD != 0
+	switch {
+	case !bit(a.delegated, src):
+		v = 0
+	case v&sourcecfgD != 0 && a.child != nil:
+		v = sourcecfgD // child index 0
+	case v&sourcecfgD != 0:
+		v = 0 // no child to delegate to
+	default:
+		v &= 0x7
+		if v == 2 || v == 3 {
+			v = smInactive // reserved modes
+		}
+	}
+	a.sourcecfg[src] = v
+	if !a.active(src) {
+		setBit(a.pending, src, false)
+		setBit(a.enabled, src, false)
+		a.target[src] = 0
+	} else if m := a.mode(src); (m == smLevel1 || m == smLevel0) && !a.msi() {
+		setBit(a.pending, src, a.rectified(src))
+	}
+	if isDelegated := v&sourcecfgD != 0; a.child != nil && isDelegated != wasDelegated {
+		a.child.setDelegated(src, isDelegated)
+	}
+}
+
+// setPending handles writes to setip and setipnum. It must be called with a.mu
+// held.
+func (a *APLIC) setPending(src int) {
+	if src <= 0 || src >= a.sources || !a.active(src) {
+		return
+	}
+	switch a.mode(src) {
+	case smLevel1, smLevel0:
+		if a.msi() && a.rectified(src) {
+			setBit(a.pending, src, true)
+		}
+	default:
+		setBit(a.pending, src, true)
+	}
+}
+
+// clearPending handles writes to in_clrip and clripnum. It must be called with
+// a.mu held.
+func (a *APLIC) clearPending(src int) {
+	if src <= 0 || src >= a.sources || !a.active(src) {
+		return
+	}
+	switch a.mode(src) {
+	case smLevel1, smLevel0:
+		if a.msi() {
+			setBit(a.pending, src, false)
+		}
+	default:
+		setBit(a.pending, src, false)
+	}
+}
+
+func (a *APLIC) setEnabled(src int, v bool) {
+	if src > 0 && src < a.sources && a.active(src) {
+		setBit(a.enabled, src, v)
+	}
+}
+
+// Load implements the Device interface.
+func (a *APLIC) Load(offset uint64, size int) (uint64, error) {
+	if size != 4 || offset%4 != 0 {
+		return 0, fmt.Errorf("APLIC: unsupported %d-byte load at offset %#x", size, offset)
+	}
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	switch {
+	case offset == aplicDomaincfg:
+		return uint64(a.domaincfg | domaincfgRO), nil
+	case offset < aplicMmsiaddrcfg:
+		if src := int(offset / 4); src < a.sources {
+			return uint64(a.sourcecfg[src]), nil
+		}
+	case offset <= aplicSmsiaddrcfgh:
+		if a.parent == nil && !a.smode {
+			a.msiMu.Lock()
+			defer a.msiMu.Unlock()
+			return uint64(a.msiaddr[(offset-aplicMmsiaddrcfg)/4]), nil
+		}
+	case offset >= aplicSetip && offset < aplicSetipnum:
+		return a.readBitmap(a.pending, offset-aplicSetip), nil
+	case offset >= aplicInClrip && offset < aplicClripnum:
+		w := int(offset-aplicInClrip) / 4
+		var v uint32
+		for i := 0; i < 32; i++ {
+			if src := 32*w + i; src < a.sources && a.active(src) && a.rectified(src) {
+				v |= 1 << uint(i)
+			}
+		}
+		return uint64(v), nil
+	case offset >= aplicSetie && offset < aplicSetienum:
+		return a.readBitmap(a.enabled, offset-aplicSetie), nil
+	case offset == aplicGenmsi:
+		return 0, nil
+	case offset >= aplicTarget && offset < aplicIDC:
+		if src := int(offset-aplicTarget)/4 + 1; src < a.sources {
+			return uint64(a.target[src]), nil
+		}
+	case offset >= aplicIDC:
+		h := int(offset-aplicIDC) / aplicIDCLen
+		if h >= len(a.idcs) {
+			break
+		}
+		idc := &a.idcs[h]
+		switch (offset - aplicIDC) % aplicIDCLen {
+		case idcIdelivery:
+			return uint64(idc.delivery), nil
+		case idcIforce:
+			return uint64(idc.force), nil
+		case idcIthreshold:
+			return uint64(idc.threshold), nil
+		case idcTopi:
+			return uint64(a.topi(h)), nil
+		case idcClaimi:
+			return uint64(a.claimi(h)), nil
+		}
+	}
+	return 0, nil
+}
+
+// Store implements the Device interface.
+func (a *APLIC) Store(offset uint64, size int, v uint64) error {
+	if size != 4 || offset%4 != 0 {
+		return fmt.Errorf("APLIC: unsupported %d-byte store at offset %#x", size, offset)
+	}
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	v32 := uint32(v)
+	switch {
+	case offset == aplicDomaincfg:
+		a.domaincfg = v32 & (domaincfgIE | domaincfgDM)
+	case offset < aplicMmsiaddrcfg:
+		if src := int(offset / 4); src < a.sources {
+			a.setSourcecfg(src, v32)
+		}
+	case offset <= aplicSmsiaddrcfgh:
+		if a.parent == nil && !a.smode {
+			a.msiMu.Lock()
+			if a.msiaddr[1]&msiaddrcfghL == 0 {
+				a.msiaddr[(offset-aplicMmsiaddrcfg)/4] = v32
+			}
+			a.msiMu.Unlock()
+		}
+	case offset >= aplicSetip && offset < aplicSetipnum:
+		a.writeBitmap(offset-aplicSetip, v32, a.setPending)
+	case offset == aplicSetipnum, offset == aplicSetipnumLE:
+		a.setPending(int(v32))
+	case offset == aplicSetipnumBE:
+		a.setPending(int(bits.ReverseBytes32(v32)))
+	case offset >= aplicInClrip && offset < aplicClripnum:
+		a.writeBitmap(offset-aplicInClrip, v32, a.clearPending)
+	case offset == aplicClripnum:
+		a.clearPending(int(v32))
+	case offset >= aplicSetie && offset < aplicSetienum:
+		a.writeBitmap(offset-aplicSetie, v32, func(src int) { a.setEnabled(src, true) })
+	case offset == aplicSetienum:
+		a.setEnabled(int(v32), true)
+	case offset >= aplicClrie && offset < aplicClrienum:
+		a.writeBitmap(offset-aplicClrie, v32, func(src int) { a.setEnabled(src, false) })
+	case offset == aplicClrienum:
+		a.setEnabled(int(v32), false)
+	case offset == aplicGenmsi:
+		if a.msi() {
+			a.sendMSI(int(v32>>18), v32&0x7ff)
+		}
+	case offset >= aplicTarget && offset < aplicIDC:
+		src := int(offset-aplicTarget)/4 + 1
+		if src >= a.sources || !a.active(src) {
+			break
+		}
+		if a.msi() {
+			a.target[src] = v32 &^ (0x3f<<12 | 1<<11) // guest index 0 only
+		} else {
+			a.target[src] = v32 & (0x3fff<<18 | 0xff)
+			if a.target[src]&0xff == 0 {
+				a.target[src] |= 1 // priority 0 is replaced with 1
+			}
+		}
+	case offset >= aplicIDC:
+		h := int(offset-aplicIDC) / aplicIDCLen
+		if h >= len(a.idcs) {
+			break
+		}
+		idc := &a.idcs[h]
+		switch (offset - aplicIDC) % aplicIDCLen {
+		case idcIdelivery:
+			idc.delivery = v32 & 1
+		case idcIforce:
+			idc.force = v32 & 1
+		case idcIthreshold:
+			idc.threshold = v32 & 0xff
+		}
+	}
+	a.update()
+	return nil
+}
+
+func (a *APLIC) readBitmap(bitmap []uint32, offset uint64) uint64 {
+	if w := int(offset / 4); w < len(bitmap) {
+		return uint64(bitmap[w])
+	}
+	return 0
+}
+
+func (a *APLIC) writeBitmap(offset uint64, v uint32, fn func(src int)) {
+	w := int(offset / 4)
+	for i := 0; i < 32; i++ {
+		if v&(1<<uint(i)) != 0 {
+			if src := 32*w + i; src < a.sources {
+				fn(src)
+			}
+		}
+	}
+}
+
+// best returns the pending and enabled source targeting hart h with the
+// highest priority (the lowest IPRIO) that isn't masked by the hart's
+// threshold. It returns 0 if there's no such source.
+func (a *APLIC) best(h int) int {
+	var src int
+	var prio uint32
+	for i := 1; i < a.sources; i++ {
+		if !bit(a.pending, i) || !bit(a.enabled, i) || int(a.target[i]>>18) != h {
+			continue
+		}
+		p := a.target[i] & 0xff
+		if t := a.idcs[h].threshold; t != 0 && p >= t {
+			continue
+		}
+		if src == 0 || p < prio {
+			src, prio = i, p
+		}
+	}
+	return src
+}
+
+func (a *APLIC) topi(h int) uint32 {
+	if src := a.best(h); src != 0 {
+		return uint32(src)<<16 | a.target[src]&0xff
+	}
+	return 0
+}
+
+func (a *APLIC) claimi(h int) uint32 {
+	v := a.topi(h)
+	if v == 0 {
+		a.idcs[h].force = 0
+	} else {
+		src := int(v >> 16)
+		setBit(a.pending, src, false)
+		if m := a.mode(src); m == smLevel1 || m == smLevel0 {
+			// In direct mode, the pending bit of level-sensitive
+			// sources follows the rectified input.
+			setBit(a.pending, src, a.rectified(src))
+		}
+	}
+	a.update()
+	return v
+}
+
+// update recomputes the outputs of the domain. It must be called with a.mu
+// held.
+func (a *APLIC) update() {
+	ie := a.domaincfg&domaincfgIE != 0
+	if !a.msi() {
+		mip := uint64(mipMEIP)
+		if a.smode {
+			mip = mipSEIP
+		}
+		for h, vm := range a.harts {
+			idc := &a.idcs[h]
+			vm.setMIP(mip, ie && idc.delivery != 0 && (a.best(h) != 0 || idc.force != 0))
+		}
+		return
+	}
+	if !ie {
+		return
+	}
+	for src := 1; src < a.sources; src++ {
+		if bit(a.pending, src) && bit(a.enabled, src) {
+			setBit(a.pending, src, false)
+			a.sendMSI(int(a.target[src]>>18), a.target[src]&0x7ff)
+		}
+	}
+}
+
+// sendMSI writes the interrupt identity to the IMSIC interrupt file of the
+// hart. The write goes straight to the device on the bus, whichever hart
+// caused it.
+//
+// AIA; Chapter 4.9.1
+func (a *APLIC) sendMSI(hart int, eiid uint32) {
+	root := a
+	for root.parent != nil {
+		root = root.parent
+	}
+	root.msiMu.Lock()
+	cfg := root.msiaddr
+	root.msiMu.Unlock()
+	hhxs := uint64(cfg[1] >> 24 & 0x1f)
+	lhxs := uint64(cfg[1] >> 20 & 0x7)
+	hhxw := uint64(cfg[1] >> 16 & 0x7)
+	lhxw := uint64(cfg[1] >> 12 & 0xf)
+	ppn := uint64(cfg[1]&0xfff)<<32 | uint64(cfg[0])
+	if a.smode {
+		lhxs = uint64(cfg[3] >> 20 & 0x7)
+		ppn = uint64(cfg[3]&0xfff)<<32 | uint64(cfg[2])
+	}
+	g := uint64(hart) >> lhxw & (1<<hhxw - 1)
+	h := uint64(hart) & (1<<lhxw - 1)
+	addr := (ppn | g<<(hhxs+12) | h<<lhxs) << 12
+	// The guest can't observe a failed MSI, so report it on the host.
+	if err := a.harts[0].Bus.store(addr, 4, uint64(eiid)); err != nil {
+		fmt.Fprintf(os.Stderr, "APLIC: dropped MSI %d to hart %d at %#x: %v\n", eiid, hart, addr, err)
+	}
+}
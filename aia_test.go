@@ -0,0 +1,250 @@
+// Copyright 2019 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"strings"
+	"testing"
+)
+
+// aiaTest is a VM with an IMSIC and a two-level APLIC hierarchy mapped at the
+// same addresses as on QEMU's virt machine.
+type aiaTest struct {
+	t    *testing.T
+	vm   *VM
+	m, s *APLIC
+}
+
+func newAIATest(t *testing.T) *aiaTest {
+	vm := &VM{Mem: make([]byte, 16), Bus: &Bus{}}
+	im := NewIMSIC(vm, 63)
+	m, s := NewAPLIC(32, false, vm), NewAPLIC(32, true, vm)
+	m.AddChild(s)
+	for _, d := range []struct {
+		addr, size uint64
+		dev        Device
+	}{
+		{imsicMAddr, IMSICFileSize, im.M},
+		{imsicSAddr, IMSICFileSize, im.S},
+		{aplicMAddr, APLICSize, m},
+		{aplicSAddr, APLICSize, s},
+	} {
+		if err := vm.Bus.Map(d.addr, d.size, d.dev); err != nil {
+			t.Fatalf("Can't map device: %v", err)
+		}
+	}
+	return &aiaTest{t: t, vm: vm, m: m, s: s}
+}
+
+func (a *aiaTest) write(addr, v uint64) {
+	a.t.Helper()
+	if err := a.vm.write(addr, 4, v); err != nil {
+		a.t.Fatalf("write(%#x, %#x) failed: %v", addr, v, err)
+	}
+}
+
+func (a *aiaTest) read(addr uint64) uint64 {
+	a.t.Helper()
+	v, err := a.vm.read(addr, 4)
+	if err != nil {
+		a.t.Fatalf("read(%#x) failed: %v", addr, err)
+	}
+	return v
+}
+
+func (a *aiaTest) csrw(csr, v uint64) {
+	a.t.Helper()
+	if err := a.vm.writeCSR(csr, v); err != nil {
+		a.t.Fatalf("writeCSR(%#x, %#x) failed: %v", csr, v, err)
+	}
+}
+
+func (a *aiaTest) csrr(csr uint64) uint64 {
+	a.t.Helper()
+	v, err := a.vm.readCSR(csr)
+	if err != nil {
+		a.t.Fatalf("readCSR(%#x) failed: %v", csr, err)
+	}
+	return v
+}
+
+func (a *aiaTest) wantMIP(desc string, want uint64) {
+	a.t.Helper()
+	if got := a.vm.CSR[csrMIP]; got != want {
+		a.t.Errorf("%s: mip = %#x; want %#x", desc, got, want)
+	}
+}
+
+func TestIMSIC(t *testing.T) {
+	a := newAIATest(t)
+
+	// Enable identities 5 and 9 in the S-level file.
+	a.csrw(csrSiselect, iselEIEFirst)
+	a.csrw(csrSireg, 1<<5|1<<9)
+	a.csrw(csrSiselect, iselEIDelivery)
+	a.csrw(csrSireg, 1)
+
+	a.write(imsicSAddr+imsicSetEIPNumLE, 9)
+	a.write(imsicSAddr+imsicSetEIPNumLE, 5)
+	a.write(imsicSAddr+imsicSetEIPNumLE, 7) // not enabled
+	a.wantMIP("MSIs received", mipSEIP)
+	a.csrw(csrSiselect, iselEIPFirst)
+	if got, want := a.csrr(csrSireg), uint64(1<<5|1<<7|1<<9); got != want {
+		t.Errorf("eip0 = %#x; want %#x", got, want)
+	}
+
+	// Threshold 5 masks all the pending identities.
+	a.csrw(csrSiselect, iselEIThreshold)
+	a.csrw(csrSireg, 5)
+	a.wantMIP("threshold 5", 0)
+	if got := a.csrr(csrStopei); got != 0 {
+		t.Errorf("stopei = %#x; want 0", got)
+	}
+	a.csrw(csrSireg, 0)
+
+	for _, want := range []uint64{5, 9, 0} {
+		if got := a.csrr(csrStopei); got != want<<16|want {
+			t.Errorf("stopei = %#x; want %#x", got, want<<16|want)
+		}
+		a.csrw(csrStopei, 0) // claim
+	}
+	a.wantMIP("all claimed", 0)
+
+	a.csrw(csrSiselect, iselEIPFirst+1)
+	if _, err := a.vm.readCSR(csrSireg); err == nil {
+		t.Errorf("reading eip1 succeeded; want error (odd registers don't exist on RV64)")
+	}
+}
+
+func TestAPLICDirect(t *testing.T) {
+	a := newAIATest(t)
+
+	// Source 2 is level-triggered, source 3 is rising-edge-triggered; both
+	// are handled by the M-level domain. Source 4 is delegated to the
+	// S-level domain.
+	a.write(aplicMAddr+aplicDomaincfg, domaincfgIE)
+	a.write(aplicMAddr+aplicSourcecfg+4*(2-1), smLevel1)
+	a.write(aplicMAddr+aplicSourcecfg+4*(3-1), smEdge1)
+	a.write(aplicMAddr+aplicSourcecfg+4*(4-1), sourcecfgD)
+	a.write(aplicMAddr+aplicTarget+4*(2-1), 7) // hart 0, priority 7
+	a.write(aplicMAddr+aplicTarget+4*(3-1), 2) // hart 0, priority 2
+	a.write(aplicMAddr+aplicSetienum, 2)
+	a.write(aplicMAddr+aplicSetienum, 3)
+	a.write(aplicMAddr+aplicIDC+idcIdelivery, 1)
+
+	a.write(aplicSAddr+aplicDomaincfg, domaincfgIE)
+	a.write(aplicSAddr+aplicSourcecfg+4*(4-1), smLevel0)
+	a.write(aplicSAddr+aplicTarget+4*(4-1), 1)
+	a.write(aplicSAddr+aplicSetienum, 4)
+	a.write(aplicSAddr+aplicIDC+idcIdelivery, 1)
+	// The line of source 4 is low, so the active-low source is pending.
+	a.wantMIP("source 4 low", mipSEIP)
+	a.m.Line(4).SetLevel(true)
+	a.wantMIP("source 4 high", 0)
+
+	a.m.Line(2).SetLevel(true)
+	a.m.Line(3).SetLevel(true)
+	a.wantMIP("sources 2 and 3 asserted", mipMEIP)
+	if got, want := a.read(aplicMAddr+aplicIDC+idcTopi), uint64(3<<16|2); got != want {
+		t.Errorf("topi = %#x; want %#x", got, want)
+	}
+	if got, want := a.read(aplicMAddr+aplicIDC+idcClaimi), uint64(3<<16|2); got != want {
+		t.Errorf("claimi = %#x; want %#x", got, want)
+	}
+	// The level-triggered source stays pending until the line goes low.
+	if got, want := a.read(aplicMAddr+aplicIDC+idcClaimi), uint64(2<<16|7); got != want {
+		t.Errorf("claimi = %#x; want %#x", got, want)
+	}
+	a.wantMIP("source 2 still asserted", mipMEIP)
+	a.m.Line(2).SetLevel(false)
+	a.wantMIP("source 2 deasserted", 0)
+	if got := a.read(aplicMAddr + aplicIDC + idcClaimi); got != 0 {
+		t.Errorf("claimi = %#x; want 0", got)
+	}
+}
+
+func TestAPLICMSI(t *testing.T) {
+	a := newAIATest(t)
+
+	a.csrw(csrSiselect, iselEIEFirst)
+	a.csrw(csrSireg, 1<<10)
+	a.csrw(csrSiselect, iselEIDelivery)
+	a.csrw(csrSireg, 1)
+
+	a.write(aplicMAddr+aplicMmsiaddrcfg, imsicMAddr>>12)
+	a.write(aplicMAddr+aplicSmsiaddrcfg, imsicSAddr>>12)
+	a.write(aplicMAddr+aplicSourcecfg+4*(5-1), sourcecfgD)
+	a.write(aplicSAddr+aplicDomaincfg, domaincfgIE|domaincfgDM)
+	a.write(aplicSAddr+aplicSourcecfg+4*(5-1), smEdge1)
+	a.write(aplicSAddr+aplicTarget+4*(5-1), 10) // hart 0, EIID 10
+	a.write(aplicSAddr+aplicSetienum, 5)
+
+	a.m.Line(5).SetLevel(true)
+	a.wantMIP("MSI forwarded", mipSEIP)
+	if got := a.read(aplicSAddr + aplicSetip); got != 0 {
+		t.Errorf("setip = %#x; want 0 (the interrupt was forwarded)", got)
+	}
+	if got, want := a.csrr(csrStopei), uint64(10<<16|10); got != want {
+		t.Errorf("stopei = %#x; want %#x", got, want)
+	}
+}
+
+func TestAPLICGenmsi(t *testing.T) {
+	f, err := ioutil.TempFile("", "stderr")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(f.Name())
+	defer f.Close()
+	stderr := os.Stderr
+	os.Stderr = f
+	defer func() { os.Stderr = stderr }()
+
+	bus := &Bus{}
+	harts := []*VM{{Bus: bus}, {Bus: bus}}
+	a := NewAPLIC(32, false, harts...)
+	for h, vm := range harts {
+		if err := bus.Map(imsicMAddr+uint64(h)*IMSICFileSize, IMSICFileSize, NewIMSIC(vm, 63).M); err != nil {
+			t.Fatalf("Can't map IMSIC: %v", err)
+		}
+	}
+	if err := bus.Map(aplicMAddr, APLICSize, a); err != nil {
+		t.Fatalf("Can't map APLIC: %v", err)
+	}
+	// Hart 1 sends MSIs to itself and to a hart without an IMSIC.
+	vm := harts[1]
+	for _, w := range []struct{ addr, v uint64 }{
+		{aplicMAddr + aplicMmsiaddrcfg, imsicMAddr >> 12},
+		{aplicMAddr + aplicMmsiaddrcfgh, 2 << 12}, // LHXW: up to 4 harts
+		{aplicMAddr + aplicDomaincfg, domaincfgDM},
+		{aplicMAddr + aplicGenmsi, 1<<18 | 7},
+		{aplicMAddr + aplicGenmsi, 3<<18 | 9},
+	} {
+		if err := vm.write(w.addr, 4, w.v); err != nil {
+			t.Fatalf("write(%#x, %#x) failed: %v", w.addr, w.v, err)
+		}
+	}
+	for h, want := range []uint64{0, 1 << 7} {
+		harts[h].CSR[csrMiselect] = iselEIPFirst
+		if got, err := harts[h].readCSR(csrMireg); err != nil || got != want {
+			t.Errorf("hart %d: eip0 = %#x, %v; want %#x, nil", h, got, err, want)
+		}
+	}
+	if b, err := ioutil.ReadFile(f.Name()); err != nil || !strings.Contains(string(b), "dropped MSI 9 to hart 3") {
+		t.Errorf("stderr = %q, %v; want a report of the dropped MSI", b, err)
+	}
+}
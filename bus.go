@@ -0,0 +1,240 @@
+// Copyright 2019 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"fmt"
+	"sync"
+	"sync/atomic"
+)
+
+// Device is a memory-mapped peripheral. Offsets are relative to the address at
+// which the device is mapped. Size is the width of the access in bytes: 1, 2, 4
+// or 8.
+type Device interface {
+	Load(offset uint64, size int) (uint64, error)
+	Store(offset uint64, size int, v uint64) error
+}
+
+// Bus routes physical addresses to memory-mapped devices. Addresses that don't
+// belong to any device go to the VM's main memory.
+type Bus struct {
+	regions []region
+
+	mu       sync.Mutex
+	deferred []func() // see Defer
+	pending  int32    // whether deferred isn't empty; accessed atomically
+}
+
+type region struct {
+	base, size uint64
+	dev        Device
+}
+
+// Map attaches the device to the bus at addresses [base, base+size).
+func (b *Bus) Map(base, size uint64, d Device) error {
+	if size == 0 || base+size < base {
+		return fmt.Errorf("can't map device at %#x: invalid size %#x", base, size)
+	}
+	for _, r := range b.regions {
+		if base < r.base+r.size && r.base < base+size {
+			return fmt.Errorf("can't map device at [%#x, %#x): overlaps with device at [%#x, %#x)", base, base+size, r.base, r.base+r.size)
+		}
+	}
+	b.regions = append(b.regions, region{base: base, size: size, dev: d})
+	return nil
+}
+
+// Defer queues f to be called by a hart between two instructions. Devices
+// working on their own goroutines, e.g. receiving data from the host, use it to
+// access guest memory in sync with the harts. It's safe to call it from any
+// goroutine.
+func (b *Bus) Defer(f func()) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.deferred = append(b.deferred, f)
+	atomic.StoreInt32(&b.pending, 1)
+}
+
+// runDeferred calls the functions queued with Defer. Harts running in parallel
+// with vm are paused meanwhile.
+func (vm *VM) runDeferred() {
+	b := vm.Bus
+	if b == nil || atomic.LoadInt32(&b.pending) == 0 {
+		return
+	}
+	vm.stopTheWorld(func() {
+		b.mu.Lock()
+		fs := b.deferred
+		b.deferred = nil
+		atomic.StoreInt32(&b.pending, 0)
+		b.mu.Unlock()
+		for _, f := range fs {
+			f()
+		}
+	})
+}
+
+// find returns the region containing addr or nil if addr doesn't belong to any
+// device.
+func (b *Bus) find(addr uint64) *region {
+	if b == nil {
+		return nil
+	}
+	for i := range b.regions {
+		if r := &b.regions[i]; addr >= r.base && addr-r.base < r.size {
+			return r
+		}
+	}
+	return nil
+}
+
+// store writes size bytes of v to the device mapped at addr on behalf of
+// another device, e.g. an MSI sent by the APLIC. Unlike write, it doesn't go
+// through a hart, so it must be called during a device access, when the other
+// harts are stopped.
+func (b *Bus) store(addr uint64, size int, v uint64) error {
+	r := b.find(addr)
+	if r == nil || addr-r.base+uint64(size) > r.size {
+		return accessFaultErr
+	}
+	return r.dev.Store(addr-r.base, size, v)
+}
+
+// read returns size bytes (little-endian) stored at the physical address addr.
+// Accesses to unmapped addresses and accesses crossing the boundary of a device
+// raise load access-fault exceptions.
+func (vm *VM) read(addr uint64, size int) (uint64, error) {
+	if r := vm.Bus.find(addr); r != nil {
+		if addr-r.base+uint64(size) > r.size {
+			return 0, &exception{cause: causeLoadAccessFault, tval: addr}
+		}
+		var v uint64
+		var err error
+		if b, off, ok := vm.sharedMem(addr, size, PermRead); ok {
+			v = loadShared(b, off, size)
+		} else {
+			vm.stopTheWorld(func() { v, err = r.dev.Load(addr-r.base, size) })
+		}
+		if err == accessFaultErr {
+			return 0, &exception{cause: causeLoadAccessFault, tval: addr}
+		}
+		return v, err
+	}
+	if addr+uint64(size) > uint64(len(vm.Mem)) || addr+uint64(size) < addr {
+		return 0, &exception{cause: causeLoadAccessFault, tval: addr}
+	}
+	if vm.world != nil {
+		return loadShared(vm.Mem, addr, size), nil
+	}
+	var v uint64
+	for i := 0; i < size; i++ {
+		v |= uint64(vm.Mem[addr+uint64(i)]) << (8 * uint(i))
+	}
+	return v, nil
+}
+
+// write stores size bytes of v (little-endian) at the physical address addr.
+// Accesses to unmapped addresses and accesses crossing the boundary of a device
+// raise store access-fault exceptions. Unless the harts run in parallel, the
+// reservations of other harts on the written bytes are cleared.
+func (vm *VM) write(addr uint64, size int, v uint64) error {
+	if vm.world == nil {
+		vm.clearReservations(addr, size)
+	}
+	if r := vm.Bus.find(addr); r != nil {
+		if addr-r.base+uint64(size) > r.size {
+			return &exception{cause: causeStoreAccessFault, tval: addr}
+		}
+		var err error
+		if b, off, ok := vm.sharedMem(addr, size, PermWrite); ok {
+			storeShared(b, off, size, v)
+		} else {
+			vm.stopTheWorld(func() { err = r.dev.Store(addr-r.base, size, v) })
+		}
+		if err == accessFaultErr {
+			return &exception{cause: causeStoreAccessFault, tval: addr}
+		}
+		return err
+	}
+	if addr+uint64(size) > uint64(len(vm.Mem)) || addr+uint64(size) < addr {
+		return &exception{cause: causeStoreAccessFault, tval: addr}
+	}
+	if vm.world != nil {
+		storeShared(vm.Mem, addr, size, v)
+		return nil
+	}
+	for i := 0; i < size; i++ {
+		vm.Mem[addr+uint64(i)] = byte(v >> (8 * uint(i)))
+	}
+	return nil
+}
+
+// loadMem loads size bytes from the virtual address addr on behalf of the
+// executing instruction. Unlike read, it evaluates debug triggers, applies the
+// misaligned access policy and translates the address.
+func (vm *VM) loadMem(addr uint64, size int) (uint64, error) {
+	if err := vm.memTriggers(mc6Load, addr, size, 0, phaseAddr); err != nil {
+		return 0, err
+	}
+	if err := vm.checkAligned(addr, size, "load", causeLoadMisaligned); err != nil {
+		return 0, err
+	}
+	v, err := vm.loadVirt(addr, size)
+	if err != nil {
+		return 0, err
+	}
+	if err := vm.memTriggers(mc6Load, addr, size, v, phaseData); err != nil {
+		return 0, err
+	}
+	return v, nil
+}
+
+// storeMem stores size bytes of v at the virtual address addr on behalf of the
+// executing instruction. Unlike write, it evaluates debug triggers, applies the
+// misaligned access policy and translates the address.
+func (vm *VM) storeMem(addr uint64, size int, v uint64) error {
+	if err := vm.memTriggers(mc6Store, addr, size, v, phaseAll); err != nil {
+		return err
+	}
+	if err := vm.checkAligned(addr, size, "store", causeStoreMisaligned); err != nil {
+		return err
+	}
+	return vm.storeVirt(addr, size, v)
+}
+
+// readBytes copies len(b) bytes of memory at the physical address addr to b.
+// Devices use it for DMA. Both the main memory and memory regions are
+// accessible this way, but other memory-mapped devices aren't.
+func (vm *VM) readBytes(addr uint64, b []byte) error {
+	m, err := vm.memSlice(addr, uint64(len(b)))
+	if err != nil {
+		return err
+	}
+	copy(b, m)
+	return nil
+}
+
+// writeBytes copies b to memory at the physical address addr. Devices use it
+// for DMA. Both the main memory and memory regions are accessible this way,
+// but other memory-mapped devices aren't.
+func (vm *VM) writeBytes(addr uint64, b []byte) error {
+	m, err := vm.memSlice(addr, uint64(len(b)))
+	if err != nil {
+		return err
+	}
+	copy(m, b)
+	return nil
+}
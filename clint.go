@@ -0,0 +1,109 @@
+// Copyright 2019 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import "fmt"
+
+// CLINT register map. See the SiFive U54-MC manual (chapter 9, "Core-Local
+// Interruptor").
+const (
+	clintMSIP     = 0x0000 // 4 bytes per hart
+	clintMtimecmp = 0x4000 // 8 bytes per hart
+	clintMtime    = 0xBFF8
+
+	// CLINTSize is the size of the CLINT's address space.
+	CLINTSize = 0x10000
+)
+
+// CLINT is a SiFive-compatible Core-Local Interruptor. It drives mip.MSIP of
+// each hart with its msip register and mip.MTIP with mtimecmp. The mtime
+// register is the time counter of the harts (the time CSR). CLINT implements
+// the Device interface.
+type CLINT struct {
+	harts []*VM
+}
+
+// NewCLINT returns a CLINT connected to the given harts.
+func NewCLINT(harts ...*VM) *CLINT {
+	c := &CLINT{harts: harts}
+	for _, vm := range harts {
+		vm.clint = c
+		vm.mtimecmp = ^uint64(0)
+		vm.tick(0)
+	}
+	return c
+}
+
+// Load implements the Device interface.
+func (c *CLINT) Load(offset uint64, size int) (uint64, error) {
+	if (size != 4 && size != 8) || offset%uint64(size) != 0 {
+		return 0, fmt.Errorf("CLINT: unsupported %d-byte load at offset %#x", size, offset)
+	}
+	var v uint64
+	switch {
+	case offset < clintMtimecmp:
+		if h := int(offset / 4); h < len(c.harts) && size == 4 {
+			v = c.harts[h].CSR[csrMIP] & mipMSIP >> 3
+		}
+	case offset < clintMtime:
+		if h := int(offset-clintMtimecmp) / 8; h < len(c.harts) {
+			v = c.harts[h].mtimecmp
+		}
+	case offset < clintMtime+8:
+		if len(c.harts) > 0 {
+			v = c.harts[0].CSR[RDTIME]
+		}
+	}
+	return v >> (8 * (offset % 8)) & sizeMask(size), nil
+}
+
+// Store implements the Device interface.
+func (c *CLINT) Store(offset uint64, size int, v uint64) error {
+	if (size != 4 && size != 8) || offset%uint64(size) != 0 {
+		return fmt.Errorf("CLINT: unsupported %d-byte store at offset %#x", size, offset)
+	}
+	switch {
+	case offset < clintMtimecmp:
+		if h := int(offset / 4); h < len(c.harts) && size == 4 {
+			c.harts[h].setMIP(mipMSIP, v&1 != 0)
+		}
+	case offset < clintMtime:
+		if h := int(offset-clintMtimecmp) / 8; h < len(c.harts) {
+			vm := c.harts[h]
+			vm.mtimecmp = merge(vm.mtimecmp, offset%8, size, v)
+			vm.tick(0)
+		}
+	case offset < clintMtime+8:
+		for _, vm := range c.harts {
+			vm.CSR[RDTIME] = merge(vm.CSR[RDTIME], offset%8, size, v)
+			vm.tick(0)
+		}
+	}
+	return nil
+}
+
+// sizeMask returns a mask of the low size bytes.
+func sizeMask(size int) uint64 {
+	if size >= 8 {
+		return ^uint64(0)
+	}
+	return 1<<(8*uint(size)) - 1
+}
+
+// merge returns old with size bytes starting at byte offset replaced with v.
+func merge(old, offset uint64, size int, v uint64) uint64 {
+	mask := sizeMask(size) << (8 * offset)
+	return old&^mask | v<<(8*offset)&mask
+}
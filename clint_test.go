@@ -0,0 +1,111 @@
+// Copyright 2019 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import "testing"
+
+const clintAddr = 0x2000000
+
+func newCLINTTest(t *testing.T) *VM {
+	vm := newTrapVM(t)
+	vm.Bus = &Bus{}
+	if err := vm.Bus.Map(clintAddr, CLINTSize, NewCLINT(vm)); err != nil {
+		t.Fatalf("Can't map the CLINT: %v", err)
+	}
+	return vm
+}
+
+func TestCLINT(t *testing.T) {
+	vm := newCLINTTest(t)
+	if got := vm.CSR[csrMIP]; got != 0 {
+		t.Errorf("mip after reset = %#x; want 0", got)
+	}
+
+	vm.write(clintAddr+clintMSIP, 4, 1)
+	if got := vm.CSR[csrMIP]; got != mipMSIP {
+		t.Errorf("mip = %#x; want MSIP", got)
+	}
+	if got, _ := vm.read(clintAddr+clintMSIP, 4); got != 1 {
+		t.Errorf("msip = %d; want 1", got)
+	}
+	vm.write(clintAddr+clintMSIP, 4, 0)
+
+	vm.write(clintAddr+clintMtime, 4, 0x100)
+	vm.write(clintAddr+clintMtime+4, 4, 0x1)
+	if got := vm.CSR[RDTIME]; got != 0x100000100 {
+		t.Errorf("time = %#x; want 0x100000100", got)
+	}
+	vm.write(clintAddr+clintMtimecmp, 8, 0x100000102)
+	if got := vm.CSR[csrMIP]; got != 0 {
+		t.Errorf("mip = %#x; want 0", got)
+	}
+	if err := vm.Run(2); err != nil {
+		t.Fatalf("Run failed: %v", err)
+	}
+	if got := vm.CSR[csrMIP]; got != mipMTIP {
+		t.Errorf("mip = %#x; want MTIP", got)
+	}
+	if got, _ := vm.read(clintAddr+clintMtime, 8); got != 0x100000102 {
+		t.Errorf("mtime = %#x; want 0x100000102", got)
+	}
+	if got, _ := vm.read(clintAddr+clintMtimecmp+4, 4); got != 0x1 {
+		t.Errorf("mtimecmp[63:32] = %#x; want 0x1", got)
+	}
+}
+
+func TestWFI(t *testing.T) {
+	const wfiInstr = 0x10500073
+	for _, tt := range []struct {
+		mstatus uint64
+		wantPC  uint64 // after the hart wakes up and executes one instruction
+	}{
+		{mstatus: mstatusMIE, wantPC: trapHandler + 4},
+		// With interrupts globally disabled the hart resumes after WFI.
+		{mstatus: 0, wantPC: 0x8},
+	} {
+		vm := newCLINTTest(t)
+		copy(vm.Mem, asBytes(wfiInstr))
+		vm.CSR[csrMIE] = mipMTIP
+		vm.CSR[csrMstatus] = tt.mstatus
+		vm.write(clintAddr+clintMtimecmp, 8, 1000000)
+
+		if err := vm.Run(1); err != nil {
+			t.Fatalf("Run failed: %v", err)
+		}
+		if !vm.waiting {
+			t.Fatalf("hart isn't waiting after WFI")
+		}
+		if err := vm.Run(1); err != nil {
+			t.Fatalf("Run failed: %v", err)
+		}
+		if got := vm.CSR[RDTIME]; got != 1000000 {
+			t.Errorf("time after idle step = %d; want 1000000", got)
+		}
+		if err := vm.Run(1); err != nil {
+			t.Fatalf("Run failed: %v", err)
+		}
+		if vm.PC != tt.wantPC {
+			t.Errorf("mstatus %#x: PC = %#x; want %#x", tt.mstatus, vm.PC, tt.wantPC)
+		}
+		if tt.mstatus != 0 {
+			if got, want := vm.CSR[csrMcause], uint64(causeInterrupt|7); got != want {
+				t.Errorf("mcause = %#x; want %#x", got, want)
+			}
+			if got := vm.CSR[csrMepc]; got != 0x4 {
+				t.Errorf("mepc = %#x; want 0x4", got)
+			}
+		}
+	}
+}
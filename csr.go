@@ -0,0 +1,186 @@
+// Copyright 2019 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"fmt"
+	"sync/atomic"
+)
+
+// CSR addresses.
+//
+// riscv-privileged-v1.10; Tables 2.2-2.5; Pages 8-10. The Smaia/Ssaia CSRs are
+// defined in "The RISC-V Advanced Interrupt Architecture"; Chapter 2.
+const (
+	csrSiselect  = 0x150 // Supervisor indirect register select (Ssaia).
+	csrSireg     = 0x151 // Supervisor indirect register alias (Ssaia).
+	csrStimecmp  = 0x14D // Supervisor timer compare (Sstc).
+	csrStopei    = 0x15C // Supervisor top external interrupt (Ssaia).
+	csrMisa      = 0x301 // ISA and extensions.
+	csrMIE       = 0x304 // Machine interrupt-enable register.
+	csrMenvcfg   = 0x30A // Machine environment configuration register.
+	csrMIP       = 0x344 // Machine interrupt pending.
+	csrMiselect  = 0x350 // Machine indirect register select (Smaia).
+	csrMireg     = 0x351 // Machine indirect register alias (Smaia).
+	csrMtopei    = 0x35C // Machine top external interrupt (Smaia).
+	csrMvendorid = 0xF11 // Vendor ID; followed by marchid and mimpid.
+	csrMhartid   = 0xF14 // Hart ID.
+)
+
+// Bits of the mip and mie CSRs.
+//
+// riscv-privileged-v1.10; Figure 3.11; Page 29
+const (
+	mipSSIP = 1 << 1  // Supervisor software interrupt.
+	mipMSIP = 1 << 3  // Machine software interrupt.
+	mipSTIP = 1 << 5  // Supervisor timer interrupt.
+	mipMTIP = 1 << 7  // Machine timer interrupt.
+	mipSEIP = 1 << 9  // Supervisor external interrupt.
+	mipMEIP = 1 << 11 // Machine external interrupt.
+)
+
+// Values of the misa CSR. Only the C bit is writable.
+//
+// riscv-privileged-v1.10; Chapter 3.1.1; Page 15
+const (
+	misaC       = 1 << ('C' - 'A')
+	misaDefault = 2<<62 | 1<<('I'-'A') | 1<<('M'-'A') | 1<<('A'-'A') | 1<<('F'-'A') | 1<<('D'-'A') | misaC | 1<<('H'-'A') | 1<<('S'-'A') | 1<<('U'-'A') // RV64IMAFDCH with S-mode and U-mode
+)
+
+// Bits of the menvcfg CSR.
+const (
+	menvcfgSTCE = 1 << 63 // STimecmp Enable (Sstc).
+)
+
+// setMIP sets (on == true) or clears (on == false) the given bits of the mip
+// CSR. Interrupt controllers call it when their outputs change. It's safe to
+// call it from a goroutine other than the one running the VM.
+func (vm *VM) setMIP(mask uint64, on bool) {
+	p := &vm.CSR[csrMIP]
+	for {
+		old := atomic.LoadUint64(p)
+		v := old &^ mask
+		if on {
+			v = old | mask
+		}
+		if v == old || atomic.CompareAndSwapUint64(p, old, v) {
+			return
+		}
+	}
+}
+
+// readCSR returns the value of the CSR.
+func (vm *VM) readCSR(csr uint64) (uint64, error) {
+	switch csr {
+	case csrMIP:
+		return atomic.LoadUint64(&vm.CSR[csrMIP]), nil
+	case csrMideleg:
+		return vm.CSR[csrMideleg] | midelegVS, nil
+	case csrSstatus:
+		return vm.CSR[csrMstatus] & sstatusMask, nil
+	case csrSie:
+		return vm.CSR[csrMIE] & vm.CSR[csrMideleg], nil
+	case csrSip:
+		return atomic.LoadUint64(&vm.CSR[csrMIP]) & vm.CSR[csrMideleg], nil
+	case RDTIME:
+		if vm.Virt {
+			return vm.CSR[RDTIME] + vm.CSR[csrHtimedelta], nil
+		}
+	case csrHstatus, csrHie, csrHip, csrHvip, csrHgeie, csrHgeip, csrHenvcfg, csrVsie, csrVsip:
+		return vm.readHyp(csr), nil
+	case csrMireg, csrSireg, csrMtopei, csrStopei:
+		return vm.readAIA(csr)
+	case csrTdata1, csrTdata2, csrTdata3, csrTinfo:
+		return vm.readTrigger(csr), nil
+	case csrFflags, csrFrm, csrFcsr:
+		return vm.readFCSR(csr)
+	}
+	if csr >= uint64(len(vm.CSR)) {
+		return 0, fmt.Errorf("invalid CSR %#x", csr)
+	}
+	return vm.CSR[csr], nil
+}
+
+// writeCSR sets the value of the CSR.
+func (vm *VM) writeCSR(csr, v uint64) error {
+	switch csr {
+	case csrMIP:
+		// External interrupt pending bits are driven by the interrupt
+		// controllers and are read-only. So is STIP when it's driven by
+		// stimecmp. VSTIP and VSEIP are set through hvip.
+		ro := uint64(mipMEIP | mipSEIP | mipVSTIP | mipVSEIP)
+		if vm.CSR[csrMenvcfg]&menvcfgSTCE != 0 {
+			ro |= mipSTIP
+		}
+		for {
+			old := atomic.LoadUint64(&vm.CSR[csrMIP])
+			if atomic.CompareAndSwapUint64(&vm.CSR[csrMIP], old, old&ro|v&^ro) {
+				return nil
+			}
+		}
+	case csrMstatus:
+		vm.CSR[csr] = withSD(v)
+		return nil
+	case csrSstatus:
+		vm.CSR[csrMstatus] = withSD(vm.CSR[csrMstatus]&^sstatusMask | v&sstatusMask)
+		return nil
+	case csrSie:
+		deleg := vm.CSR[csrMideleg]
+		vm.CSR[csrMIE] = vm.CSR[csrMIE]&^deleg | v&deleg
+		return nil
+	case csrSip:
+		// Only SSIP is writable, and only when it's delegated.
+		if vm.CSR[csrMideleg]&mipSSIP != 0 {
+			vm.setMIP(mipSSIP, v&mipSSIP != 0)
+		}
+		return nil
+	case csrSatp:
+		vm.writeSatp(v)
+		return nil
+	case csrMedeleg:
+		vm.CSR[csr] = v & medelegMask
+		return nil
+	case csrMideleg:
+		vm.CSR[csr] = v & midelegMask
+		return nil
+	case csrMireg, csrSireg, csrMtopei, csrStopei:
+		return vm.writeAIA(csr, v)
+	case csrHstatus, csrHedeleg, csrHideleg, csrHie, csrHip, csrHvip, csrHgeie, csrHenvcfg, csrHtimedelta,
+		csrHgatp, csrVsstatus, csrVsie, csrVsip, csrVsatp, csrVstimecmp:
+		vm.writeHyp(csr, v)
+		return nil
+	case csrMisa:
+		// Clearing C is ignored if it would make the next instruction
+		// misaligned.
+		if v&misaC != 0 || (vm.PC+4)&3 == 0 {
+			vm.CSR[csrMisa] = vm.CSR[csrMisa]&^misaC | v&misaC
+		}
+		return nil
+	case csrStimecmp, csrMenvcfg:
+		vm.CSR[csr] = v
+		vm.tick(0)
+		return nil
+	case csrTselect, csrTdata1, csrTdata2, csrTdata3, csrTinfo:
+		vm.writeTrigger(csr, v)
+		return nil
+	case csrFflags, csrFrm, csrFcsr:
+		return vm.writeFCSR(csr, v)
+	}
+	if csr >= uint64(len(vm.CSR)) {
+		return fmt.Errorf("invalid CSR %#x", csr)
+	}
+	vm.CSR[csr] = v
+	return nil
+}
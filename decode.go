@@ -54,9 +54,18 @@ func Decode(pc uint64, b []byte) (instr *Instruction, size int, err error) {
 	// Bits 6..2 determine base opcode which determines the format.
 	// Bits 4..3 can't be 0x7 for 32-bit instructions
 	var funct7 uint64
+	funct3 := in >> 7 & 0xE0
 	switch bop := baseOpcode(in >> 2 & 0x1f); bop {
-	case boAMO, boOp, boOp32, boOpFP: // r-type
+	case boAMO: // r-type; the aq and rl bits of funct7 are ignored
+		funct7 = in >> 17 & 0x7c00
+	case boOp, boOp32: // r-type
 		funct7 = in >> 17 & 0x7f00
+	case boOpFP: // r-type; funct3 is the rounding mode or it's decoded by the instruction
+		funct7 = in >> 17 & 0x7f00
+		funct3 = 0
+	case boMadd, boMsub, boNmsub, boNmadd: // r4-type; rs3 and the format replace funct7, funct3 is the rounding mode
+		funct7 = in >> 17 & 0x300
+		funct3 = 0
 	case boLoad, boLoadFP, boMiscMem, boOpImm, boOpImm32, boJALR, boSystem: // i-type
 		out.imm = in >> 20 & 0xfff
 	case boStore, boStoreFP: // s-type
@@ -84,7 +93,7 @@ func Decode(pc uint64, b []byte) (instr *Instruction, size int, err error) {
 		return nil, 0, fmt.Errorf("instruction %#x has unrecognized format (base opcode: %#x)", in, bop)
 	}
 
-	key := funct7 | in>>7&0xE0 | in>>2&0x1f
+	key := funct7 | funct3 | in>>2&0x1f
 	out.fn = rvi64Instructions[key]
 	if out.fn == nil {
 		return nil, 0, fmt.Errorf("can't decode instruction %#x at %#x: no entry in rvi instructions table for %#x", in, pc, key)
@@ -172,6 +181,7 @@ var rvi64Instructions = [...]func(*VM, *Instruction) (flags, error){
 	0xBC:   csrrwi,       // csr zimm 101 rd 1110011 CSRRWI
 	0xDC:   csrrsi,       // csr zimm 110 rd 1110011 CSRRSI
 	0xFC:   csrrci,       // csr zimm 111 rd 1110011 CSRRCI
+	0x9C:   hlvOrHsv,     // 0110000 00000 rs1 100 rd 1110011 HLV.B (and the other HLV, HLVX and HSV instructions)
 
 	// RV64I Base Instruction Set (in addition to RV32I); Page 105
 	0xC0:   lwu,        // imm[11:0] rs1 110 rd 0000011 LWU
@@ -203,6 +213,74 @@ var rvi64Instructions = [...]func(*VM, *Instruction) (flags, error){
 	0x1AE: divuw,  // 0000001 rs2 rs1 101 rd 0111011 DIVUW
 	0x1CE: remw,   // 0000001 rs2 rs1 110 rd 0111011 REMW
 	0x1EE: remuw,  // 0000001 rs2 rs1 111 rd 0111011 REMUW
+
+	// "A" Standard Extension for Atomic Instructions; the aq and rl bits
+	// are masked out of the keys
+	0x084B: lrW,      // 00010 aq rl 00000 rs1 010 rd 0101111 LR.W
+	0x0C4B: scW,      // 00011 aq rl rs2 rs1 010 rd 0101111 SC.W
+	0x044B: amoswapW, // 00001 aq rl rs2 rs1 010 rd 0101111 AMOSWAP.W
+	0x004B: amoaddW,  // 00000 aq rl rs2 rs1 010 rd 0101111 AMOADD.W
+	0x104B: amoxorW,  // 00100 aq rl rs2 rs1 010 rd 0101111 AMOXOR.W
+	0x304B: amoandW,  // 01100 aq rl rs2 rs1 010 rd 0101111 AMOAND.W
+	0x204B: amoorW,   // 01000 aq rl rs2 rs1 010 rd 0101111 AMOOR.W
+	0x404B: amominW,  // 10000 aq rl rs2 rs1 010 rd 0101111 AMOMIN.W
+	0x504B: amomaxW,  // 10100 aq rl rs2 rs1 010 rd 0101111 AMOMAX.W
+	0x604B: amominuW, // 11000 aq rl rs2 rs1 010 rd 0101111 AMOMINU.W
+	0x704B: amomaxuW, // 11100 aq rl rs2 rs1 010 rd 0101111 AMOMAXU.W
+	0x086B: lrD,      // 00010 aq rl 00000 rs1 011 rd 0101111 LR.D
+	0x0C6B: scD,      // 00011 aq rl rs2 rs1 011 rd 0101111 SC.D
+	0x046B: amoswapD, // 00001 aq rl rs2 rs1 011 rd 0101111 AMOSWAP.D
+	0x006B: amoaddD,  // 00000 aq rl rs2 rs1 011 rd 0101111 AMOADD.D
+	0x106B: amoxorD,  // 00100 aq rl rs2 rs1 011 rd 0101111 AMOXOR.D
+	0x306B: amoandD,  // 01100 aq rl rs2 rs1 011 rd 0101111 AMOAND.D
+	0x206B: amoorD,   // 01000 aq rl rs2 rs1 011 rd 0101111 AMOOR.D
+	0x406B: amominD,  // 10000 aq rl rs2 rs1 011 rd 0101111 AMOMIN.D
+	0x506B: amomaxD,  // 10100 aq rl rs2 rs1 011 rd 0101111 AMOMAX.D
+	0x606B: amominuD, // 11000 aq rl rs2 rs1 011 rd 0101111 AMOMINU.D
+	0x706B: amomaxuD, // 11100 aq rl rs2 rs1 011 rd 0101111 AMOMAXU.D
+
+	// "F" Standard Extension for Single-Precision Floating-Point; funct3
+	// of computational instructions is masked out of the keys
+	0x41:   flw,            // imm[11:0] rs1 010 rd 0000111 FLW
+	0x49:   fsw,            // imm[11:5] rs2 rs1 010 imm[4:0] 0100111 FSW
+	0x10:   fmaddS,         // rs3 00 rs2 rs1 rm rd 1000011 FMADD.S
+	0x11:   fmsubS,         // rs3 00 rs2 rs1 rm rd 1000111 FMSUB.S
+	0x12:   fnmsubS,        // rs3 00 rs2 rs1 rm rd 1001011 FNMSUB.S
+	0x13:   fnmaddS,        // rs3 00 rs2 rs1 rm rd 1001111 FNMADD.S
+	0x0014: faddS,          // 0000000 rs2 rs1 rm rd 1010011 FADD.S
+	0x0414: fsubS,          // 0000100 rs2 rs1 rm rd 1010011 FSUB.S
+	0x0814: fmulS,          // 0001000 rs2 rs1 rm rd 1010011 FMUL.S
+	0x0C14: fdivS,          // 0001100 rs2 rs1 rm rd 1010011 FDIV.S
+	0x2C14: fsqrtS,         // 0101100 00000 rs1 rm rd 1010011 FSQRT.S
+	0x1014: fsgnjS,         // 0010000 rs2 rs1 000 rd 1010011 FSGNJ.S (or 001 FSGNJN.S, 010 FSGNJX.S)
+	0x1414: fminmaxS,       // 0010100 rs2 rs1 000 rd 1010011 FMIN.S (or 001 FMAX.S)
+	0x6014: fcvtIntS,       // 1100000 00000 rs1 rm rd 1010011 FCVT.W.S (or 00001 FCVT.WU.S, 00010 FCVT.L.S, 00011 FCVT.LU.S)
+	0x7014: fmvxwOrFclassS, // 1110000 00000 rs1 000 rd 1010011 FMV.X.W (or 001 FCLASS.S)
+	0x5014: fcmpS,          // 1010000 rs2 rs1 010 rd 1010011 FEQ.S (or 001 FLT.S, 000 FLE.S)
+	0x6814: fcvtSInt,       // 1101000 00000 rs1 rm rd 1010011 FCVT.S.W (or 00001 FCVT.S.WU, 00010 FCVT.S.L, 00011 FCVT.S.LU)
+	0x7814: fmvWX,          // 1111000 00000 rs1 000 rd 1010011 FMV.W.X
+
+	// "D" Standard Extension for Double-Precision Floating-Point
+	0x61:   fld,            // imm[11:0] rs1 011 rd 0000111 FLD
+	0x69:   fsd,            // imm[11:5] rs2 rs1 011 imm[4:0] 0100111 FSD
+	0x110:  fmaddD,         // rs3 01 rs2 rs1 rm rd 1000011 FMADD.D
+	0x111:  fmsubD,         // rs3 01 rs2 rs1 rm rd 1000111 FMSUB.D
+	0x112:  fnmsubD,        // rs3 01 rs2 rs1 rm rd 1001011 FNMSUB.D
+	0x113:  fnmaddD,        // rs3 01 rs2 rs1 rm rd 1001111 FNMADD.D
+	0x0114: faddD,          // 0000001 rs2 rs1 rm rd 1010011 FADD.D
+	0x0514: fsubD,          // 0000101 rs2 rs1 rm rd 1010011 FSUB.D
+	0x0914: fmulD,          // 0001001 rs2 rs1 rm rd 1010011 FMUL.D
+	0x0D14: fdivD,          // 0001101 rs2 rs1 rm rd 1010011 FDIV.D
+	0x2D14: fsqrtD,         // 0101101 00000 rs1 rm rd 1010011 FSQRT.D
+	0x1114: fsgnjD,         // 0010001 rs2 rs1 000 rd 1010011 FSGNJ.D (or 001 FSGNJN.D, 010 FSGNJX.D)
+	0x1514: fminmaxD,       // 0010101 rs2 rs1 000 rd 1010011 FMIN.D (or 001 FMAX.D)
+	0x2014: fcvtSD,         // 0100000 00001 rs1 rm rd 1010011 FCVT.S.D
+	0x2114: fcvtDS,         // 0100001 00000 rs1 rm rd 1010011 FCVT.D.S
+	0x5114: fcmpD,          // 1010001 rs2 rs1 010 rd 1010011 FEQ.D (or 001 FLT.D, 000 FLE.D)
+	0x6114: fcvtIntD,       // 1100001 00000 rs1 rm rd 1010011 FCVT.W.D (or 00001 FCVT.WU.D, 00010 FCVT.L.D, 00011 FCVT.LU.D)
+	0x6914: fcvtDInt,       // 1101001 00000 rs1 rm rd 1010011 FCVT.D.W (or 00001 FCVT.D.WU, 00010 FCVT.D.L, 00011 FCVT.D.LU)
+	0x7114: fmvxdOrFclassD, // 1110001 00000 rs1 000 rd 1010011 FMV.X.D (or 001 FCLASS.D)
+	0x7914: fmvDX,          // 1111001 00000 rs1 000 rd 1010011 FMV.D.X
 }
 
 // decodeSize returns the size of the next instruction in bytes. The second
@@ -14,7 +14,10 @@
 
 package main
 
-import "errors"
+import (
+	"errors"
+	"fmt"
+)
 
 var (
 	ecallErr       = errors.New("the program is done")
@@ -34,8 +37,39 @@ func IsInvlidAddr(err error) bool {
 	return err == invalidAddrErr
 }
 
+// accessFaultErr is returned by devices that refuse an access. The VM raises
+// an access-fault exception.
+var accessFaultErr = errors.New("access fault")
+
 var exitErr = errors.New("the program is done")
 
+// ExitError is returned by VM.Run when the program ends with a status code,
+// for example by calling exit or by writing to the test finisher.
+type ExitError struct {
+	Code  int
+	Reset bool // the program asked for a reset instead of a power-off
+}
+
+func (e *ExitError) Error() string {
+	if e.Reset {
+		return fmt.Sprintf("the program requested a reset with status %d", e.Code)
+	}
+	return fmt.Sprintf("the program is done with status %d", e.Code)
+}
+
+// IsExit reports whether the program is done. The status code is available if
+// err is an *ExitError.
 func IsExit(err error) bool {
+	if _, ok := err.(*ExitError); ok {
+		return true
+	}
 	return err == exitErr
 }
+
+var triggerErr = errors.New("debug trigger fired")
+
+// IsTrigger reports whether the error was returned because VM.TriggerHook
+// asked to stop the VM.
+func IsTrigger(err error) bool {
+	return err == triggerErr
+}
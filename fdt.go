@@ -0,0 +1,364 @@
+// Copyright 2019 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"encoding/binary"
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// Flattened device tree format. See the Devicetree Specification v0.3;
+// Chapter 5.
+const (
+	fdtMagic          = 0xd00dfeed
+	fdtVersion        = 17
+	fdtLastCompatible = 16
+	fdtHeaderSize     = 40
+
+	fdtBeginNode = 1
+	fdtEndNode   = 2
+	fdtProp      = 3
+	fdtEnd       = 9
+)
+
+// timebaseFreq is the nominal frequency of the time CSR. The time advances by
+// one with every step, so it's only used to convert time to seconds.
+const timebaseFreq = 10000000
+
+// fdtNode is a device tree node.
+type fdtNode struct {
+	name     string
+	props    []fdtProperty
+	children []*fdtNode
+}
+
+type fdtProperty struct {
+	name  string
+	value []byte
+}
+
+// child adds a child node with the given name and returns it.
+func (n *fdtNode) child(name string) *fdtNode {
+	c := &fdtNode{name: name}
+	n.children = append(n.children, c)
+	return c
+}
+
+func (n *fdtNode) set(name string, value []byte) {
+	n.props = append(n.props, fdtProperty{name, value})
+}
+
+// setEmpty adds a property without a value, e.g. interrupt-controller.
+func (n *fdtNode) setEmpty(name string) { n.set(name, nil) }
+
+// setU32 adds a property holding a list of 32-bit cells.
+func (n *fdtNode) setU32(name string, cells ...uint32) {
+	b := make([]byte, 4*len(cells))
+	for i, c := range cells {
+		binary.BigEndian.PutUint32(b[4*i:], c)
+	}
+	n.set(name, b)
+}
+
+// setU64 adds a property holding a list of 64-bit values, each taking two
+// cells. It's used for addresses and sizes, as #address-cells and
+// #size-cells are always 2.
+func (n *fdtNode) setU64(name string, vals ...uint64) {
+	b := make([]byte, 8*len(vals))
+	for i, v := range vals {
+		binary.BigEndian.PutUint64(b[8*i:], v)
+	}
+	n.set(name, b)
+}
+
+// setString adds a property holding a list of strings.
+func (n *fdtNode) setString(name string, s ...string) {
+	n.set(name, []byte(strings.Join(s, "\x00")+"\x00"))
+}
+
+// Marshal returns the flattened device tree with n as the root node.
+func (n *fdtNode) Marshal() []byte {
+	var st, strs []byte
+	offsets := map[string]int{}
+	cell := func(v uint32) {
+		st = append(st, byte(v>>24), byte(v>>16), byte(v>>8), byte(v))
+	}
+	pad := func() {
+		for len(st)%4 != 0 {
+			st = append(st, 0)
+		}
+	}
+	var walk func(n *fdtNode)
+	walk = func(n *fdtNode) {
+		cell(fdtBeginNode)
+		st = append(append(st, n.name...), 0)
+		pad()
+		for _, p := range n.props {
+			off, ok := offsets[p.name]
+			if !ok {
+				off = len(strs)
+				offsets[p.name] = off
+				strs = append(append(strs, p.name...), 0)
+			}
+			cell(fdtProp)
+			cell(uint32(len(p.value)))
+			cell(uint32(off))
+			st = append(st, p.value...)
+			pad()
+		}
+		for _, c := range n.children {
+			walk(c)
+		}
+		cell(fdtEndNode)
+	}
+	walk(n)
+	cell(fdtEnd)
+
+	// The memory reservation block holds only the terminating entry.
+	const rsvmap, rsvmapSize = fdtHeaderSize, 16
+	structOff := rsvmap + rsvmapSize
+	stringsOff := structOff + len(st)
+	b := make([]byte, stringsOff, stringsOff+len(strs))
+	for i, v := range []uint32{
+		fdtMagic,
+		uint32(stringsOff + len(strs)),
+		uint32(structOff),
+		uint32(stringsOff),
+		rsvmap,
+		fdtVersion,
+		fdtLastCompatible,
+		0, // boot_cpuid_phys
+		uint32(len(strs)),
+		uint32(len(st)),
+	} {
+		binary.BigEndian.PutUint32(b[4*i:], v)
+	}
+	copy(b[structOff:], st)
+	return append(b, strs...)
+}
+
+// DTConfig holds the parts of the device tree that don't describe hardware.
+type DTConfig struct {
+	Bootargs string
+	// InitrdStart and InitrdEnd are the physical addresses of the initial
+	// ramdisk; both are zero if there's none.
+	InitrdStart, InitrdEnd uint64
+}
+
+// BuildDeviceTree returns the flattened device tree describing the machine:
+// its harts, main memory and the devices mapped on the bus of the first hart.
+// Memory shadowed by devices is left out of the memory node.
+//
+// The CLINT, PLIC, UART, virtio-mmio transports, Goldfish RTC, test finisher
+// and framebuffer are described. The AIA controllers aren't.
+func BuildDeviceTree(harts []*VM, c DTConfig) []byte {
+	vm := harts[0]
+	root := &fdtNode{}
+	root.setU32("#address-cells", 2)
+	root.setU32("#size-cells", 2)
+	root.setString("compatible", "riscv-emu")
+	root.setString("model", "riscv-emu")
+
+	var phandle uint32
+	next := func(n *fdtNode) uint32 {
+		phandle++
+		n.setU32("phandle", phandle)
+		return phandle
+	}
+
+	chosen := root.child("chosen")
+	if c.Bootargs != "" {
+		chosen.setString("bootargs", c.Bootargs)
+	}
+	if c.InitrdEnd > c.InitrdStart {
+		chosen.setU64("linux,initrd-start", c.InitrdStart)
+		chosen.setU64("linux,initrd-end", c.InitrdEnd)
+	}
+
+	if ram := ramRanges(vm); len(ram) > 0 {
+		mem := root.child(fmt.Sprintf("memory@%x", ram[0]))
+		mem.setString("device_type", "memory")
+		mem.setU64("reg", ram...)
+	}
+
+	cpus := root.child("cpus")
+	cpus.setU32("#address-cells", 1)
+	cpus.setU32("#size-cells", 0)
+	cpus.setU32("timebase-frequency", timebaseFreq)
+	intc := make([]uint32, len(harts)) // phandles of the hart-local interrupt controllers
+	for i, h := range harts {
+		cpu := cpus.child(fmt.Sprintf("cpu@%d", i))
+		cpu.setString("device_type", "cpu")
+		cpu.setU32("reg", uint32(i))
+		cpu.setString("status", "okay")
+		cpu.setString("compatible", "riscv")
+		cpu.setString("riscv,isa", isaString(h))
+		cpu.setString("mmu-type", "riscv,sv39")
+		ic := cpu.child("interrupt-controller")
+		ic.setU32("#interrupt-cells", 1)
+		ic.setEmpty("interrupt-controller")
+		ic.setString("compatible", "riscv,cpu-intc")
+		intc[i] = next(ic)
+	}
+	// perHart returns interrupts-extended cells connecting the given local
+	// interrupts of every hart.
+	perHart := func(irqs ...uint32) []uint32 {
+		var cells []uint32
+		for _, p := range intc {
+			for _, irq := range irqs {
+				cells = append(cells, p, irq)
+			}
+		}
+		return cells
+	}
+
+	soc := root.child("soc")
+	soc.setU32("#address-cells", 2)
+	soc.setU32("#size-cells", 2)
+	soc.setString("compatible", "simple-bus")
+	soc.setEmpty("ranges")
+
+	var regions []region
+	if vm.Bus != nil {
+		regions = append(regions, vm.Bus.regions...)
+	}
+	sort.Slice(regions, func(i, j int) bool { return regions[i].base < regions[j].base })
+	// Interrupt controllers go first, so that devices can refer to them.
+	plics := map[*PLIC]uint32{}
+	for _, r := range regions {
+		p, ok := r.dev.(*PLIC)
+		if !ok {
+			continue
+		}
+		n := soc.child(fmt.Sprintf("plic@%x", r.base))
+		n.setString("compatible", "sifive,plic-1.0.0", "riscv,plic0")
+		n.setU64("reg", r.base, r.size)
+		n.setU32("#address-cells", 0)
+		n.setU32("#interrupt-cells", 1)
+		n.setEmpty("interrupt-controller")
+		n.setU32("riscv,ndev", uint32(p.sources-1))
+		n.setU32("interrupts-extended", perHart(11, 9)...) // MEI, SEI
+		plics[p] = next(n)
+	}
+	stdout := false // whether stdout-path is set
+	// interrupts describes the interrupt line of a device.
+	interrupts := func(n *fdtNode, l InterruptLine) {
+		if l, ok := l.(plicLine); ok {
+			n.setU32("interrupt-parent", plics[l.p])
+			n.setU32("interrupts", uint32(l.src))
+		}
+	}
+	for _, r := range regions {
+		switch d := r.dev.(type) {
+		case *CLINT:
+			n := soc.child(fmt.Sprintf("clint@%x", r.base))
+			n.setString("compatible", "sifive,clint0", "riscv,clint0")
+			n.setU64("reg", r.base, r.size)
+			n.setU32("interrupts-extended", perHart(3, 7)...) // MSI, MTI
+		case *UART:
+			name := fmt.Sprintf("serial@%x", r.base)
+			n := soc.child(name)
+			n.setString("compatible", "ns16550a")
+			n.setU64("reg", r.base, r.size)
+			n.setU32("clock-frequency", 3686400)
+			interrupts(n, d.irq)
+			if !stdout {
+				chosen.setString("stdout-path", "/soc/"+name)
+				stdout = true
+			}
+		case *VirtioMMIO:
+			n := soc.child(fmt.Sprintf("virtio_mmio@%x", r.base))
+			n.setString("compatible", "virtio,mmio")
+			n.setU64("reg", r.base, r.size)
+			interrupts(n, d.irq)
+		case *GoldfishRTC:
+			n := soc.child(fmt.Sprintf("rtc@%x", r.base))
+			n.setString("compatible", "google,goldfish-rtc")
+			n.setU64("reg", r.base, r.size)
+			interrupts(n, d.irq)
+		case TestFinisher:
+			n := soc.child(fmt.Sprintf("test@%x", r.base))
+			n.setString("compatible", "sifive,test1", "sifive,test0", "syscon")
+			n.setU64("reg", r.base, r.size)
+			test := next(n)
+			for _, s := range []struct {
+				name  string
+				value uint32
+			}{{"poweroff", finisherPass}, {"reboot", finisherReset}} {
+				n := root.child(s.name)
+				n.setString("compatible", "syscon-"+s.name)
+				n.setU32("regmap", test)
+				n.setU32("offset", 0)
+				n.setU32("value", s.value)
+			}
+		case *Framebuffer:
+			n := chosen.child(fmt.Sprintf("framebuffer@%x", r.base))
+			n.setString("compatible", "simple-framebuffer")
+			n.setU64("reg", r.base, r.size)
+			n.setU32("width", uint32(d.Width))
+			n.setU32("height", uint32(d.Height))
+			n.setU32("stride", uint32(d.Stride))
+			n.setString("format", d.Format)
+		}
+	}
+	return root.Marshal()
+}
+
+// isaString returns the ISA string of the hart, e.g. rv64imac_zicsr.
+func isaString(vm *VM) string {
+	misa := vm.CSR[csrMisa]
+	s := "rv64"
+	for _, ext := range "imafdqcvh" {
+		if misa&(1<<uint(ext-'a')) != 0 {
+			s += string(ext)
+		}
+	}
+	return s + "_zicsr_zifencei_sstc"
+}
+
+// ramRanges returns address and size pairs describing main memory that isn't
+// shadowed by devices, followed by the writable memory regions. ROM and flash
+// aren't usable as RAM, so they're left out.
+func ramRanges(vm *VM) []uint64 {
+	var holes []region
+	if vm.Bus != nil {
+		holes = append(holes, vm.Bus.regions...)
+	}
+	sort.Slice(holes, func(i, j int) bool { return holes[i].base < holes[j].base })
+	var ranges []uint64
+	start, end := uint64(0), uint64(len(vm.Mem))
+	for _, h := range holes {
+		if h.base >= end {
+			break
+		}
+		if h.base > start {
+			ranges = append(ranges, start, h.base-start)
+		}
+		if h.base+h.size > start {
+			start = h.base + h.size
+		}
+	}
+	if start < end {
+		ranges = append(ranges, start, end-start)
+	}
+	for _, h := range holes {
+		if m, ok := h.dev.(*MemoryRegion); ok && m.Perms&PermWrite != 0 {
+			ranges = append(ranges, h.base, h.size)
+		}
+	}
+	return ranges
+}
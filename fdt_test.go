@@ -0,0 +1,142 @@
+// Copyright 2019 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// parseFDT returns the properties of all nodes of the flattened device tree,
+// by node path.
+func parseFDT(t *testing.T, b []byte) map[string]map[string][]byte {
+	t.Helper()
+	be := binary.BigEndian
+	if magic := be.Uint32(b); magic != fdtMagic {
+		t.Fatalf("magic = %#x; want %#x", magic, fdtMagic)
+	}
+	if size := be.Uint32(b[4:]); int(size) != len(b) {
+		t.Fatalf("totalsize = %d; want %d", size, len(b))
+	}
+	st, strs := b[be.Uint32(b[8:]):], b[be.Uint32(b[12:]):]
+	str := func(b []byte) string { return string(b[:bytes.IndexByte(b, 0)]) }
+	nodes := map[string]map[string][]byte{}
+	var path []string
+	for off := 0; ; {
+		tok := be.Uint32(st[off:])
+		off += 4
+		switch tok {
+		case fdtBeginNode:
+			name := str(st[off:])
+			off += (len(name) + 4) &^ 3
+			path = append(path, name)
+			nodes["/"+strings.Join(path[1:], "/")] = map[string][]byte{}
+		case fdtProp:
+			n, name := be.Uint32(st[off:]), str(strs[be.Uint32(st[off+4:]):])
+			nodes["/"+strings.Join(path[1:], "/")][name] = st[off+8 : off+8+int(n)]
+			off += 8 + (int(n)+3)&^3
+		case fdtEndNode:
+			path = path[:len(path)-1]
+		case fdtEnd:
+			return nodes
+		default:
+			t.Fatalf("invalid token %d at offset %d", tok, off-4)
+		}
+	}
+}
+
+func cells(v ...uint32) []byte {
+	b := make([]byte, 4*len(v))
+	for i, c := range v {
+		binary.BigEndian.PutUint32(b[4*i:], c)
+	}
+	return b
+}
+
+func TestDeviceTree(t *testing.T) {
+	vm := NewVM(&Prog{MemSize: 0x20000000})
+	vm.Bus = &Bus{}
+	p := NewPLIC(plicSources, vm)
+	fb, _ := NewFramebuffer(4, 2, "r5g6b5")
+	for _, d := range []struct {
+		addr, size uint64
+		dev        Device
+	}{
+		{0x2000000, CLINTSize, NewCLINT(vm)},
+		{0xc000000, PLICSize, p},
+		{0x10000000, UARTSize, NewUART(nil, p.Line(uartIRQ))},
+		{0x10001000, VirtioMMIOSize, NewVirtioMMIO(vm, NewVirtioRNG(nil), p.Line(1))},
+		{0x100000, TestFinisherSize, TestFinisher{}},
+		{0x18000000, fb.Size(), fb},
+	} {
+		if err := vm.Bus.Map(d.addr, d.size, d.dev); err != nil {
+			t.Fatal(err)
+		}
+	}
+	nodes := parseFDT(t, BuildDeviceTree([]*VM{vm}, DTConfig{
+		Bootargs:    "console=ttyS0",
+		InitrdStart: 0x8000000,
+		InitrdEnd:   0x8100000,
+	}))
+
+	for _, tt := range []struct {
+		node, prop string
+		want       []byte
+	}{
+		{"/chosen", "bootargs", []byte("console=ttyS0\x00")},
+		{"/chosen", "linux,initrd-start", cells(0, 0x8000000)},
+		{"/chosen", "linux,initrd-end", cells(0, 0x8100000)},
+		{"/chosen", "stdout-path", []byte("/soc/serial@10000000\x00")},
+		{"/chosen/framebuffer@18000000", "format", []byte("r5g6b5\x00")},
+		{"/chosen/framebuffer@18000000", "stride", cells(8)},
+		{"/cpus", "timebase-frequency", cells(timebaseFreq)},
+		{"/cpus/cpu@0", "riscv,isa", []byte("rv64imafdch_zicsr_zifencei_sstc\x00")},
+		{"/cpus/cpu@0", "mmu-type", []byte("riscv,sv39\x00")},
+		{"/cpus/cpu@0/interrupt-controller", "phandle", cells(1)},
+		// Memory shadowed by devices isn't described.
+		{"/memory@0", "reg", cells(
+			0, 0, 0, 0x100000,
+			0, 0x101000, 0, 0x2000000-0x101000,
+			0, 0x2010000, 0, 0xc000000-0x2010000,
+			0, 0x10000100, 0, 0xf00,
+			0, 0x10001200, 0, 0x18000000-0x10001200,
+			0, 0x18000010, 0, 0x20000000-0x18000010,
+		)},
+		{"/soc/clint@2000000", "interrupts-extended", cells(1, 3, 1, 7)},
+		{"/soc/plic@c000000", "interrupts-extended", cells(1, 11, 1, 9)},
+		{"/soc/plic@c000000", "phandle", cells(2)},
+		{"/soc/plic@c000000", "riscv,ndev", cells(plicSources)},
+		{"/soc/serial@10000000", "interrupts", cells(uartIRQ)},
+		{"/soc/serial@10000000", "interrupt-parent", cells(2)},
+		{"/soc/virtio_mmio@10001000", "compatible", []byte("virtio,mmio\x00")},
+		{"/soc/virtio_mmio@10001000", "reg", cells(0, 0x10001000, 0, VirtioMMIOSize)},
+		{"/soc/virtio_mmio@10001000", "interrupts", cells(1)},
+		{"/soc/test@100000", "phandle", cells(3)},
+		{"/poweroff", "regmap", cells(3)},
+		{"/reboot", "value", cells(finisherReset)},
+	} {
+		props, ok := nodes[tt.node]
+		if !ok {
+			t.Errorf("node %s is missing", tt.node)
+			continue
+		}
+		if got := props[tt.prop]; !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("%s %s = %q; want %q", tt.node, tt.prop, got, tt.want)
+		}
+	}
+}
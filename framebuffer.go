@@ -0,0 +1,130 @@
+// Copyright 2019 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"fmt"
+	"image"
+	"image/color"
+	"image/png"
+	"io"
+)
+
+// pixelFormat describes a pixel format of the simple-framebuffer device tree
+// binding. Pixels are little-endian words of size bytes; r, g and b are the
+// positions of the least significant bits of the channels and rBits, gBits
+// and bBits their widths.
+type pixelFormat struct {
+	size                int
+	r, g, b             uint
+	rBits, gBits, bBits uint
+}
+
+// fbFormats are the supported pixel formats, by their names in the
+// simple-framebuffer binding (Documentation/devicetree/bindings/display/
+// simple-framebuffer.yaml in Linux).
+var fbFormats = map[string]pixelFormat{
+	"r5g6b5":   {2, 11, 5, 0, 5, 6, 5},
+	"r8g8b8":   {3, 16, 8, 0, 8, 8, 8},
+	"x8r8g8b8": {4, 16, 8, 0, 8, 8, 8},
+	"a8r8g8b8": {4, 16, 8, 0, 8, 8, 8},
+	"x8b8g8r8": {4, 0, 8, 16, 8, 8, 8},
+	"a8b8g8r8": {4, 0, 8, 16, 8, 8, 8},
+}
+
+// Framebuffer is a linear framebuffer compatible with the simple-framebuffer
+// device tree binding. Rows of Width pixels are Stride bytes apart. It
+// implements the Device interface.
+type Framebuffer struct {
+	Width, Height int
+	Stride        int
+	Format        string
+
+	format pixelFormat
+	pix    []byte
+}
+
+// NewFramebuffer returns a black framebuffer with the given resolution and
+// pixel format.
+func NewFramebuffer(width, height int, format string) (*Framebuffer, error) {
+	f, ok := fbFormats[format]
+	if !ok {
+		return nil, fmt.Errorf("unsupported pixel format %q", format)
+	}
+	if width <= 0 || height <= 0 {
+		return nil, fmt.Errorf("invalid resolution %dx%d", width, height)
+	}
+	return &Framebuffer{
+		Width:  width,
+		Height: height,
+		Stride: width * f.size,
+		Format: format,
+		format: f,
+		pix:    make([]byte, width*f.size*height),
+	}, nil
+}
+
+// Size returns the size of the framebuffer's address space.
+func (fb *Framebuffer) Size() uint64 { return uint64(len(fb.pix)) }
+
+// Load implements the Device interface.
+func (fb *Framebuffer) Load(offset uint64, size int) (uint64, error) {
+	var v uint64
+	for i := 0; i < size; i++ {
+		v |= uint64(fb.pix[offset+uint64(i)]) << (8 * uint(i))
+	}
+	return v, nil
+}
+
+// Store implements the Device interface.
+func (fb *Framebuffer) Store(offset uint64, size int, v uint64) error {
+	for i := 0; i < size; i++ {
+		fb.pix[offset+uint64(i)] = byte(v >> (8 * uint(i)))
+	}
+	return nil
+}
+
+// Image returns a snapshot of the framebuffer's content. The alpha channel,
+// if any, is ignored.
+func (fb *Framebuffer) Image() *image.RGBA {
+	img := image.NewRGBA(image.Rect(0, 0, fb.Width, fb.Height))
+	f := fb.format
+	// channel scales the channel of the pixel to 8 bits.
+	channel := func(p uint32, shift, bits uint) uint8 {
+		v := p >> shift & (1<<bits - 1)
+		return uint8(v * 255 / (1<<bits - 1))
+	}
+	for y := 0; y < fb.Height; y++ {
+		for x := 0; x < fb.Width; x++ {
+			off := y*fb.Stride + x*f.size
+			var p uint32
+			for i := 0; i < f.size; i++ {
+				p |= uint32(fb.pix[off+i]) << (8 * uint(i))
+			}
+			img.SetRGBA(x, y, color.RGBA{
+				R: channel(p, f.r, f.rBits),
+				G: channel(p, f.g, f.gBits),
+				B: channel(p, f.b, f.bBits),
+				A: 0xff,
+			})
+		}
+	}
+	return img
+}
+
+// WritePNG writes a snapshot of the framebuffer's content to w as a PNG image.
+func (fb *Framebuffer) WritePNG(w io.Writer) error {
+	return png.Encode(w, fb.Image())
+}
@@ -0,0 +1,94 @@
+// Copyright 2019 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bytes"
+	"image/color"
+	"image/png"
+	"testing"
+)
+
+func TestFramebuffer(t *testing.T) {
+	tests := []struct {
+		format string
+		size   int
+		pixel  uint64
+		want   color.RGBA
+	}{
+		{"r5g6b5", 2, 0xf800, color.RGBA{0xff, 0, 0, 0xff}},
+		{"r5g6b5", 2, 0x07e0, color.RGBA{0, 0xff, 0, 0xff}},
+		{"r5g6b5", 2, 0x0010, color.RGBA{0, 0, 0x83, 0xff}},
+		{"r8g8b8", 3, 0x123456, color.RGBA{0x12, 0x34, 0x56, 0xff}},
+		{"x8r8g8b8", 4, 0xff123456, color.RGBA{0x12, 0x34, 0x56, 0xff}},
+		{"a8r8g8b8", 4, 0x00123456, color.RGBA{0x12, 0x34, 0x56, 0xff}},
+		{"x8b8g8r8", 4, 0x00123456, color.RGBA{0x56, 0x34, 0x12, 0xff}},
+	}
+	for _, tc := range tests {
+		fb, err := NewFramebuffer(4, 3, tc.format)
+		if err != nil {
+			t.Fatalf("NewFramebuffer(%s): %v", tc.format, err)
+		}
+		if got, want := fb.Size(), uint64(4*3*tc.size); got != want {
+			t.Errorf("%s: Size() = %d; want %d", tc.format, got, want)
+		}
+		// Pixel (1, 2). 3-byte pixels are written with two stores.
+		off := uint64(2*fb.Stride + 1*tc.size)
+		if tc.size == 3 {
+			fb.Store(off, 2, tc.pixel&0xffff)
+			fb.Store(off+2, 1, tc.pixel>>16)
+		} else {
+			fb.Store(off, tc.size, tc.pixel)
+		}
+		img := fb.Image()
+		if got := img.RGBAAt(1, 2); got != tc.want {
+			t.Errorf("%s: pixel %#x = %v; want %v", tc.format, tc.pixel, got, tc.want)
+		}
+		if got := img.RGBAAt(0, 0); got != (color.RGBA{0, 0, 0, 0xff}) {
+			t.Errorf("%s: pixel (0, 0) = %v; want black", tc.format, got)
+		}
+	}
+}
+
+func TestFramebufferPNG(t *testing.T) {
+	fb, err := NewFramebuffer(2, 2, "x8r8g8b8")
+	if err != nil {
+		t.Fatal(err)
+	}
+	fb.Store(4, 4, 0xff0000)
+	var buf bytes.Buffer
+	if err := fb.WritePNG(&buf); err != nil {
+		t.Fatalf("WritePNG: %v", err)
+	}
+	img, err := png.Decode(&buf)
+	if err != nil {
+		t.Fatalf("png.Decode: %v", err)
+	}
+	if got := color.RGBAModel.Convert(img.At(1, 0)); got != (color.RGBA{0xff, 0, 0, 0xff}) {
+		t.Errorf("pixel (1, 0) = %v; want red", got)
+	}
+	if got := img.Bounds().Size(); got.X != 2 || got.Y != 2 {
+		t.Errorf("image size = %v; want 2x2", got)
+	}
+}
+
+func TestNewFramebufferErrors(t *testing.T) {
+	if _, err := NewFramebuffer(2, 2, "rgb"); err == nil {
+		t.Error("NewFramebuffer with an unknown format succeeded")
+	}
+	if _, err := NewFramebuffer(0, 2, "r5g6b5"); err == nil {
+		t.Error("NewFramebuffer with zero width succeeded")
+	}
+}
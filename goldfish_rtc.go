@@ -0,0 +1,173 @@
+// Copyright 2019 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"fmt"
+	"sync"
+	"time"
+)
+
+// Goldfish RTC registers. See goldfish-rtc.txt in the Android emulator's
+// documentation and QEMU's hw/rtc/goldfish_rtc.c.
+const (
+	rtcTimeLow        = 0x00
+	rtcTimeHigh       = 0x04
+	rtcAlarmLow       = 0x08
+	rtcAlarmHigh      = 0x0c
+	rtcIRQEnabled     = 0x10
+	rtcClearAlarm     = 0x14
+	rtcAlarmStatus    = 0x18
+	rtcClearInterrupt = 0x1c
+
+	// GoldfishRTCSize is the size of the RTC's address space.
+	GoldfishRTCSize = 0x1000
+)
+
+// GoldfishRTC is a real-time clock counting nanoseconds since the Unix epoch.
+// It raises an interrupt when the alarm goes off. It implements the Device
+// interface.
+type GoldfishRTC struct {
+	mu       sync.Mutex
+	now      func() time.Time
+	irq      InterruptLine
+	offset   int64  // guest time minus host time
+	timeHigh uint32 // latched by a read of TIME_LOW or a write of TIME_HIGH
+	alarm    uint64
+	running  bool        // the alarm is set
+	timer    *time.Timer // fires the alarm
+	enabled  bool        // the alarm interrupt is enabled
+	pending  bool        // the alarm interrupt is pending
+}
+
+// NewGoldfishRTC returns an RTC reading the host time from now (time.Now if
+// nil) and raising alarms on irq (may be nil).
+func NewGoldfishRTC(now func() time.Time, irq InterruptLine) *GoldfishRTC {
+	if now == nil {
+		now = time.Now
+	}
+	return &GoldfishRTC{now: now, irq: irq}
+}
+
+// time returns the guest time.
+func (r *GoldfishRTC) time() uint64 {
+	return uint64(r.now().UnixNano() + r.offset)
+}
+
+// Load implements the Device interface.
+func (r *GoldfishRTC) Load(offset uint64, size int) (uint64, error) {
+	if size != 4 || offset%4 != 0 {
+		return 0, fmt.Errorf("RTC: unsupported %d-byte load at offset %#x", size, offset)
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	switch offset {
+	case rtcTimeLow:
+		t := r.time()
+		r.timeHigh = uint32(t >> 32)
+		return t & 0xffffffff, nil
+	case rtcTimeHigh:
+		return uint64(r.timeHigh), nil
+	case rtcAlarmLow:
+		return r.alarm & 0xffffffff, nil
+	case rtcAlarmHigh:
+		return r.alarm >> 32, nil
+	case rtcIRQEnabled:
+		return b2u(r.enabled), nil
+	case rtcAlarmStatus:
+		return b2u(r.running), nil
+	}
+	return 0, nil
+}
+
+// Store implements the Device interface.
+func (r *GoldfishRTC) Store(offset uint64, size int, v uint64) error {
+	if size != 4 || offset%4 != 0 {
+		return fmt.Errorf("RTC: unsupported %d-byte store at offset %#x", size, offset)
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	v &= 0xffffffff
+	switch offset {
+	case rtcTimeLow:
+		t := uint64(r.timeHigh)<<32 | v
+		r.offset = int64(t) - r.now().UnixNano()
+	case rtcTimeHigh:
+		r.timeHigh = uint32(v)
+	case rtcAlarmLow:
+		r.alarm = r.alarm&^0xffffffff | v
+		r.setAlarm()
+	case rtcAlarmHigh:
+		r.alarm = r.alarm&0xffffffff | v<<32
+	case rtcIRQEnabled:
+		r.enabled = v&1 != 0
+		r.update()
+	case rtcClearAlarm:
+		r.stopAlarm()
+	case rtcClearInterrupt:
+		r.pending = false
+		r.update()
+	}
+	return nil
+}
+
+// setAlarm arms the alarm. Alarms in the past go off immediately.
+func (r *GoldfishRTC) setAlarm() {
+	r.stopAlarm()
+	d := time.Duration(int64(r.alarm - r.time()))
+	if d <= 0 {
+		r.fire()
+		return
+	}
+	r.running = true
+	var t *time.Timer
+	t = time.AfterFunc(d, func() {
+		r.mu.Lock()
+		defer r.mu.Unlock()
+		if r.timer == t {
+			r.fire()
+		}
+	})
+	r.timer = t
+}
+
+func (r *GoldfishRTC) stopAlarm() {
+	if r.timer != nil {
+		r.timer.Stop()
+		r.timer = nil
+	}
+	r.running = false
+}
+
+func (r *GoldfishRTC) fire() {
+	r.timer = nil
+	r.running = false
+	r.pending = true
+	r.update()
+}
+
+// update reflects the state of the alarm interrupt on the interrupt line.
+func (r *GoldfishRTC) update() {
+	if r.irq != nil {
+		r.irq.SetLevel(r.pending && r.enabled)
+	}
+}
+
+func b2u(b bool) uint64 {
+	if b {
+		return 1
+	}
+	return 0
+}
@@ -0,0 +1,127 @@
+// Copyright 2019 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"sync"
+	"testing"
+	"time"
+)
+
+// syncLine is an InterruptLine safe for concurrent use.
+type syncLine struct {
+	mu   sync.Mutex
+	high bool
+}
+
+func (l *syncLine) SetLevel(high bool) {
+	l.mu.Lock()
+	l.high = high
+	l.mu.Unlock()
+}
+
+func (l *syncLine) level() bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.high
+}
+
+func TestGoldfishRTC(t *testing.T) {
+	host := time.Unix(0, 0x123456789abcdef)
+	var irq syncLine
+	r := NewGoldfishRTC(func() time.Time { return host }, &irq)
+	read := func(reg uint64) uint64 {
+		t.Helper()
+		v, err := r.Load(reg, 4)
+		if err != nil {
+			t.Fatalf("Load(%#x) failed: %v", reg, err)
+		}
+		return v
+	}
+	write := func(reg, v uint64) {
+		t.Helper()
+		if err := r.Store(reg, 4, v); err != nil {
+			t.Fatalf("Store(%#x, %#x) failed: %v", reg, v, err)
+		}
+	}
+
+	if lo, hi := read(rtcTimeLow), read(rtcTimeHigh); hi<<32|lo != 0x123456789abcdef {
+		t.Errorf("time = %#x; want 0x123456789abcdef", hi<<32|lo)
+	}
+	// TIME_HIGH is latched by the read of TIME_LOW.
+	read(rtcTimeLow)
+	host = host.Add(1 << 40)
+	if got := read(rtcTimeHigh); got != 0x1234567 {
+		t.Errorf("latched TIME_HIGH = %#x; want 0x1234567", got)
+	}
+
+	// Set the guest time to 5s and let 1s pass.
+	write(rtcTimeHigh, 1)
+	write(rtcTimeLow, 0x2a05f200)
+	host = host.Add(time.Second)
+	if lo, hi := read(rtcTimeLow), read(rtcTimeHigh); hi<<32|lo != 6e9 {
+		t.Errorf("time = %d; want 6e9", hi<<32|lo)
+	}
+
+	// An alarm in the past goes off immediately but the interrupt is
+	// delivered only when it's enabled.
+	write(rtcAlarmHigh, 0)
+	write(rtcAlarmLow, 1)
+	if irq.level() {
+		t.Error("alarm interrupt raised while disabled")
+	}
+	write(rtcIRQEnabled, 1)
+	if !irq.level() {
+		t.Error("alarm interrupt not raised")
+	}
+	write(rtcClearInterrupt, 1)
+	if irq.level() {
+		t.Error("alarm interrupt raised after clearing it")
+	}
+
+	// An alarm in the future keeps running until it's cleared.
+	write(rtcAlarmHigh, 2)
+	write(rtcAlarmLow, 0)
+	if got := read(rtcAlarmStatus); got != 1 {
+		t.Errorf("ALARM_STATUS = %d; want 1", got)
+	}
+	if got := read(rtcAlarmHigh); got != 2 {
+		t.Errorf("ALARM_HIGH = %d; want 2", got)
+	}
+	write(rtcClearAlarm, 1)
+	if got := read(rtcAlarmStatus); got != 0 {
+		t.Errorf("ALARM_STATUS after clearing the alarm = %d; want 0", got)
+	}
+}
+
+func TestGoldfishRTCAlarm(t *testing.T) {
+	var irq syncLine
+	r := NewGoldfishRTC(nil, &irq)
+	r.Store(rtcIRQEnabled, 4, 1)
+	lo, _ := r.Load(rtcTimeLow, 4)
+	hi, _ := r.Load(rtcTimeHigh, 4)
+	alarm := hi<<32 | lo + uint64(10*time.Millisecond)
+	r.Store(rtcAlarmHigh, 4, alarm>>32)
+	r.Store(rtcAlarmLow, 4, alarm&0xffffffff)
+	for deadline := time.Now().Add(5 * time.Second); !irq.level(); {
+		if time.Now().After(deadline) {
+			t.Fatal("the alarm didn't go off")
+		}
+		time.Sleep(time.Millisecond)
+	}
+	if got, _ := r.Load(rtcAlarmStatus, 4); got != 0 {
+		t.Errorf("ALARM_STATUS after the alarm went off = %d; want 0", got)
+	}
+}
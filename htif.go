@@ -0,0 +1,282 @@
+// Copyright 2019 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+	"sync"
+)
+
+// HTIF devices and commands. A command written to tohost is
+// device<<56 | command<<48 | payload. Responses are written to fromhost in the
+// same format. See riscv-isa-sim/fesvr/htif.cc, syscall.cc and device.cc.
+const (
+	htifSyscall = 0 // device 0: syscall proxy; command 0 only
+	htifConsole = 1 // device 1: console ("bcd")
+
+	htifGetchar = 0 // console command: read a character
+	htifPutchar = 1 // console command: write a character
+
+	// HTIFRegSize is the size of the tohost and fromhost registers.
+	HTIFRegSize = 8
+)
+
+// Syscalls supported by the HTIF syscall proxy. The numbers are the same as in
+// riscv-pk/pk/syscall.h.
+const (
+	htifSysClose = 57
+	htifSysRead  = 63
+	htifSysWrite = 64
+	htifSysExit  = 93
+
+	htifEFAULT = 14
+	htifENOSYS = 38
+)
+
+// HTIF is the Host-Target Interface of Spike. Programs written for Spike (e.g.
+// riscv-tests) write commands to the tohost variable and poll the fromhost
+// variable for responses. The HTIF type provides devices that replace both
+// variables in the address space of the VM; see ToHost and FromHost.
+//
+// Exiting (a command with the least significant bit set), the syscall proxy
+// (exit, read, write and close of standard streams) and the console device are
+// supported. The exit command makes VM.Run return an *ExitError.
+type HTIF struct {
+	mu       sync.Mutex
+	inReady  *sync.Cond // signaled when bytes are appended to in or eof is set
+	vm       *VM
+	out      io.Writer
+	input    io.Reader // read after the program reads a character for the first time
+	in       []byte    // characters read from input
+	eof      bool      // input can't provide more characters
+	reads    int       // getchar commands waiting for a character
+	tohost   uint64    // the low half of tohost, written by 4-byte stores
+	fromhost uint64
+	queue    []uint64 // responses waiting for the program to clear fromhost
+}
+
+// NewHTIF returns the HTIF of the VM. The console and the syscall proxy read
+// from in (may be nil) and write to out.
+func NewHTIF(vm *VM, in io.Reader, out io.Writer) *HTIF {
+	h := &HTIF{vm: vm, out: out, input: in, eof: in == nil}
+	h.inReady = sync.NewCond(&h.mu)
+	return h
+}
+
+// HTIFSymbols returns the addresses of the tohost and fromhost symbols among
+// the symbols of the loaded ELF files. ok is false if tohost isn't defined.
+// fromhost is 0 if it isn't defined.
+func HTIFSymbols(syms map[string]uint64) (tohost, fromhost uint64, ok bool) {
+	tohost, ok = syms["tohost"]
+	return tohost, syms["fromhost"], ok
+}
+
+// ToHost returns the device replacing the tohost variable.
+func (h *HTIF) ToHost() Device { return htifToHost{h} }
+
+// FromHost returns the device replacing the fromhost variable.
+func (h *HTIF) FromHost() Device { return htifFromHost{h} }
+
+type htifToHost struct{ h *HTIF }
+
+// Load implements the Device interface. Commands are processed as soon as
+// they're written, so tohost always reads as zero.
+func (d htifToHost) Load(offset uint64, size int) (uint64, error) {
+	return 0, nil
+}
+
+// Store implements the Device interface. RV32 programs write tohost with two
+// 4-byte stores, the low half first.
+func (d htifToHost) Store(offset uint64, size int, v uint64) error {
+	h := d.h
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	switch {
+	case size == 8 && offset == 0:
+	case size == 4 && offset == 0:
+		h.tohost = v & 0xffffffff
+		return nil
+	case size == 4 && offset == 4:
+		v = v<<32 | h.tohost
+		h.tohost = 0
+	default:
+		return fmt.Errorf("HTIF: unsupported %d-byte store to tohost at offset %#x", size, offset)
+	}
+	if v == 0 {
+		return nil
+	}
+	return h.command(v)
+}
+
+type htifFromHost struct{ h *HTIF }
+
+// Load implements the Device interface.
+func (d htifFromHost) Load(offset uint64, size int) (uint64, error) {
+	d.h.mu.Lock()
+	defer d.h.mu.Unlock()
+	return d.h.fromhost >> (8 * offset) & sizeMask(size), nil
+}
+
+// Store implements the Device interface. Queued responses are delivered once
+// the program clears fromhost.
+func (d htifFromHost) Store(offset uint64, size int, v uint64) error {
+	d.h.mu.Lock()
+	defer d.h.mu.Unlock()
+	d.h.fromhost = merge(d.h.fromhost, offset, size, v)
+	d.h.flush()
+	return nil
+}
+
+// command executes the command written to tohost.
+func (h *HTIF) command(v uint64) error {
+	dev, cmd, payload := v>>56, v>>48&0xff, v&(1<<48-1)
+	switch {
+	case dev == htifSyscall && cmd == 0 && payload&1 != 0:
+		return &ExitError{Code: int(payload >> 1)}
+	case dev == htifSyscall && cmd == 0:
+		return h.syscall(payload)
+	case dev == htifConsole && cmd == htifGetchar:
+		h.reads++
+		h.startInput()
+		h.deliver()
+		return nil
+	case dev == htifConsole && cmd == htifPutchar:
+		if _, err := h.out.Write([]byte{byte(payload)}); err != nil {
+			return fmt.Errorf("HTIF: %v", err)
+		}
+		h.respond(dev, cmd, 0x100|payload&0xff)
+		return nil
+	}
+	return fmt.Errorf("HTIF: unsupported command %#x", v)
+}
+
+// syscall executes the syscall described by the 8 words at addr: the syscall
+// number followed by the arguments. The return value replaces the syscall
+// number.
+func (h *HTIF) syscall(addr uint64) error {
+	var buf [64]byte
+	if err := h.vm.readBytes(addr, buf[:]); err != nil {
+		return fmt.Errorf("HTIF: %v", err)
+	}
+	var args [8]uint64
+	for i := range args {
+		args[i] = binary.LittleEndian.Uint64(buf[8*i:])
+	}
+	var ret int64
+	switch args[0] {
+	case htifSysExit:
+		return &ExitError{Code: int(int32(args[1]))}
+	case htifSysWrite:
+		fd, p, n := args[1], args[2], args[3]
+		if fd != 1 && fd != 2 {
+			ret = -htifENOSYS
+			break
+		}
+		b, err := h.vm.memSlice(p, n)
+		if err != nil {
+			ret = -htifEFAULT
+			break
+		}
+		if _, err := h.out.Write(b); err != nil {
+			return fmt.Errorf("HTIF: %v", err)
+		}
+		ret = int64(n)
+	case htifSysRead:
+		fd, p, n := args[1], args[2], args[3]
+		if fd != 0 {
+			ret = -htifENOSYS
+			break
+		}
+		h.startInput()
+		for len(h.in) == 0 && !h.eof {
+			h.inReady.Wait()
+		}
+		b := h.in
+		if uint64(len(b)) > n {
+			b = b[:n]
+		}
+		if err := h.vm.writeBytes(p, b); err != nil {
+			return fmt.Errorf("HTIF: %v", err)
+		}
+		h.in = h.in[len(b):]
+		ret = int64(len(b))
+	case htifSysClose:
+		ret = 0
+	default:
+		ret = -htifENOSYS
+	}
+	binary.LittleEndian.PutUint64(buf[:], uint64(ret))
+	if err := h.vm.writeBytes(addr, buf[:8]); err != nil {
+		return fmt.Errorf("HTIF: %v", err)
+	}
+	h.respond(htifSyscall, 0, 1)
+	return nil
+}
+
+// startInput starts reading the input in the background, if it isn't read
+// already. It's called when the program reads for the first time, so that
+// programs that don't read don't consume the input.
+func (h *HTIF) startInput() {
+	r := h.input
+	if r == nil {
+		return
+	}
+	h.input = nil
+	go func() {
+		buf := make([]byte, 256)
+		for {
+			n, err := r.Read(buf)
+			h.mu.Lock()
+			h.in = append(h.in, buf[:n]...)
+			if err != nil {
+				h.eof = true
+			}
+			h.deliver()
+			h.inReady.Broadcast()
+			h.mu.Unlock()
+			if err != nil {
+				return
+			}
+		}
+	}()
+}
+
+// deliver responds to pending getchar commands with the characters read so
+// far. At the end of the input it responds with 0xff so that programs don't
+// wait forever.
+func (h *HTIF) deliver() {
+	for ; h.reads > 0 && (len(h.in) > 0 || h.eof); h.reads-- {
+		ch := uint64(0xff)
+		if len(h.in) > 0 {
+			ch, h.in = uint64(h.in[0]), h.in[1:]
+		}
+		h.respond(htifConsole, htifGetchar, 0x100|ch)
+	}
+}
+
+// respond queues a response to a command.
+func (h *HTIF) respond(dev, cmd, payload uint64) {
+	h.queue = append(h.queue, dev<<56|cmd<<48|payload)
+	h.flush()
+}
+
+// flush writes the next queued response to fromhost if the program cleared it.
+func (h *HTIF) flush() {
+	if h.fromhost == 0 && len(h.queue) > 0 {
+		h.fromhost, h.queue = h.queue[0], h.queue[1:]
+	}
+}
@@ -0,0 +1,167 @@
+// Copyright 2019 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+const (
+	tohostAddr   = 0x1000
+	fromhostAddr = 0x1040
+)
+
+func newHTIFTest(t *testing.T, in string) (*VM, *bytes.Buffer) {
+	vm := NewVM(&Prog{MemSize: 0x2000})
+	var out bytes.Buffer
+	h := NewHTIF(vm, strings.NewReader(in), &out)
+	vm.Bus = &Bus{}
+	if err := vm.Bus.Map(tohostAddr, HTIFRegSize, h.ToHost()); err != nil {
+		t.Fatal(err)
+	}
+	if err := vm.Bus.Map(fromhostAddr, HTIFRegSize, h.FromHost()); err != nil {
+		t.Fatal(err)
+	}
+	return vm, &out
+}
+
+// waitFromHost waits for a response, clears fromhost and returns the response.
+func waitFromHost(t *testing.T, vm *VM) uint64 {
+	t.Helper()
+	for deadline := time.Now().Add(5 * time.Second); time.Now().Before(deadline); time.Sleep(time.Millisecond) {
+		v, err := vm.read(fromhostAddr, 8)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if v != 0 {
+			vm.write(fromhostAddr, 8, 0)
+			return v
+		}
+	}
+	t.Fatal("no response in fromhost")
+	return 0
+}
+
+func TestHTIFConsole(t *testing.T) {
+	vm, out := newHTIFTest(t, "xy")
+	for _, c := range "hi" {
+		if err := vm.write(tohostAddr, 8, 1<<56|1<<48|uint64(c)); err != nil {
+			t.Fatalf("putchar failed: %v", err)
+		}
+	}
+	// The second response is delivered once the program clears fromhost.
+	for _, c := range "hi" {
+		if got, want := waitFromHost(t, vm), uint64(1<<56|1<<48|0x100|uint64(c)); got != want {
+			t.Errorf("putchar response = %#x; want %#x", got, want)
+		}
+	}
+	if got := out.String(); got != "hi" {
+		t.Errorf("output = %q; want %q", got, "hi")
+	}
+	for _, c := range []uint64{'x', 'y', 0xff} {
+		vm.write(tohostAddr, 8, 1<<56)
+		if got, want := waitFromHost(t, vm), 1<<56|0x100|c; got != want {
+			t.Errorf("getchar response = %#x; want %#x", got, want)
+		}
+	}
+}
+
+func TestHTIFSyscall(t *testing.T) {
+	vm, out := newHTIFTest(t, "input")
+	const magic, buf = 0x100, 0x200
+	syscall := func(args ...uint64) int64 {
+		t.Helper()
+		b := make([]byte, 64)
+		for i, a := range args {
+			binary.LittleEndian.PutUint64(b[8*i:], a)
+		}
+		vm.writeBytes(magic, b)
+		if err := vm.write(tohostAddr, 8, magic); err != nil {
+			t.Fatalf("syscall %d failed: %v", args[0], err)
+		}
+		if got := waitFromHost(t, vm); got != 1 {
+			t.Errorf("syscall %d: fromhost = %#x; want 1", args[0], got)
+		}
+		ret, _ := vm.read(magic, 8)
+		return int64(ret)
+	}
+
+	vm.writeBytes(buf, []byte("hello"))
+	if got := syscall(htifSysWrite, 1, buf, 5); got != 5 {
+		t.Errorf("write returned %d; want 5", got)
+	}
+	if got := out.String(); got != "hello" {
+		t.Errorf("output = %q; want %q", got, "hello")
+	}
+	if got := syscall(htifSysRead, 0, buf, 3); got != 3 {
+		t.Errorf("read returned %d; want 3", got)
+	}
+	if got := string(vm.Mem[buf : buf+3]); got != "inp" {
+		t.Errorf("read %q; want %q", got, "inp")
+	}
+	if got := syscall(htifSysWrite, 1, buf, ^uint64(0)); got != -htifEFAULT {
+		t.Errorf("write of 2^64-1 bytes returned %d; want -EFAULT", got)
+	}
+	if got := syscall(1234); got != -htifENOSYS {
+		t.Errorf("unknown syscall returned %d; want -ENOSYS", got)
+	}
+
+	b := make([]byte, 64)
+	binary.LittleEndian.PutUint64(b, htifSysExit)
+	binary.LittleEndian.PutUint64(b[8:], 7)
+	vm.writeBytes(magic, b)
+	if err := vm.write(tohostAddr, 8, magic); !reflect.DeepEqual(err, &ExitError{Code: 7}) {
+		t.Errorf("exit syscall returned %v; want exit with status 7", err)
+	}
+}
+
+func TestHTIFExit(t *testing.T) {
+	for _, tt := range []struct {
+		desc   string
+		stores []struct{ off, size, v uint64 }
+		want   error
+	}{
+		{
+			desc:   "pass",
+			stores: []struct{ off, size, v uint64 }{{0, 8, 1}},
+			want:   &ExitError{},
+		},
+		{
+			desc:   "fail",
+			stores: []struct{ off, size, v uint64 }{{0, 8, 5<<1 | 1}},
+			want:   &ExitError{Code: 5},
+		},
+		{
+			// RV32 programs write the low half first.
+			desc:   "rv32",
+			stores: []struct{ off, size, v uint64 }{{0, 4, 3<<1 | 1}, {4, 4, 0}},
+			want:   &ExitError{Code: 3},
+		},
+	} {
+		vm, _ := newHTIFTest(t, "")
+		var err error
+		for _, s := range tt.stores {
+			err = vm.write(tohostAddr+s.off, int(s.size), s.v)
+		}
+		if !IsExit(err) || !reflect.DeepEqual(err, tt.want) {
+			t.Errorf("%s: got %v; want %v", tt.desc, err, tt.want)
+		}
+	}
+}
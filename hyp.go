@@ -0,0 +1,357 @@
+// Copyright 2019 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+// This file implements the hypervisor extension: the hypervisor and virtual
+// supervisor CSRs, G-stage (Sv39x4) address translation and the HLV, HSV and
+// HFENCE instructions. The virtualization mode is VM.Virt; trap delivery in
+// and out of it is in trap.go. There are no guest external interrupt files
+// (GEILEN is 0) and no VMIDs.
+//
+// riscv-privileged-20211203; Chapter 8
+
+import "sync/atomic"
+
+// Hypervisor and virtual supervisor CSR addresses.
+//
+// riscv-privileged-20211203; Table 2.3; Page 10
+const (
+	csrVsstatus   = 0x200
+	csrVsie       = 0x204
+	csrVstvec     = 0x205
+	csrVsscratch  = 0x240
+	csrVsepc      = 0x241
+	csrVscause    = 0x242
+	csrVstval     = 0x243
+	csrVsip       = 0x244
+	csrVstimecmp  = 0x24D
+	csrVsiselect  = 0x250
+	csrVsireg     = 0x251
+	csrVstopei    = 0x25C
+	csrVsatp      = 0x280
+	csrMtinst     = 0x34A
+	csrMtval2     = 0x34B
+	csrHstatus    = 0x600
+	csrHedeleg    = 0x602
+	csrHideleg    = 0x603
+	csrHie        = 0x604
+	csrHtimedelta = 0x605
+	csrHcounteren = 0x606
+	csrHgeie      = 0x607
+	csrHenvcfg    = 0x60A
+	csrHtval      = 0x643
+	csrHip        = 0x644
+	csrHvip       = 0x645
+	csrHtinst     = 0x64A
+	csrHgatp      = 0x680
+	csrHgeip      = 0xE12
+)
+
+// Exception codes of the hypervisor extension.
+//
+// riscv-privileged-20211203; Table 8.6; Page 125
+const (
+	causeECallVS             = 10
+	causeInstrGuestPageFault = 20
+	causeLoadGuestPageFault  = 21
+	causeVirtualInstr        = 22
+	causeStoreGuestPageFault = 23
+)
+
+// Bits of the hstatus CSR. VS-mode is always RV64 (VSXL is 2) and
+// little-endian.
+//
+// riscv-privileged-20211203; Figure 8.2; Page 98
+const (
+	hstatusGVA  = 1 << 6
+	hstatusSPV  = 1 << 7
+	hstatusSPVP = 1 << 8
+	hstatusHU   = 1 << 9
+	hstatusVTVM = 1 << 20
+	hstatusVTW  = 1 << 21
+	hstatusVTSR = 1 << 22
+	hstatusVSXL = 2 << 32
+
+	hstatusMask = hstatusGVA | hstatusSPV | hstatusSPVP | hstatusHU | hstatusVTVM | hstatusVTW | hstatusVTSR
+)
+
+// Bits of mstatus added by the hypervisor extension.
+//
+// riscv-privileged-20211203; Chapter 8.4.1; Page 118
+const (
+	mstatusGVA = 1 << 38 // mtval holds a guest virtual address.
+	mstatusMPV = 1 << 39 // Virtualization mode before the trap.
+)
+
+// VS-level interrupts. Their bits in mideleg are read-only ones: M-mode can't
+// handle them. hideleg delegates them further to VS-mode, where they appear as
+// the corresponding supervisor interrupts.
+//
+// riscv-privileged-20211203; Chapter 8.2.3; Page 103
+const (
+	mipVSSIP = 1 << 2
+	mipVSTIP = 1 << 6
+	mipVSEIP = 1 << 10
+
+	midelegVS = mipVSSIP | mipVSTIP | mipVSEIP
+)
+
+// hedelegMask selects the exceptions that can be delegated to VS-mode.
+// Environment calls from HS-mode and above, guest-page faults and
+// virtual-instruction exceptions are always handled by the hypervisor.
+const hedelegMask = 0x1ff | 1<<causeInstrPageFault | 1<<causeLoadPageFault | 1<<causeStorePageFault
+
+// Fields of the hgatp CSR. Only the Bare and Sv39x4 modes are supported, and
+// there are no VMID bits. The root page table of Sv39x4 is 16KiB large and
+// aligned, so the two low bits of the PPN are zero.
+//
+// riscv-privileged-20211203; Figure 8.26; Page 112
+const (
+	hgatpModeSv39x4 = 8
+	hgatpPPN        = satpPPN &^ 3
+	sv39x4Bits      = 41 // width of guest physical addresses
+)
+
+// vsCSR returns the CSR accessed in VS-mode instead of the supervisor CSR csr.
+// Supervisor CSRs without a virtual supervisor counterpart are accessed
+// directly.
+//
+// riscv-privileged-20211203; Chapter 8.2; Page 97
+func vsCSR(csr uint64) uint64 {
+	switch csr {
+	case csrSstatus, csrSie, csrStvec, csrSscratch, csrSepc, csrScause, csrStval, csrSip,
+		csrStimecmp, csrSiselect, csrSireg, csrStopei, csrSatp:
+		return csr + csrVsstatus - csrSstatus
+	}
+	return csr
+}
+
+// readHyp returns the value of a hypervisor or virtual supervisor CSR with
+// side effects.
+func (vm *VM) readHyp(csr uint64) uint64 {
+	mip := atomic.LoadUint64(&vm.CSR[csrMIP])
+	switch csr {
+	case csrHstatus:
+		return vm.CSR[csrHstatus] | hstatusVSXL
+	case csrHip, csrHvip:
+		return mip & midelegVS
+	case csrHie:
+		return vm.CSR[csrMIE] & midelegVS
+	case csrVsip:
+		return mip & vm.CSR[csrHideleg] >> 1
+	case csrVsie:
+		return vm.CSR[csrMIE] & vm.CSR[csrHideleg] >> 1
+	case csrHenvcfg:
+		// STCE is read-only zero unless M-mode enabled Sstc.
+		return vm.CSR[csrHenvcfg] &^ (menvcfgSTCE &^ vm.CSR[csrMenvcfg])
+	}
+	return 0 // hgeie and hgeip: there are no guest external interrupts
+}
+
+// writeHyp sets the value of a hypervisor or virtual supervisor CSR with side
+// effects.
+func (vm *VM) writeHyp(csr, v uint64) {
+	hideleg := vm.CSR[csrHideleg]
+	switch csr {
+	case csrHstatus:
+		vm.CSR[csr] = v & hstatusMask
+	case csrHedeleg:
+		vm.CSR[csr] = v & hedelegMask
+	case csrHideleg:
+		vm.CSR[csr] = v & midelegVS
+	case csrHie:
+		vm.CSR[csrMIE] = vm.CSR[csrMIE]&^midelegVS | v&midelegVS
+	case csrHip:
+		vm.setMIP(mipVSSIP, v&mipVSSIP != 0)
+	case csrHvip:
+		// hvip injects VS-level interrupts. VSTIP is driven by vstimecmp
+		// with Sstc.
+		mask := uint64(midelegVS)
+		if vm.readHyp(csrHenvcfg)&menvcfgSTCE != 0 {
+			mask &^= mipVSTIP
+		}
+		vm.setMIP(mask&v, true)
+		vm.setMIP(mask&^v, false)
+	case csrVsip:
+		if hideleg&mipVSSIP != 0 {
+			vm.setMIP(mipVSSIP, v&mipSSIP != 0)
+		}
+	case csrVsie:
+		vm.CSR[csrMIE] = vm.CSR[csrMIE]&^hideleg | v<<1&hideleg
+	case csrVsstatus:
+		vm.CSR[csr] = withSD(v & sstatusMask)
+	case csrVsatp:
+		switch v >> satpModeShift {
+		case satpModeBare, satpModeSv39:
+			vm.CSR[csr] = v & (0xf<<satpModeShift | satpPPN)
+			vm.flushTLB()
+		}
+	case csrHgatp:
+		switch v >> satpModeShift {
+		case satpModeBare, hgatpModeSv39x4:
+			vm.CSR[csr] = v & (0xf<<satpModeShift | hgatpPPN)
+			vm.flushTLB()
+		}
+	case csrHenvcfg, csrHtimedelta, csrVstimecmp:
+		vm.CSR[csr] = v
+		vm.tick(0)
+	}
+}
+
+// gwalk translates the guest physical address gpa with the G-stage page
+// tables and returns the leaf PTE and the physical page number of the 4KiB
+// page containing gpa. The PTE is 0 if G-stage translation is Bare. All
+// G-stage accesses are checked as U-mode accesses of type perm; faults are
+// reported as guest-page faults or access faults of the original access type
+// a at the guest virtual address va.
+//
+// riscv-privileged-20211203; Chapter 8.5.1; Page 122
+func (vm *VM) gwalk(gpa uint64, perm, a accessType, va uint64) (pte, ppn uint64, err error) {
+	hgatp := vm.CSR[csrHgatp]
+	if hgatp>>satpModeShift != hgatpModeSv39x4 {
+		return 0, gpa >> pageShift, nil
+	}
+	if gpa>>sv39x4Bits != 0 {
+		return 0, 0, a.guestPageFault(va, gpa)
+	}
+	s := vm.CSR[csrMstatus] & mstatusMXR
+	table := hgatp & hgatpPPN << pageShift
+	for level := sv39 - 1; level >= 0; level-- {
+		// The root table is indexed with 11 bits.
+		index := gpa >> (pageShift + 9*uint(level)) & 0x1ff
+		if level == sv39-1 {
+			index = gpa >> (pageShift + 9*uint(level))
+		}
+		addr := table + index*8
+		pte, err = vm.read(addr, 8)
+		if err != nil {
+			return 0, 0, withGVA(a.accessFault(va))
+		}
+		if pte&pteV == 0 || pte&pteR == 0 && pte&pteW != 0 {
+			return 0, 0, a.guestPageFault(va, gpa)
+		}
+		ppn = pte >> ptePPNShift & ptePPN
+		if pte&(pteR|pteX) == 0 {
+			table = ppn << pageShift
+			continue
+		}
+		mask := uint64(1)<<(9*uint(level)) - 1
+		if ppn&mask != 0 || !allowed(pte, perm, PrivU, s) {
+			return 0, 0, a.guestPageFault(va, gpa)
+		}
+		update := pte | pteA
+		if perm == accessStore {
+			update |= pteD
+		}
+		if update != pte {
+			if err := vm.write(addr, 8, update); err != nil {
+				return 0, 0, withGVA(a.accessFault(va))
+			}
+			pte = update
+		}
+		return pte, ppn | gpa>>pageShift&mask, nil
+	}
+	return 0, 0, a.guestPageFault(va, gpa)
+}
+
+// gstage returns the physical address of the guest physical address gpa of a
+// VS-stage page table entry. perm is accessLoad for reading the entry and
+// accessStore for updating it.
+func (vm *VM) gstage(gpa uint64, perm, a accessType, va uint64) (uint64, error) {
+	_, ppn, err := vm.gwalk(gpa, perm, a, va)
+	if err != nil {
+		return 0, err
+	}
+	return ppn<<pageShift | gpa&(pageSize-1), nil
+}
+
+// withGVA marks the exception err, if it's one, as reporting a guest virtual
+// address in tval.
+func withGVA(err error) error {
+	if e, ok := err.(*exception); ok {
+		e.gva = true
+	}
+	return err
+}
+
+// virtualInstr returns the virtual-instruction exception raised by in.
+func virtualInstr(in *Instruction) error {
+	return &exception{cause: causeVirtualInstr, tval: in.in}
+}
+
+// hlvOrHsv executes a hypervisor virtual-machine load or store: HLV.B, HLV.BU,
+// HLV.H, HLV.HU, HLVX.HU, HLV.W, HLV.WU, HLVX.WU, HLV.D, HSV.B, HSV.H, HSV.W
+// or HSV.D. They access memory as VS-mode or VU-mode (hstatus.SPVP) would.
+// HLVX loads require execute permission instead of read permission.
+//
+// riscv-privileged-20211203; Chapter 8.3.2; Page 115
+func hlvOrHsv(vm *VM, in *Instruction) (flags, error) {
+	funct7 := in.imm >> 5
+	if funct7>>3 != 0x6 {
+		return illegal(in)
+	}
+	size, store := 1<<(funct7>>1&3), funct7&1 != 0
+	switch {
+	case store && in.rd != 0,
+		!store && (in.rs2 == 2 || in.rs2 > 3 || in.rs2 == 1 && size == 8 || in.rs2 == 3 && size != 2 && size != 4):
+		return illegal(in)
+	case vm.Virt:
+		return flags{}, virtualInstr(in)
+	case vm.Priv == PrivU && vm.CSR[csrHstatus]&hstatusHU == 0:
+		return illegal(in)
+	}
+	priv := PrivU
+	if vm.CSR[csrHstatus]&hstatusSPVP != 0 {
+		priv = PrivS
+	}
+	addr := vm.Reg[in.rs1]
+	if store {
+		if err := vm.checkAligned(addr, size, "store", causeStoreMisaligned); err != nil {
+			return flags{}, withGVA(err)
+		}
+		return flags{}, vm.storeAs(addr, size, vm.Reg[in.rs2], priv, true)
+	}
+	a := accessLoad
+	if in.rs2 == 3 {
+		a = accessLoadExec
+	}
+	if err := vm.checkAligned(addr, size, "load", causeLoadMisaligned); err != nil {
+		return flags{}, withGVA(err)
+	}
+	v, err := vm.loadAs(addr, size, a, priv, true)
+	if err != nil {
+		return flags{}, err
+	}
+	if in.rs2 == 0 && size < 8 {
+		v = signExtend(v, size*8-1)
+	}
+	vm.store(in.rd, v)
+	return flags{}, nil
+}
+
+// hfence orders stores to the page tables with subsequent translations of
+// guests: HFENCE.VVMA for VS-stage and HFENCE.GVMA for G-stage translations.
+// Like SFENCE.VMA, it flushes the whole TLB. mstatus.TVM traps HFENCE.GVMA in
+// HS-mode.
+func hfence(vm *VM, in *Instruction) (flags, error) {
+	switch {
+	case vm.Virt:
+		return flags{}, virtualInstr(in)
+	case vm.Priv < PrivS, in.imm>>5 == 0x31 && vm.Priv == PrivS && vm.CSR[csrMstatus]&mstatusTVM != 0:
+		return illegal(in)
+	}
+	vm.flushTLB()
+	return flags{}, nil
+}
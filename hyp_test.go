@@ -0,0 +1,400 @@
+// Copyright 2019 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"reflect"
+	"testing"
+)
+
+// The G-stage page tables built by newGuestVM: the 16KiB root table, a
+// level-1 table and a level-0 table mapping the first 2MiB of guest physical
+// memory to the same physical addresses.
+const (
+	gRootTable = 0x10000
+	gL1Table   = 0x14000
+	gL0Table   = 0x15000
+)
+
+// Hypervisor instructions (the assembler doesn't know them).
+const (
+	hlvDT0T1   = 0x6c0342f3 // hlv.d t0, (t1)
+	hlvWT0T1   = 0x680342f3 // hlv.w t0, (t1)
+	hlvxHuT0T1 = 0x643342f3 // hlvx.hu t0, (t1)
+	hsvDT1T0   = 0x6e62c073 // hsv.d t1, (t0)
+	hfenceGVMA = 0x62000073 // hfence.gvma
+)
+
+// newGuestVM returns a VM in VS-mode with the VS-stage page tables of
+// newPagedVM (flags are those of the PTE mapping pageVA) and Sv39x4 G-stage
+// translation. The G-stage PTE of the guest page gpage has the flags gflags;
+// the other guest pages are mapped with all permissions.
+func newGuestVM(t *testing.T, flags, gpage, gflags uint64) *VM {
+	t.Helper()
+	vm := newPagedVM(t, flags)
+	vm.writeCSR(csrVsatp, vm.CSR[csrSatp])
+	vm.writeCSR(csrSatp, 0)
+	const urwx = pteV | pteR | pteW | pteX | pteU | pteA | pteD
+	w := func(addr, v uint64) {
+		if err := vm.write(addr, 8, v); err != nil {
+			t.Fatal(err)
+		}
+	}
+	w(gRootTable, pte(gL1Table, pteV))
+	w(gL1Table, pte(gL0Table, pteV))
+	for i := uint64(0); i < 512; i++ {
+		f := uint64(urwx)
+		if i<<pageShift == gpage {
+			f = gflags
+		}
+		w(gL0Table+i*8, pte(i<<pageShift, f))
+	}
+	vm.writeCSR(csrHgatp, hgatpModeSv39x4<<satpModeShift|gRootTable>>pageShift)
+	vm.Priv, vm.Virt = PrivS, true
+	return vm
+}
+
+func TestTwoStageTranslate(t *testing.T) {
+	const (
+		rwx  = pteV | pteR | pteW | pteX | pteA | pteD
+		urwx = rwx | pteU
+	)
+	for _, tt := range []struct {
+		desc   string
+		flags  uint64 // of the VS-stage PTE mapping pageVA
+		gpage  uint64
+		gflags uint64 // of the G-stage PTE mapping gpage
+		access accessType
+		want   uint64
+		err    error
+	}{
+		{desc: "load", flags: rwx, gpage: pagePA, gflags: urwx, access: accessLoad, want: pagePA + 0x123},
+		{desc: "gigapage", flags: rwx, gpage: pagePA, gflags: urwx, access: accessStore, want: 0x123},
+		{desc: "VS-stage page fault", flags: rwx &^ pteV, gpage: pagePA, gflags: urwx, access: accessLoad,
+			err: &exception{cause: causeLoadPageFault, tval: pageVA + 0x123, gva: true}},
+		{desc: "G-stage page without U", flags: rwx, gpage: pagePA, gflags: rwx, access: accessLoad,
+			err: &exception{cause: causeLoadGuestPageFault, tval: pageVA + 0x123, gpa: (pagePA + 0x123) >> 2, gva: true}},
+		{desc: "store to read-only G-stage page", flags: rwx, gpage: pagePA, gflags: pteV | pteR | pteU | pteA, access: accessStore,
+			err: &exception{cause: causeStoreGuestPageFault, tval: pageVA + 0x123, gpa: (pagePA + 0x123) >> 2, gva: true}},
+		{desc: "fetch from non-executable G-stage page", flags: rwx, gpage: pagePA, gflags: pteV | pteR | pteU | pteA, access: accessFetch,
+			err: &exception{cause: causeInstrGuestPageFault, tval: pageVA + 0x123, gpa: (pagePA + 0x123) >> 2, gva: true}},
+		{desc: "VS-stage page table not mapped", flags: rwx, gpage: l0Table, gflags: 0, access: accessStore,
+			err: &exception{cause: causeStoreGuestPageFault, tval: pageVA + 0x123, gpa: leafPTE >> 2, gva: true}},
+	} {
+		vm := newGuestVM(t, tt.flags, tt.gpage, tt.gflags)
+		va := uint64(pageVA)
+		if tt.desc == "gigapage" {
+			va = gigaVA
+		}
+		got, err := vm.translate(va+0x123, tt.access)
+		if tt.err != nil {
+			if !reflect.DeepEqual(err, tt.err) {
+				t.Errorf("%s: translate = %#x, %v; want %#v", tt.desc, got, err, tt.err)
+			}
+			continue
+		}
+		if err != nil || got != tt.want {
+			t.Errorf("%s: translate = %#x, %v; want %#x, nil", tt.desc, got, err, tt.want)
+		}
+	}
+}
+
+func TestTwoStageAccessedDirty(t *testing.T) {
+	vm := newGuestVM(t, pteV|pteR|pteW, pagePA, pteV|pteR|pteW|pteU)
+	if _, err := vm.translate(pageVA, accessStore); err != nil {
+		t.Fatal(err)
+	}
+	for _, addr := range []uint64{leafPTE, gL0Table + pagePA>>pageShift*8} {
+		if got, _ := vm.read(addr, 8); got&(pteA|pteD) != pteA|pteD {
+			t.Errorf("PTE at %#x = %#x; want A and D set", addr, got)
+		}
+	}
+}
+
+func TestGuestPageFaultTrap(t *testing.T) {
+	for _, hs := range []bool{false, true} {
+		vm := newGuestVM(t, pteV|pteR|pteW|pteX|pteA|pteD, pagePA, pteV|pteR|pteX|pteU|pteA)
+		copy(vm.Mem[pagePA:], asBytes(swX2X1))
+		vm.CSR[csrMtvec] = trapHandler
+		vm.CSR[csrStvec] = strapEntry
+		if hs {
+			vm.writeCSR(csrMedeleg, 1<<causeStoreGuestPageFault)
+		}
+		vm.PC = pageVA
+		vm.Reg[1] = pageVA + 8
+		if err := vm.Run(1); err != nil {
+			t.Fatalf("Run failed: %v", err)
+		}
+		if vm.Virt {
+			t.Errorf("HS-mode %v: the trap didn't leave the virtualization mode", hs)
+		}
+		if !hs {
+			if vm.PC != trapHandler || vm.CSR[csrMcause] != causeStoreGuestPageFault || vm.CSR[csrMtval] != pageVA+8 || vm.CSR[csrMtval2] != (pagePA+8)>>2 {
+				t.Errorf("PC, mcause, mtval, mtval2 = %#x, %d, %#x, %#x; want %#x, %d, %#x, %#x", vm.PC, vm.CSR[csrMcause], vm.CSR[csrMtval], vm.CSR[csrMtval2], trapHandler, causeStoreGuestPageFault, pageVA+8, (pagePA+8)>>2)
+			}
+			if s := vm.CSR[csrMstatus]; s&(mstatusMPV|mstatusGVA) != mstatusMPV|mstatusGVA {
+				t.Errorf("mstatus = %#x; want MPV and GVA", s)
+			}
+			continue
+		}
+		if vm.PC != strapEntry || vm.CSR[csrScause] != causeStoreGuestPageFault || vm.CSR[csrStval] != pageVA+8 || vm.CSR[csrHtval] != (pagePA+8)>>2 {
+			t.Errorf("PC, scause, stval, htval = %#x, %d, %#x, %#x; want %#x, %d, %#x, %#x", vm.PC, vm.CSR[csrScause], vm.CSR[csrStval], vm.CSR[csrHtval], strapEntry, causeStoreGuestPageFault, pageVA+8, (pagePA+8)>>2)
+		}
+		if h, _ := vm.readCSR(csrHstatus); h&(hstatusSPV|hstatusSPVP|hstatusGVA) != hstatusSPV|hstatusSPVP|hstatusGVA {
+			t.Errorf("hstatus = %#x; want SPV, SPVP and GVA", h)
+		}
+	}
+}
+
+func TestHypervisorCSRPrivilege(t *testing.T) {
+	for _, tt := range []struct {
+		desc      string
+		instr     uint64
+		priv      int
+		virt      bool
+		hstatus   uint64
+		wantCause uint64 // if non-zero, the instruction traps to M-mode
+	}{
+		{desc: "csrr t0, hstatus in HS-mode", instr: 0x600022f3, priv: PrivS},
+		{desc: "csrr t0, vsstatus in HS-mode", instr: 0x200022f3, priv: PrivS},
+		{desc: "csrr t0, hstatus in U-mode", instr: 0x600022f3, priv: PrivU, wantCause: causeIllegalInstr},
+		{desc: "csrr t0, hstatus in VS-mode", instr: 0x600022f3, priv: PrivS, virt: true, wantCause: causeVirtualInstr},
+		{desc: "csrr t0, vsstatus in VS-mode", instr: 0x200022f3, priv: PrivS, virt: true, wantCause: causeVirtualInstr},
+		{desc: "csrr t0, sstatus in VU-mode", instr: 0x100022f3, priv: PrivU, virt: true, wantCause: causeVirtualInstr},
+		{desc: "csrr t0, mstatus in VS-mode", instr: 0x300022f3, priv: PrivS, virt: true, wantCause: causeIllegalInstr},
+		{desc: "csrw satp, t0 in VS-mode", instr: 0x18029073, priv: PrivS, virt: true},
+		{desc: "csrw satp, t0 in VS-mode with VTVM", instr: 0x18029073, priv: PrivS, virt: true, hstatus: hstatusVTVM, wantCause: causeVirtualInstr},
+		{desc: "hfence.gvma in VS-mode", instr: hfenceGVMA, priv: PrivS, virt: true, wantCause: causeVirtualInstr},
+		{desc: "hfence.gvma in U-mode", instr: hfenceGVMA, priv: PrivU, wantCause: causeIllegalInstr},
+		{desc: "wfi in VS-mode with VTW", instr: 0x10500073, priv: PrivS, virt: true, hstatus: hstatusVTW, wantCause: causeVirtualInstr},
+		{desc: "sret in VS-mode with VTSR", instr: sretInstr, priv: PrivS, virt: true, hstatus: hstatusVTSR, wantCause: causeVirtualInstr},
+	} {
+		vm := newTrapVM(t)
+		copy(vm.Mem, asBytes(tt.instr))
+		vm.Priv, vm.Virt = tt.priv, tt.virt
+		vm.writeCSR(csrHstatus, tt.hstatus)
+		vm.Reg[regNums["t0"]] = 0
+		if err := vm.Run(1); err != nil {
+			t.Fatalf("%s: Run failed: %v", tt.desc, err)
+		}
+		if tt.wantCause == 0 {
+			if vm.PC == trapHandler {
+				t.Errorf("%s: trapped with mcause %d", tt.desc, vm.CSR[csrMcause])
+			}
+			continue
+		}
+		if vm.PC != trapHandler || vm.CSR[csrMcause] != tt.wantCause || vm.CSR[csrMtval] != tt.instr {
+			t.Errorf("%s: PC, mcause, mtval = %#x, %d, %#x; want %#x, %d, %#x", tt.desc, vm.PC, vm.CSR[csrMcause], vm.CSR[csrMtval], trapHandler, tt.wantCause, tt.instr)
+		}
+	}
+}
+
+func TestVSCSRs(t *testing.T) {
+	vm := newTrapVM(t)
+	copy(vm.Mem, asBytes(0x100022f3)) // csrr t0, sstatus
+	vm.writeCSR(csrVsstatus, mstatusSIE|mstatusSPP)
+	vm.CSR[csrMstatus] |= mstatusSUM
+	vm.Priv, vm.Virt = PrivS, true
+	if err := vm.Run(1); err != nil {
+		t.Fatalf("Run failed: %v", err)
+	}
+	if got := vm.Reg[regNums["t0"]]; got != mstatusSIE|mstatusSPP {
+		t.Errorf("sstatus in VS-mode = %#x; want vsstatus (SIE|SPP)", got)
+	}
+
+	// The VS-level interrupt bits of mideleg are read-only ones.
+	if got, _ := vm.readCSR(csrMideleg); got&midelegVS != midelegVS {
+		t.Errorf("mideleg = %#x; want VSSIP|VSTIP|VSEIP", got)
+	}
+	vm.writeCSR(csrHideleg, ^uint64(0))
+	if got, _ := vm.readCSR(csrHideleg); got != midelegVS {
+		t.Errorf("hideleg = %#x; want VSSIP|VSTIP|VSEIP", got)
+	}
+	vm.writeCSR(csrHvip, mipVSSIP)
+	if got, _ := vm.readCSR(csrVsip); got != mipSSIP {
+		t.Errorf("vsip = %#x; want SSIP", got)
+	}
+	if got, _ := vm.readCSR(csrHstatus); got != hstatusVSXL {
+		t.Errorf("hstatus = %#x; want VSXL=2", got)
+	}
+}
+
+func TestHLVAndHSV(t *testing.T) {
+	for _, tt := range []struct {
+		desc      string
+		instr     uint64
+		priv      int
+		virt      bool
+		hstatus   uint64
+		flags     uint64 // of the VS-stage PTE mapping pageVA
+		want      uint64 // t0 after loads, memory at pagePA after stores
+		wantCause uint64 // if non-zero, the instruction traps to M-mode
+	}{
+		{desc: "hlv.d", instr: hlvDT0T1, priv: PrivS, hstatus: hstatusSPVP, flags: pteV | pteR | pteA, want: 0x8877665544332211},
+		{desc: "hlv.w sign-extends", instr: hlvWT0T1, priv: PrivS, hstatus: hstatusSPVP, flags: pteV | pteR | pteA, want: 0xffffffff88776655},
+		{desc: "hsv.d", instr: hsvDT1T0, priv: PrivS, hstatus: hstatusSPVP, flags: pteV | pteR | pteW | pteA | pteD, want: pageVA},
+		{desc: "hlv.d as VU-mode", instr: hlvDT0T1, priv: PrivS, flags: pteV | pteR | pteA, wantCause: causeLoadPageFault},
+		{desc: "hlvx.hu", instr: hlvxHuT0T1, priv: PrivS, hstatus: hstatusSPVP, flags: pteV | pteX | pteA, want: 0x6655},
+		{desc: "hlvx.hu without execute permission", instr: hlvxHuT0T1, priv: PrivS, hstatus: hstatusSPVP, flags: pteV | pteR | pteA, wantCause: causeLoadPageFault},
+		{desc: "hlv.d in U-mode", instr: hlvDT0T1, priv: PrivU, flags: pteV | pteR | pteU | pteA, wantCause: causeIllegalInstr},
+		{desc: "hlv.d in U-mode with HU", instr: hlvDT0T1, priv: PrivU, hstatus: hstatusHU, flags: pteV | pteR | pteU | pteA, want: 0x8877665544332211},
+		{desc: "hlv.d in VS-mode", instr: hlvDT0T1, priv: PrivS, virt: true, flags: pteV | pteR | pteA, wantCause: causeVirtualInstr},
+	} {
+		vm := newPagedVM(t, tt.flags)
+		vm.writeCSR(csrVsatp, vm.CSR[csrSatp])
+		vm.writeCSR(csrSatp, 0)
+		vm.CSR[csrMtvec] = trapHandler
+		copy(vm.Mem, asBytes(tt.instr))
+		copy(vm.Mem[pagePA:], []byte{0x11, 0x22, 0x33, 0x44, 0x55, 0x66, 0x77, 0x88, 0x99})
+		vm.Priv, vm.Virt, vm.PC = tt.priv, tt.virt, 0
+		if tt.virt {
+			vm.writeCSR(csrVsatp, 0) // fetch the instruction at 0
+		}
+		vm.writeCSR(csrHstatus, tt.hstatus)
+		vm.Reg[regNums["t0"]], vm.Reg[regNums["t1"]] = pageVA+8, pageVA
+		if tt.instr == hlvWT0T1 || tt.instr == hlvxHuT0T1 {
+			vm.Reg[regNums["t1"]] = pageVA + 4
+		}
+		if err := vm.Run(1); err != nil {
+			t.Fatalf("%s: Run failed: %v", tt.desc, err)
+		}
+		if tt.wantCause != 0 {
+			if vm.PC != trapHandler || vm.CSR[csrMcause] != tt.wantCause {
+				t.Errorf("%s: PC, mcause = %#x, %d; want %#x, %d", tt.desc, vm.PC, vm.CSR[csrMcause], trapHandler, tt.wantCause)
+			}
+			if tt.wantCause == causeLoadPageFault && vm.CSR[csrMstatus]&mstatusGVA == 0 {
+				t.Errorf("%s: mstatus = %#x; want GVA", tt.desc, vm.CSR[csrMstatus])
+			}
+			continue
+		}
+		got := vm.Reg[regNums["t0"]]
+		if tt.instr == hsvDT1T0 {
+			got, _ = vm.read(pagePA+8, 8)
+		}
+		if vm.PC != 4 || got != tt.want {
+			t.Errorf("%s: PC, result = %#x, %#x; want 0x4, %#x", tt.desc, vm.PC, got, tt.want)
+		}
+	}
+}
+
+func TestVSTrap(t *testing.T) {
+	vm := newTrapVM(t)
+	vm.CSR[csrStvec] = strapEntry
+	vm.CSR[csrVstvec] = strapEntry + 0x10
+	vm.writeCSR(csrMedeleg, 1<<causeIllegalInstr|1<<causeECallVS)
+	vm.writeCSR(csrHedeleg, 1<<causeIllegalInstr|1<<causeECallVS)
+	if got := vm.CSR[csrHedeleg]; got != 1<<causeIllegalInstr {
+		t.Errorf("hedeleg = %#x; ECALL from VS-mode can't be delegated", got)
+	}
+	copy(vm.Mem, asBytes(0xffffffff))
+	copy(vm.Mem[strapEntry+0x10:], asBytes(sretInstr))
+	vm.Priv, vm.Virt = PrivU, true
+
+	// Delegated with hedeleg to VS-mode.
+	if err := vm.Run(1); err != nil {
+		t.Fatalf("Run failed: %v", err)
+	}
+	if vm.Priv != PrivS || !vm.Virt || vm.PC != strapEntry+0x10 {
+		t.Fatalf("priv, virt, PC = %d, %v, %#x; want VS-mode at %#x", vm.Priv, vm.Virt, vm.PC, strapEntry+0x10)
+	}
+	if vm.CSR[csrVscause] != causeIllegalInstr || vm.CSR[csrVsepc] != 0 || vm.CSR[csrVstval] != 0xffffffff {
+		t.Errorf("vscause, vsepc, vstval = %d, %#x, %#x; want %d, 0, 0xffffffff", vm.CSR[csrVscause], vm.CSR[csrVsepc], vm.CSR[csrVstval], causeIllegalInstr)
+	}
+	if vm.CSR[csrScause] != 0 {
+		t.Errorf("scause = %d; want the HS-mode CSRs unchanged", vm.CSR[csrScause])
+	}
+	// SRET in VS-mode returns to VU-mode.
+	if err := vm.Run(1); err != nil {
+		t.Fatalf("Run failed: %v", err)
+	}
+	if vm.Priv != PrivU || !vm.Virt || vm.PC != 0 {
+		t.Errorf("after SRET: priv, virt, PC = %d, %v, %#x; want VU-mode at 0", vm.Priv, vm.Virt, vm.PC)
+	}
+
+	// Not delegated with hedeleg: the hypervisor handles it.
+	copy(vm.Mem, asBytes(ecallInstr))
+	copy(vm.Mem[strapEntry:], asBytes(sretInstr))
+	vm.Priv = PrivS
+	if err := vm.Run(1); err != nil {
+		t.Fatalf("Run failed: %v", err)
+	}
+	if vm.Priv != PrivS || vm.Virt || vm.PC != strapEntry || vm.CSR[csrScause] != causeECallVS {
+		t.Fatalf("priv, virt, PC, scause = %d, %v, %#x, %d; want HS-mode at %#x, %d", vm.Priv, vm.Virt, vm.PC, vm.CSR[csrScause], strapEntry, causeECallVS)
+	}
+	if h, _ := vm.readCSR(csrHstatus); h&(hstatusSPV|hstatusSPVP) != hstatusSPV|hstatusSPVP {
+		t.Errorf("hstatus = %#x; want SPV and SPVP", h)
+	}
+	// SRET in HS-mode returns to the virtualization mode in hstatus.SPV.
+	if err := vm.Run(1); err != nil {
+		t.Fatalf("Run failed: %v", err)
+	}
+	if vm.Priv != PrivS || !vm.Virt || vm.PC != 0 {
+		t.Errorf("after SRET: priv, virt, PC = %d, %v, %#x; want VS-mode at 0", vm.Priv, vm.Virt, vm.PC)
+	}
+}
+
+func TestVSInterrupt(t *testing.T) {
+	for _, tt := range []struct {
+		desc   string
+		virt   bool
+		sie    bool // vsstatus.SIE
+		wantPC uint64
+	}{
+		{desc: "VS-mode with SIE", virt: true, sie: true, wantPC: strapEntry + 0x10 + 4},
+		{desc: "VS-mode without SIE", virt: true, wantPC: 4},
+		// Interrupts delegated to VS-mode aren't taken in HS-mode.
+		{desc: "HS-mode", sie: true, wantPC: 4},
+	} {
+		vm := newTrapVM(t)
+		vm.CSR[csrVstvec] = strapEntry + 0x10
+		vm.CSR[csrMstatus] = mstatusSIE
+		vm.writeCSR(csrHideleg, mipVSSIP)
+		vm.writeCSR(csrHie, mipVSSIP)
+		if tt.sie {
+			vm.writeCSR(csrVsstatus, mstatusSIE)
+		}
+		vm.Priv, vm.Virt = PrivS, tt.virt
+		vm.writeCSR(csrHvip, mipVSSIP)
+		if err := vm.Run(1); err != nil {
+			t.Fatalf("%s: Run failed: %v", tt.desc, err)
+		}
+		if vm.PC != tt.wantPC {
+			t.Errorf("%s: PC = %#x; want %#x", tt.desc, vm.PC, tt.wantPC)
+		}
+		if tt.wantPC != 4 && vm.CSR[csrVscause] != causeInterrupt|1 {
+			t.Errorf("%s: vscause = %#x; want a supervisor software interrupt", tt.desc, vm.CSR[csrVscause])
+		}
+	}
+}
+
+func TestFPInVSMode(t *testing.T) {
+	vm := newTrapVM(t)
+	copy(vm.Mem, asBytes(0xf2028053)) // fmv.d.x ft0, t0
+	vm.Priv, vm.Virt = PrivS, true
+	if err := vm.Run(1); err != nil {
+		t.Fatalf("Run failed: %v", err)
+	}
+	if vm.PC != trapHandler || vm.CSR[csrMcause] != causeIllegalInstr {
+		t.Errorf("with vsstatus.FS off: PC, mcause = %#x, %d; want %#x, %d", vm.PC, vm.CSR[csrMcause], trapHandler, causeIllegalInstr)
+	}
+	vm.writeCSR(csrVsstatus, fsInitial<<mstatusFSShift)
+	vm.Priv, vm.Virt, vm.PC = PrivS, true, 0
+	if err := vm.Run(1); err != nil {
+		t.Fatalf("Run failed: %v", err)
+	}
+	if vm.PC != 4 || vm.CSR[csrVsstatus]&mstatusSD == 0 || vm.CSR[csrMstatus]&mstatusSD == 0 {
+		t.Errorf("PC, vsstatus, mstatus = %#x, %#x, %#x; want 0x4 and both dirty", vm.PC, vm.CSR[csrVsstatus], vm.CSR[csrMstatus])
+	}
+}
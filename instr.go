@@ -31,8 +31,7 @@ type Instruction struct {
 
 // flags are returned by functions executing instructions.
 type flags struct {
-	updatedPC        bool // Whether the instruction set PC
-	updatedRDINSTRET bool // Whether the instruction set RDINSTRET CSR
+	updatedPC bool // Whether the instruction set PC
 }
 
 func (in *Instruction) String() string {
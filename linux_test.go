@@ -0,0 +1,250 @@
+// Copyright 2019 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bytes"
+	"math"
+	"os"
+	"reflect"
+	"regexp"
+	"strings"
+	"testing"
+)
+
+// linuxSteps is the number of instructions after which TestLinux gives up. A
+// defconfig kernel reaches the shell in a few billion instructions.
+const linuxSteps = 20e9
+
+// The addresses of the kernel and the initramfs on the linux machine.
+const (
+	linuxKernelAddr = 0x80200000
+	linuxInitrdAddr = 0x88000000
+)
+
+// shellPrompt matches the end of the boot log once BusyBox's shell prompts
+// for a command.
+var shellPrompt = regexp.MustCompile(`[#$] $`)
+
+// TestLinux boots a defconfig kernel Image with a BusyBox initramfs on the
+// linux machine and runs a command in the shell. The test is skipped unless
+// LINUX_IMAGE and LINUX_INITRD point at the kernel (arch/riscv/boot/Image) and
+// a cpio archive whose /init starts a shell on the console:
+//
+//	LINUX_IMAGE=linux/arch/riscv/boot/Image LINUX_INITRD=rootfs.cpio go test -run Linux -timeout 2h
+//
+// Neither is in the tree, so the test is skipped by default and the boot is
+// unverified. TestLinuxPayload is a hand-written payload, not Linux: it checks
+// on every test run the parts of the machine the kernel uses first.
+func TestLinux(t *testing.T) {
+	kernel, initrd := os.Getenv("LINUX_IMAGE"), os.Getenv("LINUX_INITRD")
+	if kernel == "" || initrd == "" {
+		t.Skip("LINUX_IMAGE and LINUX_INITRD aren't set")
+	}
+	if testing.Short() {
+		t.Skip("booting Linux takes minutes")
+	}
+	c, ok := MachineProfile("linux")
+	if !ok {
+		t.Fatal("there's no linux machine profile")
+	}
+	var out bytes.Buffer
+	vm, err := c.NewVM(&out)
+	if err != nil {
+		t.Fatalf("NewVM() failed: %v", err)
+	}
+	kimg, err := vm.Load(LoadSpec{Path: kernel, Addr: linuxKernelAddr, HasAddr: true})
+	if err != nil {
+		t.Fatalf("Load(%q) failed: %v", kernel, err)
+	}
+	rd, err := vm.Load(LoadSpec{Path: initrd, Addr: linuxInitrdAddr, HasAddr: true})
+	if err != nil {
+		t.Fatalf("Load(%q) failed: %v", initrd, err)
+	}
+	dtb := BuildDeviceTree([]*VM{vm}, DTConfig{InitrdStart: rd.Start, InitrdEnd: rd.End})
+	addr, err := defaultDTBAddr(vm, uint64(len(dtb)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	m, err := vm.memSlice(addr, uint64(len(dtb)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	copy(m, dtb)
+	vm.PC = kimg.Start
+	vm.Reg[regNums["a0"]], vm.Reg[regNums["a1"]] = 0, addr
+	var uart *UART
+	for _, r := range vm.Bus.regions {
+		if u, ok := r.dev.(*UART); ok {
+			uart = u
+		}
+	}
+
+	// The command is typed once the shell prints its first prompt. Some
+	// init scripts ask for Enter to activate the console first.
+	input := []byte("echo riscv-emu-$((6*7))\n")
+	typed, activated := false, false
+	const chunk = 1e6
+	for vm.Steps < linuxSteps {
+		if err := vm.Run(chunk); err != nil {
+			t.Fatalf("Run failed after %d steps: %v\n%s", vm.Steps, err, out.String())
+		}
+		s := out.String()
+		switch {
+		case strings.Contains(s, "riscv-emu-42"):
+			return
+		case strings.Contains(s, "Kernel panic"):
+			t.Fatalf("the kernel panicked:\n%s", s)
+		}
+		if !activated && strings.Contains(s, "Please press Enter") {
+			activated = uart.Receive([]byte("\n")) == 1
+		}
+		if !typed && shellPrompt.MatchString(s) {
+			input = input[uart.Receive(input):]
+			typed = len(input) == 0
+		}
+	}
+	t.Fatalf("the shell didn't run the command in %d steps:\n%s", uint64(linuxSteps), out.String())
+}
+
+// Addresses used by linuxPayload in the RAM of the linux machine.
+const (
+	linuxPageTable = linuxKernelAddr + 0x1000 // root table with two gigapages
+	linuxMsg       = linuxKernelAddr + 0x3000
+)
+
+// linuxPayload is a tiny program started like a kernel Image on the linux
+// machine: in S-mode with the hart ID in a0 and the device tree in a1, which
+// it saves in s0 and s5. It turns on the FPU and computes 6.0*7.0 into s3,
+// saves the SBI version in s1, and turns on Sv39 with the root table at
+// linuxPageTable. Then it prints the 13 bytes at linuxMsg with the debug
+// console and waits for a timer interrupt set with sbi_set_timer. The trap
+// handler saves scause in s4 and shuts down with sbi_system_reset. Built with
+// llvm-mc -triple=riscv64.
+var linuxPayload = []uint64{
+	0x00050413, // mv s0, a0
+	0x00058a93, // mv s5, a1
+	0x000022b7, // lui t0, 2
+	0x1002a073, // csrs sstatus, t0  # FS = Initial
+	0x00600293, // li t0, 6
+	0xd222f553, // fcvt.d.l fa0, t0
+	0x00700293, // li t0, 7
+	0xd222f5d3, // fcvt.d.l fa1, t0
+	0x12b57653, // fmul.d fa2, fa0, fa1
+	0xc22619d3, // fcvt.l.d s3, fa2, rtz
+	0x01000893, // li a7, 0x10  # BASE
+	0x00000813, // li a6, 0  # sbi_get_spec_version
+	0x00000073, // ecall
+	0x00058493, // mv s1, a1
+	0x00000297, // auipc t0, 0
+	0x07828293, // addi t0, t0, 0x78  # strap
+	0x10529073, // csrw stvec, t0
+	0xfff00293, // li t0, -1
+	0x02c29293, // slli t0, t0, 44
+	0x00128293, // addi t0, t0, 1
+	0x01329293, // slli t0, t0, 19
+	0x20128293, // addi t0, t0, 0x201  # Sv39, linuxPageTable
+	0x18029073, // csrw satp, t0
+	0x12000073, // sfence.vma
+	0x444248b7, // lui a7, 0x44424
+	0x34e8889b, // addiw a7, a7, 0x34e  # DBCN
+	0x00000813, // li a6, 0  # sbi_debug_console_write
+	0x00d00513, // li a0, 13
+	0x000805b7, // lui a1, 0x80
+	0x2035859b, // addiw a1, a1, 0x203
+	0x00c59593, // slli a1, a1, 12  # linuxMsg
+	0x00000613, // li a2, 0
+	0x00000073, // ecall
+	0x02000293, // li t0, 0x20
+	0x1042a073, // csrs sie, t0  # STIE
+	0x10016073, // csrsi sstatus, 2  # SIE
+	0xc01022f3, // rdtime t0
+	0x06428513, // addi a0, t0, 100
+	0x544958b7, // lui a7, 0x54495
+	0xd458889b, // addiw a7, a7, -0x2bb  # TIME
+	0x00000813, // li a6, 0  # sbi_set_timer
+	0x00000073, // ecall
+	0x10500073, // wfi
+	0xffdff06f, // j -4
+	// strap:
+	0x14202a73, // csrr s4, scause
+	0x535258b7, // lui a7, 0x53525
+	0x3548889b, // addiw a7, a7, 0x354  # SRST
+	0x00000813, // li a6, 0  # sbi_system_reset
+	0x00000513, // li a0, 0  # shutdown
+	0x00000593, // li a1, 0  # no reason
+	0x00000073, // ecall
+}
+
+func TestLinuxPayload(t *testing.T) {
+	c, ok := MachineProfile("linux")
+	if !ok {
+		t.Fatal("there's no linux machine profile")
+	}
+	var out bytes.Buffer
+	vm, err := c.NewVM(&out)
+	if err != nil {
+		t.Fatalf("NewVM() failed: %v", err)
+	}
+	const rwx = pteV | pteR | pteW | pteX | pteA | pteD
+	for _, w := range []struct{ addr, v uint64 }{
+		{linuxPageTable, pte(0, rwx&^pteX)}, // devices
+		{linuxPageTable + 2*8, pte(0x80000000, rwx)},
+	} {
+		if err := vm.write(w.addr, 8, w.v); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for i, in := range linuxPayload {
+		if err := vm.write(linuxKernelAddr+4*uint64(i), 4, in); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := vm.writeBytes(linuxMsg, []byte("riscv-emu-42\n")); err != nil {
+		t.Fatal(err)
+	}
+	dtb := BuildDeviceTree([]*VM{vm}, DTConfig{})
+	addr, err := defaultDTBAddr(vm, uint64(len(dtb)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := vm.writeBytes(addr, dtb); err != nil {
+		t.Fatal(err)
+	}
+	vm.PC = linuxKernelAddr
+	vm.Reg[regNums["a0"]], vm.Reg[regNums["a1"]] = 0, addr
+
+	if err := vm.Run(1000); !reflect.DeepEqual(err, &ExitError{}) {
+		t.Fatalf("Run() = %v; want a shutdown\n%v", err, vm)
+	}
+	if got := out.String(); got != "riscv-emu-42\n" {
+		t.Errorf("console output = %q; want %q", got, "riscv-emu-42\n")
+	}
+	if hart, dt := vm.Reg[regNums["s0"]], vm.Reg[regNums["s5"]]; hart != 0 || dt != addr {
+		t.Errorf("a0, a1 at entry = %d, %#x; want 0, %#x", hart, dt, addr)
+	}
+	if got := vm.Reg[regNums["s3"]]; got != 42 || math.Float64frombits(vm.FReg[12]) != 42 { // fa2
+		t.Errorf("6.0*7.0 = %d (fa2 = %#x); want 42", got, vm.FReg[12])
+	}
+	if got := vm.Reg[regNums["s1"]]; got != sbiSpecVersion {
+		t.Errorf("sbi_get_spec_version = %#x; want %#x", got, sbiSpecVersion)
+	}
+	if got := vm.Reg[regNums["s4"]]; got != causeInterrupt|5 {
+		t.Errorf("scause = %#x; want a supervisor timer interrupt", got)
+	}
+	if vm.Priv != PrivS || vm.CSR[csrSatp]>>satpModeShift != satpModeSv39 || vm.CSR[csrMstatus]&mstatusSD == 0 {
+		t.Errorf("priv, satp, mstatus = %d, %#x, %#x; want S-mode with Sv39 and a dirty FPU", vm.Priv, vm.CSR[csrSatp], vm.CSR[csrMstatus])
+	}
+}
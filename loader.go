@@ -0,0 +1,199 @@
+// Copyright 2019 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bytes"
+	"debug/elf"
+	"fmt"
+	"io/ioutil"
+	"strconv"
+	"strings"
+)
+
+// LoadSpec describes a file loaded into memory before the program starts,
+// written as FILE@ADDR or FILE.
+type LoadSpec struct {
+	Path string
+	Addr uint64
+	// HasAddr is false if the address wasn't given. ELF files are then
+	// loaded at their physical addresses; other files require an address.
+	HasAddr bool
+}
+
+// ParseLoadSpec parses FILE@ADDR or FILE. The address may be written in any
+// base accepted by strconv.ParseUint, e.g. 0x80200000.
+func ParseLoadSpec(s string) (LoadSpec, error) {
+	i := strings.LastIndex(s, "@")
+	if i < 0 {
+		return LoadSpec{Path: s}, nil
+	}
+	addr, err := strconv.ParseUint(s[i+1:], 0, 64)
+	if err != nil {
+		return LoadSpec{}, fmt.Errorf("invalid address in %q: %v", s, err)
+	}
+	return LoadSpec{Path: s[:i], Addr: addr, HasAddr: true}, nil
+}
+
+func (l LoadSpec) String() string {
+	if !l.HasAddr {
+		return l.Path
+	}
+	return fmt.Sprintf("%s@%#x", l.Path, l.Addr)
+}
+
+// Image describes a file loaded into memory.
+type Image struct {
+	Start, End uint64 // physical addresses of the loaded bytes
+	// Entry is the entry point of ELF files and Start for other files.
+	Entry uint64
+	ELF   bool
+	// Symbols holds the addresses of the symbols defined by ELF files.
+	Symbols map[string]uint64
+}
+
+// Load loads the file into memory. ELF files are loaded segment by segment at
+// their physical addresses; if an address is given, they're moved so that the
+// lowest segment starts there. Their entry point and symbols are translated to
+// physical addresses and moved with them. Other files are copied as they are.
+func (vm *VM) Load(l LoadSpec) (*Image, error) {
+	b, err := ioutil.ReadFile(l.Path)
+	if err != nil {
+		return nil, err
+	}
+	if !bytes.HasPrefix(b, []byte(elf.ELFMAG)) {
+		if !l.HasAddr {
+			return nil, fmt.Errorf("can't load %s: the address is required for files other than ELF", l.Path)
+		}
+		m, err := vm.memSlice(l.Addr, uint64(len(b)))
+		if err != nil {
+			return nil, fmt.Errorf("can't load %s: %v", l.Path, err)
+		}
+		copy(m, b)
+		return &Image{Start: l.Addr, End: l.Addr + uint64(len(b)), Entry: l.Addr}, nil
+	}
+
+	f, err := elf.NewFile(bytes.NewReader(b))
+	if err != nil {
+		return nil, fmt.Errorf("can't load %s: %v", l.Path, err)
+	}
+	var progs []*elf.Prog
+	for _, p := range f.Progs {
+		if p.Type == elf.PT_LOAD && p.Memsz > 0 {
+			progs = append(progs, p)
+		}
+	}
+	if len(progs) == 0 {
+		return nil, fmt.Errorf("can't load %s: no loadable segments", l.Path)
+	}
+	img := &Image{Start: ^uint64(0), ELF: true}
+	for _, p := range progs {
+		if p.Paddr < img.Start {
+			img.Start = p.Paddr
+		}
+	}
+	var offset uint64 // added to all physical addresses of the file
+	if l.HasAddr {
+		offset = l.Addr - img.Start
+		img.Start = l.Addr
+	}
+	for _, p := range progs {
+		addr := p.Paddr + offset
+		m, err := vm.memSlice(addr, p.Memsz)
+		if err != nil {
+			return nil, fmt.Errorf("can't load %s: %v", l.Path, err)
+		}
+		if _, err := p.ReadAt(m[:p.Filesz], 0); err != nil {
+			return nil, fmt.Errorf("can't load %s: %v", l.Path, err)
+		}
+		for i := p.Filesz; i < p.Memsz; i++ {
+			m[i] = 0
+		}
+		if end := addr + p.Memsz; end > img.End {
+			img.End = end
+		}
+	}
+	phys := func(v uint64) uint64 {
+		for _, p := range progs {
+			if v >= p.Vaddr && v-p.Vaddr < p.Memsz {
+				return v - p.Vaddr + p.Paddr + offset
+			}
+		}
+		return v + offset
+	}
+	img.Entry = phys(f.Entry)
+	img.Symbols = elfSymbols(f, phys)
+	return img, nil
+}
+
+// elfSymbols returns the addresses of the symbols defined by the file,
+// translated with phys. Absolute symbols aren't translated.
+func elfSymbols(f *elf.File, phys func(uint64) uint64) map[string]uint64 {
+	syms := map[string]uint64{}
+	all, err := f.Symbols() // stripped files have no symbols
+	if err != nil {
+		return syms
+	}
+	for _, s := range all {
+		if s.Name == "" || s.Section == elf.SHN_UNDEF {
+			continue
+		}
+		switch elf.ST_TYPE(s.Info) {
+		case elf.STT_SECTION, elf.STT_FILE:
+			continue
+		}
+		if s.Section != elf.SHN_ABS {
+			s.Value = phys(s.Value)
+		}
+		syms[s.Name] = s.Value
+	}
+	return syms
+}
+
+// mergeSymbols adds the symbols of src that aren't defined in dst to dst.
+// Symbols of earlier images take precedence, e.g. the firmware's tohost
+// over the kernel's.
+func mergeSymbols(dst, src map[string]uint64) {
+	for name, addr := range src {
+		if _, ok := dst[name]; !ok {
+			dst[name] = addr
+		}
+	}
+}
+
+// dtbAlign is the alignment of the device tree placed at the end of memory;
+// the same as on QEMU's virt machine.
+const dtbAlign = 2 << 20
+
+// defaultDTBAddr returns the address at which a device tree of the given
+// size is placed if no address was requested: the end of the highest RAM
+// range, aligned down to 2MiB, or to 8 bytes if the range is smaller than
+// 2MiB.
+func defaultDTBAddr(vm *VM, size uint64) (uint64, error) {
+	ram := ramRanges(vm)
+	var base, end uint64
+	for i := 0; i < len(ram); i += 2 {
+		if ram[i]+ram[i+1] > end {
+			base, end = ram[i], ram[i]+ram[i+1]
+		}
+	}
+	if end-base < size {
+		return 0, fmt.Errorf("no RAM for the %d-byte device tree", size)
+	}
+	if end-base < dtbAlign {
+		return (end - size) &^ 7, nil
+	}
+	return (end - size) &^ (dtbAlign - 1), nil
+}
@@ -0,0 +1,227 @@
+// Copyright 2019 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bytes"
+	"debug/elf"
+	"encoding/binary"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+// bssSize is the size of the zero-initialized memory following the code of
+// ELF files returned by buildELF.
+const bssSize = 16
+
+// buildELF returns a RISC-V ELF file with one segment holding the code at the
+// physical address paddr, followed by bssSize zeroed bytes. The virtual
+// address differs, like in kernels. The symbols are defined relative to the
+// start of the segment.
+func buildELF(entry, paddr uint64, code []byte, syms map[string]uint64) []byte {
+	const (
+		ehdrSize = 64
+		phdrSize = 56
+		shdrSize = 64
+		symSize  = 24
+		vaddr    = 0xffffffff80000000
+	)
+	codeOff := uint64(ehdrSize + phdrSize)
+	var symtab, strtab bytes.Buffer
+	strtab.WriteByte(0)
+	binary.Write(&symtab, binary.LittleEndian, elf.Sym64{}) // the null symbol
+	for _, name := range []string{"tohost", "fromhost", "_start"} {
+		off, ok := syms[name]
+		if !ok {
+			continue
+		}
+		binary.Write(&symtab, binary.LittleEndian, elf.Sym64{
+			Name:  uint32(strtab.Len()),
+			Info:  elf.ST_INFO(elf.STB_GLOBAL, elf.STT_OBJECT),
+			Shndx: 1,
+			Value: vaddr + off,
+		})
+		strtab.WriteString(name + "\x00")
+	}
+	shstrtab := "\x00.text\x00.symtab\x00.strtab\x00.shstrtab\x00"
+	symtabOff := codeOff + uint64(len(code))
+	strtabOff := symtabOff + uint64(symtab.Len())
+	shstrtabOff := strtabOff + uint64(strtab.Len())
+	shOff := (shstrtabOff + uint64(len(shstrtab)) + 7) &^ 7
+
+	var b bytes.Buffer
+	h := elf.Header64{
+		Type:      uint16(elf.ET_EXEC),
+		Machine:   uint16(elf.EM_RISCV),
+		Version:   uint32(elf.EV_CURRENT),
+		Entry:     vaddr + entry - paddr,
+		Phoff:     ehdrSize,
+		Shoff:     shOff,
+		Ehsize:    ehdrSize,
+		Phentsize: phdrSize,
+		Phnum:     1,
+		Shentsize: shdrSize,
+		Shnum:     5,
+		Shstrndx:  4,
+	}
+	copy(h.Ident[:], elf.ELFMAG)
+	h.Ident[elf.EI_CLASS] = byte(elf.ELFCLASS64)
+	h.Ident[elf.EI_DATA] = byte(elf.ELFDATA2LSB)
+	h.Ident[elf.EI_VERSION] = byte(elf.EV_CURRENT)
+	binary.Write(&b, binary.LittleEndian, h)
+	binary.Write(&b, binary.LittleEndian, elf.Prog64{
+		Type:   uint32(elf.PT_LOAD),
+		Flags:  uint32(elf.PF_R | elf.PF_W | elf.PF_X),
+		Off:    codeOff,
+		Vaddr:  vaddr,
+		Paddr:  paddr,
+		Filesz: uint64(len(code)),
+		Memsz:  uint64(len(code)) + bssSize,
+		Align:  4,
+	})
+	b.Write(code)
+	b.Write(symtab.Bytes())
+	b.Write(strtab.Bytes())
+	b.WriteString(shstrtab)
+	b.Write(make([]byte, shOff-uint64(b.Len())))
+	for _, s := range []elf.Section64{
+		{},
+		{Name: 1, Type: uint32(elf.SHT_PROGBITS), Flags: uint64(elf.SHF_ALLOC | elf.SHF_EXECINSTR), Addr: vaddr, Off: codeOff, Size: uint64(len(code)), Addralign: 4},
+		{Name: 7, Type: uint32(elf.SHT_SYMTAB), Off: symtabOff, Size: uint64(symtab.Len()), Link: 3, Info: 1, Addralign: 8, Entsize: symSize},
+		{Name: 15, Type: uint32(elf.SHT_STRTAB), Off: strtabOff, Size: uint64(strtab.Len()), Addralign: 1},
+		{Name: 23, Type: uint32(elf.SHT_STRTAB), Off: shstrtabOff, Size: uint64(len(shstrtab)), Addralign: 1},
+	} {
+		binary.Write(&b, binary.LittleEndian, s)
+	}
+	return b.Bytes()
+}
+
+func TestParseLoadSpec(t *testing.T) {
+	for _, tt := range []struct {
+		in      string
+		want    LoadSpec
+		wantErr bool
+	}{
+		{in: "fw_jump.elf", want: LoadSpec{Path: "fw_jump.elf"}},
+		{in: "Image@0x80200000", want: LoadSpec{Path: "Image", Addr: 0x80200000, HasAddr: true}},
+		{in: "a@b/blob@4096", want: LoadSpec{Path: "a@b/blob", Addr: 4096, HasAddr: true}},
+		{in: "Image@", wantErr: true},
+		{in: "Image@0xzz", wantErr: true},
+	} {
+		got, err := ParseLoadSpec(tt.in)
+		if (err != nil) != tt.wantErr || err == nil && got != tt.want {
+			t.Errorf("ParseLoadSpec(%q) = %+v, %v; want %+v, error: %v", tt.in, got, err, tt.want, tt.wantErr)
+		}
+	}
+}
+
+func TestLoad(t *testing.T) {
+	dir, err := ioutil.TempDir("", "loader")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	write := func(name string, b []byte) string {
+		path := filepath.Join(dir, name)
+		if err := ioutil.WriteFile(path, b, 0644); err != nil {
+			t.Fatal(err)
+		}
+		return path
+	}
+	code := append(asBytes(nop), asBytes(swX2X1)...)
+	syms := map[string]uint64{"_start": 4, "tohost": 8}
+	fw := write("fw.elf", buildELF(0x1004, 0x1000, code, syms))
+	blob := write("blob", []byte("blob"))
+
+	for _, tt := range []struct {
+		desc      string
+		spec      LoadSpec
+		want      *Image
+		wantAt    uint64 // address of the loaded bytes
+		wantBytes []byte
+	}{
+		{
+			desc:      "ELF at its address",
+			spec:      LoadSpec{Path: fw},
+			want:      &Image{Start: 0x1000, End: 0x1000 + 8 + bssSize, Entry: 0x1004, ELF: true, Symbols: map[string]uint64{"_start": 0x1004, "tohost": 0x1008}},
+			wantAt:    0x1000,
+			wantBytes: append(code, make([]byte, bssSize)...),
+		},
+		{
+			desc:      "moved ELF",
+			spec:      LoadSpec{Path: fw, Addr: 0x2000, HasAddr: true},
+			want:      &Image{Start: 0x2000, End: 0x2000 + 8 + bssSize, Entry: 0x2004, ELF: true, Symbols: map[string]uint64{"_start": 0x2004, "tohost": 0x2008}},
+			wantAt:    0x2000,
+			wantBytes: code,
+		},
+		{
+			desc:      "raw file",
+			spec:      LoadSpec{Path: blob, Addr: 0x3000, HasAddr: true},
+			want:      &Image{Start: 0x3000, End: 0x3004, Entry: 0x3000},
+			wantAt:    0x3000,
+			wantBytes: []byte("blob"),
+		},
+		{desc: "raw file without address", spec: LoadSpec{Path: blob}},
+		{desc: "raw file outside memory", spec: LoadSpec{Path: blob, Addr: 0x10000, HasAddr: true}},
+		{desc: "ELF outside memory", spec: LoadSpec{Path: fw, Addr: 0xfff0, HasAddr: true}},
+		{desc: "missing file", spec: LoadSpec{Path: filepath.Join(dir, "missing")}},
+	} {
+		vm := NewVM(&Prog{MemSize: 0x10000})
+		// The bss must be zeroed.
+		for i := range vm.Mem {
+			vm.Mem[i] = 0xff
+		}
+		got, err := vm.Load(tt.spec)
+		if tt.want == nil {
+			if err == nil {
+				t.Errorf("%s: Load(%v) succeeded; want an error", tt.desc, tt.spec)
+			}
+			continue
+		}
+		if err != nil || !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("%s: Load(%v) = %+v, %v; want %+v, nil", tt.desc, tt.spec, got, err, tt.want)
+			continue
+		}
+		if b := vm.Mem[tt.wantAt : tt.wantAt+uint64(len(tt.wantBytes))]; !bytes.Equal(b, tt.wantBytes) {
+			t.Errorf("%s: memory at %#x = %x; want %x", tt.desc, tt.wantAt, b, tt.wantBytes)
+		}
+	}
+}
+
+func TestMergeSymbols(t *testing.T) {
+	syms := map[string]uint64{"tohost": 0x1000}
+	mergeSymbols(syms, map[string]uint64{"tohost": 0x2000, "fromhost": 0x2008})
+	if want := map[string]uint64{"tohost": 0x1000, "fromhost": 0x2008}; !reflect.DeepEqual(syms, want) {
+		t.Errorf("mergeSymbols() = %#x; want %#x", syms, want)
+	}
+}
+
+func TestDefaultDTBAddr(t *testing.T) {
+	vm := NewVM(&Prog{MemSize: 100 << 20})
+	if addr, err := defaultDTBAddr(vm, 0x1000); err != nil || addr != 98<<20 {
+		t.Errorf("defaultDTBAddr() = %#x, %v; want %#x, nil", addr, err, 98<<20)
+	}
+	// Memory smaller than the alignment.
+	vm = NewVM(&Prog{MemSize: 0x10000})
+	if addr, err := defaultDTBAddr(vm, 0x1001); err != nil || addr != 0xeff8 {
+		t.Errorf("defaultDTBAddr() = %#x, %v; want 0xeff8, nil", addr, err)
+	}
+	if _, err := defaultDTBAddr(vm, 0x10001); err == nil {
+		t.Errorf("defaultDTBAddr() of a device tree larger than memory succeeded")
+	}
+}
@@ -0,0 +1,253 @@
+// Copyright 2019 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	crand "crypto/rand"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"strconv"
+)
+
+// MachineConfig describes a machine: its memory map, harts and devices. It's
+// read from JSON files like this one:
+//
+//	{
+//	  "memory": [
+//	    {"name": "rom", "base": "0x0", "size": "0x10000", "perms": "rx", "file": "boot.bin"},
+//	    {"name": "sram", "base": "0x20000000", "size": "0x20000", "perms": "rw"},
+//	    {"name": "flash", "base": "0x80000000", "size": "0x100000", "perms": "rx"}
+//	  ],
+//	  "reset_vector": "0x0",
+//	  "harts": 1,
+//	  "sbi": false,
+//	  "devices": [
+//	    {"type": "clint", "base": "0x2000000"},
+//	    {"type": "plic", "base": "0xc000000"},
+//	    {"type": "uart", "base": "0x10000000", "irq": 10}
+//	  ]
+//	}
+//
+// Numbers may be written as JSON numbers or as strings in any base accepted by
+// strconv.ParseUint.
+type MachineConfig struct {
+	Memory []MemoryConfig `json:"memory"`
+	// ResetVector is the initial PC. If it's not set, the program's entry
+	// point is used.
+	ResetVector *HexUint64     `json:"reset_vector"`
+	Harts       int            `json:"harts"` // 0 means 1
+	Devices     []DeviceConfig `json:"devices"`
+	// SBI installs the built-in SBI implementation and starts the harts in
+	// S-mode, which lets the machine boot supervisors like Linux without
+	// firmware. The SBI console writes to the output of the UART and has
+	// no input.
+	SBI bool `json:"sbi"`
+}
+
+// MemoryConfig describes a memory region.
+type MemoryConfig struct {
+	Name  string    `json:"name"`
+	Base  HexUint64 `json:"base"`
+	Size  HexUint64 `json:"size"`
+	Perms string    `json:"perms"` // a subset of "rwx"
+	File  string    `json:"file"`  // initial content; may be empty
+}
+
+// DeviceConfig describes a device model mapped at Base. Which fields are used
+// depends on Type:
+//
+//	clint, test-finisher: none
+//	plic: IRQs (number of interrupt sources; 95 if 0)
+//	uart, rtc, virtio-rng: IRQ; Seed (virtio-rng only; host randomness if unset)
+//	virtio-blk: IRQ, Path (disk image), ReadOnly
+//	virtio-9p: IRQ, Path (shared directory), Tag ("host" if empty), ReadOnly
+//	framebuffer: Width, Height, Format
+//
+// IRQ is the source of the PLIC the device is connected to; 0 means that the
+// interrupt isn't connected.
+type DeviceConfig struct {
+	Type     string    `json:"type"`
+	Base     HexUint64 `json:"base"`
+	IRQ      int       `json:"irq"`
+	IRQs     int       `json:"irqs"`
+	Path     string    `json:"path"`
+	Tag      string    `json:"tag"`
+	ReadOnly bool      `json:"read_only"`
+	Seed     *int64    `json:"seed"`
+	Width    int       `json:"width"`
+	Height   int       `json:"height"`
+	Format   string    `json:"format"`
+}
+
+// HexUint64 is a uint64 that can be written in JSON as a number or as a string
+// like "0x80000000".
+type HexUint64 uint64
+
+// UnmarshalJSON implements the json.Unmarshaler interface.
+func (h *HexUint64) UnmarshalJSON(b []byte) error {
+	s := string(b)
+	if uq, err := strconv.Unquote(s); err == nil {
+		s = uq
+	}
+	v, err := strconv.ParseUint(s, 0, 64)
+	if err != nil {
+		return fmt.Errorf("invalid number %s: %v", b, err)
+	}
+	*h = HexUint64(v)
+	return nil
+}
+
+// ReadMachineConfig reads a machine description in JSON.
+func ReadMachineConfig(r io.Reader) (*MachineConfig, error) {
+	d := json.NewDecoder(r)
+	d.DisallowUnknownFields()
+	var c MachineConfig
+	if err := d.Decode(&c); err != nil {
+		return nil, fmt.Errorf("invalid machine description: %v", err)
+	}
+	return &c, nil
+}
+
+// NewVM returns the boot hart of a machine built from the description; the
+// other harts are returned by its Harts method. The VM has no main memory; all
+// memory comes from the memory regions. The UART writes to out.
+func (c *MachineConfig) NewVM(out io.Writer) (*VM, error) {
+	if c.Harts < 0 {
+		return nil, fmt.Errorf("invalid number of harts %d", c.Harts)
+	}
+	vm := NewVM(&Prog{})
+	vm.Bus = &Bus{}
+	if c.ResetVector != nil {
+		vm.PC = uint64(*c.ResetVector)
+	}
+	harts := NewHarts(vm, c.Harts)
+	for _, mc := range c.Memory {
+		perms, err := ParsePerms(mc.Perms)
+		if err != nil {
+			return nil, fmt.Errorf("memory region %q: %v", mc.Name, err)
+		}
+		m := NewMemoryRegion(mc.Name, uint64(mc.Size), perms)
+		if mc.File != "" {
+			b, err := ioutil.ReadFile(mc.File)
+			if err != nil {
+				return nil, fmt.Errorf("memory region %q: %v", mc.Name, err)
+			}
+			if len(b) > len(m.Data) {
+				return nil, fmt.Errorf("memory region %q: %s doesn't fit", mc.Name, mc.File)
+			}
+			copy(m.Data, b)
+		}
+		if err := vm.Bus.Map(uint64(mc.Base), uint64(mc.Size), m); err != nil {
+			return nil, fmt.Errorf("memory region %q: %v", mc.Name, err)
+		}
+	}
+
+	// The PLIC goes first, so that other devices can be connected to it.
+	var plic *PLIC
+	for _, d := range c.Devices {
+		if d.Type != "plic" {
+			continue
+		}
+		if plic != nil {
+			return nil, fmt.Errorf("only one PLIC is supported")
+		}
+		n := d.IRQs
+		if n == 0 {
+			n = plicSources
+		}
+		plic = NewPLIC(n, harts...)
+		if err := vm.Bus.Map(uint64(d.Base), PLICSize, plic); err != nil {
+			return nil, err
+		}
+	}
+	for _, d := range c.Devices {
+		var irq InterruptLine
+		if d.IRQ != 0 {
+			if plic == nil || d.IRQ >= plic.sources {
+				return nil, fmt.Errorf("%s at %#x: interrupt source %d doesn't exist", d.Type, d.Base, d.IRQ)
+			}
+			irq = plic.Line(d.IRQ)
+		}
+		dev, size, err := d.newDevice(harts, irq, out)
+		if err != nil {
+			return nil, fmt.Errorf("%s at %#x: %v", d.Type, d.Base, err)
+		}
+		if dev == nil {
+			continue // the PLIC, mapped already
+		}
+		if err := vm.Bus.Map(uint64(d.Base), size, dev); err != nil {
+			return nil, err
+		}
+	}
+	if c.SBI {
+		NewSBI(nil, out, harts...)
+		for _, h := range harts {
+			h.Priv = PrivS
+		}
+	}
+	return vm, nil
+}
+
+// newDevice returns the device and the size of its address space.
+func (d *DeviceConfig) newDevice(harts []*VM, irq InterruptLine, out io.Writer) (Device, uint64, error) {
+	vm := harts[0]
+	// virtio returns the device's virtio-mmio transport.
+	virtio := func(dev VirtioDevice) (Device, uint64, error) {
+		return NewVirtioMMIO(vm, dev, irq), VirtioMMIOSize, nil
+	}
+	switch d.Type {
+	case "plic":
+		return nil, 0, nil
+	case "clint":
+		return NewCLINT(harts...), CLINTSize, nil
+	case "uart":
+		return NewUART(out, irq), UARTSize, nil
+	case "rtc":
+		return NewGoldfishRTC(nil, irq), GoldfishRTCSize, nil
+	case "test-finisher":
+		return TestFinisher{}, TestFinisherSize, nil
+	case "framebuffer":
+		fb, err := NewFramebuffer(d.Width, d.Height, d.Format)
+		if err != nil {
+			return nil, 0, err
+		}
+		return fb, fb.Size(), nil
+	case "virtio-blk":
+		b, err := OpenVirtioBlk(d.Path, d.ReadOnly)
+		if err != nil {
+			return nil, 0, err
+		}
+		return virtio(b)
+	case "virtio-rng":
+		src := crand.Reader
+		if d.Seed != nil {
+			src = NewSeededRNG(*d.Seed)
+		}
+		return virtio(NewVirtioRNG(src))
+	case "virtio-9p":
+		if fi, err := os.Stat(d.Path); err != nil || !fi.IsDir() {
+			return nil, 0, fmt.Errorf("can't share %q: not a directory", d.Path)
+		}
+		tag := d.Tag
+		if tag == "" {
+			tag = "host"
+		}
+		return virtio(NewVirtio9P(tag, NewP9Server(d.Path, d.ReadOnly)))
+	}
+	return nil, 0, fmt.Errorf("unknown device type")
+}
@@ -0,0 +1,329 @@
+// Copyright 2019 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// The memory map of the test machine.
+const (
+	romBase   = 0x1000
+	sramBase  = 0x20000
+	flashBase = 0x80000
+)
+
+// newMachine returns a VM with ROM holding the instructions, SRAM and flash.
+// Traps go to the end of the ROM, which holds nops.
+func newMachine(t *testing.T, instrs ...uint64) *VM {
+	t.Helper()
+	var rom []byte
+	for _, in := range instrs {
+		rom = append(rom, asBytes(in)...)
+	}
+	for len(rom) < 0x100 {
+		rom = append(rom, asBytes(nop)...)
+	}
+	dir, err := ioutil.TempDir("", "machine")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	romPath := filepath.Join(dir, "rom.bin")
+	if err := ioutil.WriteFile(romPath, rom, 0644); err != nil {
+		t.Fatal(err)
+	}
+	c, err := ReadMachineConfig(strings.NewReader(fmt.Sprintf(`{
+		"memory": [
+			{"name": "rom", "base": "%#x", "size": "0x1000", "perms": "rx", "file": %q},
+			{"name": "sram", "base": "%#x", "size": "0x1000", "perms": "rw"},
+			{"name": "flash", "base": %d, "size": "0x1000", "perms": "r"}
+		],
+		"reset_vector": "%#x",
+		"devices": [
+			{"type": "clint", "base": "0x2000000"},
+			{"type": "uart", "base": "0x10000000", "irq": 10},
+			{"type": "plic", "base": "0xc000000"},
+			{"type": "test-finisher", "base": "0x100000"}
+		]
+	}`, romBase, romPath, sramBase, flashBase, romBase)))
+	if err != nil {
+		t.Fatalf("ReadMachineConfig() failed: %v", err)
+	}
+	vm, err := c.NewVM(ioutil.Discard)
+	if err != nil {
+		t.Fatalf("NewVM() failed: %v", err)
+	}
+	vm.CSR[csrMtvec] = romBase + 0x80
+	return vm
+}
+
+func TestMachine(t *testing.T) {
+	vm := newMachine(t, nop)
+	if vm.PC != romBase {
+		t.Errorf("PC = %#x; want %#x", vm.PC, romBase)
+	}
+	if len(vm.Mem) != 0 {
+		t.Errorf("len(Mem) = %d; want 0", len(vm.Mem))
+	}
+	rom, err := vm.memSlice(romBase, 4)
+	if err != nil || !bytes.Equal(rom, asBytes(nop)) {
+		t.Errorf("memSlice(ROM) = %x, %v; want %x", rom, err, asBytes(nop))
+	}
+	var got []string
+	for _, r := range vm.Bus.regions {
+		got = append(got, fmt.Sprintf("%T@%#x", r.dev, r.base))
+	}
+	want := "*main.MemoryRegion@0x1000 *main.MemoryRegion@0x20000 *main.MemoryRegion@0x80000 " +
+		"*main.PLIC@0xc000000 *main.CLINT@0x2000000 *main.UART@0x10000000 main.TestFinisher@0x100000"
+	if strings.Join(got, " ") != want {
+		t.Errorf("bus regions = %v; want %v", got, want)
+	}
+	u := vm.Bus.find(0x10000000).dev.(*UART)
+	if l, ok := u.irq.(plicLine); !ok || l.src != 10 {
+		t.Errorf("UART interrupt line = %#v; want source 10 of the PLIC", u.irq)
+	}
+}
+
+func TestMachinePKWrite(t *testing.T) {
+	f, err := ioutil.TempFile("", "stdout")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(f.Name())
+	defer f.Close()
+	stdout := os.Stdout
+	os.Stdout = f
+	defer func() { os.Stdout = stdout }()
+
+	for _, tt := range []struct {
+		desc    string
+		buf, n  uint64
+		wantRet uint64
+	}{
+		{"buffer in SRAM", sramBase, 5, 5},
+		{"buffer past SRAM", sramBase + 0xffe, 5, u64(-htifEFAULT)},
+		{"huge buffer", sramBase, 1 << 62, u64(-htifEFAULT)},
+	} {
+		vm := newMachine(t, ecallInstr)
+		vm.CSR[csrMtvec] = 0 // let the emulator implement pk's system calls
+		if err := vm.writeBytes(sramBase, []byte("hello")); err != nil {
+			t.Fatal(err)
+		}
+		vm.Reg[regNums["a7"]], vm.Reg[regNums["a0"]] = 0x40, 1
+		vm.Reg[regNums["a1"]], vm.Reg[regNums["a2"]] = tt.buf, tt.n
+		if err := vm.Run(1); err != nil {
+			t.Fatalf("%s: Run failed: %v", tt.desc, err)
+		}
+		if got := vm.Reg[regNums["a0"]]; got != tt.wantRet {
+			t.Errorf("%s: write returned %d; want %d", tt.desc, int64(got), int64(tt.wantRet))
+		}
+	}
+	if got, err := ioutil.ReadFile(f.Name()); err != nil || string(got) != "hello" {
+		t.Errorf("stdout = %q, %v; want %q", got, err, "hello")
+	}
+}
+
+func TestMachinePerms(t *testing.T) {
+	for _, tt := range []struct {
+		desc      string
+		addr      uint64 // stored to by the second instruction
+		wantCause uint64 // 0 if there's no trap
+	}{
+		{desc: "store to SRAM", addr: sramBase + 8},
+		{desc: "store to ROM", addr: romBase + 8, wantCause: causeStoreAccessFault},
+		{desc: "store to flash", addr: flashBase, wantCause: causeStoreAccessFault},
+		{desc: "store to unmapped memory", addr: 0x40000000, wantCause: causeStoreAccessFault},
+	} {
+		vm := newMachine(t, nop, swX2X1)
+		vm.Reg[1], vm.Reg[2] = tt.addr, 0x12345678
+		if err := vm.Run(2); err != nil {
+			t.Errorf("%s: Run() failed: %v", tt.desc, err)
+			continue
+		}
+		if tt.wantCause == 0 {
+			if v, err := vm.read(tt.addr, 4); err != nil || v != 0x12345678 || vm.PC != romBase+8 {
+				t.Errorf("%s: got %#x, %v, PC = %#x; want 0x12345678, nil, %#x", tt.desc, v, err, vm.PC, romBase+8)
+			}
+			continue
+		}
+		if vm.PC != romBase+0x80 || vm.CSR[csrMcause] != tt.wantCause || vm.CSR[csrMtval] != tt.addr {
+			t.Errorf("%s: PC = %#x, mcause = %d, mtval = %#x; want %#x, %d, %#x", tt.desc, vm.PC, vm.CSR[csrMcause], vm.CSR[csrMtval], romBase+0x80, tt.wantCause, tt.addr)
+		}
+	}
+
+	// Instructions can't be fetched from SRAM, devices or unmapped memory.
+	for _, pc := range []uint64{sramBase, 0x10000000, 0x40000000} {
+		vm := newMachine(t)
+		vm.PC = pc
+		if err := vm.Run(1); err != nil {
+			t.Fatalf("fetch from %#x: Run() failed: %v", pc, err)
+		}
+		if vm.PC != romBase+0x80 || vm.CSR[csrMcause] != causeInstrAccessFault || vm.CSR[csrMtval] != pc {
+			t.Errorf("fetch from %#x: PC = %#x, mcause = %d, mtval = %#x; want %#x, %d, %#x", pc, vm.PC, vm.CSR[csrMcause], vm.CSR[csrMtval], romBase+0x80, causeInstrAccessFault, pc)
+		}
+	}
+
+	// Loads from unmapped memory raise access faults too.
+	vm := newMachine(t)
+	if _, err := vm.read(0x40000000, 8); err == nil || err.(*exception).cause != causeLoadAccessFault {
+		t.Errorf("read(unmapped) returned %v; want a load access fault", err)
+	}
+	// Huge DMA lengths don't wrap around.
+	if _, err := vm.memSlice(sramBase+8, ^uint64(0)); err == nil {
+		t.Errorf("memSlice(SRAM, 2^64-1) succeeded")
+	}
+}
+
+func TestMemoryShadowedByDevices(t *testing.T) {
+	// Like loads and stores, DMA and instruction fetches go to the devices
+	// mapped over the main memory.
+	vm := NewVM(&Prog{MemSize: 0x1000})
+	vm.Bus = &Bus{}
+	region := NewMemoryRegion("rom", 0x100, PermRead|PermExec)
+	copy(region.Data, asBytes(nop))
+	for _, d := range []struct {
+		addr uint64
+		dev  Device
+	}{
+		{0x800, region},
+		{0x900, NewUART(ioutil.Discard, nil)},
+	} {
+		if err := vm.Bus.Map(d.addr, 0x100, d.dev); err != nil {
+			t.Fatalf("Can't map device: %v", err)
+		}
+	}
+	copy(vm.Mem[0x800:], []byte{1, 2, 3, 4})
+	if b, err := vm.memSlice(0x800, 4); err != nil || !bytes.Equal(b, asBytes(nop)) {
+		t.Errorf("memSlice(region) = %x, %v; want %x, nil", b, err, asBytes(nop))
+	}
+	if b, err := vm.fetchPhys(0x800); err != nil || !bytes.Equal(b, asBytes(nop)) {
+		t.Errorf("fetchPhys(region) = %x, %v; want %x, nil", b, err, asBytes(nop))
+	}
+	if b, err := vm.memSlice(0x900, 4); err == nil {
+		t.Errorf("memSlice(UART) = %x; want an error", b)
+	}
+	if _, err := vm.fetchPhys(0x900); err == nil || err.(*exception).cause != causeInstrAccessFault {
+		t.Errorf("fetchPhys(UART) returned %v; want an instruction access fault", err)
+	}
+}
+
+func TestMachineConfigErrors(t *testing.T) {
+	for _, tt := range []struct {
+		desc, config string
+	}{
+		{"unknown field", `{"ram": []}`},
+		{"invalid number", `{"memory": [{"name": "ram", "base": "zero", "size": 16, "perms": "rw"}]}`},
+		{"invalid perms", `{"memory": [{"name": "ram", "base": 0, "size": 16, "perms": "rwz"}]}`},
+		{"overlapping regions", `{"memory": [{"base": 0, "size": 16}, {"base": 8, "size": 16}]}`},
+		{"missing image", `{"memory": [{"base": 0, "size": 16, "file": "/does/not/exist"}]}`},
+		{"unknown device", `{"devices": [{"type": "gpu", "base": 0}]}`},
+		{"IRQ without PLIC", `{"devices": [{"type": "uart", "base": 0, "irq": 1}]}`},
+		{"negative number of harts", `{"harts": -1}`},
+	} {
+		c, err := ReadMachineConfig(strings.NewReader(tt.config))
+		if err == nil {
+			_, err = c.NewVM(ioutil.Discard)
+		}
+		if err == nil {
+			t.Errorf("%s: no error", tt.desc)
+		}
+	}
+}
+
+func TestMachineDeviceTree(t *testing.T) {
+	vm := newMachine(t)
+	// Only SRAM is writable.
+	if got, want := ramRanges(vm), []uint64{sramBase, 0x1000}; fmt.Sprint(got) != fmt.Sprint(want) {
+		t.Errorf("ramRanges() = %#x; want %#x", got, want)
+	}
+}
+
+func TestMachineProfile(t *testing.T) {
+	for _, tt := range []struct {
+		name     string
+		ramSize  uint64
+		wantPriv int
+	}{
+		{"virt", 0x8000000, PrivM},
+		{"linux", 0x10000000, PrivS},
+	} {
+		c, ok := MachineProfile(tt.name)
+		if !ok {
+			t.Fatalf("MachineProfile(%s) not found", tt.name)
+		}
+		vm, err := c.NewVM(ioutil.Discard)
+		if err != nil {
+			t.Fatalf("%s: NewVM() failed: %v", tt.name, err)
+		}
+		if got, want := ramRanges(vm), []uint64{0x80000000, tt.ramSize}; fmt.Sprint(got) != fmt.Sprint(want) {
+			t.Errorf("%s: ramRanges() = %#x; want %#x", tt.name, got, want)
+		}
+		for _, addr := range []uint64{0x100000, 0x101000, 0x2000000, 0xc000000, 0x10000000} {
+			if vm.Bus.find(addr) == nil {
+				t.Errorf("%s: no device at %#x", tt.name, addr)
+			}
+		}
+		if vm.Priv != tt.wantPriv || (vm.SBI != nil) != (tt.wantPriv == PrivS) {
+			t.Errorf("%s: Priv = %d, SBI = %v; want %d and an SBI only in S-mode", tt.name, vm.Priv, vm.SBI, tt.wantPriv)
+		}
+	}
+	if _, ok := MachineProfile("missing"); ok {
+		t.Errorf("MachineProfile(missing) found a profile")
+	}
+	if got, want := machineProfileHelp(), "'linux' (virt with 256MiB of RAM and the built-in SBI, targets Linux), 'virt' (QEMU's virt memory map, targets xv6-riscv)"; got != want {
+		t.Errorf("machineProfileHelp() = %q; want %q", got, want)
+	}
+}
+
+func TestMachineHarts(t *testing.T) {
+	c, err := ReadMachineConfig(strings.NewReader(`{
+		"memory": [{"name": "ram", "base": "0x80000000", "size": "0x10000", "perms": "rwx"}],
+		"reset_vector": "0x80000000",
+		"harts": 2,
+		"sbi": true,
+		"devices": [
+			{"type": "clint", "base": "0x2000000"},
+			{"type": "plic", "base": "0xc000000"}
+		]
+	}`))
+	if err != nil {
+		t.Fatalf("ReadMachineConfig() failed: %v", err)
+	}
+	vm, err := c.NewVM(ioutil.Discard)
+	if err != nil {
+		t.Fatalf("NewVM() failed: %v", err)
+	}
+	harts := vm.Harts()
+	if len(harts) != 2 || harts[0] != vm {
+		t.Fatalf("Harts() = %v; want vm and another hart", harts)
+	}
+	h := harts[1]
+	if h.PC != 0x80000000 || h.Priv != PrivS || h.SBI != vm.SBI || !h.stopped {
+		t.Errorf("hart 1: PC, priv, SBI, stopped = %#x, %d, %p, %v; want 0x80000000, S-mode, %p, true", h.PC, h.Priv, h.SBI, h.stopped, vm.SBI)
+	}
+	if got := vm.Bus.find(0x2000000).dev.(*CLINT).harts; len(got) != 2 {
+		t.Errorf("the CLINT is connected to %d harts; want 2", len(got))
+	}
+	if got := vm.Bus.find(0xc000000).dev.(*PLIC).contexts; len(got) != 4 {
+		t.Errorf("the PLIC has %d contexts; want 4", len(got))
+	}
+}
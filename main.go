@@ -34,6 +34,14 @@
 //
 //    riscv-emu --argv=a,hello,world --env=A=B,LANG=en_US.UTF-8 --prog=PATH_TO_RISCV_BINARY
 //
+// To boot firmware, a kernel and an initramfs:
+//
+//    riscv-emu --machine=virt.json --load=fw_jump.elf --load=Image@0x80200000 --initrd=initramfs.cpio@0x88000000
+//
+// or, with the built-in SBI instead of firmware:
+//
+//    riscv-emu --machine=linux --load=Image@0x80200000 --initrd=initramfs.cpio@0x88000000 --uart_input=- --max_steps=100000000000
+//
 // To execute instructions from stdin:
 //
 //    echo -n -e "\x9b\x87\xa7\x02" | riscv-emu  # executes "addiw a5,a5,42"
@@ -44,20 +52,104 @@
 package main
 
 import (
+	crand "crypto/rand"
 	"debug/elf"
 	"flag"
 	"fmt"
 	"io/ioutil"
+	"net"
 	"os"
+	"path/filepath"
+	"strconv"
 	"strings"
 )
 
 var (
-	argv     = flag.String("argv", "", "Comma-separated argv")
-	env      = flag.String("env", "", "Comma-separated env")
-	prog     = flag.String("prog", "", "Path to the program to execute (must be an ELF file). When empty, instructions are read from stdin and 'spike' must be empty.")
-	maxSteps = flag.Int("max_steps", 10000, "Maximum number of instructions to execute")
-	spike    = flag.String("spike", "", "Path to the spike binary. Non-empty means that the emulator runs one instruction at a time, and compares results with spike after every step. NOTE: this requires Linux and cgo.")
+	argv       = flag.String("argv", "", "Comma-separated argv")
+	env        = flag.String("env", "", "Comma-separated env")
+	prog       = flag.String("prog", "", "Path to the program to execute (must be an ELF file). When empty, instructions are read from stdin and 'spike' must be empty.")
+	maxSteps   = flag.Int("max_steps", 10000, "Maximum number of instructions to execute on every hart")
+	numHarts   = flag.Int("harts", 0, "Number of harts sharing memory and devices. They start at the same address with a0 set to their hart IDs, unless the SBI stops all but the first one. 0 means the number of the machine description (see --machine), or 1. Requires --prog or --load.")
+	quantum    = flag.Int("quantum", defaultQuantum, "Number of instructions a hart executes before the next hart runs, when there are multiple harts. They run round-robin in the order of their IDs, so runs are reproducible.")
+	parallel   = flag.Bool("parallel", false, "Run every hart on its own goroutine. It's faster than round-robin on multi-core hosts, but runs aren't reproducible. Harts synchronize their clocks every --quantum instructions.")
+	spike      = flag.String("spike", "", "Path to the spike binary. Non-empty means that the emulator runs one instruction at a time, and compares results with spike after every step. NOTE: this requires Linux and cgo.")
+	uart       = flag.String("uart", "", "Address at which the NS16550A UART is mapped (e.g. 0x10000000). Its output goes to stdout. Empty means no UART.")
+	uartInput  = flag.String("uart_input", "", "Input of the UART: '-' for stdin or the path of a file with scripted input. Empty means no input.")
+	virtioBlk  = flag.String("virtio_blk", "", "Path to a disk image exposed to the guest as a virtio-mmio block device. Empty means no block device.")
+	blkRO      = flag.Bool("virtio_blk_readonly", false, "Make the virtio block device read-only.")
+	console    = flag.Bool("virtio_console", false, "Add a virtio console connected to stdin and stdout.")
+	ports      = flag.String("virtio_console_ports", "", "Comma-separated list of extra ports of the virtio console, as name=path. Named pipes and character devices at path are used for input and output; regular files receive output only.")
+	netDev     = flag.String("virtio_net", "", "Backend of a virtio network card: 'unix:LOCAL:PEER' (exchange frames with another instance over Unix datagram sockets bound at LOCAL and PEER) or 'pcap:PATH' (replay frames from a pcap file). Empty means no network card.")
+	netCapture = flag.String("virtio_net_capture", "", "Path of a pcap file receiving all frames of the virtio network card.")
+	netMAC     = flag.String("virtio_net_mac", "52:54:00:12:34:56", "MAC address of the virtio network card.")
+	share      = flag.String("virtio_9p", "", "Host directory shared with the guest over virtio-9p (9P2000.L) with mount tag 'host'. Empty means no shared directory.")
+	shareRO    = flag.Bool("virtio_9p_readonly", false, "Make the directory shared over virtio-9p read-only.")
+	rng        = flag.Bool("virtio_rng", false, "Add a virtio entropy device feeding host randomness to the guest.")
+	rngSeed    = flag.String("virtio_rng_seed", "", "Seed of the pseudo-random generator of the virtio entropy device. It makes runs reproducible and implies --virtio_rng. Empty means host randomness.")
+	fb         = flag.String("fb", "", "Address at which a simple-framebuffer is mapped (e.g. 0x30000000). Empty means no framebuffer.")
+	fbMode     = flag.String("fb_mode", "640x480", "Resolution of the framebuffer as WIDTHxHEIGHT.")
+	fbFormat   = flag.String("fb_format", "x8r8g8b8", "Pixel format of the framebuffer: r5g6b5, r8g8b8, x8r8g8b8, a8r8g8b8, x8b8g8r8 or a8b8g8r8.")
+	fbPNG      = flag.String("fb_png", "", "Path of a PNG file receiving the content of the framebuffer when the program exits.")
+	fbEvery    = flag.Int("fb_png_every", 0, "Also save the framebuffer every N steps, to the --fb_png path with the step count inserted before the extension (e.g. screen-1000.png). 0 means only at exit.")
+	rtc        = flag.String("rtc", "", "Address at which the Goldfish RTC is mapped (e.g. 0x101000). Empty means no RTC.")
+	finisher   = flag.String("test_finisher", "", "Address at which the SiFive test finisher is mapped (e.g. 0x100000). Writes to it end the program with a status code. Empty means no test finisher.")
+	bootargs   = flag.String("bootargs", "", "Kernel command line passed in the /chosen node of the device tree.")
+	dumpDTB    = flag.String("dump_dtb", "", "Path of a file receiving the flattened device tree describing the machine, e.g. for inspection with 'dtc -I dtb'.")
+	sbi        = flag.Bool("sbi", false, "Start the program in S-mode with a built-in SBI v2 implementation handling its environment calls, instead of the pk ABI. The SBI console uses stdin and stdout.")
+	semihost   = flag.String("semihosting", "", "Handle semihosting calls (EBREAK between 'slli x0, x0, 0x1f' and 'srai x0, x0, 7'). The value is the host directory that file operations are confined to, or '-' for console and exit calls only. The console uses stdin, stdout and stderr. Empty means that EBREAK does nothing.")
+	clint      = flag.String("clint", "", "Address at which the CLINT (timer and software interrupts) is mapped (e.g. 0x2000000). Empty means no CLINT.")
+	plic       = flag.String("plic", "", "Address at which the PLIC interrupt controller is mapped (e.g. 0xc000000). Empty means no PLIC.")
+	misaligned = flag.String("misaligned", "emulate", "How misaligned loads, stores and jumps are handled: 'emulate' (perform them), 'trap' (raise address-misaligned exceptions) or 'warn' (perform them and report them with the PC on exit).")
+	machine    = flag.String("machine", "", "Name of a built-in machine profile, "+machineProfileHelp()+", or path to a JSON machine description (memory regions with permissions, reset vector and devices) replacing the default machine with 100MiB of RAM at address 0. Devices requested with other flags are added to it. Requires --prog or --load.")
+	initrd     = flag.String("initrd", "", "Initial ramdisk loaded as FILE@ADDR. Its location is passed in the /chosen node of the device tree.")
+	dtbAddr    = flag.String("dtb", "", "Address at which the device tree is placed in memory (e.g. 0x82200000), or FILE@ADDR to load a device tree from a file instead of the generated one. Empty means the end of RAM when --load is used and no device tree otherwise.")
+	aia        = flag.String("aia", "", "Advanced Interrupt Architecture controllers to emulate instead of the PLIC: 'aplic' (APLIC in direct mode) or 'aplic-imsic' (APLIC and per-hart IMSICs). They're mapped at the same addresses as on QEMU's virt machine. Empty means no AIA.")
+)
+
+// loads holds the files requested with --load.
+var loads repeatedFlag
+
+func init() {
+	flag.Var(&loads, "load", "File loaded into memory before the program starts, as FILE@ADDR or FILE; repeatable. ELF files are loaded at their physical addresses, or moved to ADDR if it's given; other files (kernel images, raw blobs) require ADDR. Without --prog, the program starts at the entry point of the first ELF file, or at the first file if none is an ELF file. The boot hart starts with a0 set to its hart ID and a1 to the address of the device tree (see --dtb).")
+}
+
+// repeatedFlag is a flag that can be given multiple times.
+type repeatedFlag []string
+
+func (r *repeatedFlag) String() string { return strings.Join(*r, ",") }
+
+func (r *repeatedFlag) Set(s string) error {
+	*r = append(*r, s)
+	return nil
+}
+
+// Number of interrupt sources of the interrupt controllers.
+const (
+	plicSources  = 95
+	aplicSources = 96
+	imsicIDs     = 255
+)
+
+// Interrupt sources of devices; the same as on QEMU's virt machine.
+const (
+	uartIRQ   = 10
+	rtcIRQ    = 11
+	virtioIRQ = 1 // the first virtio-mmio slot; the next slots use the next sources
+)
+
+// Addresses of the virtio-mmio slots; the same as on QEMU's virt machine.
+const (
+	virtioAddr   = 0x10001000
+	virtioStride = 0x1000
+	virtioSlots  = 8
+)
+
+// Addresses of the AIA devices; the same as on QEMU's virt machine.
+const (
+	aplicMAddr = 0x0c000000
+	aplicSAddr = 0x0d000000
+	imsicMAddr = 0x24000000
+	imsicSAddr = 0x28000000
 )
 
 func main() {
@@ -74,7 +166,15 @@ func main() {
 		return
 	}
 
-	if prog == "" {
+	if prog == "" && len(loads) == 0 {
+		if *machine != "" {
+			fmt.Fprintf(os.Stderr, "--machine requires --prog or --load")
+			os.Exit(1)
+		}
+		if *numHarts > 1 {
+			fmt.Fprintf(os.Stderr, "--harts requires --prog or --load")
+			os.Exit(1)
+		}
 		b, err := ioutil.ReadAll(os.Stdin)
 		if err != nil {
 			fmt.Fprintf(os.Stderr, "Can't read the program from stdin: %v", err)
@@ -89,45 +189,679 @@ func main() {
 			MemSize: 100 << 20,
 		})
 		vm.Debug = DebugRegs | DebugMem | DebugInstr
+		if err := attachDevices(vm); err != nil {
+			fmt.Fprintf(os.Stderr, "Can't attach devices: %v", err)
+			os.Exit(1)
+		}
+		s, err := attachFramebuffer(vm)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Can't attach the framebuffer: %v", err)
+			os.Exit(1)
+		}
+		if err := writeDeviceTree(vm, DTConfig{Bootargs: *bootargs}); err != nil {
+			fmt.Fprintf(os.Stderr, "Can't write the device tree: %v", err)
+			os.Exit(1)
+		}
 		copy(vm.Mem[start:start+len(b)], b)
 		for i := 0; i < *maxSteps; i++ {
 			if vm.PC >= uint64(start+len(b)) {
 				break
 			}
-			if err := vm.Run(1); err != nil && !IsExit(err) {
+			err = vm.Run(1)
+			if err != nil && !IsExit(err) {
 				fmt.Fprintf(os.Stderr, "Can't execute %s: %v", prog, err)
 				os.Exit(1)
 			}
 			fmt.Println(vm)
+			if err := s.step(vm); err != nil {
+				fmt.Fprintf(os.Stderr, "Can't save the framebuffer: %v", err)
+				os.Exit(1)
+			}
+			if err != nil {
+				break
+			}
+		}
+		reportMisaligned(vm)
+		if err := s.exit(); err != nil {
+			fmt.Fprintf(os.Stderr, "Can't save the framebuffer: %v", err)
+			os.Exit(1)
 		}
+		exitWithStatus(err)
 		return
 	}
 
-	f, err := elf.Open(prog)
+	var f *elf.File
+	var entry uint64
+	if prog != "" {
+		var err error
+		f, err = elf.Open(prog)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Can't read program: %v", err)
+			os.Exit(1)
+		}
+		defer f.Close()
+		entry = f.Entry
+	} else {
+		prog = loads[0]
+	}
+
+	var vm *VM
+	var mc *MachineConfig
+	switch {
+	case *machine != "":
+		var err error
+		vm, mc, err = loadMachine(*machine)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Can't build the machine: %v", err)
+			os.Exit(1)
+		}
+	case f != nil:
+		vm = NewVM(&Prog{
+			Argv:    append([]string{prog}, argv...),
+			Env:     env,
+			MemSize: 100 << 20,
+		})
+	default:
+		vm = NewVM(&Prog{MemSize: 100 << 20})
+	}
+	if *machine == "" && *numHarts > 1 {
+		NewHarts(vm, *numHarts)
+	}
+	for _, h := range vm.Harts() {
+		h.Debug = DebugRegs | DebugInstr
+	}
+	if err := attachDevices(vm); err != nil {
+		fmt.Fprintf(os.Stderr, "Can't attach devices: %v", err)
+		os.Exit(1)
+	}
+	shots, err := attachFramebuffer(vm)
 	if err != nil {
-		fmt.Fprintf(os.Stderr, "Can't read program: %v", err)
+		fmt.Fprintf(os.Stderr, "Can't attach the framebuffer: %v", err)
 		os.Exit(1)
 	}
-	defer f.Close()
-
-	vm := NewVM(&Prog{
-		Argv:    append([]string{prog}, argv...),
-		Env:     env,
-		Start:   f.Entry,
-		MemSize: 100 << 20,
-	})
-	vm.Debug = DebugRegs | DebugInstr
-	for _, s := range f.Sections {
-		if s.Flags&elf.SHF_ALLOC == 0 {
-			continue
-		}
-		if _, err := s.ReadAt(vm.Mem[s.Addr:s.Addr+s.Size], 0); err != nil {
-			fmt.Fprintf(os.Stderr, "Can't load section %s (addr %d): %v", s.Name, s.Addr, err)
-			os.Exit(1)
+	syms := map[string]uint64{}
+	if f != nil {
+		for _, s := range f.Sections {
+			if s.Flags&elf.SHF_ALLOC == 0 {
+				continue
+			}
+			if s.Type == elf.SHT_NOBITS {
+				continue // already zeroed
+			}
+			b, err := vm.memSlice(s.Addr, s.Size)
+			if err != nil {
+				fmt.Fprintf(os.Stderr, "Can't load section %s: %v", s.Name, err)
+				os.Exit(1)
+			}
+			if _, err := s.ReadAt(b, 0); err != nil {
+				fmt.Fprintf(os.Stderr, "Can't load section %s (addr %d): %v", s.Name, s.Addr, err)
+				os.Exit(1)
+			}
+		}
+		syms = elfSymbols(f, func(v uint64) uint64 { return v })
+	}
+	dt, imgEntry, err := loadImages(vm, syms)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Can't load images: %v", err)
+		os.Exit(1)
+	}
+	if f == nil {
+		entry = imgEntry
+	}
+	if mc == nil || mc.ResetVector == nil {
+		for _, h := range vm.Harts() {
+			h.PC = entry
 		}
 	}
-	if err := vm.Run(*maxSteps); err != nil && !IsExit(err) {
+	if err := writeDeviceTree(vm, dt); err != nil {
+		fmt.Fprintf(os.Stderr, "Can't write the device tree: %v", err)
+		os.Exit(1)
+	}
+	if err := attachHTIF(vm, syms); err != nil {
+		fmt.Fprintf(os.Stderr, "Can't attach HTIF: %v", err)
+		os.Exit(1)
+	}
+	err = shots.run(NewScheduler(vm, *quantum, *parallel), *maxSteps)
+	reportMisaligned(vm)
+	if err := shots.exit(); err != nil {
+		fmt.Fprintf(os.Stderr, "Can't save the framebuffer: %v", err)
+		os.Exit(1)
+	}
+	if err != nil && !IsExit(err) {
 		fmt.Fprintf(os.Stderr, "Can't execute %s: %v", prog, err)
 		os.Exit(1)
 	}
+	exitWithStatus(err)
+}
+
+// loadMachine returns a VM built from the built-in machine profile with the
+// given name or the machine description in the file at path, and the
+// description.
+func loadMachine(path string) (*VM, *MachineConfig, error) {
+	c, ok := MachineProfile(path)
+	if !ok {
+		r, err := os.Open(path)
+		if err != nil {
+			return nil, nil, err
+		}
+		defer r.Close()
+		c, err = ReadMachineConfig(r)
+		if err != nil {
+			return nil, nil, err
+		}
+	}
+	if *numHarts > 0 {
+		c.Harts = *numHarts
+	}
+	vm, err := c.NewVM(os.Stdout)
+	if err != nil {
+		return nil, nil, err
+	}
+	return vm, c, nil
+}
+
+// loadImages loads the files requested with --load and --initrd and adds the
+// symbols of ELF files to syms. It returns the device tree configuration and
+// the entry point: that of the first ELF file, or the start of the first file
+// if none is an ELF file.
+func loadImages(vm *VM, syms map[string]uint64) (DTConfig, uint64, error) {
+	dt := DTConfig{Bootargs: *bootargs}
+	var entry uint64
+	haveEntry, elfEntry := false, false
+	for _, s := range loads {
+		l, err := ParseLoadSpec(s)
+		if err != nil {
+			return dt, 0, err
+		}
+		img, err := vm.Load(l)
+		if err != nil {
+			return dt, 0, err
+		}
+		if !haveEntry || img.ELF && !elfEntry {
+			entry, haveEntry, elfEntry = img.Entry, true, img.ELF
+		}
+		mergeSymbols(syms, img.Symbols)
+	}
+	if *initrd != "" {
+		l, err := ParseLoadSpec(*initrd)
+		if err != nil {
+			return dt, 0, err
+		}
+		if !l.HasAddr {
+			return dt, 0, fmt.Errorf("the address of the initrd is required")
+		}
+		img, err := vm.Load(LoadSpec{Path: l.Path, Addr: l.Addr, HasAddr: true})
+		if err != nil {
+			return dt, 0, err
+		}
+		if img.ELF {
+			return dt, 0, fmt.Errorf("the initrd %s is an ELF file", l.Path)
+		}
+		dt.InitrdStart, dt.InitrdEnd = img.Start, img.End
+	}
+	return dt, entry, nil
+}
+
+// attachHTIF maps Spike's Host-Target Interface at the tohost and fromhost
+// symbols of the loaded ELF files, if they define them.
+func attachHTIF(vm *VM, syms map[string]uint64) error {
+	tohost, fromhost, ok := HTIFSymbols(syms)
+	if !ok {
+		return nil
+	}
+	h := NewHTIF(vm, os.Stdin, os.Stdout)
+	if err := vm.Bus.Map(tohost, HTIFRegSize, h.ToHost()); err != nil {
+		return err
+	}
+	if fromhost == 0 {
+		return nil
+	}
+	return vm.Bus.Map(fromhost, HTIFRegSize, h.FromHost())
+}
+
+// writeDeviceTree writes the device tree of the machine to the file requested
+// with --dump_dtb. When files are loaded with --load or --dtb is set, it also
+// places the device tree in memory and sets the registers of the harts: a0 to
+// the hart ID and a1 to the address of the device tree.
+func writeDeviceTree(vm *VM, c DTConfig) error {
+	dtb := BuildDeviceTree(vm.Harts(), c)
+	if *dumpDTB != "" {
+		if err := ioutil.WriteFile(*dumpDTB, dtb, 0644); err != nil {
+			return err
+		}
+	}
+	if len(loads) == 0 && *dtbAddr == "" {
+		return nil
+	}
+	var addr uint64
+	switch l, err := ParseLoadSpec(*dtbAddr); {
+	case *dtbAddr == "":
+		addr, err = defaultDTBAddr(vm, uint64(len(dtb)))
+		if err != nil {
+			return err
+		}
+	case err != nil:
+		return err
+	case l.HasAddr:
+		// A device tree from a file replaces the generated one.
+		img, err := vm.Load(l)
+		if err != nil {
+			return err
+		}
+		addr, dtb = img.Start, nil
+	default:
+		addr, err = strconv.ParseUint(l.Path, 0, 64)
+		if err != nil {
+			return fmt.Errorf("invalid device tree address %q: %v", *dtbAddr, err)
+		}
+	}
+	if dtb != nil {
+		m, err := vm.memSlice(addr, uint64(len(dtb)))
+		if err != nil {
+			return fmt.Errorf("can't place the device tree: %v", err)
+		}
+		copy(m, dtb)
+	}
+	for i, h := range vm.Harts() {
+		h.Reg[regNums["a0"]] = uint64(i) // the hart ID
+		h.Reg[regNums["a1"]] = addr
+	}
+	return nil
+}
+
+// exitWithStatus exits with the status code of the program if it ended with
+// one.
+func exitWithStatus(err error) {
+	e, ok := err.(*ExitError)
+	if !ok {
+		return
+	}
+	if e.Reset {
+		fmt.Fprintf(os.Stderr, "%v; resets aren't supported\n", e)
+	}
+	os.Exit(e.Code)
+}
+
+// screenshots saves the content of the framebuffer to PNG files.
+type screenshots struct {
+	fb    *Framebuffer // nil if there's no framebuffer
+	path  string       // empty if screenshots are disabled
+	every int          // 0 means only at exit
+	next  int          // step count of the next periodic screenshot
+}
+
+// attachFramebuffer maps the framebuffer requested with command-line flags to
+// the VM's bus.
+func attachFramebuffer(vm *VM) (*screenshots, error) {
+	s := &screenshots{path: *fbPNG, every: *fbEvery, next: *fbEvery}
+	if *fb == "" {
+		return s, nil
+	}
+	addr, err := strconv.ParseUint(*fb, 0, 64)
+	if err != nil {
+		return nil, fmt.Errorf("invalid framebuffer address %q: %v", *fb, err)
+	}
+	var w, h int
+	if _, err := fmt.Sscanf(*fbMode, "%dx%d", &w, &h); err != nil {
+		return nil, fmt.Errorf("invalid framebuffer resolution %q: %v", *fbMode, err)
+	}
+	if s.fb, err = NewFramebuffer(w, h, *fbFormat); err != nil {
+		return nil, err
+	}
+	return s, vm.Bus.Map(addr, s.fb.Size(), s.fb)
+}
+
+// run executes at most n steps on every hart, stopping every s.every steps to
+// save the framebuffer.
+func (s *screenshots) run(sched *Scheduler, n int) error {
+	if s.fb == nil || s.path == "" || s.every <= 0 {
+		return sched.Run(n)
+	}
+	for n > 0 {
+		chunk := s.every
+		if chunk > n {
+			chunk = n
+		}
+		n -= chunk
+		err := sched.Run(chunk)
+		if err := s.step(sched.Harts[0]); err != nil {
+			return err
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// step saves the framebuffer if a periodic screenshot is due.
+func (s *screenshots) step(vm *VM) error {
+	if s.fb == nil || s.path == "" || s.every <= 0 || vm.Steps < s.next {
+		return nil
+	}
+	for s.next <= vm.Steps {
+		s.next += s.every
+	}
+	ext := filepath.Ext(s.path)
+	return s.save(fmt.Sprintf("%s-%d%s", strings.TrimSuffix(s.path, ext), vm.Steps, ext))
+}
+
+// exit saves the framebuffer when the program exits.
+func (s *screenshots) exit() error {
+	if s.fb == nil || s.path == "" {
+		return nil
+	}
+	return s.save(s.path)
+}
+
+func (s *screenshots) save(path string) error {
+	f, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+	if err := s.fb.WritePNG(f); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+// openNet returns the virtio network card configured with flags.
+func openNet() (*VirtioNet, error) {
+	mac, err := net.ParseMAC(*netMAC)
+	if err != nil {
+		return nil, err
+	}
+	var b NetBackend
+	switch kind, arg := splitFlag(*netDev); kind {
+	case "unix":
+		paths := strings.SplitN(arg, ":", 2)
+		if len(paths) != 2 {
+			return nil, fmt.Errorf("invalid network backend %q: want unix:LOCAL:PEER", *netDev)
+		}
+		if b, err = NewUnixNet(paths[0], paths[1]); err != nil {
+			return nil, err
+		}
+	case "pcap":
+		f, err := os.Open(arg)
+		if err != nil {
+			return nil, err
+		}
+		if b, err = NewPcapReplay(f); err != nil {
+			return nil, err
+		}
+	default:
+		return nil, fmt.Errorf("unsupported network backend %q", *netDev)
+	}
+	var capture *PcapWriter
+	if *netCapture != "" {
+		f, err := os.Create(*netCapture)
+		if err != nil {
+			return nil, err
+		}
+		if capture, err = NewPcapWriter(f); err != nil {
+			return nil, err
+		}
+	}
+	return NewVirtioNet(mac, b, capture), nil
+}
+
+// splitFlag splits "kind:arg" flag values.
+func splitFlag(s string) (kind, arg string) {
+	if i := strings.Index(s, ":"); i >= 0 {
+		return s[:i], s[i+1:]
+	}
+	return s, ""
+}
+
+// openConsolePort returns a virtio console port described by "name=path".
+func openConsolePort(spec string) (*ConsolePort, error) {
+	i := strings.Index(spec, "=")
+	if i <= 0 {
+		return nil, fmt.Errorf("invalid console port %q: want name=path", spec)
+	}
+	name, path := spec[:i], spec[i+1:]
+	fi, err := os.Stat(path)
+	if err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+	if err == nil && fi.Mode()&(os.ModeNamedPipe|os.ModeCharDevice) != 0 {
+		f, err := os.OpenFile(path, os.O_RDWR, 0)
+		if err != nil {
+			return nil, err
+		}
+		return &ConsolePort{Name: name, In: f, Out: f}, nil
+	}
+	f, err := os.Create(path)
+	if err != nil {
+		return nil, err
+	}
+	return &ConsolePort{Name: name, Out: f}, nil
+}
+
+// reportMisaligned prints warnings about misaligned accesses recorded under the
+// "warn" policy.
+func reportMisaligned(vm *VM) {
+	for _, h := range vm.Harts() {
+		for _, a := range h.MisalignedAccesses {
+			fmt.Fprintf(os.Stderr, "Warning: %v\n", a)
+		}
+	}
+}
+
+// attachDevices maps devices requested with command-line flags to the VM's bus
+// and connects them to all harts.
+func attachDevices(vm *VM) error {
+	policy, err := ParseMisalignedPolicy(*misaligned)
+	if err != nil {
+		return err
+	}
+	harts := vm.Harts()
+	for _, h := range harts {
+		h.Misaligned = policy
+	}
+	if vm.Bus == nil {
+		vm.Bus = &Bus{}
+	}
+	// irq returns the interrupt line of the given source of the interrupt
+	// controller, if there's one. Devices of the machine description may
+	// include a PLIC.
+	irq := func(src int) InterruptLine { return nil }
+	var machineUART *UART
+	for _, r := range vm.Bus.regions {
+		switch d := r.dev.(type) {
+		case *PLIC:
+			irq = d.Line
+		case *UART:
+			if machineUART == nil {
+				machineUART = d
+			}
+		}
+	}
+	if *clint != "" {
+		addr, err := strconv.ParseUint(*clint, 0, 64)
+		if err != nil {
+			return fmt.Errorf("invalid CLINT address %q: %v", *clint, err)
+		}
+		if err := vm.Bus.Map(addr, CLINTSize, NewCLINT(harts...)); err != nil {
+			return err
+		}
+	}
+	if *plic != "" {
+		addr, err := strconv.ParseUint(*plic, 0, 64)
+		if err != nil {
+			return fmt.Errorf("invalid PLIC address %q: %v", *plic, err)
+		}
+		p := NewPLIC(plicSources, harts...)
+		if err := vm.Bus.Map(addr, PLICSize, p); err != nil {
+			return err
+		}
+		irq = p.Line
+	}
+	switch *aia {
+	case "":
+	case "aplic", "aplic-imsic":
+		if *aia == "aplic-imsic" {
+			// The interrupt files of the harts follow each other.
+			for i, h := range harts {
+				im := NewIMSIC(h, imsicIDs)
+				offset := uint64(i) * IMSICFileSize
+				if err := vm.Bus.Map(imsicMAddr+offset, IMSICFileSize, im.M); err != nil {
+					return err
+				}
+				if err := vm.Bus.Map(imsicSAddr+offset, IMSICFileSize, im.S); err != nil {
+					return err
+				}
+			}
+		}
+		m, s := NewAPLIC(aplicSources, false, harts...), NewAPLIC(aplicSources, true, harts...)
+		m.AddChild(s)
+		if err := vm.Bus.Map(aplicMAddr, APLICSize, m); err != nil {
+			return err
+		}
+		if err := vm.Bus.Map(aplicSAddr, APLICSize, s); err != nil {
+			return err
+		}
+		irq = m.Line
+	default:
+		return fmt.Errorf("unsupported AIA configuration %q", *aia)
+	}
+	// addVirtio maps the device to the next free virtio-mmio slot.
+	// Slots taken by devices of the machine description are skipped.
+	slot := 0
+	addVirtio := func(dev VirtioDevice) error {
+		for slot < virtioSlots && vm.Bus.find(uint64(virtioAddr+virtioStride*slot)) != nil {
+			slot++
+		}
+		if slot == virtioSlots {
+			return fmt.Errorf("too many virtio devices; the limit is %d", virtioSlots)
+		}
+		t := NewVirtioMMIO(vm, dev, irq(virtioIRQ+slot))
+		addr := uint64(virtioAddr + virtioStride*slot)
+		slot++
+		return vm.Bus.Map(addr, VirtioMMIOSize, t)
+	}
+	if *virtioBlk != "" {
+		b, err := OpenVirtioBlk(*virtioBlk, *blkRO)
+		if err != nil {
+			return fmt.Errorf("can't open the disk image: %v", err)
+		}
+		if err := addVirtio(b); err != nil {
+			return err
+		}
+	}
+	if *console || *ports != "" {
+		p := []*ConsolePort{{In: os.Stdin, Out: os.Stdout}}
+		for _, spec := range strings.Split(*ports, ",") {
+			if spec == "" {
+				continue
+			}
+			port, err := openConsolePort(spec)
+			if err != nil {
+				return err
+			}
+			p = append(p, port)
+		}
+		if err := addVirtio(NewVirtioConsole(p...)); err != nil {
+			return err
+		}
+	}
+	if *netDev != "" {
+		n, err := openNet()
+		if err != nil {
+			return err
+		}
+		if err := addVirtio(n); err != nil {
+			return err
+		}
+	}
+	if *share != "" {
+		if fi, err := os.Stat(*share); err != nil || !fi.IsDir() {
+			return fmt.Errorf("can't share %q: not a directory", *share)
+		}
+		if err := addVirtio(NewVirtio9P("host", NewP9Server(*share, *shareRO))); err != nil {
+			return err
+		}
+	}
+	if *rng || *rngSeed != "" {
+		src := crand.Reader
+		if *rngSeed != "" {
+			seed, err := strconv.ParseInt(*rngSeed, 0, 64)
+			if err != nil {
+				return fmt.Errorf("invalid virtio-rng seed %q: %v", *rngSeed, err)
+			}
+			src = NewSeededRNG(seed)
+		}
+		if err := addVirtio(NewVirtioRNG(src)); err != nil {
+			return err
+		}
+	}
+	if *rtc != "" {
+		addr, err := strconv.ParseUint(*rtc, 0, 64)
+		if err != nil {
+			return fmt.Errorf("invalid RTC address %q: %v", *rtc, err)
+		}
+		if err := vm.Bus.Map(addr, GoldfishRTCSize, NewGoldfishRTC(nil, irq(rtcIRQ))); err != nil {
+			return err
+		}
+	}
+	if *finisher != "" {
+		addr, err := strconv.ParseUint(*finisher, 0, 64)
+		if err != nil {
+			return fmt.Errorf("invalid test finisher address %q: %v", *finisher, err)
+		}
+		if err := vm.Bus.Map(addr, TestFinisherSize, TestFinisher{}); err != nil {
+			return err
+		}
+	}
+	u := machineUART
+	if *uart != "" {
+		addr, err := strconv.ParseUint(*uart, 0, 64)
+		if err != nil {
+			return fmt.Errorf("invalid UART address %q: %v", *uart, err)
+		}
+		u = NewUART(os.Stdout, irq(uartIRQ))
+		if err := vm.Bus.Map(addr, UARTSize, u); err != nil {
+			return err
+		}
+	}
+	// The input goes to the UART of the machine description if --uart
+	// isn't set.
+	switch {
+	case *uartInput == "":
+	case u == nil:
+		return fmt.Errorf("--uart_input needs a machine with a UART")
+	case *uartInput == "-":
+		u.Input(os.Stdin)
+	default:
+		f, err := os.Open(*uartInput)
+		if err != nil {
+			return fmt.Errorf("can't open UART input: %v", err)
+		}
+		u.Input(f)
+	}
+	if *sbi && vm.SBI == nil {
+		// The supervisor starts with a0 set to the hart ID.
+		NewSBI(os.Stdin, os.Stdout, harts...)
+		for i, h := range harts {
+			h.Priv = PrivS
+			h.Reg[regNums["a0"]] = uint64(i)
+		}
+	}
+	if *semihost != "" {
+		root := *semihost
+		if root == "-" {
+			root = ""
+		}
+		// SYS_GET_CMDLINE returns the program and its arguments.
+		cmdline := os.ExpandEnv(*prog)
+		if *argv != "" {
+			cmdline += " " + strings.Replace(*argv, ",", " ", -1)
+		}
+		sh := NewSemihosting(root, cmdline, os.Stdin, os.Stdout, os.Stderr)
+		for _, h := range harts {
+			h.Semihosting = sh
+		}
+	}
+	return nil
 }
@@ -0,0 +1,168 @@
+// Copyright 2019 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"fmt"
+	"strings"
+)
+
+// Perms is a set of access permissions of a memory region.
+type Perms uint8
+
+const (
+	PermRead  = Perms(1 << iota) // Loads are allowed.
+	PermWrite                    // Stores are allowed.
+	PermExec                     // Instruction fetches are allowed.
+)
+
+// ParsePerms parses permissions written as a subset of "rwx", e.g. "rx".
+func ParsePerms(s string) (Perms, error) {
+	var p Perms
+	for _, c := range s {
+		switch c {
+		case 'r':
+			p |= PermRead
+		case 'w':
+			p |= PermWrite
+		case 'x':
+			p |= PermExec
+		default:
+			return 0, fmt.Errorf("invalid permissions %q: want a subset of \"rwx\"", s)
+		}
+	}
+	return p, nil
+}
+
+func (p Perms) String() string {
+	var b strings.Builder
+	for i, c := range "rwx" {
+		if p&(1<<uint(i)) != 0 {
+			b.WriteRune(c)
+		} else {
+			b.WriteByte('-')
+		}
+	}
+	return b.String()
+}
+
+// MemoryRegion is RAM, ROM or flash mapped on the bus in addition to the
+// VM's main memory. Loads, stores and instruction fetches that the
+// permissions don't allow raise access-fault exceptions. Devices (DMA) and
+// the program loader aren't restricted by the permissions. It implements the
+// Device interface.
+type MemoryRegion struct {
+	Name  string
+	Perms Perms
+	Data  []byte
+}
+
+// NewMemoryRegion returns a zeroed memory region of the given size.
+func NewMemoryRegion(name string, size uint64, perms Perms) *MemoryRegion {
+	return &MemoryRegion{Name: name, Perms: perms, Data: make([]byte, size)}
+}
+
+// Load implements the Device interface.
+func (m *MemoryRegion) Load(offset uint64, size int) (uint64, error) {
+	if m.Perms&PermRead == 0 {
+		return 0, accessFaultErr
+	}
+	var v uint64
+	for i := 0; i < size; i++ {
+		v |= uint64(m.Data[offset+uint64(i)]) << (8 * uint(i))
+	}
+	return v, nil
+}
+
+// Store implements the Device interface.
+func (m *MemoryRegion) Store(offset uint64, size int, v uint64) error {
+	if m.Perms&PermWrite == 0 {
+		return accessFaultErr
+	}
+	for i := 0; i < size; i++ {
+		m.Data[offset+uint64(i)] = byte(v >> (8 * uint(i)))
+	}
+	return nil
+}
+
+// memSlice returns the n bytes of memory at the physical address addr, either
+// in the main memory or in a memory region. The bytes can't span multiple
+// regions. Like in read and write, devices hide the main memory at their
+// addresses.
+func (vm *VM) memSlice(addr, n uint64) ([]byte, error) {
+	if r := vm.Bus.find(addr); r != nil {
+		if m, ok := r.dev.(*MemoryRegion); ok && addr-r.base+n <= uint64(len(m.Data)) && addr-r.base+n >= addr-r.base {
+			return m.Data[addr-r.base : addr-r.base+n], nil
+		}
+	} else if addr+n <= uint64(len(vm.Mem)) && addr+n >= addr {
+		return vm.Mem[addr : addr+n], nil
+	}
+	return nil, fmt.Errorf("can't access %d bytes at %#x: %v", n, addr, invalidAddrErr)
+}
+
+// memSize returns the total size of the main memory and the memory regions.
+// Buffers passed by the guest can't be larger.
+func (vm *VM) memSize() uint64 {
+	n := uint64(len(vm.Mem))
+	if vm.Bus != nil {
+		for _, r := range vm.Bus.regions {
+			if m, ok := r.dev.(*MemoryRegion); ok {
+				n += uint64(len(m.Data))
+			}
+		}
+	}
+	return n
+}
+
+// fetchPhys returns up to 4 bytes of the instruction at the physical address
+// pc. Instructions of size 2 and 4 are supported. Fetches from unmapped
+// addresses, from devices other than memory regions and from non-executable
+// regions raise instruction access-fault exceptions. Devices hide the main
+// memory at their addresses.
+func (vm *VM) fetchPhys(pc uint64) ([]byte, error) {
+	if r := vm.Bus.find(pc); r != nil {
+		if m, ok := r.dev.(*MemoryRegion); ok && m.Perms&PermExec != 0 {
+			return vm.fetchBytes(m.Data, pc-r.base), nil
+		}
+	} else if pc < uint64(len(vm.Mem)) {
+		return vm.fetchBytes(vm.Mem, pc), nil
+	}
+	return nil, &exception{cause: causeInstrAccessFault, tval: pc}
+}
+
+// fetchBytes returns up to 4 bytes at b[off:]. In parallel mode, other harts
+// may store to them, so they're copied one 16-bit parcel at a time with atomic
+// loads.
+func (vm *VM) fetchBytes(b []byte, off uint64) []byte {
+	end := off + 4
+	if end > uint64(len(b)) {
+		end = uint64(len(b))
+	}
+	if vm.world == nil {
+		return b[off:end]
+	}
+	c := make([]byte, end-off)
+	for i := 0; i < len(c); i += 2 {
+		n := len(c) - i
+		if n > 2 {
+			n = 2
+		}
+		v := loadShared(b, off+uint64(i), n)
+		for j := 0; j < n; j++ {
+			c[i+j] = byte(v >> (8 * uint(j)))
+		}
+	}
+	return c
+}
@@ -0,0 +1,88 @@
+// Copyright 2019 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import "fmt"
+
+// MisalignedPolicy determines how the VM handles misaligned loads, stores and
+// jump targets.
+type MisalignedPolicy int
+
+const (
+	// MisalignedEmulate performs misaligned accesses as if they were
+	// aligned. This is the default.
+	MisalignedEmulate MisalignedPolicy = iota
+	// MisalignedTrap raises address-misaligned exceptions.
+	MisalignedTrap
+	// MisalignedWarn performs misaligned accesses and records them in
+	// VM.MisalignedAccesses.
+	MisalignedWarn
+)
+
+// ParseMisalignedPolicy returns the policy named "emulate", "trap" or "warn".
+func ParseMisalignedPolicy(s string) (MisalignedPolicy, error) {
+	switch s {
+	case "emulate":
+		return MisalignedEmulate, nil
+	case "trap":
+		return MisalignedTrap, nil
+	case "warn":
+		return MisalignedWarn, nil
+	}
+	return 0, fmt.Errorf("unknown misaligned access policy %q", s)
+}
+
+// MisalignedAccess describes a misaligned access performed under the
+// MisalignedWarn policy.
+type MisalignedAccess struct {
+	PC   uint64 // address of the instruction
+	Addr uint64 // accessed address or jump target
+	Size int    // size of the access in bytes
+	Kind string // "load", "store" or "jump"
+}
+
+func (a MisalignedAccess) String() string {
+	return fmt.Sprintf("misaligned %d-byte %s at %#x (pc %#x)", a.Size, a.Kind, a.Addr, a.PC)
+}
+
+// checkAligned applies the VM's misaligned access policy to an access of size
+// bytes at addr. It returns an exception with the given cause if the access
+// must trap.
+func (vm *VM) checkAligned(addr uint64, size int, kind string, cause uint64) error {
+	if addr&uint64(size-1) == 0 {
+		return nil
+	}
+	switch vm.Misaligned {
+	case MisalignedTrap:
+		return &exception{cause: cause, tval: addr}
+	case MisalignedWarn:
+		vm.MisalignedAccesses = append(vm.MisalignedAccesses, MisalignedAccess{PC: vm.PC, Addr: addr, Size: size, Kind: kind})
+	}
+	return nil
+}
+
+// jump sets PC to the target of a jump or a taken branch. Without the C
+// extension targets must be aligned to 4 bytes.
+//
+// riscv-spec-v2.2; Chapter 2.5; Page 15
+func (vm *VM) jump(target uint64) error {
+	if vm.CSR[csrMisa]&misaC == 0 {
+		if err := vm.checkAligned(target, 4, "jump", causeInstrMisaligned); err != nil {
+			return err
+		}
+	}
+	vm.PC = target
+	return nil
+}
@@ -0,0 +1,121 @@
+// Copyright 2019 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestMisalignedLoadStore(t *testing.T) {
+	const (
+		lwX3X1 = 0x0000a183 // lw x3, 0(x1)
+		addr   = 0x62
+	)
+	for _, tt := range []struct {
+		policy    MisalignedPolicy
+		in        uint64
+		wantPC    uint64
+		wantCause uint64
+		wantMem   uint64
+		wantReg3  uint64
+		wantLog   []MisalignedAccess
+	}{
+		{policy: MisalignedEmulate, in: swX2X1, wantPC: 0x4, wantMem: 0x12345678},
+		{policy: MisalignedEmulate, in: lwX3X1, wantPC: 0x4, wantReg3: 0xabcd},
+		{policy: MisalignedTrap, in: swX2X1, wantPC: trapHandler, wantCause: causeStoreMisaligned, wantMem: 0xabcd},
+		{policy: MisalignedTrap, in: lwX3X1, wantPC: trapHandler, wantCause: causeLoadMisaligned},
+		{
+			policy: MisalignedWarn, in: swX2X1, wantPC: 0x4, wantMem: 0x12345678,
+			wantLog: []MisalignedAccess{{PC: 0, Addr: addr, Size: 4, Kind: "store"}},
+		},
+		{
+			policy: MisalignedWarn, in: lwX3X1, wantPC: 0x4, wantMem: 0xabcd, wantReg3: 0xabcd,
+			wantLog: []MisalignedAccess{{PC: 0, Addr: addr, Size: 4, Kind: "load"}},
+		},
+	} {
+		vm := newTrapVM(t)
+		vm.Misaligned = tt.policy
+		copy(vm.Mem, asBytes(tt.in))
+		copy(vm.Mem[addr:], []byte{0xcd, 0xab, 0, 0})
+		vm.Reg[1], vm.Reg[2] = addr, 0x12345678
+		if err := vm.Run(1); err != nil {
+			t.Fatalf("policy %d, instruction %#x: Run failed: %v", tt.policy, tt.in, err)
+		}
+		if vm.PC != tt.wantPC {
+			t.Errorf("policy %d, instruction %#x: PC = %#x; want %#x", tt.policy, tt.in, vm.PC, tt.wantPC)
+		}
+		if tt.wantPC == trapHandler {
+			if got := vm.CSR[csrMcause]; got != tt.wantCause {
+				t.Errorf("policy %d, instruction %#x: mcause = %d; want %d", tt.policy, tt.in, got, tt.wantCause)
+			}
+			if got := vm.CSR[csrMtval]; got != addr {
+				t.Errorf("policy %d, instruction %#x: mtval = %#x; want %#x", tt.policy, tt.in, got, addr)
+			}
+		}
+		if tt.wantMem != 0 {
+			if got := vm.Memory(addr) & 0xffffffff; got != tt.wantMem {
+				t.Errorf("policy %d, instruction %#x: memory = %#x; want %#x", tt.policy, tt.in, got, tt.wantMem)
+			}
+		}
+		if vm.Reg[3] != tt.wantReg3 {
+			t.Errorf("policy %d, instruction %#x: x3 = %#x; want %#x", tt.policy, tt.in, vm.Reg[3], tt.wantReg3)
+		}
+		if !reflect.DeepEqual(vm.MisalignedAccesses, tt.wantLog) {
+			t.Errorf("policy %d, instruction %#x: MisalignedAccesses = %v; want %v", tt.policy, tt.in, vm.MisalignedAccesses, tt.wantLog)
+		}
+	}
+}
+
+func TestMisalignedJump(t *testing.T) {
+	const jalRA6 = 0x006000ef // jal ra, 6
+	for _, tt := range []struct {
+		noC    bool
+		policy MisalignedPolicy
+		wantPC uint64
+		wantRA uint64
+	}{
+		{noC: false, policy: MisalignedTrap, wantPC: 0x6, wantRA: 0x4},
+		{noC: true, policy: MisalignedEmulate, wantPC: 0x6, wantRA: 0x4},
+		{noC: true, policy: MisalignedWarn, wantPC: 0x6, wantRA: 0x4},
+		{noC: true, policy: MisalignedTrap, wantPC: trapHandler},
+	} {
+		vm := newTrapVM(t)
+		vm.Misaligned = tt.policy
+		copy(vm.Mem, asBytes(jalRA6))
+		if tt.noC {
+			if err := vm.writeCSR(csrMisa, 0); err != nil {
+				t.Fatalf("Can't disable C: %v", err)
+			}
+		}
+		if err := vm.Run(1); err != nil {
+			t.Fatalf("C disabled %v, policy %d: Run failed: %v", tt.noC, tt.policy, err)
+		}
+		if vm.PC != tt.wantPC {
+			t.Errorf("C disabled %v, policy %d: PC = %#x; want %#x", tt.noC, tt.policy, vm.PC, tt.wantPC)
+		}
+		if got := vm.Reg[RA]; got != tt.wantRA {
+			t.Errorf("C disabled %v, policy %d: ra = %#x; want %#x", tt.noC, tt.policy, got, tt.wantRA)
+		}
+		if tt.wantPC == trapHandler {
+			if got := vm.CSR[csrMcause]; got != causeInstrMisaligned {
+				t.Errorf("C disabled %v, policy %d: mcause = %d; want %d", tt.noC, tt.policy, got, causeInstrMisaligned)
+			}
+			if got := vm.CSR[csrMtval]; got != 0x6 {
+				t.Errorf("C disabled %v, policy %d: mtval = %#x; want 0x6", tt.noC, tt.policy, got)
+			}
+		}
+	}
+}
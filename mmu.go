@@ -0,0 +1,399 @@
+// Copyright 2019 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+// This file implements Sv39 virtual memory. See riscv-privileged-v1.10;
+// Chapter 4.3 and 4.4. In VS-mode and VU-mode, translations are followed by
+// the G-stage translations of hyp.go.
+
+// Page fault exception codes.
+//
+// riscv-privileged-v1.10; Table 3.6; Page 35
+const (
+	causeInstrPageFault = 12
+	causeLoadPageFault  = 13
+	causeStorePageFault = 15
+)
+
+// Fields of the satp CSR. Only the Bare and Sv39 modes are supported, and
+// there are no ASID bits.
+//
+// riscv-privileged-v1.10; Figure 4.12; Page 58
+const (
+	satpModeShift = 60
+	satpModeBare  = 0
+	satpModeSv39  = 8
+	satpPPN       = 1<<44 - 1
+)
+
+// Bits of page table entries.
+//
+// riscv-privileged-v1.10; Figure 4.18; Page 63
+const (
+	pteV = 1 << 0
+	pteR = 1 << 1
+	pteW = 1 << 2
+	pteX = 1 << 3
+	pteU = 1 << 4
+	pteA = 1 << 6
+	pteD = 1 << 7
+
+	ptePPNShift = 10
+	ptePPN      = 1<<44 - 1 // after shifting by ptePPNShift
+)
+
+const (
+	pageShift = 12
+	pageSize  = 1 << pageShift
+	sv39      = 3 // levels of page tables
+)
+
+// mstatusMPRV makes loads and stores in M-mode use the privilege level in
+// mstatus.MPP for translation and protection.
+const mstatusMPRV = 1 << 17
+
+// accessType is the kind of memory access being translated.
+type accessType int
+
+const (
+	accessFetch accessType = iota
+	accessLoad
+	accessStore    // stores and AMOs
+	accessLoadExec // HLVX loads, which need execute permission instead of read permission
+)
+
+// pageFault returns the page-fault exception for the access type.
+func (a accessType) pageFault(va uint64) error {
+	cause := [...]uint64{causeInstrPageFault, causeLoadPageFault, causeStorePageFault, causeLoadPageFault}[a]
+	return &exception{cause: cause, tval: va}
+}
+
+// accessFault returns the access-fault exception for the access type.
+func (a accessType) accessFault(va uint64) error {
+	cause := [...]uint64{causeInstrAccessFault, causeLoadAccessFault, causeStoreAccessFault, causeLoadAccessFault}[a]
+	return &exception{cause: cause, tval: va}
+}
+
+// guestPageFault returns the guest-page-fault exception for the access type
+// at the guest virtual address va and the guest physical address gpa.
+func (a accessType) guestPageFault(va, gpa uint64) error {
+	cause := [...]uint64{causeInstrGuestPageFault, causeLoadGuestPageFault, causeStoreGuestPageFault, causeLoadGuestPageFault}[a]
+	return &exception{cause: cause, tval: va, gpa: gpa >> 2, gva: true}
+}
+
+// tlbSize is the number of entries of the direct-mapped TLB.
+const tlbSize = 256
+
+// tlbEntry caches the leaf page table entry of a 4KiB virtual page. Entries
+// of superpages are split into 4KiB pages. Entries of VS-mode and VU-mode
+// (virt) cache both translation stages.
+type tlbEntry struct {
+	valid bool
+	virt  bool
+	vpn   uint64
+	pte   uint64 // the leaf PTE with A set; D is set if it was set in memory; 0 if the VS-stage is Bare
+	gpte  uint64 // the leaf G-stage PTE, like pte; 0 if the G-stage is Bare or virt isn't set
+	gppn  uint64 // the guest physical page number if virt is set
+	ppn   uint64 // of the 4KiB page
+}
+
+// flushTLB invalidates all cached translations. It's called by SFENCE.VMA,
+// HFENCE.VVMA, HFENCE.GVMA and writes to satp, vsatp and hgatp.
+func (vm *VM) flushTLB() {
+	vm.tlb = [tlbSize]tlbEntry{}
+}
+
+// writeSatp writes the satp CSR. Writes selecting an unsupported mode have no
+// effect, which lets software probe the supported modes.
+func (vm *VM) writeSatp(v uint64) {
+	switch v >> satpModeShift {
+	case satpModeBare, satpModeSv39:
+		vm.CSR[csrSatp] = v & (0xf<<satpModeShift | satpPPN)
+		vm.flushTLB()
+	}
+}
+
+// translate returns the physical address of the virtual address va accessed
+// by the hart. Loads and stores in M-mode use the privilege level and the
+// virtualization mode in mstatus.MPP and mstatus.MPV if mstatus.MPRV is set.
+func (vm *VM) translate(va uint64, a accessType) (uint64, error) {
+	if a == accessFetch {
+		return vm.translateAs(va, a, vm.Priv, vm.Virt)
+	}
+	priv, virt := vm.dataMode()
+	return vm.translateAs(va, a, priv, virt)
+}
+
+// dataMode returns the privilege level and the virtualization mode of loads
+// and stores.
+func (vm *VM) dataMode() (priv int, virt bool) {
+	s := vm.CSR[csrMstatus]
+	if vm.Priv != PrivM || s&mstatusMPRV == 0 {
+		return vm.Priv, vm.Virt
+	}
+	priv = int(s & mstatusMPP >> mstatusShift)
+	return priv, priv != PrivM && s&mstatusMPV != 0
+}
+
+// translateAs returns the physical address of the virtual address va accessed
+// at the privilege level priv. If virt is set, the address is translated by
+// the VS-stage (vsatp) to a guest physical address, which the G-stage (hgatp)
+// translates to the physical address. Page table entries without the A bit,
+// or without the D bit for stores, are updated by the hart.
+func (vm *VM) translateAs(va uint64, a accessType, priv int, virt bool) (uint64, error) {
+	if priv == PrivM {
+		return va, nil
+	}
+	s, satp := vm.CSR[csrMstatus], vm.CSR[csrSatp]
+	if virt {
+		// mstatus.MXR applies to the VS-stage too.
+		s, satp = vm.CSR[csrVsstatus]|s&mstatusMXR, vm.CSR[csrVsatp]
+	}
+	paging := satp>>satpModeShift == satpModeSv39
+	if !paging && !virt {
+		return va, nil
+	}
+	// Bits 63-39 must be copies of bit 38.
+	if hi := va >> 38; paging && hi != 0 && hi != 1<<26-1 {
+		return 0, gvaIf(a.pageFault(va), virt)
+	}
+	vpn := va >> pageShift
+	e := &vm.tlb[vpn%tlbSize]
+	if !e.valid || e.virt != virt || e.vpn != vpn || a == accessStore && (e.pte != 0 && e.pte&pteD == 0 || e.gpte != 0 && e.gpte&pteD == 0) {
+		n := tlbEntry{valid: true, virt: virt, vpn: vpn, ppn: vpn}
+		var err error
+		if paging {
+			if n.pte, n.ppn, err = vm.walk(va, a, priv, s, virt); err != nil {
+				return 0, gvaIf(err, virt)
+			}
+		}
+		if virt {
+			n.gppn = n.ppn
+			gpa := n.gppn<<pageShift | va&(pageSize-1)
+			if n.gpte, n.ppn, err = vm.gwalk(gpa, a, a, va); err != nil {
+				return 0, err
+			}
+		}
+		*e = n
+	}
+	if e.pte != 0 && !allowed(e.pte, a, priv, s) {
+		return 0, gvaIf(a.pageFault(va), virt)
+	}
+	if e.gpte != 0 && !allowed(e.gpte, a, PrivU, vm.CSR[csrMstatus]&mstatusMXR) {
+		return 0, a.guestPageFault(va, e.gppn<<pageShift|va&(pageSize-1))
+	}
+	return e.ppn<<pageShift | va&(pageSize-1), nil
+}
+
+// gvaIf marks the exception err as reporting a guest virtual address if virt
+// is set.
+func gvaIf(err error, virt bool) error {
+	if virt {
+		return withGVA(err)
+	}
+	return err
+}
+
+// allowed reports whether the leaf PTE permits the access at the privilege
+// level given the mstatus value s.
+func allowed(pte uint64, a accessType, priv int, s uint64) bool {
+	if priv == PrivU && pte&pteU == 0 {
+		return false
+	}
+	// Supervisor code can access user pages with SUM, but never execute
+	// them.
+	if priv == PrivS && pte&pteU != 0 && (a == accessFetch || s&mstatusSUM == 0) {
+		return false
+	}
+	switch a {
+	case accessFetch, accessLoadExec:
+		return pte&pteX != 0
+	case accessLoad:
+		return pte&pteR != 0 || s&mstatusMXR != 0 && pte&pteX != 0
+	}
+	return pte&pteW != 0
+}
+
+// walk walks the page tables and returns the leaf PTE mapping va and the
+// physical page number of the 4KiB page containing va. It sets the A bit of
+// the PTE and, for stores, the D bit if the access is permitted at the
+// privilege level given the mstatus value s. In parallel mode, the update is
+// atomic with the checks of the PTE (see runParallel). If virt is set, the page tables
+// are the VS-stage tables of vsatp, and walk returns the guest physical page
+// number.
+//
+// riscv-privileged-v1.10; Chapter 4.3.2; Page 61
+func (vm *VM) walk(va uint64, a accessType, priv int, s uint64, virt bool) (pte, ppn uint64, err error) {
+	satp := vm.CSR[csrSatp]
+	if virt {
+		satp = vm.CSR[csrVsatp]
+	}
+	table := satp & satpPPN << pageShift
+	for level := sv39 - 1; level >= 0; level-- {
+		addr := table + (va>>(pageShift+9*uint(level))&0x1ff)*8
+		pa := addr
+		if virt {
+			// Page table entries are read and updated as guest physical
+			// memory.
+			if pa, err = vm.gstage(addr, accessLoad, a, va); err != nil {
+				return 0, 0, err
+			}
+		}
+		pte, err = vm.read(pa, 8)
+		if err != nil {
+			return 0, 0, a.accessFault(va)
+		}
+		if pte&pteV == 0 || pte&pteR == 0 && pte&pteW != 0 {
+			return 0, 0, a.pageFault(va)
+		}
+		ppn = pte >> ptePPNShift & ptePPN
+		if pte&(pteR|pteX) == 0 {
+			table = ppn << pageShift
+			continue
+		}
+		// A leaf. Superpages must be aligned.
+		mask := uint64(1)<<(9*uint(level)) - 1
+		if ppn&mask != 0 {
+			return 0, 0, a.pageFault(va)
+		}
+		if !allowed(pte, a, priv, s) {
+			return 0, 0, a.pageFault(va)
+		}
+		update := pte | pteA
+		if a == accessStore {
+			update |= pteD
+		}
+		if update != pte {
+			if virt {
+				if pa, err = vm.gstage(addr, accessStore, a, va); err != nil {
+					return 0, 0, err
+				}
+			}
+			if b, off, ok := vm.sharedMem(pa, 8, PermWrite); ok && off%8 == 0 {
+				if !casShared(b, off, 8, pte, update) {
+					// Another hart changed the PTE after it was read.
+					return vm.walk(va, a, priv, s, virt)
+				}
+			} else if err := vm.write(pa, 8, update); err != nil {
+				return 0, 0, a.accessFault(va)
+			}
+			pte = update
+		}
+		return pte, ppn | va>>pageShift&mask, nil
+	}
+	return 0, 0, a.pageFault(va)
+}
+
+// fetch returns up to 4 bytes of the instruction at the virtual address pc. A
+// 4-byte instruction can cross a page boundary; its halves are translated
+// separately.
+func (vm *VM) fetch(pc uint64) ([]byte, error) {
+	pa, err := vm.translate(pc, accessFetch)
+	if err != nil {
+		return nil, err
+	}
+	b, err := vm.fetchPhys(pa)
+	if err != nil {
+		return nil, err
+	}
+	n := pageSize - pc&(pageSize-1)
+	if n >= 4 {
+		return b, nil
+	}
+	if len(b) > int(n) {
+		b = b[:n]
+	}
+	if b[0]&3 != 3 {
+		return b, nil // a compressed instruction
+	}
+	pa, err = vm.translate(pc+n, accessFetch)
+	if err != nil {
+		return nil, err
+	}
+	next, err := vm.fetchPhys(pa)
+	if err != nil {
+		return nil, err
+	}
+	if len(next) > 2 {
+		next = next[:2]
+	}
+	return append(append([]byte(nil), b...), next...), nil
+}
+
+// loadVirt loads size bytes from the virtual address addr.
+func (vm *VM) loadVirt(addr uint64, size int) (uint64, error) {
+	priv, virt := vm.dataMode()
+	return vm.loadAs(addr, size, accessLoad, priv, virt)
+}
+
+// storeVirt stores size bytes of v at the virtual address addr.
+func (vm *VM) storeVirt(addr uint64, size int, v uint64) error {
+	priv, virt := vm.dataMode()
+	return vm.storeAs(addr, size, v, priv, virt)
+}
+
+// loadAs loads size bytes from the virtual address addr translated at the
+// privilege level priv in the virtualization mode virt. a is accessLoad or
+// accessLoadExec. Accesses crossing a page boundary are translated byte by
+// byte.
+func (vm *VM) loadAs(addr uint64, size int, a accessType, priv int, virt bool) (uint64, error) {
+	if addr&(pageSize-1)+uint64(size) <= pageSize {
+		pa, err := vm.translateAs(addr, a, priv, virt)
+		if err != nil {
+			return 0, err
+		}
+		return vm.read(pa, size)
+	}
+	var v uint64
+	for i := 0; i < size; i++ {
+		pa, err := vm.translateAs(addr+uint64(i), a, priv, virt)
+		if err != nil {
+			return 0, err
+		}
+		b, err := vm.read(pa, 1)
+		if err != nil {
+			return 0, err
+		}
+		v |= b << (8 * uint(i))
+	}
+	return v, nil
+}
+
+// storeAs stores size bytes of v at the virtual address addr translated at the
+// privilege level priv in the virtualization mode virt. Accesses crossing a
+// page boundary are translated before any byte is stored.
+func (vm *VM) storeAs(addr uint64, size int, v uint64, priv int, virt bool) error {
+	if addr&(pageSize-1)+uint64(size) <= pageSize {
+		pa, err := vm.translateAs(addr, accessStore, priv, virt)
+		if err != nil {
+			return err
+		}
+		return vm.write(pa, size, v)
+	}
+	pas := make([]uint64, size)
+	for i := range pas {
+		pa, err := vm.translateAs(addr+uint64(i), accessStore, priv, virt)
+		if err != nil {
+			return err
+		}
+		pas[i] = pa
+	}
+	for i, pa := range pas {
+		if err := vm.write(pa, 1, v>>(8*uint(i))); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,190 @@
+// Copyright 2019 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"reflect"
+	"testing"
+)
+
+// The page tables built by newPagedVM: the root table, a level-1 table and a
+// level-0 table.
+const (
+	rootTable = 0x1000
+	l1Table   = 0x2000
+	l0Table   = 0x3000
+
+	pageVA  = 0x400000   // mapped by l0Table[0]
+	gigaVA  = 0x40000000 // a gigapage mapped by rootTable[1]
+	megaVA  = 0x600000   // a megapage mapped by l1Table[3]
+	pagePA  = 0x8000
+	leafPTE = l0Table // address of the PTE mapping pageVA
+)
+
+func pte(pa, flags uint64) uint64 { return pa>>pageShift<<ptePPNShift | flags }
+
+// newPagedVM returns a VM in S-mode with Sv39 enabled. pageVA is mapped to
+// pagePA with the given PTE flags; gigaVA is mapped to physical address 0.
+func newPagedVM(t *testing.T, flags uint64) *VM {
+	t.Helper()
+	vm := NewVM(&Prog{MemSize: 0x200000})
+	for _, w := range []struct{ addr, v uint64 }{
+		{rootTable, pte(l1Table, pteV)},
+		{rootTable + 8, pte(0, pteV|pteR|pteW|pteX|pteA|pteD)},
+		{l1Table + 2*8, pte(l0Table, pteV)},
+		{l1Table + 3*8, pte(pageSize, pteV|pteR|pteA)}, // misaligned megapage
+		{leafPTE, pte(pagePA, flags)},
+	} {
+		if err := vm.write(w.addr, 8, w.v); err != nil {
+			t.Fatal(err)
+		}
+	}
+	vm.writeCSR(csrSatp, satpModeSv39<<satpModeShift|rootTable>>pageShift)
+	vm.Priv = PrivS
+	return vm
+}
+
+func TestTranslate(t *testing.T) {
+	const rwx = pteV | pteR | pteW | pteX | pteA | pteD
+	for _, tt := range []struct {
+		desc      string
+		flags     uint64 // of the PTE mapping pageVA
+		priv      int
+		mstatus   uint64
+		va        uint64
+		access    accessType
+		want      uint64
+		wantCause uint64 // if non-zero, the access faults
+	}{
+		{desc: "load", flags: rwx, priv: PrivS, va: pageVA + 0x123, access: accessLoad, want: pagePA + 0x123},
+		{desc: "gigapage", flags: rwx, priv: PrivS, va: gigaVA + 0x4567, access: accessStore, want: 0x4567},
+		{desc: "M-mode", flags: rwx, priv: PrivM, va: pageVA, access: accessLoad, want: pageVA},
+		{desc: "MPRV", flags: rwx, priv: PrivM, mstatus: mstatusMPRV | PrivS<<mstatusShift, va: pageVA, access: accessLoad, want: pagePA},
+		{desc: "MPRV doesn't affect fetches", flags: rwx, priv: PrivM, mstatus: mstatusMPRV | PrivS<<mstatusShift, va: pageVA, access: accessFetch, want: pageVA},
+		{desc: "unmapped", flags: rwx, priv: PrivS, va: pageVA + pageSize, access: accessFetch, wantCause: causeInstrPageFault},
+		{desc: "invalid PTE", flags: rwx &^ pteV, priv: PrivS, va: pageVA, access: accessLoad, wantCause: causeLoadPageFault},
+		{desc: "write-only PTE", flags: pteV | pteW, priv: PrivS, va: pageVA, access: accessLoad, wantCause: causeLoadPageFault},
+		{desc: "store to read-only page", flags: pteV | pteR, priv: PrivS, va: pageVA, access: accessStore, wantCause: causeStorePageFault},
+		{desc: "fetch from non-executable page", flags: pteV | pteR, priv: PrivS, va: pageVA, access: accessFetch, wantCause: causeInstrPageFault},
+		{desc: "load from execute-only page", flags: pteV | pteX, priv: PrivS, va: pageVA, access: accessLoad, wantCause: causeLoadPageFault},
+		{desc: "MXR", flags: pteV | pteX, priv: PrivS, mstatus: mstatusMXR, va: pageVA, access: accessLoad, want: pagePA},
+		{desc: "user page in U-mode", flags: rwx | pteU, priv: PrivU, va: pageVA, access: accessStore, want: pagePA},
+		{desc: "supervisor page in U-mode", flags: rwx, priv: PrivU, va: pageVA, access: accessLoad, wantCause: causeLoadPageFault},
+		{desc: "user page in S-mode", flags: rwx | pteU, priv: PrivS, va: pageVA, access: accessLoad, wantCause: causeLoadPageFault},
+		{desc: "SUM", flags: rwx | pteU, priv: PrivS, mstatus: mstatusSUM, va: pageVA, access: accessLoad, want: pagePA},
+		{desc: "SUM doesn't allow fetches", flags: rwx | pteU, priv: PrivS, mstatus: mstatusSUM, va: pageVA, access: accessFetch, wantCause: causeInstrPageFault},
+		{desc: "misaligned superpage", flags: rwx, priv: PrivS, va: megaVA, access: accessLoad, wantCause: causeLoadPageFault},
+		{desc: "non-canonical address", flags: rwx, priv: PrivS, va: 1 << 40, access: accessLoad, wantCause: causeLoadPageFault},
+		{desc: "canonical high address", flags: rwx, priv: PrivS, va: ^uint64(0), access: accessLoad, wantCause: causeLoadPageFault},
+	} {
+		vm := newPagedVM(t, tt.flags)
+		vm.Priv = tt.priv
+		vm.CSR[csrMstatus] = tt.mstatus
+		got, err := vm.translate(tt.va, tt.access)
+		if tt.wantCause != 0 {
+			want := &exception{cause: tt.wantCause, tval: tt.va}
+			if !reflect.DeepEqual(err, want) {
+				t.Errorf("%s: translate(%#x) = %#x, %v; want %v", tt.desc, tt.va, got, err, want)
+			}
+			continue
+		}
+		if err != nil || got != tt.want {
+			t.Errorf("%s: translate(%#x) = %#x, %v; want %#x, nil", tt.desc, tt.va, got, err, tt.want)
+		}
+	}
+}
+
+func TestTranslateAccessedDirty(t *testing.T) {
+	vm := newPagedVM(t, pteV|pteR|pteW)
+	for _, tt := range []struct {
+		access accessType
+		want   uint64
+	}{
+		{accessLoad, pteV | pteR | pteW | pteA},
+		{accessLoad, pteV | pteR | pteW | pteA},
+		// The TLB entry is refreshed to set D.
+		{accessStore, pteV | pteR | pteW | pteA | pteD},
+	} {
+		if _, err := vm.translate(pageVA, tt.access); err != nil {
+			t.Fatalf("translate failed: %v", err)
+		}
+		if got, _ := vm.read(leafPTE, 8); got != pte(pagePA, tt.want) {
+			t.Errorf("PTE after access %d = %#x; want %#x", tt.access, got, pte(pagePA, tt.want))
+		}
+	}
+}
+
+func TestTLBFlush(t *testing.T) {
+	vm := newPagedVM(t, pteV|pteR|pteA)
+	if _, err := vm.translate(pageVA, accessLoad); err != nil {
+		t.Fatalf("translate failed: %v", err)
+	}
+	// Without SFENCE.VMA the cached translation is used.
+	vm.write(leafPTE, 8, 0)
+	if _, err := vm.translate(pageVA, accessLoad); err != nil {
+		t.Errorf("translate with a cached PTE failed: %v", err)
+	}
+	if _, err := sfenceVMA(vm, &Instruction{}); err != nil {
+		t.Fatalf("SFENCE.VMA failed: %v", err)
+	}
+	if _, err := vm.translate(pageVA, accessLoad); err == nil {
+		t.Errorf("translate after SFENCE.VMA succeeded; want a page fault")
+	}
+}
+
+func TestSatp(t *testing.T) {
+	vm := NewVM(&Prog{MemSize: 0x10})
+	const sv39 = satpModeSv39<<satpModeShift | 0x1234
+	vm.writeCSR(csrSatp, sv39|0xffff<<44) // ASID bits aren't implemented
+	if got, _ := vm.readCSR(csrSatp); got != sv39 {
+		t.Errorf("satp = %#x; want %#x", got, uint64(sv39))
+	}
+	// Sv48 isn't supported, so the write is ignored.
+	vm.writeCSR(csrSatp, 9<<satpModeShift|0x1234)
+	if got, _ := vm.readCSR(csrSatp); got != sv39 {
+		t.Errorf("satp after selecting Sv48 = %#x; want %#x", got, uint64(sv39))
+	}
+}
+
+func TestFetchAcrossPages(t *testing.T) {
+	// The second half of the instruction at pageVA-2 comes from pageVA,
+	// which is mapped elsewhere.
+	vm := newPagedVM(t, pteV|pteX|pteA)
+	vm.write(l1Table+8, 8, pte(0, pteV|pteX|pteA)) // a megapage at 0x200000
+
+	// addi x1, x1, 1, with its first half mapped at pageVA-2.
+	const addi = 0x00108093
+	vm.write(0x200000-2, 2, addi&0xffff)
+	vm.write(pagePA, 2, addi>>16)
+	vm.Priv = PrivS
+	got, err := vm.fetch(pageVA - 2)
+	if want := asBytes(addi); err != nil || !reflect.DeepEqual(got, want) {
+		t.Errorf("fetch(%#x) = %x, %v; want %x, nil", pageVA-2, got, err, want)
+	}
+}
+
+func TestPageFaultTrap(t *testing.T) {
+	vm := newPagedVM(t, pteV|pteR|pteX|pteA)
+	copy(vm.Mem[pagePA:], asBytes(swX2X1))
+	vm.CSR[csrMtvec] = trapHandler
+	vm.PC = pageVA
+	vm.Reg[1] = pageVA + 8
+	if err := vm.Run(1); err != nil {
+		t.Fatalf("Run failed: %v", err)
+	}
+	if vm.PC != trapHandler || vm.CSR[csrMcause] != causeStorePageFault || vm.CSR[csrMtval] != pageVA+8 || vm.CSR[csrMepc] != pageVA {
+		t.Errorf("PC, mcause, mtval, mepc = %#x, %d, %#x, %#x; want %#x, %d, %#x, %#x", vm.PC, vm.CSR[csrMcause], vm.CSR[csrMtval], vm.CSR[csrMepc], trapHandler, causeStorePageFault, pageVA+8, pageVA)
+	}
+}
@@ -0,0 +1,923 @@
+// Copyright 2019 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+// This file implements a 9P2000.L file server exporting a host directory. See
+// https://github.com/chaos/diod/blob/master/protocol.md for the protocol and
+// Linux's include/net/9p/9p.h for the message numbers.
+
+import (
+	"encoding/binary"
+	"io"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// 9P message types. Responses are requests + 1.
+const (
+	p9Rlerror    = 7
+	p9Tstatfs    = 8
+	p9Tlopen     = 12
+	p9Tlcreate   = 14
+	p9Tsymlink   = 16
+	p9Treadlink  = 22
+	p9Tgetattr   = 24
+	p9Tsetattr   = 26
+	p9Txattrwalk = 30
+	p9Treaddir   = 40
+	p9Tfsync     = 50
+	p9Tlock      = 52
+	p9Tgetlock   = 54
+	p9Tlink      = 70
+	p9Tmkdir     = 72
+	p9Trenameat  = 74
+	p9Tunlinkat  = 76
+	p9Tversion   = 100
+	p9Tattach    = 104
+	p9Tflush     = 108
+	p9Twalk      = 110
+	p9Tread      = 116
+	p9Twrite     = 118
+	p9Tclunk     = 120
+	p9Tremove    = 122
+	p9Trename    = 20
+
+	p9HeaderSize = 7  // size, type, tag
+	p9IOHeader   = 11 // header and count of Rread/Rwrite
+	p9MaxMsize   = 1 << 20
+	p9MaxWalk    = 16
+	p9Version    = "9P2000.L"
+)
+
+// Linux error numbers returned in Rlerror.
+const (
+	p9ENOENT     = 2
+	p9EIO        = 5
+	p9EBADF      = 9
+	p9EACCES     = 13
+	p9EEXIST     = 17
+	p9ENOTDIR    = 20
+	p9EINVAL     = 22
+	p9EROFS      = 30
+	p9ELOOP      = 40
+	p9EOPNOTSUPP = 95
+)
+
+// Qid types and directory entry types.
+const (
+	p9QTDir     = 0x80
+	p9QTSymlink = 0x02
+	p9QTFile    = 0x00
+
+	p9DTDir = 4
+	p9DTReg = 8
+	p9DTLnk = 10
+)
+
+// Linux open flags (Tlopen, Tlcreate) and file mode bits (Rgetattr).
+const (
+	p9OWronly = 01
+	p9ORdwr   = 02
+	p9OCreat  = 0100
+	p9OExcl   = 0200
+	p9OTrunc  = 01000
+	p9OAppend = 02000
+
+	p9SIFDIR = 0040000
+	p9SIFREG = 0100000
+	p9SIFLNK = 0120000
+)
+
+// Tsetattr valid bits.
+const (
+	p9SetattrMode     = 0x1
+	p9SetattrSize     = 0x8
+	p9SetattrAtime    = 0x10
+	p9SetattrMtime    = 0x20
+	p9SetattrAtimeSet = 0x80
+	p9SetattrMtimeSet = 0x100
+
+	p9GetattrBasic = 0x7ff
+)
+
+// P9Server serves a host directory over 9P2000.L.
+//
+// The guest can't access files outside of the root: walks can't go above the
+// root, names can't contain slashes, and the server never follows symbolic
+// links (the guest kernel resolves them itself). Before every operation on the
+// host, the directories leading to the file are checked not to be symbolic
+// links, since the guest may have replaced a walked directory by one. Fids of
+// removed files are invalidated.
+type P9Server struct {
+	mu       sync.Mutex
+	root     string
+	readOnly bool
+	msize    uint32
+	fids     map[uint32]*p9fid
+	qids     map[string]uint64 // qid paths assigned to files
+}
+
+type p9fid struct {
+	path    string   // slash-separated path relative to the root; "" is the root
+	removed bool     // the file was removed or replaced; only file is usable
+	file    *os.File // set by Tlopen and Tlcreate
+	append  bool     // file was opened with O_APPEND
+	dir     []p9dirent
+}
+
+type p9dirent struct {
+	name string
+	qid  []byte
+	typ  byte
+}
+
+// NewP9Server returns a server exporting the directory root. If readOnly is
+// set, the guest can't modify files.
+func NewP9Server(root string, readOnly bool) *P9Server {
+	return &P9Server{root: root, readOnly: readOnly, msize: p9MaxMsize, fids: map[uint32]*p9fid{}, qids: map[string]uint64{}}
+}
+
+// p9err is a Linux error number.
+type p9err uint32
+
+// p9dec decodes fields of a message. Reading past the end of the message sets
+// short.
+type p9dec struct {
+	b     []byte
+	short bool
+}
+
+func (d *p9dec) next(n int) []byte {
+	if len(d.b) < n {
+		d.short = true
+		return make([]byte, n)
+	}
+	b := d.b[:n]
+	d.b = d.b[n:]
+	return b
+}
+
+func (d *p9dec) u8() uint8   { return d.next(1)[0] }
+func (d *p9dec) u16() uint16 { return binary.LittleEndian.Uint16(d.next(2)) }
+func (d *p9dec) u32() uint32 { return binary.LittleEndian.Uint32(d.next(4)) }
+func (d *p9dec) u64() uint64 { return binary.LittleEndian.Uint64(d.next(8)) }
+func (d *p9dec) str() string { return string(d.next(int(d.u16()))) }
+
+// p9enc encodes fields of a message.
+type p9enc []byte
+
+func (e *p9enc) u8(v uint8)   { *e = append(*e, v) }
+func (e *p9enc) u16(v uint16) { *e = append(*e, byte(v), byte(v>>8)) }
+func (e *p9enc) u32(v uint32) { *e = append(*e, byte(v), byte(v>>8), byte(v>>16), byte(v>>24)) }
+func (e *p9enc) u64(v uint64) { e.u32(uint32(v)); e.u32(uint32(v >> 32)) }
+func (e *p9enc) str(s string) { e.u16(uint16(len(s))); *e = append(*e, s...) }
+
+// Handle processes a request and returns the response.
+func (s *P9Server) Handle(req []byte) []byte {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	d := &p9dec{b: req}
+	d.u32() // size
+	typ := d.u8()
+	tag := d.u16()
+	var body p9enc
+	err := s.dispatch(typ, d, &body)
+	if err == 0 && d.short {
+		err = p9EINVAL
+	}
+	rtyp := typ + 1
+	if err != 0 {
+		rtyp = p9Rlerror
+		body = nil
+		body.u32(uint32(err))
+	}
+	out := make(p9enc, 0, p9HeaderSize+len(body))
+	out.u32(uint32(p9HeaderSize + len(body)))
+	out.u8(rtyp)
+	out.u16(tag)
+	return append(out, body...)
+}
+
+func (s *P9Server) dispatch(typ uint8, d *p9dec, r *p9enc) p9err {
+	switch typ {
+	case p9Tversion:
+		msize, version := d.u32(), d.str()
+		if s.msize = msize; msize > p9MaxMsize {
+			s.msize = p9MaxMsize
+		}
+		for _, f := range s.fids {
+			f.close()
+		}
+		s.fids = map[uint32]*p9fid{}
+		if version != p9Version {
+			version = "unknown"
+		}
+		r.u32(s.msize)
+		r.str(version)
+		return 0
+	case p9Tattach:
+		fid := d.u32()
+		d.u32() // afid
+		d.str() // uname
+		d.str() // aname
+		d.u32() // n_uname
+		if _, ok := s.fids[fid]; ok {
+			return p9EBADF
+		}
+		qid, err := s.qid("")
+		if err != 0 {
+			return err
+		}
+		s.fids[fid] = &p9fid{}
+		*r = append(*r, qid...)
+		return 0
+	case p9Tflush:
+		d.u16() // oldtag; requests are processed synchronously
+		return 0
+	case p9Tclunk, p9Tremove:
+		fid := d.u32()
+		f, ok := s.fids[fid]
+		if !ok {
+			return p9EBADF
+		}
+		f.close()
+		delete(s.fids, fid)
+		if typ == p9Tremove {
+			if s.readOnly {
+				return p9EROFS
+			}
+			return s.remove(f.path, f)
+		}
+		return 0
+	}
+
+	fid := d.u32()
+	f, ok := s.fids[fid]
+	if !ok {
+		return p9EBADF
+	}
+	switch typ {
+	case p9Twalk:
+		return s.walk(fid, f, d, r)
+	case p9Tlopen:
+		return s.lopen(f, d.u32(), r)
+	case p9Tlcreate:
+		name, flags, mode := d.str(), d.u32(), d.u32()
+		d.u32() // gid
+		return s.lcreate(f, name, flags, mode, r)
+	case p9Tread:
+		return s.read(f, d.u64(), d.u32(), r)
+	case p9Twrite:
+		off, n := d.u64(), d.u32()
+		return s.write(f, off, d.next(int(n)), r)
+	case p9Tgetattr:
+		d.u64() // request_mask
+		return s.getattr(f, r)
+	case p9Tsetattr:
+		return s.setattr(f, d)
+	case p9Treaddir:
+		return s.readdir(f, d.u64(), d.u32(), r)
+	case p9Tstatfs:
+		r.u32(0x01021997) // V9FS_MAGIC
+		r.u32(4096)       // bsize
+		for i := 0; i < 5; i++ {
+			r.u64(1 << 20) // blocks, bfree, bavail, files, ffree
+		}
+		r.u64(0)   // fsid
+		r.u32(255) // namelen
+		return 0
+	case p9Tfsync:
+		if f.file != nil {
+			return s.errno(f.file.Sync())
+		}
+		return 0
+	case p9Tlock:
+		r.u8(0) // P9_LOCK_SUCCESS; locks are advisory and the guest is alone
+		return 0
+	case p9Tgetlock:
+		d.u8() // type
+		start, length, pid, client := d.u64(), d.u64(), d.u32(), d.str()
+		r.u8(2) // F_UNLCK
+		r.u64(start)
+		r.u64(length)
+		r.u32(pid)
+		r.str(client)
+		return 0
+	case p9Treadlink:
+		h, errno := s.fidHost(f)
+		if errno != 0 {
+			return errno
+		}
+		target, err := os.Readlink(h)
+		if err != nil {
+			return s.errno(err)
+		}
+		r.str(target)
+		return 0
+	case p9Txattrwalk:
+		return p9EOPNOTSUPP
+	}
+
+	if s.readOnly {
+		return p9EROFS
+	}
+	switch typ {
+	case p9Tmkdir:
+		name, mode := d.str(), d.u32()
+		d.u32() // gid
+		p, h, err := s.child(f, name)
+		if err != 0 {
+			return err
+		}
+		if err := s.errno(os.Mkdir(h, os.FileMode(mode&0777))); err != 0 {
+			return err
+		}
+		return s.putQid(p, r)
+	case p9Tsymlink:
+		name, target := d.str(), d.str()
+		d.u32() // gid
+		p, h, err := s.child(f, name)
+		if err != 0 {
+			return err
+		}
+		if err := s.errno(os.Symlink(target, h)); err != 0 {
+			return err
+		}
+		return s.putQid(p, r)
+	case p9Tlink:
+		target, ok := s.fids[d.u32()]
+		name := d.str()
+		if !ok {
+			return p9EBADF
+		}
+		old, err := s.fidHost(target)
+		if err != 0 {
+			return err
+		}
+		_, h, err := s.child(f, name)
+		if err != 0 {
+			return err
+		}
+		return s.errno(os.Link(old, h))
+	case p9Tunlinkat:
+		name := d.str()
+		d.u32() // flags; os.Remove handles both files and directories
+		p, _, err := s.child(f, name)
+		if err != 0 {
+			return err
+		}
+		return s.remove(p, nil)
+	case p9Trenameat:
+		oldName := d.str()
+		newDir, ok := s.fids[d.u32()]
+		newName := d.str()
+		if !ok {
+			return p9EBADF
+		}
+		return s.rename(f, oldName, newDir, newName)
+	case p9Trename:
+		newDir, ok := s.fids[d.u32()]
+		newName := d.str()
+		if !ok {
+			return p9EBADF
+		}
+		if f.path == "" {
+			return p9EINVAL
+		}
+		if f.removed {
+			return p9ENOENT
+		}
+		dir, name := path.Split(f.path)
+		if err := s.rename(&p9fid{path: strings.TrimSuffix(dir, "/")}, name, newDir, newName); err != 0 {
+			return err
+		}
+		f.path = path.Join(newDir.path, newName)
+		return 0
+	}
+	return p9EOPNOTSUPP
+}
+
+// host returns the host path of the file. The directories leading to the file
+// must be directories, not symbolic links to them, so that the path stays
+// within the root. The file itself may be a symbolic link.
+func (s *P9Server) host(p string) (string, p9err) {
+	h := s.root
+	if p == "" {
+		return h, 0
+	}
+	elems := strings.Split(p, "/")
+	for _, e := range elems[:len(elems)-1] {
+		h = filepath.Join(h, e)
+		fi, err := os.Lstat(h)
+		switch {
+		case err != nil:
+			return "", s.errno(err)
+		case fi.Mode()&os.ModeSymlink != 0:
+			return "", p9ELOOP
+		case !fi.IsDir():
+			return "", p9ENOTDIR
+		}
+	}
+	return filepath.Join(h, elems[len(elems)-1]), 0
+}
+
+// fidHost returns the host path of the file of f.
+func (s *P9Server) fidHost(f *p9fid) (string, p9err) {
+	if f.removed {
+		return "", p9ENOENT
+	}
+	return s.host(f.path)
+}
+
+// child returns the path and the host path of the entry name in the directory
+// of f. The name must be a single path element.
+func (s *P9Server) child(f *p9fid, name string) (string, string, p9err) {
+	if name == "" || name == "." || name == ".." || strings.ContainsAny(name, "/\x00") {
+		return "", "", p9EINVAL
+	}
+	if f.removed {
+		return "", "", p9ENOENT
+	}
+	p := path.Join(f.path, name)
+	h, err := s.host(p)
+	return p, h, err
+}
+
+// remove removes the file p and invalidates the fids referring to it or to
+// files below it, except for keep.
+func (s *P9Server) remove(p string, keep *p9fid) p9err {
+	h, err := s.host(p)
+	if err != 0 {
+		return err
+	}
+	if err := s.errno(os.Remove(h)); err != 0 {
+		return err
+	}
+	s.invalidate(p, keep)
+	return 0
+}
+
+// invalidate marks the fids referring to the file p or to files below it as
+// removed, except for keep.
+func (s *P9Server) invalidate(p string, keep *p9fid) {
+	for _, f := range s.fids {
+		if f != keep && (f.path == p || strings.HasPrefix(f.path, p+"/")) {
+			f.removed = true
+		}
+	}
+}
+
+// qid returns the encoded qid of the file, without following symbolic links.
+func (s *P9Server) qid(p string) ([]byte, p9err) {
+	h, errno := s.host(p)
+	if errno != 0 {
+		return nil, errno
+	}
+	fi, err := os.Lstat(h)
+	if err != nil {
+		return nil, s.errno(err)
+	}
+	return s.qidOf(p, fi), 0
+}
+
+func (s *P9Server) qidOf(p string, fi os.FileInfo) []byte {
+	id, ok := s.qids[p]
+	if !ok {
+		id = uint64(len(s.qids) + 1)
+		s.qids[p] = id
+	}
+	var q p9enc
+	switch {
+	case fi.IsDir():
+		q.u8(p9QTDir)
+	case fi.Mode()&os.ModeSymlink != 0:
+		q.u8(p9QTSymlink)
+	default:
+		q.u8(p9QTFile)
+	}
+	q.u32(uint32(fi.ModTime().UnixNano())) // version
+	q.u64(id)
+	return q
+}
+
+func (s *P9Server) putQid(p string, r *p9enc) p9err {
+	q, err := s.qid(p)
+	*r = append(*r, q...)
+	return err
+}
+
+func (s *P9Server) walk(fid uint32, f *p9fid, d *p9dec, r *p9enc) p9err {
+	newfid := d.u32()
+	n := int(d.u16())
+	if n > p9MaxWalk {
+		return p9EINVAL
+	}
+	names := make([]string, n)
+	for i := range names {
+		names[i] = d.str()
+	}
+	if d.short {
+		return p9EINVAL
+	}
+	if _, ok := s.fids[newfid]; ok && newfid != fid {
+		return p9EBADF
+	}
+	if f.removed {
+		return p9ENOENT
+	}
+	p := f.path
+	var qids [][]byte
+	for i, name := range names {
+		h, errno := s.host(p)
+		if errno != 0 {
+			return errno
+		}
+		fi, err := os.Lstat(h)
+		if err != nil {
+			return s.errno(err)
+		}
+		if !fi.IsDir() {
+			if i == 0 {
+				return p9ENOTDIR
+			}
+			break
+		}
+		switch {
+		case name == "..":
+			if p = path.Dir(p); p == "." {
+				p = ""
+			}
+		case name == "." || name == "" || strings.ContainsAny(name, "/\x00"):
+			return p9EINVAL
+		default:
+			p = path.Join(p, name)
+		}
+		q, err2 := s.qid(p)
+		if err2 != 0 {
+			if i == 0 {
+				return err2
+			}
+			break
+		}
+		qids = append(qids, q)
+	}
+	r.u16(uint16(len(qids)))
+	for _, q := range qids {
+		*r = append(*r, q...)
+	}
+	if len(qids) == len(names) {
+		if newfid == fid {
+			f.close()
+		}
+		s.fids[newfid] = &p9fid{path: p}
+	}
+	return 0
+}
+
+// lopen opens the file of f.
+func (s *P9Server) lopen(f *p9fid, flags uint32, r *p9enc) p9err {
+	if f.file != nil {
+		return p9EBADF
+	}
+	h, errno := s.fidHost(f)
+	if errno != 0 {
+		return errno
+	}
+	if s.readOnly && flags&(p9OWronly|p9ORdwr|p9OTrunc|p9OAppend) != 0 {
+		return p9EROFS
+	}
+	file, err := os.OpenFile(h, osFlags(flags)&^(os.O_CREATE|os.O_EXCL)|syscall.O_NOFOLLOW, 0)
+	if err != nil {
+		return s.errno(err)
+	}
+	fi, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return s.errno(err)
+	}
+	f.file, f.append = file, flags&p9OAppend != 0
+	*r = append(*r, s.qidOf(f.path, fi)...)
+	r.u32(0) // iounit: use msize
+	return 0
+}
+
+// lcreate creates and opens a file in the directory of f. f then refers to
+// the new file.
+func (s *P9Server) lcreate(f *p9fid, name string, flags, mode uint32, r *p9enc) p9err {
+	if s.readOnly {
+		return p9EROFS
+	}
+	if f.file != nil {
+		return p9EBADF
+	}
+	p, h, err := s.child(f, name)
+	if err != 0 {
+		return err
+	}
+	file, oerr := os.OpenFile(h, osFlags(flags)|os.O_CREATE|syscall.O_NOFOLLOW, os.FileMode(mode&0777))
+	if oerr != nil {
+		return s.errno(oerr)
+	}
+	f.path, f.file, f.append = p, file, flags&p9OAppend != 0
+	if err := s.putQid(p, r); err != 0 {
+		return err
+	}
+	r.u32(0) // iounit
+	return 0
+}
+
+// osFlags converts Linux open flags to os.OpenFile flags.
+func osFlags(flags uint32) int {
+	var f int
+	switch flags & 3 {
+	case p9OWronly:
+		f = os.O_WRONLY
+	case p9ORdwr:
+		f = os.O_RDWR
+	default:
+		f = os.O_RDONLY
+	}
+	for _, m := range []struct {
+		linux uint32
+		os    int
+	}{{p9OCreat, os.O_CREATE}, {p9OExcl, os.O_EXCL}, {p9OTrunc, os.O_TRUNC}, {p9OAppend, os.O_APPEND}} {
+		if flags&m.linux != 0 {
+			f |= m.os
+		}
+	}
+	return f
+}
+
+func (s *P9Server) read(f *p9fid, off uint64, n uint32, r *p9enc) p9err {
+	if f.file == nil {
+		return p9EBADF
+	}
+	if max := s.msize - p9IOHeader; n > max {
+		n = max
+	}
+	buf := make([]byte, n)
+	m, err := f.file.ReadAt(buf, int64(off))
+	if err != nil && err != io.EOF {
+		return s.errno(err)
+	}
+	r.u32(uint32(m))
+	*r = append(*r, buf[:m]...)
+	return 0
+}
+
+func (s *P9Server) write(f *p9fid, off uint64, data []byte, r *p9enc) p9err {
+	if s.readOnly {
+		return p9EROFS
+	}
+	if f.file == nil {
+		return p9EBADF
+	}
+	var n int
+	var err error
+	if f.append {
+		n, err = f.file.Write(data)
+	} else {
+		n, err = f.file.WriteAt(data, int64(off))
+	}
+	if err != nil {
+		return s.errno(err)
+	}
+	r.u32(uint32(n))
+	return 0
+}
+
+func (s *P9Server) getattr(f *p9fid, r *p9enc) p9err {
+	h, errno := s.fidHost(f)
+	if errno != 0 {
+		return errno
+	}
+	fi, err := os.Lstat(h)
+	if err != nil {
+		return s.errno(err)
+	}
+	mode := uint32(fi.Mode().Perm())
+	switch {
+	case fi.IsDir():
+		mode |= p9SIFDIR
+	case fi.Mode()&os.ModeSymlink != 0:
+		mode |= p9SIFLNK
+	default:
+		mode |= p9SIFREG
+	}
+	mt := fi.ModTime()
+	r.u64(p9GetattrBasic)
+	*r = append(*r, s.qidOf(f.path, fi)...)
+	r.u32(mode)
+	r.u32(0) // uid
+	r.u32(0) // gid
+	r.u64(1) // nlink
+	r.u64(0) // rdev
+	r.u64(uint64(fi.Size()))
+	r.u64(4096)                        // blksize
+	r.u64(uint64(fi.Size()+511) / 512) // blocks
+	// atime, mtime, ctime and btime.
+	for i := 0; i < 4; i++ {
+		r.u64(uint64(mt.Unix()))
+		r.u64(uint64(mt.Nanosecond()))
+	}
+	r.u64(0) // gen
+	r.u64(0) // data_version
+	return 0
+}
+
+func (s *P9Server) setattr(f *p9fid, d *p9dec) p9err {
+	valid, mode := d.u32(), d.u32()
+	d.u32() // uid
+	d.u32() // gid
+	size := d.u64()
+	atime := time.Unix(int64(d.u64()), int64(d.u64()))
+	mtime := time.Unix(int64(d.u64()), int64(d.u64()))
+	if d.short {
+		return p9EINVAL
+	}
+	if s.readOnly {
+		return p9EROFS
+	}
+	h, errno := s.fidHost(f)
+	if errno != 0 {
+		return errno
+	}
+	fi, err := os.Lstat(h)
+	if err != nil {
+		return s.errno(err)
+	}
+	if fi.Mode()&os.ModeSymlink != 0 {
+		// Changing the attributes would follow the link. Ownership
+		// and times of links don't matter to the guest.
+		return 0
+	}
+	if valid&p9SetattrMode != 0 {
+		if err := os.Chmod(h, os.FileMode(mode&0777)); err != nil {
+			return s.errno(err)
+		}
+	}
+	if valid&p9SetattrSize != 0 {
+		if err := os.Truncate(h, int64(size)); err != nil {
+			return s.errno(err)
+		}
+	}
+	if valid&(p9SetattrAtime|p9SetattrMtime) != 0 {
+		now := time.Now()
+		if valid&p9SetattrAtimeSet == 0 {
+			atime = now
+		}
+		if valid&p9SetattrMtimeSet == 0 {
+			mtime = now
+		}
+		if valid&p9SetattrAtime == 0 {
+			atime = fi.ModTime()
+		}
+		if valid&p9SetattrMtime == 0 {
+			mtime = fi.ModTime()
+		}
+		if err := os.Chtimes(h, atime, mtime); err != nil {
+			return s.errno(err)
+		}
+	}
+	return 0
+}
+
+// readdir returns directory entries starting at offset, which is the index of
+// the entry. The entries are read when offset is 0.
+func (s *P9Server) readdir(f *p9fid, off uint64, n uint32, r *p9enc) p9err {
+	if f.file == nil {
+		return p9EBADF
+	}
+	if off == 0 || f.dir == nil {
+		names, err := f.file.Readdirnames(-1)
+		f.file.Seek(0, io.SeekStart)
+		if err != nil {
+			return s.errno(err)
+		}
+		sort.Strings(names)
+		f.dir = nil
+		for _, name := range append([]string{".", ".."}, names...) {
+			p := path.Join(f.path, name)
+			if name == ".." {
+				p = path.Dir(f.path)
+			}
+			if p == "." {
+				p = ""
+			}
+			h, errno := s.host(p)
+			if errno != 0 {
+				continue
+			}
+			fi, err := os.Lstat(h)
+			if err != nil {
+				continue // removed in the meantime
+			}
+			e := p9dirent{name: name, qid: s.qidOf(p, fi), typ: p9DTReg}
+			if fi.IsDir() {
+				e.typ = p9DTDir
+			} else if fi.Mode()&os.ModeSymlink != 0 {
+				e.typ = p9DTLnk
+			}
+			f.dir = append(f.dir, e)
+		}
+	}
+	if max := s.msize - p9IOHeader; n > max {
+		n = max
+	}
+	var entries p9enc
+	for i := off; i < uint64(len(f.dir)); i++ {
+		e := f.dir[i]
+		if len(entries)+len(e.qid)+8+1+2+len(e.name) > int(n) {
+			break
+		}
+		entries = append(entries, e.qid...)
+		entries.u64(i + 1)
+		entries.u8(e.typ)
+		entries.str(e.name)
+	}
+	r.u32(uint32(len(entries)))
+	*r = append(*r, entries...)
+	return 0
+}
+
+func (s *P9Server) rename(oldDir *p9fid, oldName string, newDir *p9fid, newName string) p9err {
+	from, fromHost, err := s.child(oldDir, oldName)
+	if err != 0 {
+		return err
+	}
+	to, toHost, err := s.child(newDir, newName)
+	if err != 0 {
+		return err
+	}
+	if err := s.errno(os.Rename(fromHost, toHost)); err != 0 {
+		return err
+	}
+	if from == to {
+		return 0
+	}
+	// Fids of a replaced file are invalid. Fids of the renamed file and its
+	// children follow it.
+	s.invalidate(to, nil)
+	for _, f := range s.fids {
+		if f.path == from || strings.HasPrefix(f.path, from+"/") {
+			f.path = to + strings.TrimPrefix(f.path, from)
+		}
+	}
+	return 0
+}
+
+// errno converts err to a Linux error number.
+func (s *P9Server) errno(err error) p9err {
+	switch {
+	case err == nil:
+		return 0
+	case os.IsNotExist(err):
+		return p9ENOENT
+	case os.IsExist(err):
+		return p9EEXIST
+	case os.IsPermission(err):
+		return p9EACCES
+	}
+	for {
+		switch e := err.(type) {
+		case *os.PathError:
+			err = e.Err
+			continue
+		case *os.LinkError:
+			err = e.Err
+			continue
+		case *os.SyscallError:
+			err = e.Err
+			continue
+		case syscall.Errno:
+			return p9err(e)
+		}
+		return p9EIO
+	}
+}
+
+func (f *p9fid) close() {
+	if f.file != nil {
+		f.file.Close()
+		f.file = nil
+	}
+	f.dir = nil
+}
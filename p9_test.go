@@ -0,0 +1,362 @@
+// Copyright 2019 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+// p9client sends requests to a P9Server.
+type p9client struct {
+	t   *testing.T
+	srv *P9Server
+	tag uint16
+}
+
+// call sends the request and returns the decoded response body. It fails the
+// test if the response type isn't typ+1.
+func (c *p9client) call(typ uint8, body p9enc) *p9dec {
+	c.t.Helper()
+	d, errno := c.try(typ, body)
+	if errno != 0 {
+		c.t.Fatalf("request %d failed with errno %d", typ, errno)
+	}
+	return d
+}
+
+// try sends the request and returns the response body or the error number.
+func (c *p9client) try(typ uint8, body p9enc) (*p9dec, p9err) {
+	c.t.Helper()
+	var req p9enc
+	req.u32(uint32(p9HeaderSize + len(body)))
+	req.u8(typ)
+	c.tag++
+	req.u16(c.tag)
+	resp := c.srv.Handle(append(req, body...))
+	d := &p9dec{b: resp}
+	if size := d.u32(); int(size) != len(resp) {
+		c.t.Fatalf("response size = %d; want %d", size, len(resp))
+	}
+	rtyp, tag := d.u8(), d.u16()
+	if tag != c.tag {
+		c.t.Fatalf("response tag = %d; want %d", tag, c.tag)
+	}
+	if rtyp == p9Rlerror {
+		return nil, p9err(d.u32())
+	}
+	if rtyp != typ+1 {
+		c.t.Fatalf("response type = %d; want %d", rtyp, typ+1)
+	}
+	return d, 0
+}
+
+func newP9Client(t *testing.T, root string, readOnly bool) *p9client {
+	c := &p9client{t: t, srv: NewP9Server(root, readOnly)}
+	var b p9enc
+	b.u32(8192)
+	b.str(p9Version)
+	d := c.call(p9Tversion, b)
+	if msize, version := d.u32(), d.str(); msize != 8192 || version != p9Version {
+		t.Fatalf("Rversion = %d, %q; want 8192, %q", msize, version, p9Version)
+	}
+	b = nil
+	b.u32(0)          // fid
+	b.u32(^uint32(0)) // afid
+	b.str("root")
+	b.str("")
+	b.u32(0)
+	c.call(p9Tattach, b)
+	return c
+}
+
+// walk walks from fid to newfid and returns the number of qids.
+func (c *p9client) walk(fid, newfid uint32, names ...string) (int, p9err) {
+	c.t.Helper()
+	var b p9enc
+	b.u32(fid)
+	b.u32(newfid)
+	b.u16(uint16(len(names)))
+	for _, n := range names {
+		b.str(n)
+	}
+	d, err := c.try(p9Twalk, b)
+	if err != 0 {
+		return 0, err
+	}
+	return int(d.u16()), 0
+}
+
+func (c *p9client) open(fid, flags uint32) p9err {
+	c.t.Helper()
+	var b p9enc
+	b.u32(fid)
+	b.u32(flags)
+	_, err := c.try(p9Tlopen, b)
+	return err
+}
+
+func (c *p9client) read(fid uint32) string {
+	c.t.Helper()
+	var b p9enc
+	b.u32(fid)
+	b.u64(0)
+	b.u32(4096)
+	d := c.call(p9Tread, b)
+	return string(d.next(int(d.u32())))
+}
+
+func newP9Dir(t *testing.T) string {
+	dir, err := ioutil.TempDir("", "p9")
+	if err != nil {
+		t.Fatal(err)
+	}
+	root := filepath.Join(dir, "root")
+	os.MkdirAll(filepath.Join(root, "sub"), 0755)
+	ioutil.WriteFile(filepath.Join(root, "sub", "hello.txt"), []byte("hello"), 0644)
+	ioutil.WriteFile(filepath.Join(dir, "secret"), []byte("secret"), 0644)
+	os.Symlink(filepath.Join(dir, "secret"), filepath.Join(root, "escape"))
+	os.Symlink(dir, filepath.Join(root, "escapedir"))
+	return dir
+}
+
+func TestP9Read(t *testing.T) {
+	dir := newP9Dir(t)
+	defer os.RemoveAll(dir)
+	c := newP9Client(t, filepath.Join(dir, "root"), true)
+
+	if n, err := c.walk(0, 1, "sub", "hello.txt"); n != 2 || err != 0 {
+		t.Fatalf("walk(sub, hello.txt) = %d, %d; want 2, 0", n, err)
+	}
+	if err := c.open(1, 0); err != 0 {
+		t.Fatalf("open failed: %d", err)
+	}
+	if got := c.read(1); got != "hello" {
+		t.Errorf("read = %q; want %q", got, "hello")
+	}
+
+	// Directory listing.
+	c.walk(0, 2)
+	if err := c.open(2, 0); err != 0 {
+		t.Fatalf("open(root) failed: %d", err)
+	}
+	var b p9enc
+	b.u32(2)
+	b.u64(0)
+	b.u32(4096)
+	d := c.call(p9Treaddir, b)
+	d = &p9dec{b: d.next(int(d.u32()))}
+	var names []string
+	for len(d.b) > 0 {
+		d.next(13) // qid
+		d.u64()    // offset
+		d.u8()     // type
+		names = append(names, d.str())
+	}
+	if want := []string{".", "..", "escape", "escapedir", "sub"}; !reflect.DeepEqual(names, want) {
+		t.Errorf("readdir = %q; want %q", names, want)
+	}
+}
+
+func TestP9Confinement(t *testing.T) {
+	dir := newP9Dir(t)
+	defer os.RemoveAll(dir)
+	c := newP9Client(t, filepath.Join(dir, "root"), false)
+
+	// ".." at the root is the root.
+	if n, err := c.walk(0, 1, "..", "..", "sub"); n != 3 || err != 0 {
+		t.Errorf("walk(.., .., sub) = %d, %d; want 3, 0", n, err)
+	}
+	if _, err := c.walk(0, 2, "sub/hello.txt"); err != p9EINVAL {
+		t.Errorf("walk(sub/hello.txt) error = %d; want EINVAL", err)
+	}
+	// Symbolic links aren't followed by the server.
+	if n, err := c.walk(0, 3, "escape"); n != 1 || err != 0 {
+		t.Fatalf("walk(escape) = %d, %d; want 1, 0", n, err)
+	}
+	if err := c.open(3, 0); err != p9ELOOP {
+		t.Errorf("open(escape) error = %d; want ELOOP", err)
+	}
+	if n, _ := c.walk(0, 4, "escapedir", "secret"); n != 1 {
+		t.Errorf("walk(escapedir, secret) returned %d qids; want 1", n)
+	}
+	if err := c.open(4, 0); err != p9EBADF {
+		t.Errorf("open of a fid from a partial walk error = %d; want EBADF", err)
+	}
+	var b p9enc
+	b.u32(0)
+	b.str("../secret")
+	b.u32(p9OWronly | p9OTrunc)
+	b.u32(0644)
+	b.u32(0)
+	if _, err := c.try(p9Tlcreate, b); err != p9EINVAL {
+		t.Errorf("lcreate(../secret) error = %d; want EINVAL", err)
+	}
+	if got, _ := ioutil.ReadFile(filepath.Join(dir, "secret")); string(got) != "secret" {
+		t.Errorf("file outside of the root = %q; want %q", got, "secret")
+	}
+}
+
+func TestP9ReplacedDirectory(t *testing.T) {
+	dir := newP9Dir(t)
+	defer os.RemoveAll(dir)
+	root := filepath.Join(dir, "root")
+	c := newP9Client(t, root, false)
+	lcreate := func(fid uint32) p9err {
+		var b p9enc
+		b.u32(fid)
+		b.str("secret")
+		b.u32(p9OWronly | p9OTrunc)
+		b.u32(0644)
+		b.u32(0)
+		_, err := c.try(p9Tlcreate, b)
+		return err
+	}
+
+	// The guest replaces a walked directory by a link to the outside.
+	var b p9enc
+	b.u32(0)
+	b.str("a")
+	b.u32(0755)
+	b.u32(0)
+	c.call(p9Tmkdir, b)
+	c.walk(0, 1, "a")
+	b = nil
+	b.u32(0)
+	b.str("a")
+	b.u32(0)
+	c.call(p9Tunlinkat, b)
+	b = nil
+	b.u32(0)
+	b.str("a")
+	b.str(dir)
+	b.u32(0)
+	c.call(p9Tsymlink, b)
+	if err := lcreate(1); err != p9ENOENT {
+		t.Errorf("lcreate in a removed directory error = %d; want ENOENT", err)
+	}
+	if _, err := c.walk(1, 2); err != p9ENOENT {
+		t.Errorf("walk from a removed directory error = %d; want ENOENT", err)
+	}
+
+	// So does the host.
+	os.Mkdir(filepath.Join(root, "b"), 0755)
+	c.walk(0, 3, "b")
+	os.Remove(filepath.Join(root, "b"))
+	os.Symlink(dir, filepath.Join(root, "b"))
+	if err := lcreate(3); err != p9ELOOP {
+		t.Errorf("lcreate in a directory replaced by a link error = %d; want ELOOP", err)
+	}
+	if got, _ := ioutil.ReadFile(filepath.Join(dir, "secret")); string(got) != "secret" {
+		t.Errorf("file outside of the root = %q; want %q", got, "secret")
+	}
+}
+
+func TestP9Write(t *testing.T) {
+	dir := newP9Dir(t)
+	defer os.RemoveAll(dir)
+	root := filepath.Join(dir, "root")
+	c := newP9Client(t, root, false)
+
+	c.walk(0, 1, "sub")
+	var b p9enc
+	b.u32(1)
+	b.str("new.txt")
+	b.u32(p9ORdwr)
+	b.u32(0644)
+	b.u32(0)
+	c.call(p9Tlcreate, b)
+	b = nil
+	b.u32(1)
+	b.u64(0)
+	b.u32(5)
+	b = append(b, "world"...)
+	if n := c.call(p9Twrite, b).u32(); n != 5 {
+		t.Errorf("write returned %d; want 5", n)
+	}
+	if got, _ := ioutil.ReadFile(filepath.Join(root, "sub", "new.txt")); string(got) != "world" {
+		t.Errorf("new.txt = %q; want %q", got, "world")
+	}
+
+	b = nil
+	b.u32(0)
+	b.str("dir")
+	b.u32(0755)
+	b.u32(0)
+	c.call(p9Tmkdir, b)
+	c.walk(0, 2, "sub")
+	c.walk(0, 3, "dir")
+	b = nil
+	b.u32(2)
+	b.str("new.txt")
+	b.u32(3)
+	b.str("moved.txt")
+	c.call(p9Trenameat, b)
+	if _, err := os.Stat(filepath.Join(root, "dir", "moved.txt")); err != nil {
+		t.Errorf("renamed file is missing: %v", err)
+	}
+	b = nil
+	b.u32(3)
+	b.str("moved.txt")
+	b.u32(0)
+	c.call(p9Tunlinkat, b)
+	if _, err := os.Stat(filepath.Join(root, "dir", "moved.txt")); !os.IsNotExist(err) {
+		t.Errorf("Stat of removed file = %v; want not exist", err)
+	}
+}
+
+func TestP9ReadOnly(t *testing.T) {
+	dir := newP9Dir(t)
+	defer os.RemoveAll(dir)
+	c := newP9Client(t, filepath.Join(dir, "root"), true)
+	c.walk(0, 1, "sub", "hello.txt")
+	if err := c.open(1, p9ORdwr); err != p9EROFS {
+		t.Errorf("open(O_RDWR) error = %d; want EROFS", err)
+	}
+	var b p9enc
+	b.u32(0)
+	b.str("dir")
+	b.u32(0755)
+	b.u32(0)
+	if _, err := c.try(p9Tmkdir, b); err != p9EROFS {
+		t.Errorf("mkdir error = %d; want EROFS", err)
+	}
+}
+
+func TestVirtio9P(t *testing.T) {
+	dir := newP9Dir(t)
+	defer os.RemoveAll(dir)
+	d := newVirtioDriver(t, NewVirtio9P("host", NewP9Server(filepath.Join(dir, "root"), true)))
+	if got := d.config(0, 2); got != 4 {
+		t.Errorf("tag_len = %d; want 4", got)
+	}
+	var req p9enc
+	req.u32(uint32(p9HeaderSize + 4 + 2 + len(p9Version)))
+	req.u8(p9Tversion)
+	req.u16(0xffff)
+	req.u32(8192)
+	req.str(p9Version)
+	resp := &testBuf{write: true, n: 8192}
+	head := d.submit(0, &testBuf{data: req}, resp)
+	n := d.mustPop(0, head)
+	r := &p9dec{b: d.bytes(resp)[:n]}
+	r.u32()
+	if typ := r.u8(); typ != p9Tversion+1 {
+		t.Errorf("response type = %d; want Rversion", typ)
+	}
+}
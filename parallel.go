@@ -0,0 +1,245 @@
+// Copyright 2019 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"fmt"
+	"math/bits"
+	"sync"
+	"sync/atomic"
+	"unsafe"
+)
+
+// runParallel executes n instructions on every hart, each on its own goroutine,
+// in quanta of q instructions. The first error stops all harts.
+//
+//   - Loads, stores and AMOs on memory (the main memory and memory regions)
+//     are sync/atomic operations on the aligned words holding the accessed
+//     bytes, so naturally aligned accesses are single-copy atomic. Go's atomic
+//     operations are sequentially consistent, which is stronger than RVWMO:
+//     FENCE and the aq and rl bits need no further action.
+//     The bytes at the end of memory whose size isn't a multiple of 4 aren't
+//     in any word; accesses to them hold tailMu instead.
+//   - The A and D bits of PTEs are set with compare-and-swap. If another hart
+//     changed the PTE since the page table walk read it, the walk restarts.
+//   - SC is a compare-and-swap with the value loaded by LR. Like in other
+//     emulators that map LR/SC to compare-and-swap, SC succeeds if other harts
+//     changed the memory and then restored the loaded value.
+//   - Accesses to devices, environment calls and semihosting calls stop the
+//     world: the other harts are paused between quanta, so that devices and
+//     the SBI can safely change their state.
+//   - The time counters of the harts are synchronized at quantum boundaries:
+//     every hart moves its clock forward to the latest time of any hart.
+//     Idle harts don't warp their clocks.
+//
+// Instruction fetches load every 16-bit parcel atomically, so a 4-byte
+// instruction that another hart is replacing can be fetched half old and half
+// new. Code written by other harts must be published with atomic operations,
+// e.g. a store of a flag that the executing hart reads before FENCE.I, as
+// RISC-V requires as well.
+func (s *Scheduler) runParallel(n, q int) error {
+	var (
+		world sync.RWMutex
+		stop  int32  // set when a hart fails
+		now   uint64 // the latest time of any hart at a quantum boundary
+		mu    sync.Mutex
+		first error // of the first hart that failed
+		wg    sync.WaitGroup
+	)
+	for _, h := range s.Harts {
+		h.world = &world
+	}
+	for i, h := range s.Harts {
+		wg.Add(1)
+		go func(i int, h *VM) {
+			defer wg.Done()
+			for left := n; left > 0 && atomic.LoadInt32(&stop) == 0; {
+				k := q
+				if k > left {
+					k = left
+				}
+				world.RLock()
+				h.syncTime(&now)
+				err := h.Run(k)
+				world.RUnlock()
+				if err != nil {
+					if !IsExit(err) && !IsTrigger(err) {
+						err = fmt.Errorf("hart %d: %v", i, err)
+					}
+					mu.Lock()
+					if first == nil {
+						first = err
+					}
+					mu.Unlock()
+					atomic.StoreInt32(&stop, 1)
+					return
+				}
+				left -= k
+			}
+		}(i, h)
+	}
+	wg.Wait()
+	for _, h := range s.Harts {
+		h.world = nil
+	}
+	return first
+}
+
+// syncTime moves the clock of the hart forward to *now, the latest time of any
+// hart, or moves *now forward to the time of the hart.
+func (vm *VM) syncTime(now *uint64) {
+	for {
+		t := atomic.LoadUint64(now)
+		if t > vm.CSR[RDTIME] {
+			vm.tick(t - vm.CSR[RDTIME])
+			return
+		}
+		if t == vm.CSR[RDTIME] || atomic.CompareAndSwapUint64(now, t, vm.CSR[RDTIME]) {
+			return
+		}
+	}
+}
+
+// stopTheWorld calls f while the other harts running in parallel with vm are
+// paused. Unless vm runs in parallel mode, it just calls f. It's reentrant.
+func (vm *VM) stopTheWorld(f func()) {
+	if vm.world == nil || vm.exclusive {
+		f()
+		return
+	}
+	vm.world.RUnlock()
+	vm.world.Lock()
+	vm.exclusive = true
+	f()
+	vm.exclusive = false
+	vm.world.Unlock()
+	vm.world.RLock()
+}
+
+// sharedMem returns the memory holding the size bytes at the physical address
+// addr and their offset in it, if vm runs in parallel mode and the bytes are
+// in the main memory or in a memory region with the given permissions.
+func (vm *VM) sharedMem(addr uint64, size int, perms Perms) ([]byte, uint64, bool) {
+	if vm.world == nil {
+		return nil, 0, false
+	}
+	if r := vm.Bus.find(addr); r != nil {
+		m, ok := r.dev.(*MemoryRegion)
+		if !ok || m.Perms&perms != perms || addr-r.base+uint64(size) > uint64(len(m.Data)) {
+			return nil, 0, false
+		}
+		return m.Data, addr - r.base, true
+	}
+	if addr+uint64(size) > uint64(len(vm.Mem)) || addr+uint64(size) < addr {
+		return nil, 0, false
+	}
+	return vm.Mem, addr, true
+}
+
+// hostLittleEndian is true if the host stores words in little-endian order,
+// like RISC-V.
+var hostLittleEndian = func() bool {
+	w := uint16(1)
+	return *(*byte)(unsafe.Pointer(&w)) == 1
+}()
+
+// le32 and le64 convert words between the host's byte order and little-endian.
+func le32(w uint32) uint32 {
+	if hostLittleEndian {
+		return w
+	}
+	return bits.ReverseBytes32(w)
+}
+
+func le64(w uint64) uint64 {
+	if hostLittleEndian {
+		return w
+	}
+	return bits.ReverseBytes64(w)
+}
+
+// word32 and word64 return pointers to the aligned words at b[off:].
+func word32(b []byte, off uint64) *uint32 { return (*uint32)(unsafe.Pointer(&b[off])) }
+func word64(b []byte, off uint64) *uint64 { return (*uint64)(unsafe.Pointer(&b[off])) }
+
+// inWord reports whether the size bytes at b[off:] are within an aligned
+// 4-byte word of b.
+func inWord(b []byte, off uint64, size int) bool {
+	return off%4+uint64(size) <= 4 && off&^3+4 <= uint64(len(b))
+}
+
+// tailMu guards the bytes at the end of shared memory that aren't in any
+// aligned 4-byte word of it.
+var tailMu sync.Mutex
+
+// loadShared atomically loads size bytes (little-endian) at b[off:].
+// Misaligned accesses are performed one byte at a time.
+func loadShared(b []byte, off uint64, size int) uint64 {
+	switch {
+	case size == 8 && off%8 == 0:
+		return le64(atomic.LoadUint64(word64(b, off)))
+	case inWord(b, off, size):
+		w := le32(atomic.LoadUint32(word32(b, off&^3)))
+		return uint64(w) >> (8 * (off % 4)) & sizeMask(size)
+	case size == 1:
+		tailMu.Lock()
+		defer tailMu.Unlock()
+		return uint64(b[off])
+	}
+	var v uint64
+	for i := 0; i < size; i++ {
+		v |= loadShared(b, off+uint64(i), 1) << (8 * uint(i))
+	}
+	return v
+}
+
+// storeShared atomically stores size bytes of v (little-endian) at b[off:].
+// Bytes and halfwords are merged into their words with compare-and-swap.
+// Misaligned accesses are performed one byte at a time.
+func storeShared(b []byte, off uint64, size int, v uint64) {
+	switch {
+	case size == 8 && off%8 == 0:
+		atomic.StoreUint64(word64(b, off), le64(v))
+	case size == 4 && off%4 == 0:
+		atomic.StoreUint32(word32(b, off), le32(uint32(v)))
+	case inWord(b, off, size):
+		p, shift := word32(b, off&^3), 8*(off%4)
+		mask := uint32(sizeMask(size)) << shift
+		for {
+			old := atomic.LoadUint32(p)
+			w := le32(old)&^mask | uint32(v)<<shift&mask
+			if atomic.CompareAndSwapUint32(p, old, le32(w)) {
+				return
+			}
+		}
+	case size == 1:
+		tailMu.Lock()
+		b[off] = byte(v)
+		tailMu.Unlock()
+	default:
+		for i := 0; i < size; i++ {
+			storeShared(b, off+uint64(i), 1, v>>(8*uint(i)))
+		}
+	}
+}
+
+// casShared atomically replaces the naturally aligned 4 or 8 bytes at b[off:]
+// with v if they hold old. It reports whether it did.
+func casShared(b []byte, off uint64, size int, old, v uint64) bool {
+	if size == 8 {
+		return atomic.CompareAndSwapUint64(word64(b, off), le64(old), le64(v))
+	}
+	return atomic.CompareAndSwapUint32(word32(b, off), le32(uint32(old)), le32(uint32(v)))
+}
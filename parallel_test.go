@@ -0,0 +1,230 @@
+// Copyright 2019 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+const (
+	amoaddZeroT2A2 = 0x0076302f // amoadd.d zero, t2, (a2)
+	jMinus4        = 0xffdff06f // j -4
+	addiT1T1One    = 0x00130313 // addi t1, t1, 1
+	scT3T1A2       = 0x18663e2f // sc.d t3, t1, (a2)
+	bnezT3Minus12  = 0xfe0e1ae3 // bnez t3, -12
+	addiS0S0One    = 0x00140413 // addi s0, s0, 1
+	jMinus20       = 0xfedff06f // j -20
+	sdT2A2         = 0x00763023 // sd t2, 0(a2)
+	fenceRWRW      = 0x0330000f // fence rw, rw
+	sdT2A3         = 0x0076b023 // sd t2, 0(a3)
+	jZero          = 0x0000006f // j 0
+	ldT1A3         = 0x0006b303 // ld t1, 0(a3)
+	beqzT1Minus4   = 0xfe030ee3 // beqz t1, -4
+	ldT4A2         = 0x00063e83 // ld t4, 0(a2)
+	lbuT1A2        = 0x00064303 // lbu t1, 0(a2)
+	sbT1A2         = 0x00660023 // sb t1, 0(a2)
+	swT2A3         = 0x0076a023 // sw t2, 0(a3)
+	swT5A4         = 0x01e72023 // sw t5, 0(a4)
+	lwT1A2         = 0x00062303 // lw t1, 0(a2)
+	sfenceVMAInstr = 0x12000073 // sfence.vma
+	jMinus8        = 0xff9ff06f // j -8
+	amoandZeroT3A3 = 0x61c6b02f // amoand.d zero, t3, (a3)
+	swZeroA2       = 0x00062023 // sw zero, 0(a2)
+	andiT1T1D      = 0x08037313 // andi t1, t1, 0x80 (pteD)
+	bnezT1Minus20  = 0xfe0316e3 // bnez t1, -20
+)
+
+// runParallelTest runs n instructions on every hart in parallel mode.
+func runParallelTest(t *testing.T, harts []*VM, n int) {
+	t.Helper()
+	s := &Scheduler{Harts: harts, Quantum: 10, Parallel: true}
+	if err := s.Run(n); err != nil {
+		t.Fatalf("Run failed: %v", err)
+	}
+	for i, h := range harts {
+		if h.Steps != n {
+			t.Errorf("hart %d executed %d steps; want %d", i, h.Steps, n)
+		}
+		if h.world != nil {
+			t.Errorf("hart %d still runs in parallel mode", i)
+		}
+	}
+}
+
+func TestParallelAMO(t *testing.T) {
+	const iters = 5000
+	harts := newSMPTest(t, 4, amoaddZeroT2A2, jMinus4)
+	for _, h := range harts {
+		h.Reg[regNums["t2"]], h.Reg[regNums["a2"]] = 1, 0x800
+	}
+	runParallelTest(t, harts, 2*iters)
+	if got, _ := harts[0].read(0x800, 8); got != 4*iters {
+		t.Errorf("counter = %d; want %d", got, 4*iters)
+	}
+}
+
+func TestParallelLRSC(t *testing.T) {
+	harts := newSMPTest(t, 4, lrT1A2, addiT1T1One, scT3T1A2, bnezT3Minus12, addiS0S0One, jMinus20)
+	for _, h := range harts {
+		h.Reg[regNums["a2"]] = 0x800
+	}
+	runParallelTest(t, harts, 10000)
+	// Every successful SC incremented the counter once. s0 counts them,
+	// except for the last one of a hart that stopped right after it.
+	var want uint64
+	for _, h := range harts {
+		want += h.Reg[regNums["s0"]]
+		if h.PC == 16 || h.PC == 12 && h.Reg[regNums["t3"]] == 0 {
+			want++
+		}
+	}
+	if got, _ := harts[0].read(0x800, 8); got != want || got == 0 {
+		t.Errorf("counter = %d; want %d successful SCs", got, want)
+	}
+}
+
+func TestParallelMessagePassing(t *testing.T) {
+	const (
+		data     = 0x800
+		flag     = 0x900
+		finisher = 0x2000
+	)
+	// Hart 0 stores the data and then the flag. Hart 1 waits for the flag,
+	// loads the data and powers off the machine.
+	harts := newSMPTest(t, 2, sdT2A2, fenceRWRW, sdT2A3, jZero,
+		ldT1A3, beqzT1Minus4, fenceRWRW, ldT4A2, swT5A4)
+	if err := harts[0].Bus.Map(finisher, TestFinisherSize, TestFinisher{}); err != nil {
+		t.Fatal(err)
+	}
+	harts[1].PC = 0x10
+	for _, h := range harts {
+		h.Reg[regNums["t2"]], h.Reg[regNums["a2"]], h.Reg[regNums["a3"]] = 42, data, flag
+		h.Reg[regNums["t5"]], h.Reg[regNums["a4"]] = finisherPass, finisher
+	}
+	s := &Scheduler{Harts: harts, Quantum: 10, Parallel: true}
+	if err := s.Run(1 << 30); !IsExit(err) {
+		t.Fatalf("Run returned %v; want an exit", err)
+	}
+	if got := harts[1].Reg[regNums["t4"]]; got != 42 {
+		t.Errorf("hart 1 loaded %d; want 42", got)
+	}
+}
+
+func TestParallelByteStores(t *testing.T) {
+	// Every hart increments its own byte of the same word.
+	const iters = 200
+	harts := newSMPTest(t, 4, lbuT1A2, addiT1T1One, sbT1A2, jMinus12)
+	for i, h := range harts {
+		h.Reg[regNums["a2"]] = 0x800 + uint64(i)
+	}
+	runParallelTest(t, harts, 4*iters)
+	if got, _ := harts[0].read(0x800, 4); got != 0xc8c8c8c8 {
+		t.Errorf("word = %#x; want 0xc8c8c8c8", got)
+	}
+}
+
+func TestParallelPTEUpdates(t *testing.T) {
+	const code = 0x10000
+	// Hart 0 loads from pageVA, setting the A bit of its PTE. Hart 1 clears
+	// the A and D bits, stores to pageVA and checks that the D bit is set:
+	// a walk of hart 0 that read the PTE before the store must not clear it.
+	// That takes a narrow interleaving, so a regression may go unnoticed.
+	// The page tables are mapped at gigaVA.
+	vm := newPagedVM(t, pteV|pteR|pteW)
+	for i, in := range []uint64{
+		lwT1A2, sfenceVMAInstr, jMinus8,
+		amoandZeroT3A3, sfenceVMAInstr, swZeroA2, ldT1A3, andiT1T1D, bnezT1Minus20,
+	} {
+		copy(vm.Mem[code+4*i:], asBytes(in))
+	}
+	harts := NewHarts(vm, 2)
+	for _, h := range harts {
+		h.writeCSR(csrSatp, vm.CSR[csrSatp])
+		h.Priv = PrivS
+		h.Reg[regNums["a2"]], h.Reg[regNums["a3"]] = pageVA, gigaVA+leafPTE
+		h.Reg[regNums["t3"]] = ^uint64(pteA | pteD)
+	}
+	harts[0].PC, harts[1].PC = gigaVA+code, gigaVA+code+12
+	runParallelTest(t, harts, 30000)
+}
+
+func TestParallelCodeStores(t *testing.T) {
+	// Hart 0 executes the instruction that hart 1 keeps storing. Under the
+	// race detector and GOMAXPROCS > 1, this checks that fetches are atomic
+	// loads.
+	harts := newSMPTest(t, 2, jZero, swT2A3, jMinus4)
+	harts[1].PC = 4
+	harts[1].Reg[regNums["t2"]] = jZero
+	runParallelTest(t, harts, 1000)
+	if harts[0].PC != 0 {
+		t.Errorf("hart 0: PC = %#x; want 0", harts[0].PC)
+	}
+}
+
+func TestParallelStop(t *testing.T) {
+	const finisher = 0x2000
+	// Hart 0 loops forever; hart 1 powers off the machine.
+	harts := newSMPTest(t, 3, jZero, swT2A3)
+	if err := harts[0].Bus.Map(finisher, TestFinisherSize, TestFinisher{}); err != nil {
+		t.Fatal(err)
+	}
+	harts[1].PC = 4
+	harts[1].Reg[regNums["t2"]], harts[1].Reg[regNums["a3"]] = finisherPass, finisher
+	s := &Scheduler{Harts: harts, Quantum: 10, Parallel: true}
+	if err := s.Run(1 << 30); !IsExit(err) {
+		t.Fatalf("Run returned %v; want an exit", err)
+	}
+
+	// Hart 1 executes an illegal instruction, which fails when there's no
+	// trap handler.
+	harts = newSMPTest(t, 2, jZero, 0)
+	harts[1].PC = 4
+	s = &Scheduler{Harts: harts, Quantum: 10, Parallel: true}
+	if err := s.Run(1 << 30); err == nil || !strings.HasPrefix(err.Error(), "hart 1: ") {
+		t.Fatalf("Run returned %v; want an error of hart 1", err)
+	}
+}
+
+func TestSharedMemory(t *testing.T) {
+	b := make([]byte, 18)
+	for _, tt := range []struct {
+		off  uint64
+		size int
+		v    uint64
+	}{
+		{0, 8, 0x0807060504030201},
+		{8, 4, 0x44332211},
+		{13, 1, 0xab},
+		{14, 2, 0xcdef},
+		{3, 2, 0x1234},             // crosses a word boundary
+		{5, 8, 0x1122334455667788}, // misaligned
+		{16, 2, 0x5678},            // the end of odd-sized memory
+	} {
+		storeShared(b, tt.off, tt.size, tt.v)
+		if got := loadShared(b, tt.off, tt.size); got != tt.v {
+			t.Errorf("loadShared(%d, %d) = %#x after storing %#x", tt.off, tt.size, got, tt.v)
+		}
+		for i := 0; i < tt.size; i++ {
+			if got, want := b[tt.off+uint64(i)], byte(tt.v>>(8*uint(i))); got != want {
+				t.Errorf("store of %#x at %d: byte %d = %#x; want %#x", tt.v, tt.off, i, got, want)
+			}
+		}
+	}
+	old := loadShared(b, 0, 8)
+	if casShared(b, 0, 8, old+1, 7) || !casShared(b, 0, 8, old, 7) || loadShared(b, 0, 8) != 7 {
+		t.Errorf("casShared replaced a word that didn't hold the old value, or didn't replace one that did")
+	}
+}
@@ -0,0 +1,128 @@
+// Copyright 2019 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+	"sync"
+	"time"
+)
+
+// pcap file format constants. See
+// https://wiki.wireshark.org/Development/LibpcapFileFormat
+const (
+	pcapMagic         = 0xa1b2c3d4 // microsecond timestamps
+	pcapMagicNano     = 0xa1b23c4d // nanosecond timestamps
+	pcapHeaderSize    = 24
+	pcapRecordSize    = 16
+	pcapSnapLen       = 65535
+	pcapLinkEthernet  = 1
+	pcapVersionMajor  = 2
+	pcapVersionMinor  = 4
+	pcapMaxRecordSize = 1 << 18
+)
+
+// PcapWriter writes Ethernet frames to a pcap file. It's safe for concurrent
+// use.
+type PcapWriter struct {
+	mu sync.Mutex
+	w  io.Writer
+}
+
+// NewPcapWriter writes the pcap file header to w and returns a writer of
+// frames.
+func NewPcapWriter(w io.Writer) (*PcapWriter, error) {
+	var h [pcapHeaderSize]byte
+	binary.LittleEndian.PutUint32(h[0:], pcapMagic)
+	binary.LittleEndian.PutUint16(h[4:], pcapVersionMajor)
+	binary.LittleEndian.PutUint16(h[6:], pcapVersionMinor)
+	binary.LittleEndian.PutUint32(h[16:], pcapSnapLen)
+	binary.LittleEndian.PutUint32(h[20:], pcapLinkEthernet)
+	if _, err := w.Write(h[:]); err != nil {
+		return nil, err
+	}
+	return &PcapWriter{w: w}, nil
+}
+
+// WriteFrame appends the frame to the file.
+func (p *PcapWriter) WriteFrame(frame []byte) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	now := time.Now()
+	incl := len(frame)
+	if incl > pcapSnapLen {
+		incl = pcapSnapLen
+	}
+	var h [pcapRecordSize]byte
+	binary.LittleEndian.PutUint32(h[0:], uint32(now.Unix()))
+	binary.LittleEndian.PutUint32(h[4:], uint32(now.Nanosecond()/1000))
+	binary.LittleEndian.PutUint32(h[8:], uint32(incl))
+	binary.LittleEndian.PutUint32(h[12:], uint32(len(frame)))
+	if _, err := p.w.Write(h[:]); err != nil {
+		return err
+	}
+	_, err := p.w.Write(frame[:incl])
+	return err
+}
+
+// PcapReader reads Ethernet frames from a pcap file.
+type PcapReader struct {
+	r     io.Reader
+	order binary.ByteOrder
+}
+
+// NewPcapReader reads the pcap file header from r and returns a reader of
+// frames. Only Ethernet captures are supported.
+func NewPcapReader(r io.Reader) (*PcapReader, error) {
+	var h [pcapHeaderSize]byte
+	if _, err := io.ReadFull(r, h[:]); err != nil {
+		return nil, fmt.Errorf("can't read pcap header: %v", err)
+	}
+	p := &PcapReader{r: r}
+	for _, o := range []binary.ByteOrder{binary.LittleEndian, binary.BigEndian} {
+		if m := o.Uint32(h[0:]); m == pcapMagic || m == pcapMagicNano {
+			p.order = o
+		}
+	}
+	if p.order == nil {
+		return nil, fmt.Errorf("not a pcap file (magic %#x)", binary.LittleEndian.Uint32(h[0:]))
+	}
+	if link := p.order.Uint32(h[20:]); link != pcapLinkEthernet {
+		return nil, fmt.Errorf("unsupported pcap link type %d; want Ethernet (%d)", link, pcapLinkEthernet)
+	}
+	return p, nil
+}
+
+// ReadFrame returns the next frame. It returns io.EOF at the end of the file.
+func (p *PcapReader) ReadFrame() ([]byte, error) {
+	var h [pcapRecordSize]byte
+	if _, err := io.ReadFull(p.r, h[:]); err != nil {
+		if err == io.ErrUnexpectedEOF {
+			err = fmt.Errorf("truncated pcap record header")
+		}
+		return nil, err
+	}
+	n := p.order.Uint32(h[8:])
+	if n > pcapMaxRecordSize {
+		return nil, fmt.Errorf("pcap record too large (%d bytes)", n)
+	}
+	frame := make([]byte, n)
+	if _, err := io.ReadFull(p.r, frame); err != nil {
+		return nil, fmt.Errorf("truncated pcap record: %v", err)
+	}
+	return frame, nil
+}
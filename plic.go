@@ -0,0 +1,258 @@
+// Copyright 2019 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"fmt"
+	"sync"
+)
+
+// PLIC register map. See the SiFive U54-MC manual (chapter 10, "Platform-Level
+// Interrupt Controller") and the RISC-V PLIC specification.
+const (
+	plicPriority   = 0x000000 // 4 bytes per source
+	plicPending    = 0x001000 // 1 bit per source
+	plicEnable     = 0x002000 // 0x80 bytes per context; 1 bit per source
+	plicEnableSize = 0x80
+	plicContext    = 0x200000 // 0x1000 bytes per context
+	plicContextLen = 0x1000
+	plicThreshold  = 0x0 // offset within the context block
+	plicClaim      = 0x4 // offset within the context block
+
+	// PLICSize is the size of the PLIC's address space.
+	PLICSize = 0x4000000
+
+	// plicMaxPriority is the highest priority supported by the PLIC. Only
+	// the bits set in plicMaxPriority are writable in the priority and
+	// threshold registers.
+	plicMaxPriority = 7
+)
+
+// InterruptLine is a wire from a device model to an interrupt controller.
+// Device models call SetLevel(true) to assert the line and SetLevel(false) to
+// deassert it. Lines are level-triggered.
+type InterruptLine interface {
+	SetLevel(high bool)
+}
+
+// PLIC is a SiFive-compatible Platform-Level Interrupt Controller. It
+// implements the Device interface.
+//
+// Each hart has two contexts: context 2*i drives mip.MEIP of hart i and context
+// 2*i+1 drives mip.SEIP of hart i. Interrupt source 0 doesn't exist.
+type PLIC struct {
+	mu       sync.Mutex
+	sources  int        // number of sources, including the non-existent source 0
+	priority []uint32   // per source
+	level    []bool     // per source; current level of the interrupt line
+	pending  []uint32   // bitmap of pending sources
+	claimed  []uint32   // bitmap of sources claimed but not completed yet
+	contexts []*plicCtx // see the PLIC type comment
+}
+
+type plicCtx struct {
+	vm        *VM
+	mip       uint64   // the mip bit driven by this context
+	enable    []uint32 // bitmap of enabled sources
+	threshold uint32
+}
+
+// NewPLIC returns a PLIC with interrupt sources 1 to n (inclusive) that
+// delivers interrupts to the given harts.
+func NewPLIC(n int, harts ...*VM) *PLIC {
+	if n < 1 || n > 1023 {
+		panic(fmt.Sprintf("the PLIC supports 1 to 1023 interrupt sources; got %d", n))
+	}
+	words := (n + 1 + 31) / 32
+	p := &PLIC{
+		sources:  n + 1,
+		priority: make([]uint32, n+1),
+		level:    make([]bool, n+1),
+		pending:  make([]uint32, words),
+		claimed:  make([]uint32, words),
+	}
+	for _, vm := range harts {
+		for _, mip := range []uint64{mipMEIP, mipSEIP} {
+			p.contexts = append(p.contexts, &plicCtx{
+				vm:     vm,
+				mip:    mip,
+				enable: make([]uint32, words),
+			})
+		}
+	}
+	return p
+}
+
+// Line returns the interrupt line connected to the given source.
+func (p *PLIC) Line(src int) InterruptLine {
+	if src <= 0 || src >= p.sources {
+		panic(fmt.Sprintf("PLIC interrupt source %d out of range [1, %d]", src, p.sources-1))
+	}
+	return plicLine{p: p, src: src}
+}
+
+type plicLine struct {
+	p   *PLIC
+	src int
+}
+
+func (l plicLine) SetLevel(high bool) { l.p.SetLevel(l.src, high) }
+
+// SetLevel asserts (high == true) or deasserts (high == false) the interrupt
+// line of the given source. While a source is claimed by a hart, changes of
+// its level are latched and forwarded to the PLIC core once the hart
+// signals completion.
+func (p *PLIC) SetLevel(src int, high bool) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if src <= 0 || src >= p.sources {
+		return
+	}
+	p.level[src] = high
+	if !bit(p.claimed, src) {
+		setBit(p.pending, src, high)
+	}
+	p.update()
+}
+
+// Load implements the Device interface.
+func (p *PLIC) Load(offset uint64, size int) (uint64, error) {
+	if size != 4 || offset%4 != 0 {
+		return 0, fmt.Errorf("PLIC: unsupported %d-byte load at offset %#x", size, offset)
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	switch {
+	case offset < plicPending:
+		if src := int(offset / 4); src < p.sources {
+			return uint64(p.priority[src]), nil
+		}
+	case offset < plicEnable:
+		if w := int(offset-plicPending) / 4; w < len(p.pending) {
+			return uint64(p.pending[w]), nil
+		}
+	case offset < plicContext:
+		ctx, w := int(offset-plicEnable)/plicEnableSize, int(offset-plicEnable)%plicEnableSize/4
+		if ctx < len(p.contexts) && w < len(p.pending) {
+			return uint64(p.contexts[ctx].enable[w]), nil
+		}
+	default:
+		ctx := int(offset-plicContext) / plicContextLen
+		if ctx >= len(p.contexts) {
+			break
+		}
+		c := p.contexts[ctx]
+		switch offset % plicContextLen {
+		case plicThreshold:
+			return uint64(c.threshold), nil
+		case plicClaim:
+			src := p.best(c)
+			if src != 0 {
+				setBit(p.pending, src, false)
+				setBit(p.claimed, src, true)
+				p.update()
+			}
+			return uint64(src), nil
+		}
+	}
+	return 0, nil
+}
+
+// Store implements the Device interface.
+func (p *PLIC) Store(offset uint64, size int, v uint64) error {
+	if size != 4 || offset%4 != 0 {
+		return fmt.Errorf("PLIC: unsupported %d-byte store at offset %#x", size, offset)
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	switch {
+	case offset < plicPending:
+		if src := int(offset / 4); src > 0 && src < p.sources {
+			p.priority[src] = uint32(v) & plicMaxPriority
+		}
+	case offset < plicEnable:
+		// The pending bits are read-only.
+	case offset < plicContext:
+		ctx, w := int(offset-plicEnable)/plicEnableSize, int(offset-plicEnable)%plicEnableSize/4
+		if ctx < len(p.contexts) && w < len(p.pending) {
+			v := uint32(v)
+			if w == 0 {
+				v &^= 1 // source 0 doesn't exist
+			}
+			if w == len(p.pending)-1 && p.sources%32 != 0 {
+				v &= 1<<uint(p.sources%32) - 1
+			}
+			p.contexts[ctx].enable[w] = v
+		}
+	default:
+		ctx := int(offset-plicContext) / plicContextLen
+		if ctx >= len(p.contexts) {
+			break
+		}
+		c := p.contexts[ctx]
+		switch offset % plicContextLen {
+		case plicThreshold:
+			c.threshold = uint32(v) & plicMaxPriority
+		case plicClaim:
+			// Completion for sources that aren't enabled for the context
+			// is silently ignored.
+			src := int(uint32(v))
+			if src <= 0 || src >= p.sources || !bit(c.enable, src) || !bit(p.claimed, src) {
+				break
+			}
+			setBit(p.claimed, src, false)
+			setBit(p.pending, src, p.level[src])
+		}
+	}
+	p.update()
+	return nil
+}
+
+// best returns the pending source with the highest priority that is enabled
+// for the context and whose priority exceeds the context's threshold. Ties
+// are broken in favor of the lowest source ID. It returns 0 if there's no such
+// source.
+func (p *PLIC) best(c *plicCtx) int {
+	var src int
+	var prio uint32
+	for i := 1; i < p.sources; i++ {
+		if !bit(p.pending, i) || !bit(c.enable, i) {
+			continue
+		}
+		if pr := p.priority[i]; pr > c.threshold && pr > prio {
+			src, prio = i, pr
+		}
+	}
+	return src
+}
+
+// update recomputes the PLIC outputs and reflects them in the mip CSRs.
+func (p *PLIC) update() {
+	for _, c := range p.contexts {
+		c.vm.setMIP(c.mip, p.best(c) != 0)
+	}
+}
+
+func bit(bitmap []uint32, i int) bool {
+	return bitmap[i/32]&(1<<uint(i%32)) != 0
+}
+
+func setBit(bitmap []uint32, i int, v bool) {
+	if v {
+		bitmap[i/32] |= 1 << uint(i%32)
+	} else {
+		bitmap[i/32] &^= 1 << uint(i%32)
+	}
+}
@@ -0,0 +1,90 @@
+// Copyright 2019 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import "testing"
+
+func TestPLIC(t *testing.T) {
+	const base = 0xc000000
+	vm := &VM{Mem: make([]byte, 16), Bus: &Bus{}}
+	p := NewPLIC(40, vm)
+	if err := vm.Bus.Map(base, PLICSize, p); err != nil {
+		t.Fatalf("Can't map the PLIC: %v", err)
+	}
+	write := func(off, v uint64) {
+		t.Helper()
+		if err := vm.write(base+off, 4, v); err != nil {
+			t.Fatalf("write(%#x, %#x) failed: %v", off, v, err)
+		}
+	}
+	read := func(off uint64) uint64 {
+		t.Helper()
+		v, err := vm.read(base+off, 4)
+		if err != nil {
+			t.Fatalf("read(%#x) failed: %v", off, err)
+		}
+		return v
+	}
+	wantMIP := func(desc string, want uint64) {
+		t.Helper()
+		if got := vm.CSR[csrMIP]; got != want {
+			t.Errorf("%s: mip = %#x; want %#x", desc, got, want)
+		}
+	}
+
+	// Source 3 with priority 1 and source 33 with priority 5; both enabled
+	// for the M-mode context. Source 33 is enabled for the S-mode context.
+	write(3*4, 1)
+	write(33*4, 5)
+	write(plicEnable, 1<<3)
+	write(plicEnable+4, 1<<1)
+	write(plicEnable+plicEnableSize+4, 1<<1)
+	wantMIP("no lines asserted", 0)
+
+	p.Line(3).SetLevel(true)
+	wantMIP("source 3 asserted", mipMEIP)
+	if got, want := read(plicPending), uint64(1<<3); got != want {
+		t.Errorf("pending = %#x; want %#x", got, want)
+	}
+
+	p.Line(33).SetLevel(true)
+	wantMIP("sources 3 and 33 asserted", mipMEIP|mipSEIP)
+
+	// Threshold 5 masks both sources for the S-mode context.
+	write(plicContext+plicContextLen+plicThreshold, 5)
+	wantMIP("S-mode threshold", mipMEIP)
+	write(plicContext+plicContextLen+plicThreshold, 0)
+
+	if got := read(plicContext + plicClaim); got != 33 {
+		t.Errorf("claim = %d; want 33 (the highest priority)", got)
+	}
+	if got := read(plicContext + plicClaim); got != 3 {
+		t.Errorf("claim = %d; want 3", got)
+	}
+	if got := read(plicContext + plicClaim); got != 0 {
+		t.Errorf("claim = %d; want 0 (nothing pending)", got)
+	}
+	wantMIP("all claimed", 0)
+
+	// Line 3 is still high, so completing it makes it pending again. Line 33
+	// was deasserted while claimed.
+	p.Line(33).SetLevel(false)
+	write(plicContext+plicClaim, 33)
+	wantMIP("33 completed", 0)
+	write(plicContext+plicClaim, 3)
+	wantMIP("3 completed", mipMEIP)
+	p.Line(3).SetLevel(false)
+	wantMIP("3 deasserted", 0)
+}
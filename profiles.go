@@ -0,0 +1,101 @@
+// Copyright 2019 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// machineProfile is a built-in machine description.
+type machineProfile struct {
+	desc   string // shown in the help of --machine
+	config string // JSON, see MachineConfig
+}
+
+// machineProfiles are built-in machine descriptions, selected by name instead
+// of a path with --machine.
+var machineProfiles = map[string]machineProfile{
+	// virt has the memory map of QEMU's virt machine: 128MiB of RAM at
+	// 0x80000000, a CLINT, a PLIC, a UART, an RTC and a test finisher.
+	// Virtio devices requested with flags are mapped at QEMU's virtio-mmio
+	// slots. It targets unmodified xv6-riscv; booting it hasn't been
+	// verified (TestXV6 needs a kernel and a file system image that aren't
+	// in the tree, see TestVirtPayload for what is tested):
+	//
+	//	riscv-emu --machine=virt --load=kernel/kernel --virtio_blk=fs.img --uart_input=- --max_steps=10000000000
+	"virt": {"QEMU's virt memory map, targets xv6-riscv", `{
+		"memory": [
+			{"name": "ram", "base": "0x80000000", "size": "0x8000000", "perms": "rwx"}
+		],
+		"devices": [
+			{"type": "test-finisher", "base": "0x100000"},
+			{"type": "rtc", "base": "0x101000", "irq": 11},
+			{"type": "clint", "base": "0x2000000"},
+			{"type": "plic", "base": "0xc000000"},
+			{"type": "uart", "base": "0x10000000", "irq": 10}
+		]
+	}`},
+	// linux is virt with 256MiB of RAM and the built-in SBI, which starts
+	// the kernel in S-mode. It targets a stock defconfig kernel Image with
+	// a BusyBox initramfs; booting one hasn't been verified (TestLinux needs
+	// images that aren't in the tree, see TestLinuxPayload for what is
+	// tested):
+	//
+	//	riscv-emu --machine=linux --load=Image@0x80200000 --initrd=rootfs.cpio@0x88000000 --uart_input=- --max_steps=100000000000
+	"linux": {"virt with 256MiB of RAM and the built-in SBI, targets Linux", `{
+		"memory": [
+			{"name": "ram", "base": "0x80000000", "size": "0x10000000", "perms": "rwx"}
+		],
+		"sbi": true,
+		"devices": [
+			{"type": "test-finisher", "base": "0x100000"},
+			{"type": "rtc", "base": "0x101000", "irq": 11},
+			{"type": "clint", "base": "0x2000000"},
+			{"type": "plic", "base": "0xc000000"},
+			{"type": "uart", "base": "0x10000000", "irq": 10}
+		]
+	}`},
+}
+
+// MachineProfile returns the built-in machine description with the given
+// name. ok is false if there's no such profile.
+func MachineProfile(name string) (c *MachineConfig, ok bool) {
+	p, ok := machineProfiles[name]
+	if !ok {
+		return nil, false
+	}
+	c, err := ReadMachineConfig(strings.NewReader(p.config))
+	if err != nil {
+		panic("invalid machine profile " + name + ": " + err.Error())
+	}
+	return c, true
+}
+
+// machineProfileHelp describes the built-in machine profiles for the help of
+// --machine.
+func machineProfileHelp() string {
+	var names []string
+	for name := range machineProfiles {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	var descs []string
+	for _, name := range names {
+		descs = append(descs, fmt.Sprintf("'%s' (%s)", name, machineProfiles[name].desc))
+	}
+	return strings.Join(descs, ", ")
+}
@@ -0,0 +1,223 @@
+// Copyright 2019 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+// "A" Standard Extension for Atomic Instructions
+//
+// riscv-spec-v2.2; Chapter 7; Page 39. The aq and rl bits are ignored: a hart
+// performs its memory accesses in program order, and harts running in parallel
+// access memory with sequentially consistent atomic operations.
+
+// atomicAddr returns the physical address accessed by the AMO, LR or SC
+// instruction. The address must be naturally aligned; misaligned addresses
+// raise address-misaligned exceptions regardless of the misaligned access
+// policy.
+func (vm *VM) atomicAddr(in *Instruction, size int, a accessType) (uint64, error) {
+	addr := vm.Reg[in.rs1]
+	kind, cause := uint64(mc6Store), uint64(causeStoreMisaligned)
+	if a == accessLoad {
+		kind, cause = mc6Load, causeLoadMisaligned
+	}
+	if err := vm.memTriggers(kind, addr, size, 0, phaseAddr); err != nil {
+		return 0, err
+	}
+	if addr&uint64(size-1) != 0 {
+		return 0, &exception{cause: cause, tval: addr}
+	}
+	return vm.translate(addr, a)
+}
+
+// amo atomically loads size bytes at rs1, stores op(loaded value, rs2) there
+// and writes the loaded value, sign-extended, to rd. Words are sign-extended
+// before they're passed to op.
+func amo(vm *VM, in *Instruction, size int, op func(v, src uint64) uint64) (flags, error) {
+	pa, err := vm.atomicAddr(in, size, accessStore)
+	if err != nil {
+		return flags{}, err
+	}
+	if b, off, ok := vm.sharedMem(pa, size, PermRead|PermWrite); ok {
+		// Other harts run in parallel; retry until no other hart
+		// changes the memory between the load and the store.
+		src := vm.Reg[in.rs2]
+		if size == 4 {
+			src = signExtend(src&0xffffffff, 31)
+		}
+		for {
+			old := loadShared(b, off, size)
+			v := old
+			if size == 4 {
+				v = signExtend(v, 31)
+			}
+			if casShared(b, off, size, old, op(v, src)) {
+				vm.store(in.rd, v)
+				return flags{}, nil
+			}
+		}
+	}
+	var out flags
+	vm.stopTheWorld(func() { out, err = amoPhys(vm, in, pa, size, op) })
+	return out, err
+}
+
+// amoPhys performs the AMO at the physical address pa while no other hart
+// accesses memory.
+func amoPhys(vm *VM, in *Instruction, pa uint64, size int, op func(v, src uint64) uint64) (flags, error) {
+	v, err := vm.read(pa, size)
+	if e, ok := err.(*exception); ok {
+		// AMOs raise store/AMO faults.
+		return flags{}, &exception{cause: causeStoreAccessFault, tval: e.tval}
+	}
+	if err != nil {
+		return flags{}, err
+	}
+	src := vm.Reg[in.rs2]
+	if size == 4 {
+		v, src = signExtend(v, 31), signExtend(src&0xffffffff, 31)
+	}
+	if err := vm.write(pa, size, op(v, src)); err != nil {
+		return flags{}, err
+	}
+	vm.store(in.rd, v)
+	return flags{}, nil
+}
+
+// lr loads size bytes at rs1 and registers a reservation on them.
+func lr(vm *VM, in *Instruction, size int) (flags, error) {
+	pa, err := vm.atomicAddr(in, size, accessLoad)
+	if err != nil {
+		return flags{}, err
+	}
+	v, err := vm.read(pa, size)
+	if err != nil {
+		return flags{}, err
+	}
+	vm.reserved, vm.reservation = true, pa
+	vm.lrValue, vm.lrSize = v, size
+	if size == 4 {
+		v = signExtend(v, 31)
+	}
+	vm.store(in.rd, v)
+	return flags{}, nil
+}
+
+// sc stores size bytes of rs2 at rs1 if there's a reservation on them, and
+// writes 0 to rd if the store succeeded or 1 if it didn't. The reservation is
+// cleared either way.
+//
+// Stores of other harts clear reservations, unless the harts run in parallel.
+// Then the store succeeds only if the memory still holds the value loaded by
+// LR.
+func sc(vm *VM, in *Instruction, size int) (flags, error) {
+	pa, err := vm.atomicAddr(in, size, accessStore)
+	if err != nil {
+		return flags{}, err
+	}
+	ok := vm.reserved && vm.reservation == pa
+	vm.reserved = false
+	if b, off, shared := vm.sharedMem(pa, size, PermWrite); shared && ok {
+		ok = vm.lrSize == size && casShared(b, off, size, vm.lrValue, vm.Reg[in.rs2])
+	} else if ok {
+		if err := vm.write(pa, size, vm.Reg[in.rs2]); err != nil {
+			return flags{}, err
+		}
+	}
+	if !ok {
+		vm.store(in.rd, 1)
+		return flags{}, nil
+	}
+	vm.store(in.rd, 0)
+	return flags{}, nil
+}
+
+// clearReservations clears the reservations of other harts overlapping the
+// size bytes at the physical address addr, which vm stores to. Their SCs fail
+// then. Reservation sets are naturally aligned doublewords.
+func (vm *VM) clearReservations(addr uint64, size int) {
+	for _, h := range vm.harts {
+		if h == vm || !h.reserved {
+			continue
+		}
+		if set := h.reservation &^ 7; addr < set+8 && set < addr+uint64(size) {
+			h.reserved = false
+		}
+	}
+}
+
+func amoSwap(v, src uint64) uint64 { return src }
+func amoAdd(v, src uint64) uint64  { return v + src }
+func amoXor(v, src uint64) uint64  { return v ^ src }
+func amoAnd(v, src uint64) uint64  { return v & src }
+func amoOr(v, src uint64) uint64   { return v | src }
+
+func amoMin(v, src uint64) uint64 {
+	if int64(src) < int64(v) {
+		return src
+	}
+	return v
+}
+
+func amoMax(v, src uint64) uint64 {
+	if int64(src) > int64(v) {
+		return src
+	}
+	return v
+}
+
+func amoMinu(v, src uint64) uint64 {
+	if src < v {
+		return src
+	}
+	return v
+}
+
+func amoMaxu(v, src uint64) uint64 {
+	if src > v {
+		return src
+	}
+	return v
+}
+
+// amoMinuW and amoMaxuW compare the low words of sign-extended values as
+// unsigned numbers.
+func amoMinuW(v, src uint64) uint64 { return amoMinu(v&0xffffffff, src&0xffffffff) }
+func amoMaxuW(v, src uint64) uint64 { return amoMaxu(v&0xffffffff, src&0xffffffff) }
+
+// RV32A Standard Extension
+
+func lrW(vm *VM, in *Instruction) (flags, error)      { return lr(vm, in, 4) }
+func scW(vm *VM, in *Instruction) (flags, error)      { return sc(vm, in, 4) }
+func amoswapW(vm *VM, in *Instruction) (flags, error) { return amo(vm, in, 4, amoSwap) }
+func amoaddW(vm *VM, in *Instruction) (flags, error)  { return amo(vm, in, 4, amoAdd) }
+func amoxorW(vm *VM, in *Instruction) (flags, error)  { return amo(vm, in, 4, amoXor) }
+func amoandW(vm *VM, in *Instruction) (flags, error)  { return amo(vm, in, 4, amoAnd) }
+func amoorW(vm *VM, in *Instruction) (flags, error)   { return amo(vm, in, 4, amoOr) }
+func amominW(vm *VM, in *Instruction) (flags, error)  { return amo(vm, in, 4, amoMin) }
+func amomaxW(vm *VM, in *Instruction) (flags, error)  { return amo(vm, in, 4, amoMax) }
+func amominuW(vm *VM, in *Instruction) (flags, error) { return amo(vm, in, 4, amoMinuW) }
+func amomaxuW(vm *VM, in *Instruction) (flags, error) { return amo(vm, in, 4, amoMaxuW) }
+
+// RV64A Standard Extension (in addition to RV32A)
+
+func lrD(vm *VM, in *Instruction) (flags, error)      { return lr(vm, in, 8) }
+func scD(vm *VM, in *Instruction) (flags, error)      { return sc(vm, in, 8) }
+func amoswapD(vm *VM, in *Instruction) (flags, error) { return amo(vm, in, 8, amoSwap) }
+func amoaddD(vm *VM, in *Instruction) (flags, error)  { return amo(vm, in, 8, amoAdd) }
+func amoxorD(vm *VM, in *Instruction) (flags, error)  { return amo(vm, in, 8, amoXor) }
+func amoandD(vm *VM, in *Instruction) (flags, error)  { return amo(vm, in, 8, amoAnd) }
+func amoorD(vm *VM, in *Instruction) (flags, error)   { return amo(vm, in, 8, amoOr) }
+func amominD(vm *VM, in *Instruction) (flags, error)  { return amo(vm, in, 8, amoMin) }
+func amomaxD(vm *VM, in *Instruction) (flags, error)  { return amo(vm, in, 8, amoMax) }
+func amominuD(vm *VM, in *Instruction) (flags, error) { return amo(vm, in, 8, amoMinu) }
+func amomaxuD(vm *VM, in *Instruction) (flags, error) { return amo(vm, in, 8, amoMaxu) }
@@ -0,0 +1,174 @@
+// Copyright 2019 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import "testing"
+
+// Values of the funct5 field of A instructions.
+const (
+	funct5LR      = 0x02
+	funct5SC      = 0x03
+	funct5AMOSwap = 0x01
+	funct5AMOAdd  = 0x00
+	funct5AMOXor  = 0x04
+	funct5AMOAnd  = 0x0c
+	funct5AMOOr   = 0x08
+	funct5AMOMin  = 0x10
+	funct5AMOMax  = 0x14
+	funct5AMOMinu = 0x18
+	funct5AMOMaxu = 0x1c
+)
+
+// atomicInstr returns the A instruction with the given funct5 operating on
+// size bytes, with rd=x3, rs1=x1 and rs2=x2. The aq and rl bits are set to
+// check that they're ignored.
+func atomicInstr(funct5 uint64, size int) uint64 {
+	funct3 := uint64(2)
+	if size == 8 {
+		funct3 = 3
+	}
+	return funct5<<27 | 3<<25 | 2<<20 | 1<<15 | funct3<<12 | 3<<7 | 0x2f
+}
+
+func TestAMO(t *testing.T) {
+	const addr = 0x70
+	for _, tt := range []struct {
+		desc    string
+		funct5  uint64
+		size    int
+		mem     uint64
+		src     uint64
+		wantMem uint64
+		wantRd  uint64
+	}{
+		{desc: "amoswap.w", funct5: funct5AMOSwap, size: 4, mem: 0x11111111, src: 0x22222222, wantMem: 0x22222222, wantRd: 0x11111111},
+		{desc: "amoadd.w", funct5: funct5AMOAdd, size: 4, mem: 0x7fffffff, src: 1, wantMem: 0x80000000, wantRd: 0x7fffffff},
+		{desc: "amoadd.w sign-extends", funct5: funct5AMOAdd, size: 4, mem: 0x80000000, src: 1, wantMem: 0x80000001, wantRd: u64(-0x80000000)},
+		{desc: "amoxor.w", funct5: funct5AMOXor, size: 4, mem: 0xff00, src: 0x0ff0, wantMem: 0xf0f0, wantRd: 0xff00},
+		{desc: "amoand.w", funct5: funct5AMOAnd, size: 4, mem: 0xff00, src: 0x0ff0, wantMem: 0x0f00, wantRd: 0xff00},
+		{desc: "amoor.w", funct5: funct5AMOOr, size: 4, mem: 0xff00, src: 0x0ff0, wantMem: 0xfff0, wantRd: 0xff00},
+		{desc: "amomin.w", funct5: funct5AMOMin, size: 4, mem: 1, src: u64(-1), wantMem: 0xffffffff, wantRd: 1},
+		{desc: "amomax.w", funct5: funct5AMOMax, size: 4, mem: 1, src: u64(-1), wantMem: 1, wantRd: 1},
+		{desc: "amominu.w", funct5: funct5AMOMinu, size: 4, mem: 1, src: u64(-1), wantMem: 1, wantRd: 1},
+		{desc: "amomaxu.w", funct5: funct5AMOMaxu, size: 4, mem: 0xffffffff, src: 1, wantMem: 0xffffffff, wantRd: u64(-1)},
+		// Only the low word of rs2 is used.
+		{desc: "amomaxu.w high bits", funct5: funct5AMOMaxu, size: 4, mem: 2, src: 0x100000001, wantMem: 2, wantRd: 2},
+
+		{desc: "amoswap.d", funct5: funct5AMOSwap, size: 8, mem: 0x1111111111111111, src: 0x2222222222222222, wantMem: 0x2222222222222222, wantRd: 0x1111111111111111},
+		{desc: "amoadd.d", funct5: funct5AMOAdd, size: 8, mem: 0xffffffff, src: 1, wantMem: 0x100000000, wantRd: 0xffffffff},
+		{desc: "amoxor.d", funct5: funct5AMOXor, size: 8, mem: 0xff00000000, src: 0x0ff0000000, wantMem: 0xf0f0000000, wantRd: 0xff00000000},
+		{desc: "amoand.d", funct5: funct5AMOAnd, size: 8, mem: 0xff00000000, src: 0x0ff0000000, wantMem: 0x0f00000000, wantRd: 0xff00000000},
+		{desc: "amoor.d", funct5: funct5AMOOr, size: 8, mem: 0xff00000000, src: 0x0ff0000000, wantMem: 0xfff0000000, wantRd: 0xff00000000},
+		{desc: "amomin.d", funct5: funct5AMOMin, size: 8, mem: 1, src: u64(-1), wantMem: u64(-1), wantRd: 1},
+		{desc: "amomax.d", funct5: funct5AMOMax, size: 8, mem: u64(-2), src: u64(-1), wantMem: u64(-1), wantRd: u64(-2)},
+		{desc: "amominu.d", funct5: funct5AMOMinu, size: 8, mem: 1, src: u64(-1), wantMem: 1, wantRd: 1},
+		{desc: "amomaxu.d", funct5: funct5AMOMaxu, size: 8, mem: 1, src: u64(-1), wantMem: u64(-1), wantRd: 1},
+	} {
+		vm := newTrapVM(t)
+		copy(vm.Mem, asBytes(atomicInstr(tt.funct5, tt.size)))
+		vm.write(addr, 8, 0xaaaaaaaaaaaaaaaa)
+		vm.write(addr, tt.size, tt.mem)
+		vm.Reg[1], vm.Reg[2] = addr, tt.src
+		if err := vm.Run(1); err != nil {
+			t.Fatalf("%s: Run failed: %v", tt.desc, err)
+		}
+		if vm.PC != 4 {
+			t.Errorf("%s: PC = %#x; want 0x4", tt.desc, vm.PC)
+		}
+		if got, _ := vm.read(addr, tt.size); got != tt.wantMem {
+			t.Errorf("%s: memory = %#x; want %#x", tt.desc, got, tt.wantMem)
+		}
+		if tt.size == 4 {
+			if got, _ := vm.read(addr+4, 4); got != 0xaaaaaaaa {
+				t.Errorf("%s: the next word was overwritten with %#x", tt.desc, got)
+			}
+		}
+		if vm.Reg[3] != tt.wantRd {
+			t.Errorf("%s: x3 = %#x; want %#x", tt.desc, vm.Reg[3], tt.wantRd)
+		}
+	}
+}
+
+func TestLRSC(t *testing.T) {
+	const addr = 0x70
+	for _, tt := range []struct {
+		desc    string
+		size    int
+		lrAddr  uint64 // no LR if 0
+		between uint64 // an instruction executed between LR and SC
+		wantRd  uint64
+		wantMem uint64
+	}{
+		{desc: "sc.w without lr.w", size: 4, wantRd: 1, wantMem: 0x1234},
+		{desc: "lr.w; sc.w", size: 4, lrAddr: addr, wantRd: 0, wantMem: 0xcafe},
+		{desc: "lr.d; sc.d", size: 8, lrAddr: addr, wantRd: 0, wantMem: 0xcafe},
+		{desc: "reservation on another address", size: 4, lrAddr: addr + 8, wantRd: 1, wantMem: 0x1234},
+		// A failed SC clears the reservation.
+		{desc: "second sc.w", size: 4, lrAddr: addr, between: atomicInstr(funct5SC, 4) &^ (1 << 15) /* rs1 = x0 */, wantRd: 1, wantMem: 0x1234},
+	} {
+		vm := newTrapVM(t)
+		code := asBytes(atomicInstr(funct5LR, tt.size) &^ (0x1f << 7) /* rd = x0 */)
+		if tt.lrAddr == 0 {
+			code = asBytes(nop)
+		}
+		code = append(code, asBytes(nop)...)
+		if tt.between != 0 {
+			copy(code[4:], asBytes(tt.between))
+		}
+		code = append(code, asBytes(atomicInstr(funct5SC, tt.size))...)
+		copy(vm.Mem, code)
+		vm.write(addr, 8, 0x1234)
+		vm.Reg[1], vm.Reg[2] = tt.lrAddr, 0xcafe
+		if err := vm.Run(1); err != nil {
+			t.Fatalf("%s: Run failed: %v", tt.desc, err)
+		}
+		vm.Reg[1] = addr
+		if err := vm.Run(2); err != nil {
+			t.Fatalf("%s: Run failed: %v", tt.desc, err)
+		}
+		if vm.PC != 12 {
+			t.Fatalf("%s: PC = %#x; want 0xc (mcause %d)", tt.desc, vm.PC, vm.CSR[csrMcause])
+		}
+		if vm.Reg[3] != tt.wantRd {
+			t.Errorf("%s: x3 = %d; want %d", tt.desc, vm.Reg[3], tt.wantRd)
+		}
+		if got, _ := vm.read(addr, 8); got != tt.wantMem {
+			t.Errorf("%s: memory = %#x; want %#x", tt.desc, got, tt.wantMem)
+		}
+	}
+}
+
+func TestAtomicMisaligned(t *testing.T) {
+	for _, tt := range []struct {
+		in        uint64
+		wantCause uint64
+	}{
+		{atomicInstr(funct5LR, 4), causeLoadMisaligned},
+		{atomicInstr(funct5SC, 8), causeStoreMisaligned},
+		{atomicInstr(funct5AMOAdd, 8), causeStoreMisaligned},
+	} {
+		// Atomics trap even if misaligned accesses are emulated.
+		vm := newTrapVM(t)
+		vm.Misaligned = MisalignedEmulate
+		copy(vm.Mem, asBytes(tt.in))
+		vm.Reg[1] = 0x62
+		if err := vm.Run(1); err != nil {
+			t.Fatalf("%#x: Run failed: %v", tt.in, err)
+		}
+		if vm.PC != trapHandler || vm.CSR[csrMcause] != tt.wantCause || vm.CSR[csrMtval] != 0x62 {
+			t.Errorf("%#x: PC, mcause, mtval = %#x, %d, %#x; want %#x, %d, 0x62", tt.in, vm.PC, vm.CSR[csrMcause], vm.CSR[csrMtval], trapHandler, tt.wantCause)
+		}
+	}
+}
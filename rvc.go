@@ -32,7 +32,9 @@ func rvcDecode(in uint16) (*Instruction, error) {
 		imm = imm&0xc0>>2 | imm&0x3c<<4 | imm&0x2<<1 | imm&0x1<<3
 		return &Instruction{fn: addi, rd: r, rs1: SP, imm: imm}, nil
 	case 0x04: // C.FLD (RV32/64); C.LQ (RV128)
-		panic("C.FLD (the F standard extension) is not supported")
+		imm, r1, r2 := decodeCL(in)
+		imm = (imm<<6 | imm<<1) & 0xf8
+		return &Instruction{fn: fld, rd: r2, rs1: r1, imm: imm}, nil
 	case 0x08: // C.LW
 		imm, r1, r2 := decodeCL(in)
 		imm = (imm<<5 | imm) & 0x3e << 1 // 54326 -> 6543200
@@ -42,9 +44,11 @@ func rvcDecode(in uint16) (*Instruction, error) {
 		imm = (imm<<6 | imm<<1) & 0xf8
 		return &Instruction{fn: ld, rd: r2, rs1: r1, imm: imm}, nil
 	case 0x10: // reserved
-		panic("reserved")
+		return nil, fmt.Errorf("illegal instruction %#x", in)
 	case 0x14: // C.FSD (RV32/64); C.SQ (RV128)
-		panic("C.FSD (the F standard extension) is not suppored")
+		imm, r1, r2 := decodeCS(in)
+		imm = (imm<<5 | imm) << 1 & 0xf8 // 54376 -> 76543000
+		return &Instruction{fn: fsd, rs2: r2, rs1: r1, imm: imm}, nil
 	case 0x18: // C.SW
 		imm, r1, r2 := decodeCS(in)
 		imm = (imm<<5 | imm) << 1 & 0x7c // 54326->6543200
@@ -102,7 +106,7 @@ func rvcDecode(in uint16) (*Instruction, error) {
 			return &Instruction{fn: addw, rd: r1, rs1: r1, rs2: r2}, nil
 		case 0x1e, 0x1f: // Reserved
 		}
-		panic("unreachable")
+		return nil, fmt.Errorf("illegal instruction %#x", in)
 	case 0x15: // C.J
 		imm := decodeCJ(in)
 		// B498A673215 -> BA9876543210
@@ -124,7 +128,9 @@ func rvcDecode(in uint16) (*Instruction, error) {
 		imm, r := decodeCI(in)
 		return &Instruction{fn: slli, rd: r, rs1: r, imm: imm}, nil
 	case 0x06: // C.FLDSP (RV32/64); C.LQSP (RV128; RES, rd=0)
-		panic("FLDSP (the F standard extension) is not suppored")
+		imm, r := decodeCI(in)
+		imm = (imm<<6 | imm) & 0x1f8 // 543876 -> 876543000
+		return &Instruction{fn: fld, rd: r, rs1: SP, imm: imm}, nil
 	case 0x0A: // C.LWSP (RES, rd=0)
 		imm, r := decodeCI(in)
 		imm = (imm<<6 | imm) & 0xfc // 543276 -> 76543200
@@ -149,7 +155,9 @@ func rvcDecode(in uint16) (*Instruction, error) {
 			return &Instruction{fn: add, rd: r1, rs1: r1, rs2: r2}, nil
 		}
 	case 0x16: // C.FSDSP (RV32/64); C.SQSP (RV128)
-		panic("FSDSP (the F standard extension) is not suppored")
+		imm, r := decodeCSS(in)
+		imm = (imm<<6 | imm) & 0x1f8 // 543876 -> 876543000
+		return &Instruction{fn: fsd, rs1: SP, rs2: r, imm: imm}, nil
 	case 0x1A: // C.SWSP
 		imm, r := decodeCSS(in)
 		imm = (imm<<6 | imm) & 0xfc // 543876 -> 765432
@@ -205,13 +213,19 @@ func decodeCJ(in uint16) (offset uint64) {
 }
 
 func rvcJAL(vm *VM, in *Instruction) (flags, error) {
-	vm.store(in.rd, vm.PC+2)
-	vm.PC = in.imm + vm.PC
+	pc := vm.PC
+	if err := vm.jump(in.imm + pc); err != nil {
+		return flags{}, err
+	}
+	vm.store(in.rd, pc+2)
 	return flags{updatedPC: true}, nil
 }
 
 func rvcJALR(vm *VM, in *Instruction) (flags, error) {
-	vm.store(in.rd, vm.PC+2)
-	vm.PC = (in.imm + vm.Reg[in.rs1]) &^ 0x1
+	pc := vm.PC
+	if err := vm.jump((in.imm + vm.Reg[in.rs1]) &^ 0x1); err != nil {
+		return flags{}, err
+	}
+	vm.store(in.rd, pc+2)
 	return flags{updatedPC: true}, nil
 }
@@ -0,0 +1,867 @@
+// Copyright 2019 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"math"
+	"math/big"
+)
+
+// "F" Standard Extension for Single-Precision Floating-Point and "D" Standard
+// Extension for Double-Precision Floating-Point
+//
+// riscv-spec-v2.2; Chapters 8 and 9; Pages 43-59. Results are computed exactly
+// with math/big and rounded in software, so all rounding modes and exception
+// flags are implemented. Single-precision values are NaN-boxed in the 64-bit
+// floating-point registers.
+
+// Floating-point CSRs. fflags and frm are fields of fcsr, which is stored in
+// vm.CSR[csrFcsr].
+//
+// riscv-spec-v2.2; Figure 8.2; Page 44
+const (
+	csrFflags = 0x001
+	csrFrm    = 0x002
+	csrFcsr   = 0x003
+)
+
+// Accrued exception flags (fflags).
+//
+// riscv-spec-v2.2; Table 8.5; Page 45
+const (
+	fflagNX = 1 << 0 // inexact
+	fflagUF = 1 << 1 // underflow
+	fflagOF = 1 << 2 // overflow
+	fflagDZ = 1 << 3 // divide by zero
+	fflagNV = 1 << 4 // invalid operation
+)
+
+// Rounding modes.
+//
+// riscv-spec-v2.2; Table 8.1; Page 44
+const (
+	rmRNE = 0 // to nearest, ties to even
+	rmRTZ = 1 // towards zero
+	rmRDN = 2 // down
+	rmRUP = 3 // up
+	rmRMM = 4 // to nearest, ties to max magnitude
+	rmDyn = 7 // the rounding mode in frm
+)
+
+var bigRoundingModes = [...]big.RoundingMode{
+	rmRNE: big.ToNearestEven,
+	rmRTZ: big.ToZero,
+	rmRDN: big.ToNegativeInf,
+	rmRUP: big.ToPositiveInf,
+	rmRMM: big.ToNearestAway,
+}
+
+// The FS field of mstatus holds the state of the floating-point unit.
+// Floating-point instructions are illegal when it's Off and set it to Dirty
+// when they change the registers or fcsr. SD is set when FS is Dirty.
+//
+// riscv-privileged-v1.10; Chapter 3.1.11; Page 23
+const (
+	mstatusFS      = 3 << 13
+	mstatusFSShift = 13
+	mstatusSD      = 1 << 63
+
+	fsOff     = 0
+	fsInitial = 1
+	fsDirty   = 3
+)
+
+// withSD returns the mstatus value v with SD reflecting FS.
+func withSD(v uint64) uint64 {
+	if v&mstatusFS == fsDirty<<mstatusFSShift {
+		return v | mstatusSD
+	}
+	return v &^ mstatusSD
+}
+
+// fpFormat is an IEEE 754 binary floating-point format. Values of both formats
+// are passed around as float64s, which represent single-precision values
+// exactly.
+type fpFormat struct {
+	bits int     // width of the encoding
+	prec int     // bits of the significand, including the implicit one
+	emin int     // exponent of the smallest normal numbers, as returned by big.Float.MantExp
+	emax int     // exponent of the largest finite numbers, as returned by big.Float.MantExp
+	max  float64 // the largest finite number
+	nan  uint64  // the canonical NaN
+}
+
+var (
+	single = &fpFormat{bits: 32, prec: 24, emin: -125, emax: 128, max: math.MaxFloat32, nan: 0x7fc00000}
+	double = &fpFormat{bits: 64, prec: 53, emin: -1021, emax: 1024, max: math.MaxFloat64, nan: 0x7ff8000000000000}
+)
+
+func (f *fpFormat) signBit() uint64 { return 1 << uint(f.bits-1) }
+
+// isNaN reports whether the bits encode a NaN: all exponent bits are set and
+// the significand isn't zero.
+func (f *fpFormat) isNaN(b uint64) bool {
+	inf := (f.signBit() - 1) &^ (1<<uint(f.prec-1) - 1)
+	return b&^f.signBit() > inf
+}
+
+// isSNaN reports whether the bits encode a signaling NaN, which has the most
+// significant bit of the significand clear.
+func (f *fpFormat) isSNaN(b uint64) bool {
+	return f.isNaN(b) && b&(1<<uint(f.prec-2)) == 0
+}
+
+// value returns the value encoded by the bits.
+func (f *fpFormat) value(b uint64) float64 {
+	if f.bits == 32 {
+		return float64(math.Float32frombits(uint32(b)))
+	}
+	return math.Float64frombits(b)
+}
+
+// encode returns the encoding of v, which must be representable in the
+// format. NaNs are encoded as the canonical NaN.
+func (f *fpFormat) encode(v float64) uint64 {
+	switch {
+	case math.IsNaN(v):
+		return f.nan
+	case f.bits == 32:
+		return uint64(math.Float32bits(float32(v)))
+	}
+	return math.Float64bits(v)
+}
+
+// nanResult returns the result of an operation if any of its operands is a
+// NaN: the canonical NaN, raising the invalid flag if any of them is
+// signaling. ok is false if there are no NaN operands.
+func (f *fpFormat) nanResult(ops ...uint64) (r, fflags uint64, ok bool) {
+	for _, b := range ops {
+		if f.isSNaN(b) {
+			fflags = fflagNV
+		}
+		ok = ok || f.isNaN(b)
+	}
+	return f.nan, fflags, ok
+}
+
+// special returns the result of an operation with infinite operands, which is
+// computed natively. Such operations are exact unless they're invalid.
+func (f *fpFormat) special(v float64) (r, fflags uint64) {
+	if math.IsNaN(v) {
+		return f.nan, fflagNV
+	}
+	return f.encode(v), 0
+}
+
+// round rounds x to the format with the rounding mode and returns the result
+// and the exception flags raised. x must be finite and either exact or
+// rounded to odd with at least prec+2 bits, which makes the second rounding
+// correct. Tininess is detected after rounding.
+func (f *fpFormat) round(x *big.Float, rm int) (float64, uint64) {
+	if x.Sign() == 0 {
+		v, _ := x.Float64()
+		return v, 0
+	}
+	neg := x.Signbit()
+	exp := x.MantExp(nil)
+	prec := f.prec
+	if exp < f.emin {
+		prec -= f.emin - exp // a subnormal number
+	}
+	if prec <= 0 {
+		// x is smaller than the smallest subnormal number, so the
+		// result is either that number or zero.
+		half := new(big.Float).SetMantExp(big.NewFloat(0.5), f.emin-f.prec)
+		c := new(big.Float).Abs(x).Cmp(half)
+		v := 0.0
+		switch {
+		case rm == rmRNE && c > 0, rm == rmRMM && c >= 0, rm == rmRDN && neg, rm == rmRUP && !neg:
+			v = math.Ldexp(1, f.emin-f.prec)
+		}
+		if neg {
+			v = math.Copysign(v, -1)
+		}
+		return v, fflagUF | fflagNX
+	}
+	r := new(big.Float).SetMode(bigRoundingModes[rm]).SetPrec(uint(prec)).Set(x)
+	var fflags uint64
+	if r.Acc() != big.Exact {
+		fflags = fflagNX
+	}
+	if r.MantExp(nil) > f.emax {
+		// Rounding towards zero overflows to the largest finite number.
+		v := math.Inf(1)
+		if rm == rmRTZ || rm == rmRDN && !neg || rm == rmRUP && neg {
+			v = f.max
+		}
+		if neg {
+			v = -v
+		}
+		return v, fflagOF | fflagNX
+	}
+	if fflags != 0 && exp < f.emin {
+		// The result is tiny if it's subnormal when rounded with an
+		// unbounded exponent range.
+		t := new(big.Float).SetMode(r.Mode()).SetPrec(uint(f.prec)).Set(x)
+		if t.MantExp(nil) < f.emin {
+			fflags |= fflagUF
+		}
+	}
+	v, _ := r.Float64()
+	return v, fflags
+}
+
+// exact returns v as a big.Float with the rounding mode, which determines the
+// sign of exact zero sums.
+func exact(v float64, rm int) *big.Float {
+	return new(big.Float).SetMode(bigRoundingModes[rm]).SetFloat64(v)
+}
+
+// exactSum returns x+y without rounding. It has the rounding mode of x.
+func exactSum(x, y *big.Float) *big.Float {
+	prec := x.Prec() + y.Prec() + 1
+	if x.Sign() != 0 && y.Sign() != 0 {
+		d := x.MantExp(nil) - y.MantExp(nil)
+		if d < 0 {
+			d = -d
+		}
+		prec += uint(d)
+	}
+	return new(big.Float).SetMode(x.Mode()).SetPrec(prec).Add(x, y)
+}
+
+// mantissa returns m and e such that |v| = m × 2^e. v must be finite.
+func mantissa(v float64) (uint64, int) {
+	frac, exp := math.Frexp(math.Abs(v))
+	return uint64(math.Ldexp(frac, 53)), exp - 53
+}
+
+// quotient returns x/y rounded to odd with at least 128 bits. x and y must be
+// finite and non-zero.
+func quotient(x, y float64) *big.Float {
+	const shift = 128
+	mx, ex := mantissa(x)
+	my, ey := mantissa(y)
+	n := new(big.Int).Lsh(new(big.Int).SetUint64(mx), shift)
+	q, r := new(big.Int).QuoRem(n, new(big.Int).SetUint64(my), new(big.Int))
+	if r.Sign() != 0 {
+		q.SetBit(q, 0, 1)
+	}
+	z := new(big.Float).SetInt(q)
+	z.SetMantExp(z, ex-ey-shift)
+	if (x < 0) != (y < 0) {
+		z.Neg(z)
+	}
+	return z
+}
+
+// root returns the square root of x rounded to odd with at least 64 bits. x
+// must be finite and positive.
+func root(x float64) *big.Float {
+	const shift = 128 // even
+	m, e := mantissa(x)
+	n := new(big.Int).SetUint64(m)
+	if e%2 != 0 {
+		n.Lsh(n, 1)
+		e--
+	}
+	n.Lsh(n, shift)
+	s := new(big.Int).Sqrt(n)
+	if new(big.Int).Mul(s, s).Cmp(n) != 0 {
+		s.SetBit(s, 0, 1)
+	}
+	z := new(big.Float).SetInt(s)
+	return z.SetMantExp(z, (e-shift)/2)
+}
+
+// The following functions compute operations on encoded values and return
+// the encoded result and the exception flags raised.
+
+func fpAdd(f *fpFormat, a, b uint64, rm int) (uint64, uint64) {
+	if r, fflags, ok := f.nanResult(a, b); ok {
+		return r, fflags
+	}
+	x, y := f.value(a), f.value(b)
+	if math.IsInf(x, 0) || math.IsInf(y, 0) {
+		return f.special(x + y)
+	}
+	v, fflags := f.round(exactSum(exact(x, rm), exact(y, rm)), rm)
+	return f.encode(v), fflags
+}
+
+func fpSub(f *fpFormat, a, b uint64, rm int) (uint64, uint64) {
+	return fpAdd(f, a, b^f.signBit(), rm)
+}
+
+func fpMul(f *fpFormat, a, b uint64, rm int) (uint64, uint64) {
+	if r, fflags, ok := f.nanResult(a, b); ok {
+		return r, fflags
+	}
+	x, y := f.value(a), f.value(b)
+	if math.IsInf(x, 0) || math.IsInf(y, 0) {
+		return f.special(x * y)
+	}
+	p := new(big.Float).SetPrec(2*53).Mul(exact(x, rm), exact(y, rm))
+	v, fflags := f.round(p, rm)
+	return f.encode(v), fflags
+}
+
+func fpDiv(f *fpFormat, a, b uint64, rm int) (uint64, uint64) {
+	if r, fflags, ok := f.nanResult(a, b); ok {
+		return r, fflags
+	}
+	x, y := f.value(a), f.value(b)
+	switch {
+	case math.IsInf(x, 0) || math.IsInf(y, 0) || x == 0:
+		return f.special(x / y)
+	case y == 0:
+		return f.encode(x / y), fflagDZ
+	}
+	v, fflags := f.round(quotient(x, y), rm)
+	return f.encode(v), fflags
+}
+
+func fpSqrt(f *fpFormat, a uint64, rm int) (uint64, uint64) {
+	if r, fflags, ok := f.nanResult(a); ok {
+		return r, fflags
+	}
+	switch x := f.value(a); {
+	case x == 0 || math.IsInf(x, 1):
+		return a, 0
+	case x < 0:
+		return f.nan, fflagNV
+	}
+	v, fflags := f.round(root(f.value(a)), rm)
+	return f.encode(v), fflags
+}
+
+// fpMulAdd returns a×b+c rounded once.
+func fpMulAdd(f *fpFormat, a, b, c uint64, rm int) (uint64, uint64) {
+	x, y, z := f.value(a), f.value(b), f.value(c)
+	// Multiplying infinity by zero is invalid even if the addend is a
+	// quiet NaN.
+	invalid := math.IsInf(x, 0) && y == 0 || x == 0 && math.IsInf(y, 0)
+	if r, fflags, ok := f.nanResult(a, b, c); ok {
+		if invalid {
+			fflags = fflagNV
+		}
+		return r, fflags
+	}
+	if invalid || math.IsInf(x, 0) || math.IsInf(y, 0) || math.IsInf(z, 0) {
+		return f.special(math.FMA(x, y, z))
+	}
+	p := new(big.Float).SetMode(bigRoundingModes[rm]).SetPrec(2*53).Mul(exact(x, rm), exact(y, rm))
+	v, fflags := f.round(exactSum(p, exact(z, rm)), rm)
+	return f.encode(v), fflags
+}
+
+// fpConvert converts the value a of the format from to the format to.
+func fpConvert(to, from *fpFormat, a uint64, rm int) (uint64, uint64) {
+	if _, fflags, ok := from.nanResult(a); ok {
+		return to.nan, fflags
+	}
+	x := from.value(a)
+	if math.IsInf(x, 0) {
+		return to.encode(x), 0
+	}
+	v, fflags := to.round(exact(x, rm), rm)
+	return to.encode(v), fflags
+}
+
+// fpFromInt converts the integer v, signed or not, to the format.
+func fpFromInt(f *fpFormat, v uint64, signed bool, rm int) (uint64, uint64) {
+	x := new(big.Float).SetMode(bigRoundingModes[rm])
+	if signed {
+		x.SetInt64(int64(v))
+	} else {
+		x.SetUint64(v)
+	}
+	r, fflags := f.round(x, rm)
+	return f.encode(r), fflags
+}
+
+// fpToInt converts the value to an integer of the given width (32 or 64
+// bits), signed or not, rounding it with the mode. Values out of range
+// saturate and raise the invalid flag; NaNs convert to the largest integer.
+// 32-bit results are sign-extended.
+func fpToInt(f *fpFormat, a uint64, rm int, width uint, signed bool) (uint64, uint64) {
+	lo, hi := 0.0, math.Ldexp(1, int(width)) // the range is [lo, hi)
+	min, max := uint64(0), ^uint64(0)
+	if signed {
+		hi = math.Ldexp(1, int(width-1))
+		lo = -hi
+		min, max = ^uint64(0)<<(width-1), 1<<(width-1)-1
+	}
+	if f.isNaN(a) {
+		return max, fflagNV
+	}
+	x := f.value(a)
+	var r float64
+	switch rm {
+	case rmRTZ:
+		r = math.Trunc(x)
+	case rmRDN:
+		r = math.Floor(x)
+	case rmRUP:
+		r = math.Ceil(x)
+	case rmRMM:
+		r = math.Round(x)
+	default:
+		r = math.RoundToEven(x)
+	}
+	switch {
+	case r < lo:
+		return min, fflagNV
+	case r >= hi:
+		return max, fflagNV
+	}
+	var fflags uint64
+	if r != x {
+		fflags = fflagNX
+	}
+	if signed {
+		return uint64(int64(r)), fflags
+	}
+	if width == 32 {
+		return signExtend(uint64(r), 31), fflags
+	}
+	return uint64(r), fflags
+}
+
+// fpLess reports whether x is less than y, ordering -0 before +0.
+func fpLess(f *fpFormat, a, b uint64) bool {
+	x, y := f.value(a), f.value(b)
+	return x < y || x == y && a&f.signBit() != 0 && b&f.signBit() == 0
+}
+
+// fpMinMax returns the smaller (or, if max is set, the larger) value. If only
+// one of them is a NaN, the other is returned.
+func fpMinMax(f *fpFormat, a, b uint64, max bool) (uint64, uint64) {
+	var fflags uint64
+	if f.isSNaN(a) || f.isSNaN(b) {
+		fflags = fflagNV
+	}
+	switch {
+	case f.isNaN(a) && f.isNaN(b):
+		return f.nan, fflags
+	case f.isNaN(a):
+		return b, fflags
+	case f.isNaN(b):
+		return a, fflags
+	}
+	if fpLess(f, a, b) != max {
+		return a, fflags
+	}
+	return b, fflags
+}
+
+// fpClass returns the FCLASS mask of the value.
+//
+// riscv-spec-v2.2; Table 8.7; Page 52
+func fpClass(f *fpFormat, a uint64) uint64 {
+	neg := a&f.signBit() != 0
+	x := math.Abs(f.value(a))
+	var class uint // the bit of the positive class
+	switch {
+	case f.isSNaN(a):
+		return 1 << 8
+	case f.isNaN(a):
+		return 1 << 9
+	case math.IsInf(x, 0):
+		class = 7
+	case x == 0:
+		class = 4
+	case x < math.Ldexp(0.5, f.emin): // subnormal
+		class = 5
+	default:
+		class = 6
+	}
+	if neg {
+		// Negative classes mirror the positive ones.
+		class = 7 - class
+	}
+	return 1 << class
+}
+
+// fpOff reports whether the floating-point unit is off. In VS-mode and VU-mode
+// it's off if either mstatus.FS or vsstatus.FS is Off.
+func (vm *VM) fpOff() bool {
+	return vm.CSR[csrMstatus]&mstatusFS == fsOff || vm.Virt && vm.CSR[csrVsstatus]&mstatusFS == fsOff
+}
+
+// fpDirty sets FS to Dirty, in vsstatus too in VS-mode and VU-mode.
+func (vm *VM) fpDirty() {
+	vm.CSR[csrMstatus] |= mstatusFS | mstatusSD
+	if vm.Virt {
+		vm.CSR[csrVsstatus] |= mstatusFS | mstatusSD
+	}
+}
+
+// fpCheck returns an illegal-instruction exception if the floating-point unit
+// is off.
+func (vm *VM) fpCheck(in *Instruction) error {
+	if vm.fpOff() {
+		return &exception{cause: causeIllegalInstr, tval: in.in}
+	}
+	return nil
+}
+
+// roundingMode returns the rounding mode of the instruction: its rm field or,
+// if that's dynamic, frm. Reserved rounding modes are illegal.
+func (vm *VM) roundingMode(in *Instruction) (int, error) {
+	if err := vm.fpCheck(in); err != nil {
+		return 0, err
+	}
+	rm := int(in.in >> 12 & 7)
+	if rm == rmDyn {
+		rm = int(vm.CSR[csrFcsr] >> 5 & 7)
+	}
+	if rm > rmRMM {
+		return 0, &exception{cause: causeIllegalInstr, tval: in.in}
+	}
+	return rm, nil
+}
+
+// freg returns the encoding of the value of the format in the register.
+// Single-precision values that aren't NaN-boxed read as the canonical NaN.
+func (vm *VM) freg(f *fpFormat, r uint64) uint64 {
+	v := vm.FReg[r]
+	if f.bits == 32 {
+		if v>>32 != 0xffffffff {
+			return f.nan
+		}
+		return v & 0xffffffff
+	}
+	return v
+}
+
+// setFreg writes the encoding of a value of the format to the register,
+// NaN-boxing single-precision values.
+func (vm *VM) setFreg(f *fpFormat, r, v uint64) {
+	if f.bits == 32 {
+		v |= 0xffffffff << 32
+	}
+	vm.FReg[r] = v
+	vm.fpDirty()
+}
+
+// fpRaise accrues the exception flags in fflags.
+func (vm *VM) fpRaise(fflags uint64) {
+	if fflags != 0 {
+		vm.CSR[csrFcsr] |= fflags
+		vm.fpDirty()
+	}
+}
+
+// readFCSR returns the value of fflags, frm or fcsr.
+func (vm *VM) readFCSR(csr uint64) (uint64, error) {
+	if vm.fpOff() {
+		return 0, &exception{cause: causeIllegalInstr}
+	}
+	v := vm.CSR[csrFcsr]
+	switch csr {
+	case csrFflags:
+		return v & 0x1f, nil
+	case csrFrm:
+		return v >> 5 & 7, nil
+	}
+	return v & 0xff, nil
+}
+
+// writeFCSR sets the value of fflags, frm or fcsr.
+func (vm *VM) writeFCSR(csr, v uint64) error {
+	if vm.fpOff() {
+		return &exception{cause: causeIllegalInstr}
+	}
+	old := vm.CSR[csrFcsr]
+	switch csr {
+	case csrFflags:
+		v = old&^0x1f | v&0x1f
+	case csrFrm:
+		v = old&^0xe0 | v&7<<5
+	}
+	vm.CSR[csrFcsr] = v & 0xff
+	vm.fpDirty()
+	return nil
+}
+
+func illegal(in *Instruction) (flags, error) {
+	return flags{}, &exception{cause: causeIllegalInstr, tval: in.in}
+}
+
+// fpArith executes an instruction computing rd = op(rs1, rs2) with the
+// rounding mode of the instruction.
+func fpArith(vm *VM, in *Instruction, f *fpFormat, op func(f *fpFormat, a, b uint64, rm int) (uint64, uint64)) (flags, error) {
+	rm, err := vm.roundingMode(in)
+	if err != nil {
+		return flags{}, err
+	}
+	r, fflags := op(f, vm.freg(f, in.rs1), vm.freg(f, in.rs2), rm)
+	vm.setFreg(f, in.rd, r)
+	vm.fpRaise(fflags)
+	return flags{}, nil
+}
+
+func fsqrt(vm *VM, in *Instruction, f *fpFormat) (flags, error) {
+	if in.rs2 != 0 {
+		return illegal(in)
+	}
+	return fpArith(vm, in, f, func(f *fpFormat, a, _ uint64, rm int) (uint64, uint64) { return fpSqrt(f, a, rm) })
+}
+
+// fusedMulAdd executes FMADD, FMSUB, FNMSUB and FNMADD, which compute
+// ±(rs1×rs2)±rs3. rs3 is encoded in the top 5 bits of the instruction.
+func fusedMulAdd(vm *VM, in *Instruction, f *fpFormat, negProduct, negAddend bool) (flags, error) {
+	rm, err := vm.roundingMode(in)
+	if err != nil {
+		return flags{}, err
+	}
+	a, b, c := vm.freg(f, in.rs1), vm.freg(f, in.rs2), vm.freg(f, in.in>>27)
+	if negProduct {
+		a ^= f.signBit()
+	}
+	if negAddend {
+		c ^= f.signBit()
+	}
+	r, fflags := fpMulAdd(f, a, b, c, rm)
+	vm.setFreg(f, in.rd, r)
+	vm.fpRaise(fflags)
+	return flags{}, nil
+}
+
+// fsgnj executes FSGNJ, FSGNJN and FSGNJX, selected by funct3.
+func fsgnj(vm *VM, in *Instruction, f *fpFormat) (flags, error) {
+	if err := vm.fpCheck(in); err != nil {
+		return flags{}, err
+	}
+	a, b, s := vm.freg(f, in.rs1), vm.freg(f, in.rs2), f.signBit()
+	switch in.in >> 12 & 7 {
+	case 0:
+		vm.setFreg(f, in.rd, a&^s|b&s)
+	case 1:
+		vm.setFreg(f, in.rd, a&^s|^b&s)
+	case 2:
+		vm.setFreg(f, in.rd, a^b&s)
+	default:
+		return illegal(in)
+	}
+	return flags{}, nil
+}
+
+// fminmax executes FMIN and FMAX, selected by funct3.
+func fminmax(vm *VM, in *Instruction, f *fpFormat) (flags, error) {
+	if err := vm.fpCheck(in); err != nil {
+		return flags{}, err
+	}
+	funct3 := in.in >> 12 & 7
+	if funct3 > 1 {
+		return illegal(in)
+	}
+	r, fflags := fpMinMax(f, vm.freg(f, in.rs1), vm.freg(f, in.rs2), funct3 == 1)
+	vm.setFreg(f, in.rd, r)
+	vm.fpRaise(fflags)
+	return flags{}, nil
+}
+
+// fcmp executes FEQ, FLT and FLE, selected by funct3. Comparisons with NaNs
+// are false. FEQ raises the invalid flag only for signaling NaNs; FLT and FLE
+// raise it for all NaNs.
+func fcmp(vm *VM, in *Instruction, f *fpFormat) (flags, error) {
+	if err := vm.fpCheck(in); err != nil {
+		return flags{}, err
+	}
+	a, b := vm.freg(f, in.rs1), vm.freg(f, in.rs2)
+	funct3 := in.in >> 12 & 7
+	if funct3 > 2 {
+		return illegal(in)
+	}
+	var r, fflags uint64
+	switch {
+	case f.isNaN(a) || f.isNaN(b):
+		if funct3 != 2 || f.isSNaN(a) || f.isSNaN(b) {
+			fflags = fflagNV
+		}
+	case funct3 == 2: // FEQ
+		if f.value(a) == f.value(b) {
+			r = 1
+		}
+	case funct3 == 1: // FLT
+		if f.value(a) < f.value(b) {
+			r = 1
+		}
+	default: // FLE
+		if f.value(a) <= f.value(b) {
+			r = 1
+		}
+	}
+	vm.store(in.rd, r)
+	vm.fpRaise(fflags)
+	return flags{}, nil
+}
+
+// fmvxOrFclass executes FMV.X.W (FMV.X.D) or FCLASS, selected by funct3.
+// FMV.X.W moves the low 32 bits of the register, sign-extended, whether
+// they're NaN-boxed or not.
+func fmvxOrFclass(vm *VM, in *Instruction, f *fpFormat) (flags, error) {
+	if err := vm.fpCheck(in); err != nil {
+		return flags{}, err
+	}
+	switch {
+	case in.rs2 != 0:
+		return illegal(in)
+	case in.in>>12&7 == 1:
+		vm.store(in.rd, fpClass(f, vm.freg(f, in.rs1)))
+	case in.in>>12&7 != 0:
+		return illegal(in)
+	case f.bits == 32:
+		vm.store(in.rd, signExtend(vm.FReg[in.rs1]&0xffffffff, 31))
+	default:
+		vm.store(in.rd, vm.FReg[in.rs1])
+	}
+	return flags{}, nil
+}
+
+// fmvx executes FMV.W.X and FMV.D.X.
+func fmvfx(vm *VM, in *Instruction, f *fpFormat) (flags, error) {
+	if err := vm.fpCheck(in); err != nil {
+		return flags{}, err
+	}
+	if in.rs2 != 0 || in.in>>12&7 != 0 {
+		return illegal(in)
+	}
+	v := vm.Reg[in.rs1]
+	if f.bits == 32 {
+		v &= 0xffffffff
+	}
+	vm.setFreg(f, in.rd, v)
+	return flags{}, nil
+}
+
+// fcvtToInt executes FCVT.W, FCVT.WU, FCVT.L and FCVT.LU, selected by rs2.
+func fcvtToInt(vm *VM, in *Instruction, f *fpFormat) (flags, error) {
+	rm, err := vm.roundingMode(in)
+	if err != nil {
+		return flags{}, err
+	}
+	if in.rs2 > 3 {
+		return illegal(in)
+	}
+	width := uint(32) << (in.rs2 >> 1)
+	r, fflags := fpToInt(f, vm.freg(f, in.rs1), rm, width, in.rs2&1 == 0)
+	vm.store(in.rd, r)
+	vm.fpRaise(fflags)
+	return flags{}, nil
+}
+
+// fcvtFromInt executes FCVT.S.W, FCVT.S.WU, FCVT.S.L and FCVT.S.LU (and their
+// double-precision versions), selected by rs2.
+func fcvtFromInt(vm *VM, in *Instruction, f *fpFormat) (flags, error) {
+	rm, err := vm.roundingMode(in)
+	if err != nil {
+		return flags{}, err
+	}
+	v := vm.Reg[in.rs1]
+	switch in.rs2 {
+	case 0:
+		v = signExtend(v&0xffffffff, 31)
+	case 1:
+		v &= 0xffffffff
+	case 2, 3:
+	default:
+		return illegal(in)
+	}
+	r, fflags := fpFromInt(f, v, in.rs2&1 == 0, rm)
+	vm.setFreg(f, in.rd, r)
+	vm.fpRaise(fflags)
+	return flags{}, nil
+}
+
+// fcvtFloat executes FCVT.S.D and FCVT.D.S. rs2 holds the source format.
+func fcvtFloat(vm *VM, in *Instruction, to, from *fpFormat) (flags, error) {
+	rm, err := vm.roundingMode(in)
+	if err != nil {
+		return flags{}, err
+	}
+	if in.rs2 != uint64(from.bits/32-1) {
+		return illegal(in)
+	}
+	r, fflags := fpConvert(to, from, vm.freg(from, in.rs1), rm)
+	vm.setFreg(to, in.rd, r)
+	vm.fpRaise(fflags)
+	return flags{}, nil
+}
+
+func fload(vm *VM, in *Instruction, f *fpFormat) (flags, error) {
+	if err := vm.fpCheck(in); err != nil {
+		return flags{}, err
+	}
+	v, err := vm.loadMem(vm.Reg[in.rs1]+signExtend(in.imm, 11), f.bits/8)
+	if err != nil {
+		return flags{}, err
+	}
+	vm.setFreg(f, in.rd, v)
+	return flags{}, nil
+}
+
+func fstore(vm *VM, in *Instruction, f *fpFormat) (flags, error) {
+	if err := vm.fpCheck(in); err != nil {
+		return flags{}, err
+	}
+	return flags{}, vm.storeMem(vm.Reg[in.rs1]+signExtend(in.imm, 11), f.bits/8, vm.FReg[in.rs2])
+}
+
+// RV32F Standard Extension
+
+func flw(vm *VM, in *Instruction) (flags, error)            { return fload(vm, in, single) }
+func fsw(vm *VM, in *Instruction) (flags, error)            { return fstore(vm, in, single) }
+func fmaddS(vm *VM, in *Instruction) (flags, error)         { return fusedMulAdd(vm, in, single, false, false) }
+func fmsubS(vm *VM, in *Instruction) (flags, error)         { return fusedMulAdd(vm, in, single, false, true) }
+func fnmsubS(vm *VM, in *Instruction) (flags, error)        { return fusedMulAdd(vm, in, single, true, false) }
+func fnmaddS(vm *VM, in *Instruction) (flags, error)        { return fusedMulAdd(vm, in, single, true, true) }
+func faddS(vm *VM, in *Instruction) (flags, error)          { return fpArith(vm, in, single, fpAdd) }
+func fsubS(vm *VM, in *Instruction) (flags, error)          { return fpArith(vm, in, single, fpSub) }
+func fmulS(vm *VM, in *Instruction) (flags, error)          { return fpArith(vm, in, single, fpMul) }
+func fdivS(vm *VM, in *Instruction) (flags, error)          { return fpArith(vm, in, single, fpDiv) }
+func fsqrtS(vm *VM, in *Instruction) (flags, error)         { return fsqrt(vm, in, single) }
+func fsgnjS(vm *VM, in *Instruction) (flags, error)         { return fsgnj(vm, in, single) }
+func fminmaxS(vm *VM, in *Instruction) (flags, error)       { return fminmax(vm, in, single) }
+func fcvtIntS(vm *VM, in *Instruction) (flags, error)       { return fcvtToInt(vm, in, single) }
+func fmvxwOrFclassS(vm *VM, in *Instruction) (flags, error) { return fmvxOrFclass(vm, in, single) }
+func fcmpS(vm *VM, in *Instruction) (flags, error)          { return fcmp(vm, in, single) }
+func fcvtSInt(vm *VM, in *Instruction) (flags, error)       { return fcvtFromInt(vm, in, single) }
+func fmvWX(vm *VM, in *Instruction) (flags, error)          { return fmvfx(vm, in, single) }
+
+// RV32D Standard Extension
+
+func fld(vm *VM, in *Instruction) (flags, error)            { return fload(vm, in, double) }
+func fsd(vm *VM, in *Instruction) (flags, error)            { return fstore(vm, in, double) }
+func fmaddD(vm *VM, in *Instruction) (flags, error)         { return fusedMulAdd(vm, in, double, false, false) }
+func fmsubD(vm *VM, in *Instruction) (flags, error)         { return fusedMulAdd(vm, in, double, false, true) }
+func fnmsubD(vm *VM, in *Instruction) (flags, error)        { return fusedMulAdd(vm, in, double, true, false) }
+func fnmaddD(vm *VM, in *Instruction) (flags, error)        { return fusedMulAdd(vm, in, double, true, true) }
+func faddD(vm *VM, in *Instruction) (flags, error)          { return fpArith(vm, in, double, fpAdd) }
+func fsubD(vm *VM, in *Instruction) (flags, error)          { return fpArith(vm, in, double, fpSub) }
+func fmulD(vm *VM, in *Instruction) (flags, error)          { return fpArith(vm, in, double, fpMul) }
+func fdivD(vm *VM, in *Instruction) (flags, error)          { return fpArith(vm, in, double, fpDiv) }
+func fsqrtD(vm *VM, in *Instruction) (flags, error)         { return fsqrt(vm, in, double) }
+func fsgnjD(vm *VM, in *Instruction) (flags, error)         { return fsgnj(vm, in, double) }
+func fminmaxD(vm *VM, in *Instruction) (flags, error)       { return fminmax(vm, in, double) }
+func fcvtSD(vm *VM, in *Instruction) (flags, error)         { return fcvtFloat(vm, in, single, double) }
+func fcvtDS(vm *VM, in *Instruction) (flags, error)         { return fcvtFloat(vm, in, double, single) }
+func fcmpD(vm *VM, in *Instruction) (flags, error)          { return fcmp(vm, in, double) }
+func fcvtIntD(vm *VM, in *Instruction) (flags, error)       { return fcvtToInt(vm, in, double) }
+func fcvtDInt(vm *VM, in *Instruction) (flags, error)       { return fcvtFromInt(vm, in, double) }
+func fmvxdOrFclassD(vm *VM, in *Instruction) (flags, error) { return fmvxOrFclass(vm, in, double) }
+func fmvDX(vm *VM, in *Instruction) (flags, error)          { return fmvfx(vm, in, double) }
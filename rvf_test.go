@@ -0,0 +1,305 @@
+// Copyright 2019 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"math"
+	"testing"
+)
+
+// Encodings of floating-point values used by the tests.
+const (
+	d0     = 0x0000000000000000
+	dNeg0  = 0x8000000000000000
+	d1     = 0x3ff0000000000000
+	d2     = 0x4000000000000000
+	d3     = 0x4008000000000000
+	dNeg1  = 0xbff0000000000000
+	dInf   = 0x7ff0000000000000
+	dMax   = 0x7fefffffffffffff
+	dMinN  = 0x0010000000000000 // the smallest normal number
+	dSNaN  = 0x7ff0000000000001
+	dQNaN  = 0x7ff8000000000001
+	dTiny  = 0x3c90000000000000 // 2^-54
+	s1     = 0x3f800000
+	s3     = 0x40400000
+	sMax   = 0x7f7fffff
+	sMinS  = 0x00000001 // the smallest subnormal number
+	sHalf  = 0x3f000000
+	sSNaN  = 0x7f800001
+	sCanon = 0x7fc00000
+)
+
+func TestFPArith(t *testing.T) {
+	for _, tt := range []struct {
+		desc       string
+		f          *fpFormat
+		op         func(f *fpFormat, a, b uint64, rm int) (uint64, uint64)
+		a, b       uint64
+		rm         int
+		want       uint64
+		wantFflags uint64
+	}{
+		{desc: "1+2", f: double, op: fpAdd, a: d1, b: d2, want: d3},
+		{desc: "1+2^-54 rne", f: double, op: fpAdd, a: d1, b: dTiny, want: d1, wantFflags: fflagNX},
+		{desc: "1+2^-54 rup", f: double, op: fpAdd, a: d1, b: dTiny, rm: rmRUP, want: d1 + 1, wantFflags: fflagNX},
+		{desc: "1-2^-54 rtz", f: double, op: fpSub, a: d1, b: dTiny, rm: rmRTZ, want: 0x3fefffffffffffff, wantFflags: fflagNX},
+		{desc: "1-1 rne", f: double, op: fpSub, a: d1, b: d1, want: d0},
+		{desc: "1-1 rdn", f: double, op: fpSub, a: d1, b: d1, rm: rmRDN, want: dNeg0},
+		{desc: "-0+-0", f: double, op: fpAdd, a: dNeg0, b: dNeg0, want: dNeg0},
+		{desc: "overflow", f: double, op: fpAdd, a: dMax, b: dMax, want: dInf, wantFflags: fflagOF | fflagNX},
+		{desc: "overflow rtz", f: double, op: fpAdd, a: dMax, b: dMax, rm: rmRTZ, want: dMax, wantFflags: fflagOF | fflagNX},
+		{desc: "inf-inf", f: double, op: fpSub, a: dInf, b: dInf, want: double.nan, wantFflags: fflagNV},
+		{desc: "qNaN", f: double, op: fpAdd, a: dQNaN, b: d1, want: double.nan},
+		{desc: "sNaN", f: double, op: fpAdd, a: d1, b: dSNaN, want: double.nan, wantFflags: fflagNV},
+		{desc: "single overflow", f: single, op: fpMul, a: sMax, b: s3, want: 0x7f800000, wantFflags: fflagOF | fflagNX},
+		{desc: "single sNaN", f: single, op: fpMul, a: sSNaN, b: s1, want: sCanon, wantFflags: fflagNV},
+		// Half of the smallest subnormal number is a tie.
+		{desc: "underflow to zero", f: single, op: fpMul, a: sMinS, b: sHalf, want: 0, wantFflags: fflagUF | fflagNX},
+		{desc: "underflow rup", f: single, op: fpMul, a: sMinS, b: sHalf, rm: rmRUP, want: sMinS, wantFflags: fflagUF | fflagNX},
+		{desc: "underflow rmm", f: single, op: fpMul, a: sMinS, b: sHalf, rm: rmRMM, want: sMinS, wantFflags: fflagUF | fflagNX},
+		{desc: "exact subnormal", f: double, op: fpMul, a: dMinN, b: 0x3fe0000000000000, want: 0x0008000000000000},
+		// The result rounds to the smallest normal number, but it's tiny
+		// when rounded with an unbounded exponent range.
+		{desc: "tiny after rounding", f: double, op: fpMul, a: 0x3fefffffffffffff, b: dMinN, want: dMinN, wantFflags: fflagUF | fflagNX},
+		{desc: "inf*0", f: double, op: fpMul, a: dInf, b: d0, want: double.nan, wantFflags: fflagNV},
+		{desc: "1/3", f: single, op: fpDiv, a: s1, b: s3, want: 0x3eaaaaab, wantFflags: fflagNX},
+		{desc: "1/3 rdn", f: single, op: fpDiv, a: s1, b: s3, rm: rmRDN, want: 0x3eaaaaaa, wantFflags: fflagNX},
+		{desc: "1/0", f: double, op: fpDiv, a: d1, b: dNeg0, want: dInf | dNeg0, wantFflags: fflagDZ},
+		{desc: "0/0", f: double, op: fpDiv, a: d0, b: d0, want: double.nan, wantFflags: fflagNV},
+		{desc: "3/-1", f: double, op: fpDiv, a: d3, b: dNeg1, want: d3 | dNeg0},
+	} {
+		got, fflags := tt.op(tt.f, tt.a, tt.b, tt.rm)
+		if got != tt.want || fflags != tt.wantFflags {
+			t.Errorf("%s: got %#x, fflags %#x; want %#x, %#x", tt.desc, got, fflags, tt.want, tt.wantFflags)
+		}
+	}
+}
+
+func TestFPSqrtAndMulAdd(t *testing.T) {
+	for _, tt := range []struct {
+		desc       string
+		got        func() (uint64, uint64)
+		want       uint64
+		wantFflags uint64
+	}{
+		{"sqrt(4)", func() (uint64, uint64) { return fpSqrt(double, 0x4010000000000000, rmRNE) }, d2, 0},
+		{"sqrt(2)", func() (uint64, uint64) { return fpSqrt(double, d2, rmRNE) }, math.Float64bits(math.Sqrt2), fflagNX},
+		{"sqrt(-0)", func() (uint64, uint64) { return fpSqrt(double, dNeg0, rmRNE) }, dNeg0, 0},
+		{"sqrt(-1)", func() (uint64, uint64) { return fpSqrt(double, dNeg1, rmRNE) }, double.nan, fflagNV},
+		{"sqrt(3) single", func() (uint64, uint64) { return fpSqrt(single, s3, rmRNE) }, 0x3fddb3d7, fflagNX},
+		{"1*1+2^-54", func() (uint64, uint64) { return fpMulAdd(double, d1, d1, dTiny, rmRUP) }, d1 + 1, fflagNX},
+		// The product isn't rounded before the addition.
+		{"fused", func() (uint64, uint64) { return fpMulAdd(double, d1+1, d1-1, dNeg1, rmRNE) }, 0x3c9ffffffffffffe, 0},
+		{"inf*0+qNaN", func() (uint64, uint64) { return fpMulAdd(double, dInf, d0, dQNaN, rmRNE) }, double.nan, fflagNV},
+		{"1*1-1 rdn", func() (uint64, uint64) { return fpMulAdd(double, d1, d1, dNeg1, rmRDN) }, dNeg0, 0},
+	} {
+		got, fflags := tt.got()
+		if got != tt.want || fflags != tt.wantFflags {
+			t.Errorf("%s: got %#x, fflags %#x; want %#x, %#x", tt.desc, got, fflags, tt.want, tt.wantFflags)
+		}
+	}
+}
+
+func TestFPConvert(t *testing.T) {
+	for _, tt := range []struct {
+		desc       string
+		got        func() (uint64, uint64)
+		want       uint64
+		wantFflags uint64
+	}{
+		{"fcvt.w.d 3.5", func() (uint64, uint64) { return fpToInt(double, 0x400c000000000000, rmRNE, 32, true) }, 4, fflagNX},
+		{"fcvt.w.d -3.5 rtz", func() (uint64, uint64) { return fpToInt(double, 0xc00c000000000000, rmRTZ, 32, true) }, u64(-3), fflagNX},
+		{"fcvt.w.d 2^31", func() (uint64, uint64) { return fpToInt(double, 0x41e0000000000000, rmRNE, 32, true) }, 0x7fffffff, fflagNV},
+		{"fcvt.w.d -inf", func() (uint64, uint64) { return fpToInt(double, dInf|dNeg0, rmRNE, 32, true) }, u64(-0x80000000), fflagNV},
+		{"fcvt.w.d NaN", func() (uint64, uint64) { return fpToInt(double, dQNaN, rmRNE, 32, true) }, 0x7fffffff, fflagNV},
+		{"fcvt.wu.d -1", func() (uint64, uint64) { return fpToInt(double, dNeg1, rmRNE, 32, false) }, 0, fflagNV},
+		{"fcvt.wu.d -0.5 rtz", func() (uint64, uint64) { return fpToInt(double, 0xbfe0000000000000, rmRTZ, 32, false) }, 0, fflagNX},
+		// 32-bit results are sign-extended even if they're unsigned.
+		{"fcvt.wu.d 2^32-1", func() (uint64, uint64) { return fpToInt(double, 0x41efffffffe00000, rmRNE, 32, false) }, u64(-1), 0},
+		{"fcvt.l.d -2^63", func() (uint64, uint64) { return fpToInt(double, 0xc3e0000000000000, rmRNE, 64, true) }, 1 << 63, 0},
+		{"fcvt.lu.d 2^64", func() (uint64, uint64) { return fpToInt(double, 0x43f0000000000000, rmRNE, 64, false) }, u64(-1), fflagNV},
+		{"fcvt.lu.s 2.5 rmm", func() (uint64, uint64) { return fpToInt(single, 0x40200000, rmRMM, 64, false) }, 3, fflagNX},
+		{"fcvt.s.l 2^24+1", func() (uint64, uint64) { return fpFromInt(single, 1<<24+1, true, rmRNE) }, 0x4b800000, fflagNX},
+		{"fcvt.s.l 2^24+1 rup", func() (uint64, uint64) { return fpFromInt(single, 1<<24+1, true, rmRUP) }, 0x4b800001, fflagNX},
+		{"fcvt.d.l -1", func() (uint64, uint64) { return fpFromInt(double, u64(-1), true, rmRNE) }, dNeg1, 0},
+		{"fcvt.d.lu 2^64-1", func() (uint64, uint64) { return fpFromInt(double, u64(-1), false, rmRNE) }, 0x43f0000000000000, fflagNX},
+		{"fcvt.s.d 1/3", func() (uint64, uint64) { return fpConvert(single, double, 0x3fd5555555555555, rmRNE) }, 0x3eaaaaab, fflagNX},
+		{"fcvt.s.d max", func() (uint64, uint64) { return fpConvert(single, double, dMax, rmRNE) }, 0x7f800000, fflagOF | fflagNX},
+		{"fcvt.s.d sNaN", func() (uint64, uint64) { return fpConvert(single, double, dSNaN, rmRNE) }, sCanon, fflagNV},
+		{"fcvt.d.s 3", func() (uint64, uint64) { return fpConvert(double, single, s3, rmRNE) }, d3, 0},
+	} {
+		got, fflags := tt.got()
+		if got != tt.want || fflags != tt.wantFflags {
+			t.Errorf("%s: got %#x, fflags %#x; want %#x, %#x", tt.desc, got, fflags, tt.want, tt.wantFflags)
+		}
+	}
+}
+
+func TestFPClass(t *testing.T) {
+	for _, tt := range []struct {
+		f    *fpFormat
+		a    uint64
+		want uint64
+	}{
+		{double, dInf | dNeg0, 1 << 0},
+		{double, dNeg1, 1 << 1},
+		{double, dNeg0 | 1, 1 << 2},
+		{double, dNeg0, 1 << 3},
+		{double, d0, 1 << 4},
+		{double, 1, 1 << 5},
+		{double, dMinN, 1 << 6},
+		{double, dInf, 1 << 7},
+		{double, dSNaN, 1 << 8},
+		{double, dQNaN, 1 << 9},
+		{single, sMinS, 1 << 5},
+		{single, 0x00800000, 1 << 6},
+		{single, sSNaN, 1 << 8},
+	} {
+		if got := fpClass(tt.f, tt.a); got != tt.want {
+			t.Errorf("fpClass(%#x) = %#x; want %#x", tt.a, got, tt.want)
+		}
+	}
+}
+
+func TestFPInstructions(t *testing.T) {
+	const addr = 0x70
+	for _, tt := range []struct {
+		desc       string
+		in         uint64
+		f1, f2, f3 uint64
+		f4         uint64
+		x1         uint64
+		frm        uint64
+		mem        uint64
+		wantF3     uint64
+		wantX3     uint64
+		wantMem    uint64
+		wantFflags uint64
+	}{
+		{desc: "fadd.s", in: 0x0020f1d3, f1: boxed(s1), f2: boxed(s3), wantF3: boxed(0x40800000)},
+		{desc: "fadd.s unboxed", in: 0x0020f1d3, f1: s1, f2: boxed(s3), wantF3: boxed(sCanon)},
+		{desc: "fadd.d rne", in: 0x022081d3, f1: d1, f2: dTiny, frm: rmRUP, wantF3: d1, wantFflags: fflagNX},
+		{desc: "fadd.d dyn", in: 0x0220f1d3, f1: d1, f2: dTiny, frm: rmRUP, wantF3: d1 + 1, wantFflags: fflagNX},
+		{desc: "fmin.d -0 +0", in: 0x2a2081d3, f1: d0, f2: dNeg0, wantF3: dNeg0},
+		{desc: "fmin.d NaN", in: 0x2a2081d3, f1: dQNaN, f2: d2, wantF3: d2},
+		{desc: "fmax.d sNaN", in: 0x2a2091d3, f1: d2, f2: dSNaN, wantF3: d2, wantFflags: fflagNV},
+		{desc: "fmax.d NaNs", in: 0x2a2091d3, f1: dQNaN, f2: dQNaN, wantF3: double.nan},
+		{desc: "feq.d", in: 0xa220a1d3, f1: d0, f2: dNeg0, wantX3: 1},
+		{desc: "feq.d qNaN", in: 0xa220a1d3, f1: dQNaN, f2: dQNaN},
+		{desc: "flt.d", in: 0xa22091d3, f1: dNeg1, f2: d1, wantX3: 1},
+		{desc: "flt.d qNaN", in: 0xa22091d3, f1: dQNaN, f2: d1, wantFflags: fflagNV},
+		{desc: "fle.d", in: 0xa22081d3, f1: d1, f2: d1, wantX3: 1},
+		{desc: "fclass.d", in: 0xe20091d3, f1: dNeg1, wantX3: 1 << 1},
+		{desc: "fclass.s", in: 0xe00091d3, f1: boxed(sSNaN), wantX3: 1 << 8},
+		{desc: "fmv.x.w", in: 0xe00081d3, f1: 0x12345678bf800000, wantX3: 0xffffffffbf800000},
+		{desc: "fmv.w.x", in: 0xf00081d3, x1: 0x1234567840400000, wantF3: boxed(s3)},
+		{desc: "fmv.x.d", in: 0xe20081d3, f1: dSNaN, wantX3: dSNaN},
+		{desc: "fmv.d.x", in: 0xf20081d3, x1: dSNaN, wantF3: dSNaN},
+		{desc: "fsgnjn.d", in: 0x222091d3, f1: d3, f2: d1, wantF3: d3 | dNeg0},
+		{desc: "fsgnjx.s", in: 0x2020a1d3, f1: boxed(s3 | 0x80000000), f2: boxed(0x80000000), wantF3: boxed(s3)},
+		{desc: "fcvt.w.d rtz", in: 0xc20091d3, f1: 0xc00c000000000000, wantX3: u64(-3), wantFflags: fflagNX},
+		{desc: "fcvt.d.s", in: 0x420081d3, f1: boxed(s3), wantF3: d3},
+		{desc: "fcvt.s.d", in: 0x4010f1d3, f1: d3, wantF3: boxed(s3)},
+		{desc: "fcvt.d.l", in: 0xd220f1d3, x1: u64(-1), wantF3: dNeg1},
+		{desc: "fmadd.d", in: 0x2220f1c3, f1: d1, f2: d2, f4: d1, wantF3: d3},
+		{desc: "fnmsub.d", in: 0x2220f1cb, f1: d1, f2: d2, f4: d3, wantF3: d1},
+		{desc: "fsqrt.d", in: 0x5a00f1d3, f1: 0x4022000000000000, wantF3: d3},
+		{desc: "flw", in: 0x0080a187, x1: addr - 8, mem: 0x1122334440400000, wantF3: boxed(s3), wantMem: 0x1122334440400000},
+		{desc: "fsd", in: 0x0030b827, x1: addr - 16, f3: d3, wantF3: d3, wantMem: d3},
+		{desc: "fscsr", in: 0x003091f3, x1: 0xff, wantX3: 0, wantFflags: 0x1f},
+	} {
+		vm := newTrapVM(t)
+		copy(vm.Mem, asBytes(tt.in))
+		vm.write(addr, 8, tt.mem)
+		vm.FReg[1], vm.FReg[2], vm.FReg[3], vm.FReg[4] = tt.f1, tt.f2, tt.f3, tt.f4
+		vm.Reg[1] = tt.x1
+		vm.CSR[csrFcsr] = tt.frm << 5
+		if err := vm.Run(1); err != nil {
+			t.Fatalf("%s: Run failed: %v", tt.desc, err)
+		}
+		if vm.PC != 4 {
+			t.Fatalf("%s: PC = %#x; want 0x4 (mcause %d)", tt.desc, vm.PC, vm.CSR[csrMcause])
+		}
+		if vm.FReg[3] != tt.wantF3 {
+			t.Errorf("%s: f3 = %#x; want %#x", tt.desc, vm.FReg[3], tt.wantF3)
+		}
+		if vm.Reg[3] != tt.wantX3 {
+			t.Errorf("%s: x3 = %#x; want %#x", tt.desc, vm.Reg[3], tt.wantX3)
+		}
+		if got, _ := vm.read(addr, 8); got != tt.wantMem {
+			t.Errorf("%s: memory = %#x; want %#x", tt.desc, got, tt.wantMem)
+		}
+		if got := vm.CSR[csrFcsr] & 0x1f; got != tt.wantFflags {
+			t.Errorf("%s: fflags = %#x; want %#x", tt.desc, got, tt.wantFflags)
+		}
+	}
+}
+
+func TestFPCompressed(t *testing.T) {
+	const addr = 0x70
+	vm := newTrapVM(t)
+	code := append(asBytes(0x21a2) /* c.fldsp f3, 8(sp) */, asBytes(0xa80e)... /* c.fsdsp f3, 16(sp) */)
+	copy(vm.Mem, code)
+	vm.Reg[SP] = addr - 8
+	vm.write(addr, 8, d3)
+	if err := vm.Run(2); err != nil {
+		t.Fatalf("Run failed: %v", err)
+	}
+	if vm.FReg[3] != d3 {
+		t.Errorf("f3 = %#x; want %#x", vm.FReg[3], uint64(d3))
+	}
+	if got, _ := vm.read(addr+8, 8); got != d3 {
+		t.Errorf("memory = %#x; want %#x", got, uint64(d3))
+	}
+}
+
+func TestFPState(t *testing.T) {
+	const faddS = 0x0020f1d3
+	for _, tt := range []struct {
+		desc      string
+		fs        uint64
+		frm       uint64
+		wantCause uint64 // 0 if there's no trap
+		wantFS    uint64
+	}{
+		{desc: "initial", fs: fsInitial, wantFS: fsDirty},
+		{desc: "off", fs: fsOff, wantCause: causeIllegalInstr, wantFS: fsOff},
+		{desc: "reserved frm", fs: fsInitial, frm: 5, wantCause: causeIllegalInstr, wantFS: fsInitial},
+	} {
+		vm := newTrapVM(t)
+		copy(vm.Mem, asBytes(faddS))
+		vm.CSR[csrMstatus] = tt.fs << mstatusFSShift
+		vm.CSR[csrFcsr] = tt.frm << 5
+		if err := vm.Run(1); err != nil {
+			t.Fatalf("%s: Run failed: %v", tt.desc, err)
+		}
+		if tt.wantCause != 0 && (vm.PC != trapHandler || vm.CSR[csrMcause] != tt.wantCause) {
+			t.Errorf("%s: PC, mcause = %#x, %d; want %#x, %d", tt.desc, vm.PC, vm.CSR[csrMcause], trapHandler, tt.wantCause)
+		}
+		if tt.wantCause == 0 && vm.PC != 4 {
+			t.Errorf("%s: PC = %#x; want 0x4", tt.desc, vm.PC)
+		}
+		s := vm.CSR[csrMstatus]
+		if fs := s & mstatusFS >> mstatusFSShift; fs != tt.wantFS || (s&mstatusSD != 0) != (fs == fsDirty) {
+			t.Errorf("%s: mstatus = %#x; want FS = %d and SD set only if it's dirty", tt.desc, s, tt.wantFS)
+		}
+	}
+}
+
+// boxed returns the NaN-boxed single-precision value.
+func boxed(v uint64) uint64 {
+	return 0xffffffff00000000 | v
+}
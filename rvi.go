@@ -29,129 +29,125 @@ func lui(vm *VM, in *Instruction) (flags, error) {
 }
 
 func auipc(vm *VM, in *Instruction) (flags, error) {
-	vm.store(in.rd, signExtend(in.imm+vm.PC, 31))
+	vm.store(in.rd, signExtend(in.imm, 31)+vm.PC)
 	return flags{}, nil
 }
 
 func jal(vm *VM, in *Instruction) (flags, error) {
-	vm.store(in.rd, vm.PC+4)
-	vm.PC = signExtend(in.imm, 19) + vm.PC
+	pc := vm.PC
+	if err := vm.jump(signExtend(in.imm, 19) + pc); err != nil {
+		return flags{}, err
+	}
+	vm.store(in.rd, pc+4)
 	return flags{updatedPC: true}, nil
 }
 
 func jalr(vm *VM, in *Instruction) (flags, error) {
-	vm.store(in.rd, vm.PC+4)
-	vm.PC = (signExtend(in.imm, 12) + vm.Reg[in.rs1]) &^ 0x1
+	pc := vm.PC
+	if err := vm.jump((signExtend(in.imm, 12) + vm.Reg[in.rs1]) &^ 0x1); err != nil {
+		return flags{}, err
+	}
+	vm.store(in.rd, pc+4)
 	return flags{updatedPC: true}, nil
 }
 
 func beq(vm *VM, in *Instruction) (flags, error) {
 	if vm.Reg[in.rs1] == vm.Reg[in.rs2] {
-		vm.PC = vm.PC + signExtend(in.imm, 12)
-		return flags{updatedPC: true}, nil
+		return flags{updatedPC: true}, vm.jump(vm.PC + signExtend(in.imm, 12))
 	}
 	return flags{}, nil
 }
 
 func bne(vm *VM, in *Instruction) (flags, error) {
 	if vm.Reg[in.rs1] != vm.Reg[in.rs2] {
-		vm.PC = vm.PC + signExtend(in.imm, 12)
-		return flags{updatedPC: true}, nil
+		return flags{updatedPC: true}, vm.jump(vm.PC + signExtend(in.imm, 12))
 	}
 	return flags{}, nil
 }
 
 func blt(vm *VM, in *Instruction) (flags, error) {
 	if int64(vm.Reg[in.rs1]) < int64(vm.Reg[in.rs2]) {
-		vm.PC = vm.PC + signExtend(in.imm, 12)
-		return flags{updatedPC: true}, nil
+		return flags{updatedPC: true}, vm.jump(vm.PC + signExtend(in.imm, 12))
 	}
 	return flags{}, nil
 }
 
 func bge(vm *VM, in *Instruction) (flags, error) {
 	if int64(vm.Reg[in.rs1]) >= int64(vm.Reg[in.rs2]) {
-		vm.PC = vm.PC + signExtend(in.imm, 12)
-		return flags{updatedPC: true}, nil
+		return flags{updatedPC: true}, vm.jump(vm.PC + signExtend(in.imm, 12))
 	}
 	return flags{}, nil
 }
 
 func bltu(vm *VM, in *Instruction) (flags, error) {
 	if vm.Reg[in.rs1] < vm.Reg[in.rs2] {
-		vm.PC = vm.PC + signExtend(in.imm, 12)
-		return flags{updatedPC: true}, nil
+		return flags{updatedPC: true}, vm.jump(vm.PC + signExtend(in.imm, 12))
 	}
 	return flags{}, nil
 }
 
 func bgeu(vm *VM, in *Instruction) (flags, error) {
 	if vm.Reg[in.rs1] >= vm.Reg[in.rs2] {
-		vm.PC = vm.PC + signExtend(in.imm, 12)
-		return flags{updatedPC: true}, nil
+		return flags{updatedPC: true}, vm.jump(vm.PC + signExtend(in.imm, 12))
 	}
 	return flags{}, nil
 }
 
 func lb(vm *VM, in *Instruction) (flags, error) {
-	a := vm.Reg[in.rs1] + signExtend(in.imm, 11)
-	vm.store(in.rd, signExtend(uint64(vm.Mem[a]), 7))
+	v, err := vm.loadMem(vm.Reg[in.rs1]+signExtend(in.imm, 11), 1)
+	if err != nil {
+		return flags{}, err
+	}
+	vm.store(in.rd, signExtend(v, 7))
 	return flags{}, nil
 }
 
 func lh(vm *VM, in *Instruction) (flags, error) {
-	a := vm.Reg[in.rs1] + signExtend(in.imm, 11)
-	v := uint64(vm.Mem[a])
-	v |= uint64(vm.Mem[a+1]) << 8
+	v, err := vm.loadMem(vm.Reg[in.rs1]+signExtend(in.imm, 11), 2)
+	if err != nil {
+		return flags{}, err
+	}
 	vm.store(in.rd, signExtend(v, 15))
 	return flags{}, nil
 }
 
 func lw(vm *VM, in *Instruction) (flags, error) {
-	a := vm.Reg[in.rs1] + signExtend(in.imm, 11)
-	v := uint64(vm.Mem[a])
-	v |= uint64(vm.Mem[a+1]) << 8
-	v |= uint64(vm.Mem[a+2]) << 16
-	v |= uint64(vm.Mem[a+3]) << 24
+	v, err := vm.loadMem(vm.Reg[in.rs1]+signExtend(in.imm, 11), 4)
+	if err != nil {
+		return flags{}, err
+	}
 	vm.store(in.rd, signExtend(v, 31))
 	return flags{}, nil
 }
 
 func lbu(vm *VM, in *Instruction) (flags, error) {
-	a := vm.Reg[in.rs1] + signExtend(in.imm, 11)
-	vm.store(in.rd, uint64(vm.Mem[a]))
+	v, err := vm.loadMem(vm.Reg[in.rs1]+signExtend(in.imm, 11), 1)
+	if err != nil {
+		return flags{}, err
+	}
+	vm.store(in.rd, v)
 	return flags{}, nil
 }
 
 func lhu(vm *VM, in *Instruction) (flags, error) {
-	a := vm.Reg[in.rs1] + signExtend(in.imm, 11)
-	v := uint64(vm.Mem[a])
-	v |= uint64(vm.Mem[a+1]) << 8
+	v, err := vm.loadMem(vm.Reg[in.rs1]+signExtend(in.imm, 11), 2)
+	if err != nil {
+		return flags{}, err
+	}
 	vm.store(in.rd, v)
 	return flags{}, nil
 }
 
 func sb(vm *VM, in *Instruction) (flags, error) {
-	vm.Mem[vm.Reg[in.rs1]+signExtend(in.imm, 11)] = byte(vm.Reg[in.rs2] & 0xff)
-	return flags{}, nil
+	return flags{}, vm.storeMem(vm.Reg[in.rs1]+signExtend(in.imm, 11), 1, vm.Reg[in.rs2])
 }
 
 func sh(vm *VM, in *Instruction) (flags, error) {
-	a := vm.Reg[in.rs1] + signExtend(in.imm, 11)
-	v := vm.Reg[in.rs2]
-	vm.Mem[a] = byte(v)
-	vm.Mem[a+1] = byte(v >> 8)
-	return flags{}, nil
+	return flags{}, vm.storeMem(vm.Reg[in.rs1]+signExtend(in.imm, 11), 2, vm.Reg[in.rs2])
 }
 
 func sw(vm *VM, in *Instruction) (flags, error) {
-	a := vm.Reg[in.rs1] + signExtend(in.imm, 11)
-	v := vm.Reg[in.rs2]
-	vm.Mem[a] = byte(v)
-	vm.Mem[a+1] = byte(v >> 8)
-	vm.Mem[a+2] = byte(v >> 16)
-	vm.Mem[a+3] = byte(v >> 24)
-	return flags{}, nil
+	return flags{}, vm.storeMem(vm.Reg[in.rs1]+signExtend(in.imm, 11), 4, vm.Reg[in.rs2])
 }
 
 func addi(vm *VM, in *Instruction) (flags, error) {
@@ -251,8 +247,10 @@ func and(vm *VM, in *Instruction) (flags, error) {
 }
 
 func fence(vm *VM, in *Instruction) (flags, error) {
-	// We provide a single hart and execute instructions sequentially in the
-	// program order. FENCE can be ignored.
+	// Harts execute instructions sequentially in the program order, and
+	// take turns unless they run in parallel. Harts running in parallel
+	// access memory with sequentially consistent atomic operations (see
+	// runParallel). FENCE can be ignored.
 	return flags{}, nil
 }
 
@@ -264,21 +262,48 @@ func fence_i(vm *VM, in *Instruction) (flags, error) {
 }
 
 func ecallOrBreak(vm *VM, in *Instruction) (flags, error) {
-	switch in.imm >> 12 {
-	case 0:
+	// riscv-privileged-v1.10; Table 9.2; Page 106
+	switch in.imm {
+	case 0x000:
 		return ecall(vm, in)
-	case 1:
+	case 0x001:
 		return ebreak(vm, in)
-	default:
-		panic("unrecognized instruction")
+	case 0x102:
+		return sret(vm, in)
+	case 0x105:
+		return wfi(vm, in)
+	case 0x302:
+		return mret(vm, in)
+	}
+	switch in.imm >> 5 {
+	case 0x09: // 0001001 rs2 rs1 000 00000 1110011 SFENCE.VMA
+		return sfenceVMA(vm, in)
+	case 0x11, 0x31: // 0010001 rs2 rs1 000 00000 1110011 HFENCE.VVMA (or 0110001 HFENCE.GVMA)
+		return hfence(vm, in)
 	}
+	return flags{}, &exception{cause: causeIllegalInstr, tval: in.in}
 }
 
-func ecall(vm *VM, in *Instruction) (flags, error) {
+// ecall performs an environment call. The environment may change the state of
+// other harts and devices, so harts running in parallel are paused.
+func ecall(vm *VM, in *Instruction) (out flags, err error) {
+	vm.stopTheWorld(func() { out, err = envCall(vm, in) })
+	return out, err
+}
+
+func envCall(vm *VM, in *Instruction) (flags, error) {
+	if vm.SBI != nil {
+		return vm.SBI.ecall(vm, in)
+	}
+	// Programs that run below M-mode or install a trap handler, such as
+	// kernels, implement the environment themselves.
+	if vm.Priv != PrivM || vm.CSR[csrMtvec] != 0 {
+		return flags{}, &exception{cause: vm.ecallCause()}
+	}
 	// See riscv-tools/riscv-pk/pk/syscall.h for the syscall table.
 	switch call := vm.Reg[regNums["a7"]]; call {
 	case 0x5D:
-		return flags{}, exitErr // TODO: add r0 as exit code in exitErr
+		return flags{}, &ExitError{Code: int(int32(vm.Reg[regNums["a0"]]))}
 	case 0x40:
 		var out io.Writer
 		switch fd := vm.Reg[regNums["a0"]]; fd {
@@ -289,81 +314,194 @@ func ecall(vm *VM, in *Instruction) (flags, error) {
 		default:
 			return flags{}, fmt.Errorf("unrecognized fd %d in %s", fd, in)
 		}
-		buf := int(vm.Reg[regNums["a1"]])
-		n := int(vm.Reg[regNums["a2"]])
-		n, _ = fmt.Fprint(out, string(vm.Mem[buf:buf+n]))
-		vm.store(uint64(regNums["a0"]), uint64(n))
+		// Like pk, return -EFAULT (HTIF uses the same errno values)
+		// for buffers outside memory.
+		ret := int64(-htifEFAULT)
+		if b, err := vm.memSlice(vm.Reg[regNums["a1"]], vm.Reg[regNums["a2"]]); err == nil {
+			n, _ := out.Write(b)
+			ret = int64(n)
+		}
+		vm.store(uint64(regNums["a0"]), uint64(ret))
 		return flags{}, nil
 	default:
 		return flags{}, fmt.Errorf("unrecognized ecall %#x (%d): %s", call, call, in)
 	}
 }
 
-func ebreak(vm *VM, in *Instruction) (flags, error) { return flags{}, nil }
+// ebreak performs a semihosting call if it's surrounded by the semihosting
+// sequence. Other EBREAKs do nothing.
+func ebreak(vm *VM, in *Instruction) (flags, error) {
+	if vm.Semihosting != nil && vm.isSemihostingCall(in) {
+		var err error
+		vm.stopTheWorld(func() { err = vm.Semihosting.call(vm) })
+		return flags{}, err
+	}
+	return flags{}, nil
+}
 
-// It's unclear which CSRs are read-only and what are side effects of
-// reading/writing CSRs. When that's clear, make reading/writing CSRs go through
-// a function call.
+// CSRs are read and written through readCSR and writeCSR (see csr.go), which
+// implement side effects of accessing CSRs.
+
+// checkCSR returns the CSR accessed by the CSR instruction: in VS-mode,
+// supervisor CSRs are replaced by their virtual supervisor counterparts. It
+// raises an illegal-instruction exception if the instruction accesses a CSR
+// that requires a higher privilege level, or writes (if write is set) a
+// read-only CSR. Accesses from VS-mode and VU-mode that would be allowed in
+// HS-mode raise virtual-instruction exceptions instead. Below M-mode, stimecmp
+// is accessible only if menvcfg.STCE is set, and in VS-mode only if
+// henvcfg.STCE is set too. mstatus.TVM traps satp and hgatp in HS-mode, like
+// hstatus.VTVM traps satp in VS-mode.
+//
+// riscv-privileged-v1.10; Chapter 2.1; Page 7; riscv-privileged-20211203;
+// Chapter 8.6.1; Page 126
+func (vm *VM) checkCSR(in *Instruction, write bool) (uint64, error) {
+	csr, level := in.imm, int(in.imm>>8&3)
+	if level == 2 {
+		level = PrivS // hypervisor and VS CSRs belong to HS-mode
+	}
+	switch {
+	case write && csr>>10&3 == 3, csr>>8&3 == PrivM && vm.Priv < PrivM, !vm.Virt && level > vm.Priv:
+		return 0, &exception{cause: causeIllegalInstr, tval: in.in}
+	case vm.Virt && (csr>>8&3 == 2 || level > vm.Priv):
+		return 0, virtualInstr(in)
+	}
+	if vm.Virt {
+		csr = vsCSR(csr)
+	}
+	switch csr {
+	case csrStimecmp, csrVstimecmp:
+		if vm.Priv < PrivM && vm.CSR[csrMenvcfg]&menvcfgSTCE == 0 {
+			return 0, &exception{cause: causeIllegalInstr, tval: in.in}
+		}
+		if vm.Virt && vm.CSR[csrHenvcfg]&menvcfgSTCE == 0 {
+			return 0, virtualInstr(in)
+		}
+	case csrSatp, csrHgatp:
+		if !vm.Virt && vm.Priv == PrivS && vm.CSR[csrMstatus]&mstatusTVM != 0 {
+			return 0, &exception{cause: causeIllegalInstr, tval: in.in}
+		}
+	case csrVsatp:
+		if vm.Virt && vm.CSR[csrHstatus]&hstatusVTVM != 0 {
+			return 0, virtualInstr(in)
+		}
+	case csrVsireg, csrVstopei:
+		// There are no guest interrupt files.
+		if vm.Virt {
+			return 0, virtualInstr(in)
+		}
+		return 0, &exception{cause: causeIllegalInstr, tval: in.in}
+	}
+	return csr, nil
+}
 
 func csrrw(vm *VM, in *Instruction) (flags, error) {
+	csr, err := vm.checkCSR(in, true)
+	if err != nil {
+		return flags{}, err
+	}
 	if in.rd == 0 {
-		vm.CSR[in.imm] = vm.Reg[in.rs1]
-		if in.imm == RDINSTRET {
-			return flags{updatedRDINSTRET: true}, nil
-		}
-		return flags{}, nil
+		return flags{}, vm.writeCSR(csr, vm.Reg[in.rs1])
+	}
+	v, err := vm.readCSR(csr)
+	if err != nil {
+		return flags{}, err
+	}
+	if err := vm.writeCSR(csr, vm.Reg[in.rs1]); err != nil {
+		return flags{}, err
 	}
-	v := vm.CSR[in.imm]
-	vm.CSR[in.imm] = vm.Reg[in.rs1]
 	vm.store(in.rd, v)
 	return flags{}, nil
 }
 
 func csrrs(vm *VM, in *Instruction) (flags, error) {
-	v := vm.CSR[in.imm]
+	csr, err := vm.checkCSR(in, in.rs1 != 0)
+	if err != nil {
+		return flags{}, err
+	}
+	v, err := vm.readCSR(csr)
+	if err != nil {
+		return flags{}, err
+	}
 	if in.rs1 != 0 {
-		vm.CSR[in.imm] |= vm.Reg[in.rs1]
+		if err := vm.writeCSR(csr, v|vm.Reg[in.rs1]); err != nil {
+			return flags{}, err
+		}
 	}
 	vm.store(in.rd, v)
 	return flags{}, nil
 }
 
 func csrrc(vm *VM, in *Instruction) (flags, error) {
-	v := vm.CSR[in.imm]
+	csr, err := vm.checkCSR(in, in.rs1 != 0)
+	if err != nil {
+		return flags{}, err
+	}
+	v, err := vm.readCSR(csr)
+	if err != nil {
+		return flags{}, err
+	}
 	if in.rs1 != 0 {
-		vm.CSR[in.imm] &^= vm.Reg[in.rs1]
+		if err := vm.writeCSR(csr, v&^vm.Reg[in.rs1]); err != nil {
+			return flags{}, err
+		}
 	}
 	vm.store(in.rd, v)
 	return flags{}, nil
 }
 
 func csrrwi(vm *VM, in *Instruction) (flags, error) {
+	csr, err := vm.checkCSR(in, true)
+	if err != nil {
+		return flags{}, err
+	}
 	uimm := signExtend(in.rs1&0x1f, 4)
 	if in.rd == 0 {
-		vm.CSR[in.imm] = uimm
-		return flags{}, nil
+		return flags{}, vm.writeCSR(csr, uimm)
+	}
+	v, err := vm.readCSR(csr)
+	if err != nil {
+		return flags{}, err
+	}
+	if err := vm.writeCSR(csr, uimm); err != nil {
+		return flags{}, err
 	}
-	v := vm.CSR[in.imm]
-	vm.CSR[in.imm] = uimm
 	vm.store(in.rd, v)
 	return flags{}, nil
 }
 
 func csrrsi(vm *VM, in *Instruction) (flags, error) {
+	csr, err := vm.checkCSR(in, in.rs1&0x1f != 0)
+	if err != nil {
+		return flags{}, err
+	}
 	uimm := signExtend(in.rs1&0x1f, 4)
-	v := vm.CSR[in.imm]
+	v, err := vm.readCSR(csr)
+	if err != nil {
+		return flags{}, err
+	}
 	if uimm != 0 {
-		vm.CSR[in.imm] |= uimm
+		if err := vm.writeCSR(csr, v|uimm); err != nil {
+			return flags{}, err
+		}
 	}
 	vm.store(in.rd, v)
 	return flags{}, nil
 }
 
 func csrrci(vm *VM, in *Instruction) (flags, error) {
+	csr, err := vm.checkCSR(in, in.rs1&0x1f != 0)
+	if err != nil {
+		return flags{}, err
+	}
 	uimm := signExtend(in.rs1&0x1f, 4)
-	v := vm.CSR[in.imm]
+	v, err := vm.readCSR(csr)
+	if err != nil {
+		return flags{}, err
+	}
 	if uimm != 0 {
-		vm.CSR[in.imm] &^= uimm
+		if err := vm.writeCSR(csr, v&^uimm); err != nil {
+			return flags{}, err
+		}
 	}
 	vm.store(in.rd, v)
 	return flags{}, nil
@@ -372,41 +510,25 @@ func csrrci(vm *VM, in *Instruction) (flags, error) {
 // RV64I Base Instruction Set
 
 func lwu(vm *VM, in *Instruction) (flags, error) {
-	a := vm.Reg[in.rs1] + signExtend(in.imm, 11)
-	v := uint64(vm.Mem[a])
-	v |= uint64(vm.Mem[a+1]) << 8
-	v |= uint64(vm.Mem[a+2]) << 16
-	v |= uint64(vm.Mem[a+3]) << 24
+	v, err := vm.loadMem(vm.Reg[in.rs1]+signExtend(in.imm, 11), 4)
+	if err != nil {
+		return flags{}, err
+	}
 	vm.store(in.rd, v)
 	return flags{}, nil
 }
 
 func ld(vm *VM, in *Instruction) (flags, error) {
-	a := vm.Reg[in.rs1] + signExtend(in.imm, 11)
-	v := uint64(vm.Mem[a])
-	v |= uint64(vm.Mem[a+1]) << 8
-	v |= uint64(vm.Mem[a+2]) << 16
-	v |= uint64(vm.Mem[a+3]) << 24
-	v |= uint64(vm.Mem[a+4]) << 32
-	v |= uint64(vm.Mem[a+5]) << 40
-	v |= uint64(vm.Mem[a+6]) << 48
-	v |= uint64(vm.Mem[a+7]) << 56
+	v, err := vm.loadMem(vm.Reg[in.rs1]+signExtend(in.imm, 11), 8)
+	if err != nil {
+		return flags{}, err
+	}
 	vm.store(in.rd, v)
 	return flags{}, nil
 }
 
 func sd(vm *VM, in *Instruction) (flags, error) {
-	a := vm.Reg[in.rs1] + signExtend(in.imm, 11)
-	v := vm.Reg[in.rs2]
-	vm.Mem[a] = byte(v)
-	vm.Mem[a+1] = byte(v >> 8)
-	vm.Mem[a+2] = byte(v >> 16)
-	vm.Mem[a+3] = byte(v >> 24)
-	vm.Mem[a+4] = byte(v >> 32)
-	vm.Mem[a+5] = byte(v >> 40)
-	vm.Mem[a+6] = byte(v >> 48)
-	vm.Mem[a+7] = byte(v >> 56)
-	return flags{}, nil
+	return flags{}, vm.storeMem(vm.Reg[in.rs1]+signExtend(in.imm, 11), 8, vm.Reg[in.rs2])
 }
 
 // TODO: add exceptions generated as the spec says
@@ -419,13 +541,13 @@ func slli(vm *VM, in *Instruction) (flags, error) {
 func shiftRight(vm *VM, in *Instruction) (flags, error) {
 	// srli and srai are encoded with I-Type format specialize based on top
 	// 6 bits of the immediate.
-	switch in.imm & 0xFC00 {
-	case 0x00:
+	switch in.imm & 0xFC0 {
+	case 0x000:
 		return srli(vm, in)
-	case 0x10:
+	case 0x400:
 		return srai(vm, in)
 	default:
-		panic("invalid instruction")
+		return illegal(in)
 	}
 }
 
@@ -181,6 +181,8 @@ func TestShifts(t *testing.T) {
 		{desc: "srai max", fn: srai, a: 0xffffffffffffffff, imm: 63, want: 0xffffffffffffffff},
 		{desc: "srai neg", fn: srai, a: u64(-5), imm: 2, want: u64(-2)},
 		{desc: "srai discard high shift bits", fn: srai, a: 1 << 62, imm: 0xfc0 | 0x3e, want: 1},
+		{desc: "shiftRight srli", fn: shiftRight, a: u64(-8), imm: 2, want: u64(-8) >> 2},
+		{desc: "shiftRight srai", fn: shiftRight, a: u64(-8), imm: 0x400 | 2, want: u64(-2)},
 
 		{desc: "slliw zero", fn: slliw, a: 0, imm: 10, want: 0 << 10},
 		{desc: "slliw", fn: slliw, a: 1, imm: 2, want: 1 << 2},
@@ -535,6 +537,8 @@ func TestLUIAUIPC(t *testing.T) {
 		{desc: "lui signextend", fn: lui, imm: 0x82345000, want: 0xffffffff82345000},
 		{desc: "auipc", fn: auipc, pc: 0x678, imm: 0x12345000, want: 0x12345678},
 		{desc: "auipc signextend", fn: auipc, pc: 0x678, imm: 0x82345000, want: 0xffffffff82345678},
+		{desc: "auipc above 2GiB", fn: auipc, pc: 0x80000058, imm: 0x1000, want: 0x80001058},
+		{desc: "auipc negative above 2GiB", fn: auipc, pc: 0x80001004, imm: 0xfffff000, want: 0x80000004},
 	}
 	for _, tt := range tests {
 		t.Run(tt.desc, func(t *testing.T) {
@@ -0,0 +1,337 @@
+// Copyright 2019 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"io"
+	"sync"
+)
+
+// SBI extension IDs (EIDs), passed in a7. See the RISC-V Supervisor Binary
+// Interface Specification v2.0.
+const (
+	sbiLegacyPutchar = 0x01
+	sbiLegacyGetchar = 0x02
+	sbiBase          = 0x10
+	sbiTime          = 0x54494D45 // "TIME"
+	sbiIPI           = 0x735049   // "sPI"
+	sbiRFence        = 0x52464E43 // "RFNC"
+	sbiHSM           = 0x48534D   // "HSM"
+	sbiSRST          = 0x53525354 // "SRST"
+	sbiDBCN          = 0x4442434E // "DBCN"
+)
+
+// SBI error codes, returned in a0.
+const (
+	sbiSuccess         = 0
+	sbiErrFailed       = -1
+	sbiErrNotSupported = -2
+	sbiErrInvalidParam = -3
+	sbiErrInvalidAddr  = -5
+	sbiErrAlreadyAvail = -6
+)
+
+const (
+	sbiSpecVersion      = 2 << 24 // v2.0
+	sbiImplID           = 0xFFFF  // not registered with RISC-V International
+	sbiImplVersion      = 1
+	sbiHartMaskBaseAll  = ^uint64(0) // hart_mask_base selecting all harts
+	sbiSuspendRetentive = 0          // the default retentive suspend type
+)
+
+// HSM hart states.
+const (
+	hsmStarted = 0
+	hsmStopped = 1
+)
+
+// SBI is a Supervisor Binary Interface implementation that replaces M-mode
+// firmware such as OpenSBI. Environment calls from S-mode (HS-mode) are handled
+// in Go; environment calls from U-mode, M-mode and the virtualization mode
+// raise exceptions.
+//
+// It implements the BASE, TIME, IPI, RFENCE, HSM, SRST and DBCN extensions
+// and the legacy console calls. Timers use the Sstc stimecmp CSR. Remote
+// SFENCE.VMA flushes the whole TLB of the selected harts; there are no
+// instruction caches, so remote FENCE.I only validates its arguments.
+type SBI struct {
+	mu    sync.Mutex
+	harts []*VM
+	state []int // HSM state of every hart
+	out   io.Writer
+	input io.Reader // read after the first read from the console
+	in    []byte    // characters read from input
+}
+
+// NewSBI returns the SBI implementation for the harts and installs it in
+// them. All exceptions that can be delegated and the supervisor interrupts
+// are delegated to S-mode. The first hart is started; the others are stopped
+// until the supervisor starts them with the HSM extension. The console reads
+// from in (may be nil) and writes to out.
+func NewSBI(in io.Reader, out io.Writer, harts ...*VM) *SBI {
+	s := &SBI{harts: harts, state: make([]int, len(harts)), out: out, input: in}
+	for i, vm := range harts {
+		vm.SBI = s
+		vm.writeCSR(csrMedeleg, medelegMask)
+		vm.writeCSR(csrMideleg, midelegMask)
+		vm.writeCSR(csrMenvcfg, vm.CSR[csrMenvcfg]|menvcfgSTCE)
+		vm.writeCSR(csrStimecmp, ^uint64(0))
+		if i > 0 {
+			s.state[i] = hsmStopped
+			vm.stopped = true
+		}
+	}
+	return s
+}
+
+// ecall handles the ECALL instruction.
+func (s *SBI) ecall(vm *VM, in *Instruction) (flags, error) {
+	if vm.Priv != PrivS || vm.Virt {
+		// Only HS-mode calls the SBI. The hypervisor implements it
+		// for VS-mode.
+		return flags{}, &exception{cause: vm.ecallCause()}
+	}
+	a := func(i int) uint64 { return vm.Reg[regNums["a0"]+i] }
+	eid, fid := a(7), a(6)
+	switch eid {
+	case sbiLegacyPutchar:
+		s.out.Write([]byte{byte(a(0))})
+		vm.store(uint64(regNums["a0"]), 0)
+		return flags{}, nil
+	case sbiLegacyGetchar:
+		ch := int64(-1)
+		s.mu.Lock()
+		s.startInput()
+		if len(s.in) > 0 {
+			ch, s.in = int64(s.in[0]), s.in[1:]
+		}
+		s.mu.Unlock()
+		vm.store(uint64(regNums["a0"]), uint64(ch))
+		return flags{}, nil
+	}
+	ret, val, err := s.call(vm, eid, fid, a)
+	if err != nil {
+		return flags{}, err
+	}
+	vm.store(uint64(regNums["a0"]), uint64(ret))
+	vm.store(uint64(regNums["a1"]), val)
+	return flags{}, nil
+}
+
+// call executes the function of the extension. It returns the SBI error code
+// and the value returned to the supervisor. a returns the arguments.
+func (s *SBI) call(vm *VM, eid, fid uint64, a func(int) uint64) (int64, uint64, error) {
+	switch eid {
+	case sbiBase:
+		switch fid {
+		case 0: // sbi_get_spec_version
+			return sbiSuccess, sbiSpecVersion, nil
+		case 1: // sbi_get_impl_id
+			return sbiSuccess, sbiImplID, nil
+		case 2: // sbi_get_impl_version
+			return sbiSuccess, sbiImplVersion, nil
+		case 3: // sbi_probe_extension
+			switch a(0) {
+			case sbiLegacyPutchar, sbiLegacyGetchar, sbiBase, sbiTime, sbiIPI, sbiRFence, sbiHSM, sbiSRST, sbiDBCN:
+				return sbiSuccess, 1, nil
+			}
+			return sbiSuccess, 0, nil
+		case 4, 5, 6: // sbi_get_mvendorid, sbi_get_marchid, sbi_get_mimpid
+			return sbiSuccess, vm.CSR[csrMvendorid+fid-4], nil
+		}
+	case sbiTime:
+		if fid == 0 { // sbi_set_timer
+			vm.writeCSR(csrStimecmp, a(0))
+			return sbiSuccess, 0, nil
+		}
+	case sbiIPI:
+		if fid == 0 { // sbi_send_ipi
+			harts, ok := s.selectHarts(a(0), a(1))
+			if !ok {
+				return sbiErrInvalidParam, 0, nil
+			}
+			for _, h := range harts {
+				h.setMIP(mipSSIP, true)
+			}
+			return sbiSuccess, 0, nil
+		}
+	case sbiRFence:
+		switch fid {
+		case 0, 1, 2: // remote FENCE.I, SFENCE.VMA and SFENCE.VMA with ASID
+			harts, ok := s.selectHarts(a(0), a(1))
+			if !ok {
+				return sbiErrInvalidParam, 0, nil
+			}
+			if fid != 0 {
+				for _, h := range harts {
+					h.flushTLB()
+				}
+			}
+			return sbiSuccess, 0, nil
+		}
+	case sbiHSM:
+		return s.hsm(vm, fid, a)
+	case sbiSRST:
+		if fid == 0 { // sbi_system_reset
+			typ, reason := a(0), a(1)
+			switch {
+			case typ >= 0xF0000000 || reason >= 0xF0000000:
+				return sbiErrNotSupported, 0, nil
+			case typ > 2 || reason > 1:
+				return sbiErrInvalidParam, 0, nil
+			}
+			// Reason 1 is a system failure.
+			return 0, 0, &ExitError{Code: int(reason), Reset: typ != 0}
+		}
+	case sbiDBCN:
+		return s.console(vm, fid, a)
+	}
+	return sbiErrNotSupported, 0, nil
+}
+
+// hsm executes a function of the Hart State Management extension.
+func (s *SBI) hsm(vm *VM, fid uint64, a func(int) uint64) (int64, uint64, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	switch fid {
+	case 0: // sbi_hart_start
+		id, addr, opaque := a(0), a(1), a(2)
+		if id >= uint64(len(s.harts)) {
+			return sbiErrInvalidParam, 0, nil
+		}
+		if s.state[id] != hsmStopped {
+			return sbiErrAlreadyAvail, 0, nil
+		}
+		h := s.harts[id]
+		if _, err := h.memSlice(addr, 2); err != nil {
+			return sbiErrInvalidAddr, 0, nil
+		}
+		h.Reg[regNums["a0"]], h.Reg[regNums["a1"]] = id, opaque
+		h.PC, h.Priv, h.Virt = addr, PrivS, false
+		h.writeSatp(0)
+		h.CSR[csrMstatus] &^= mstatusSIE
+		h.stopped, h.waiting = false, false
+		s.state[id] = hsmStarted
+		return sbiSuccess, 0, nil
+	case 1: // sbi_hart_stop
+		for i, h := range s.harts {
+			if h == vm {
+				s.state[i] = hsmStopped
+			}
+		}
+		vm.stopped = true
+		return sbiSuccess, 0, nil
+	case 2: // sbi_hart_get_status
+		id := a(0)
+		if id >= uint64(len(s.harts)) {
+			return sbiErrInvalidParam, 0, nil
+		}
+		return sbiSuccess, uint64(s.state[id]), nil
+	case 3: // sbi_hart_suspend
+		switch typ := uint32(a(0)); {
+		case typ == sbiSuspendRetentive:
+			// The same as WFI: the call returns when an interrupt
+			// is pending.
+			if vm.pendingInterrupts() == 0 {
+				vm.waiting = true
+			}
+			return sbiSuccess, 0, nil
+		case typ < 0x10000000, typ >= 0x80000001 && typ < 0x90000000:
+			return sbiErrInvalidParam, 0, nil
+		}
+		// Non-retentive and platform-specific suspend types.
+		return sbiErrNotSupported, 0, nil
+	}
+	return sbiErrNotSupported, 0, nil
+}
+
+// console executes a function of the Debug Console extension.
+func (s *SBI) console(vm *VM, fid uint64, a func(int) uint64) (int64, uint64, error) {
+	n, addr := a(0), a(1)
+	if fid < 2 && a(2) != 0 {
+		return sbiErrInvalidParam, 0, nil
+	}
+	switch fid {
+	case 0: // sbi_debug_console_write
+		b, err := vm.memSlice(addr, n)
+		if err != nil {
+			return sbiErrInvalidParam, 0, nil
+		}
+		if _, err := s.out.Write(b); err != nil {
+			return sbiErrFailed, 0, nil
+		}
+		return sbiSuccess, n, nil
+	case 1: // sbi_debug_console_read
+		s.mu.Lock()
+		defer s.mu.Unlock()
+		s.startInput()
+		b := s.in
+		if uint64(len(b)) > n {
+			b = b[:n]
+		}
+		if err := vm.writeBytes(addr, b); err != nil {
+			return sbiErrInvalidParam, 0, nil
+		}
+		s.in = s.in[len(b):]
+		return sbiSuccess, uint64(len(b)), nil
+	case 2: // sbi_debug_console_write_byte
+		if _, err := s.out.Write([]byte{byte(a(0))}); err != nil {
+			return sbiErrFailed, 0, nil
+		}
+		return sbiSuccess, 0, nil
+	}
+	return sbiErrNotSupported, 0, nil
+}
+
+// selectHarts returns the harts selected by hart_mask and hart_mask_base.
+func (s *SBI) selectHarts(mask, base uint64) ([]*VM, bool) {
+	if base == sbiHartMaskBaseAll {
+		return s.harts, true
+	}
+	var harts []*VM
+	for i := uint64(0); i < 64; i++ {
+		if mask&(1<<i) == 0 {
+			continue
+		}
+		if base+i >= uint64(len(s.harts)) {
+			return nil, false
+		}
+		harts = append(harts, s.harts[base+i])
+	}
+	return harts, true
+}
+
+// startInput starts reading the console input in the background, if it isn't
+// read already. Reads from the console don't block: they return what was read
+// so far. s.mu must be held.
+func (s *SBI) startInput() {
+	r := s.input
+	if r == nil {
+		return
+	}
+	s.input = nil
+	go func() {
+		buf := make([]byte, 256)
+		for {
+			n, err := r.Read(buf)
+			s.mu.Lock()
+			s.in = append(s.in, buf[:n]...)
+			s.mu.Unlock()
+			if err != nil {
+				return
+			}
+		}
+	}()
+}
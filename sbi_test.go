@@ -0,0 +1,158 @@
+// Copyright 2019 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bytes"
+	"reflect"
+	"testing"
+)
+
+const ecallInstr = 0x00000073
+
+// sbiCall executes ECALL in S-mode and returns a0 and a1.
+func sbiCall(t *testing.T, vm *VM, eid, fid uint64, args ...uint64) (int64, uint64) {
+	t.Helper()
+	copy(vm.Mem, asBytes(ecallInstr))
+	vm.PC = 0
+	for i, a := range args {
+		vm.Reg[regNums["a0"]+i] = a
+	}
+	vm.Reg[regNums["a6"]], vm.Reg[regNums["a7"]] = fid, eid
+	if err := vm.Run(1); err != nil {
+		t.Fatalf("SBI call %#x/%d failed: %v", eid, fid, err)
+	}
+	return int64(vm.Reg[regNums["a0"]]), vm.Reg[regNums["a1"]]
+}
+
+func newSBITest(t *testing.T) (*VM, *bytes.Buffer) {
+	vm := newTrapVM(t)
+	var out bytes.Buffer
+	NewSBI(nil, &out, vm)
+	vm.Priv = PrivS
+	return vm, &out
+}
+
+func TestSBI(t *testing.T) {
+	vm, out := newSBITest(t)
+	copy(vm.Mem[0x20:], "hi")
+	for _, tt := range []struct {
+		desc     string
+		eid, fid uint64
+		args     []uint64
+		wantErr  int64
+		wantVal  uint64
+	}{
+		{"spec version", sbiBase, 0, nil, sbiSuccess, 2 << 24},
+		{"probe HSM", sbiBase, 3, []uint64{sbiHSM}, sbiSuccess, 1},
+		{"probe legacy console", sbiBase, 3, []uint64{sbiLegacyPutchar}, sbiSuccess, 1},
+		{"probe unknown extension", sbiBase, 3, []uint64{0x1234}, sbiSuccess, 0},
+		{"unknown extension", 0x1234, 0, nil, sbiErrNotSupported, 0},
+		{"unknown function", sbiBase, 100, nil, sbiErrNotSupported, 0},
+		{"console write", sbiDBCN, 0, []uint64{2, 0x20, 0}, sbiSuccess, 2},
+		{"console write outside memory", sbiDBCN, 0, []uint64{2, 0x1000, 0}, sbiErrInvalidParam, 0},
+		{"console write of 2^64-1 bytes", sbiDBCN, 0, []uint64{^uint64(0), 0x20, 0}, sbiErrInvalidParam, 0},
+		{"console write byte", sbiDBCN, 2, []uint64{'!'}, sbiSuccess, 0},
+		{"hart status", sbiHSM, 2, []uint64{0}, sbiSuccess, hsmStarted},
+		{"start running hart", sbiHSM, 0, []uint64{0, 0, 0}, sbiErrAlreadyAvail, 0},
+		{"start missing hart", sbiHSM, 0, []uint64{1, 0, 0}, sbiErrInvalidParam, 0},
+		{"IPI to missing hart", sbiIPI, 0, []uint64{2, 0}, sbiErrInvalidParam, 0},
+		{"remote fence", sbiRFence, 1, []uint64{1, 0, 0, 0}, sbiSuccess, 0},
+		{"hypervisor fence", sbiRFence, 3, []uint64{1, 0, 0, 0}, sbiErrNotSupported, 0},
+		{"reserved reset type", sbiSRST, 0, []uint64{5, 0}, sbiErrInvalidParam, 0},
+	} {
+		vm.Reg[regNums["a1"]] = 0
+		gotErr, gotVal := sbiCall(t, vm, tt.eid, tt.fid, tt.args...)
+		if gotErr != tt.wantErr || gotVal != tt.wantVal {
+			t.Errorf("%s: got %d, %#x; want %d, %#x", tt.desc, gotErr, gotVal, tt.wantErr, tt.wantVal)
+		}
+		if vm.PC != 4 {
+			t.Errorf("%s: PC after ECALL = %#x; want 0x4", tt.desc, vm.PC)
+		}
+	}
+	sbiCall(t, vm, sbiLegacyPutchar, 0, '?')
+	if got := out.String(); got != "hi!?" {
+		t.Errorf("console output = %q; want %q", got, "hi!?")
+	}
+	if got, _ := sbiCall(t, vm, sbiLegacyGetchar, 0); got != -1 {
+		t.Errorf("getchar without input = %d; want -1", got)
+	}
+}
+
+func TestSBITimerAndIPI(t *testing.T) {
+	vm, _ := newSBITest(t)
+	vm.writeCSR(csrSie, mipSTIP|mipSSIP)
+	now := vm.CSR[RDTIME]
+	sbiCall(t, vm, sbiTime, 0, now+3)
+	if got, _ := vm.readCSR(csrSip); got != 0 {
+		t.Fatalf("sip after set_timer = %#x; want 0", got)
+	}
+	vm.Run(3) // interrupts are disabled in sstatus
+	if got, _ := vm.readCSR(csrSip); got != mipSTIP {
+		t.Errorf("sip after the deadline = %#x; want STIP", got)
+	}
+	sbiCall(t, vm, sbiTime, 0, ^uint64(0))
+	if got, _ := vm.readCSR(csrSip); got != 0 {
+		t.Errorf("sip after moving the deadline = %#x; want 0", got)
+	}
+	sbiCall(t, vm, sbiIPI, 0, 1, 0)
+	if got, _ := vm.readCSR(csrSip); got != mipSSIP {
+		t.Errorf("sip after send_ipi = %#x; want SSIP", got)
+	}
+}
+
+func TestSBIECallTraps(t *testing.T) {
+	vm, _ := newSBITest(t)
+	vm.CSR[csrStvec] = strapEntry
+	copy(vm.Mem, asBytes(ecallInstr))
+	vm.Priv = PrivU
+	if err := vm.Run(1); err != nil {
+		t.Fatalf("Run failed: %v", err)
+	}
+	if vm.Priv != PrivS || vm.PC != strapEntry || vm.CSR[csrScause] != causeECallU {
+		t.Errorf("priv, PC, scause = %d, %#x, %d; want S-mode, %#x, %d", vm.Priv, vm.PC, vm.CSR[csrScause], strapEntry, causeECallU)
+	}
+}
+
+func TestSBIReset(t *testing.T) {
+	for _, tt := range []struct {
+		typ, reason uint64
+		want        *ExitError
+	}{
+		{0, 0, &ExitError{}},
+		{0, 1, &ExitError{Code: 1}},
+		{1, 0, &ExitError{Reset: true}},
+	} {
+		vm, _ := newSBITest(t)
+		copy(vm.Mem, asBytes(ecallInstr))
+		vm.Reg[regNums["a0"]], vm.Reg[regNums["a1"]] = tt.typ, tt.reason
+		vm.Reg[regNums["a6"]], vm.Reg[regNums["a7"]] = 0, sbiSRST
+		if err := vm.Run(1); !reflect.DeepEqual(err, tt.want) {
+			t.Errorf("system_reset(%d, %d) = %v; want %v", tt.typ, tt.reason, err, tt.want)
+		}
+	}
+}
+
+func TestSBIHartStop(t *testing.T) {
+	vm, _ := newSBITest(t)
+	sbiCall(t, vm, sbiHSM, 1)
+	if !vm.stopped || vm.SBI.state[0] != hsmStopped {
+		t.Fatal("hart_stop didn't stop the hart")
+	}
+	// A stopped hart doesn't execute instructions.
+	if err := vm.Run(5); err != nil || vm.PC != 4 {
+		t.Errorf("Run() = %v, PC = %#x; want nil, 0x4", err, vm.PC)
+	}
+}
@@ -0,0 +1,319 @@
+// Copyright 2019 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+// This file implements debug triggers (the Sdtrig extension) as seen by
+// machine-mode software. See "RISC-V Debug Specification", version 1.0;
+// Chapter 5.
+
+// Trigger CSR addresses.
+//
+// Debug spec; Table 5.1
+const (
+	csrTselect = 0x7A0
+	csrTdata1  = 0x7A1
+	csrTdata2  = 0x7A2
+	csrTdata3  = 0x7A3
+	csrTinfo   = 0x7A4
+)
+
+// numTriggers is the number of implemented triggers.
+const numTriggers = 4
+
+// Trigger types (tdata1.type).
+const (
+	trigNone      = 0
+	trigIcount    = 3
+	trigItrigger  = 4
+	trigMcontrol6 = 6
+	trigDisabled  = 15
+
+	trigTypeShift = 60
+)
+
+// Fields of tdata1 for each trigger type.
+//
+// Debug spec; Chapters 5.7.11, 5.7.12, 5.7.13
+const (
+	mc6Hit0        = 1 << 22
+	mc6Select      = 1 << 21
+	mc6SizeShift   = 16
+	mc6ActionShift = 12
+	mc6Chain       = 1 << 11
+	mc6MatchShift  = 7
+	mc6M           = 1 << 6
+	mc6S           = 1 << 4
+	mc6U           = 1 << 3
+	mc6Execute     = 1 << 2
+	mc6Store       = 1 << 1
+	mc6Load        = 1 << 0
+	mc6Writable    = mc6Hit0 | mc6Select | 7<<mc6SizeShift | 0xf<<mc6ActionShift | mc6Chain | 0xf<<mc6MatchShift | mc6M | mc6S | mc6U | mc6Execute | mc6Store | mc6Load
+
+	icountHit        = 1 << 24
+	icountCountShift = 10
+	icountCountMask  = 0x3fff << icountCountShift
+	icountM          = 1 << 9
+	icountPending    = 1 << 8
+	icountS          = 1 << 7
+	icountU          = 1 << 6
+	icountWritable   = icountHit | icountCountMask | icountM | icountPending | icountS | icountU | 0x3f
+
+	itriggerHit      = 1 << 58
+	itriggerM        = 1 << 9
+	itriggerS        = 1 << 7
+	itriggerU        = 1 << 6
+	itriggerWritable = itriggerHit | itriggerM | itriggerS | itriggerU | 0x3f
+)
+
+// Trigger actions.
+const (
+	actionBreakpoint = 0 // raise a breakpoint exception
+	actionDebugMode  = 1 // enter Debug Mode; reported to VM.TriggerHook only
+)
+
+// trigger holds the state of a single trigger.
+type trigger struct {
+	tdata1, tdata2 uint64
+}
+
+func (t *trigger) typ() uint64 { return t.tdata1 >> trigTypeShift }
+
+// anyTriggers reports whether any trigger is enabled. It's used to avoid
+// evaluating triggers in the common case.
+func (vm *VM) anyTriggers() bool {
+	for i := range vm.triggers {
+		if typ := vm.triggers[i].typ(); typ != trigNone && typ != trigDisabled {
+			return true
+		}
+	}
+	return false
+}
+
+// readTrigger returns the value of a trigger CSR.
+func (vm *VM) readTrigger(csr uint64) uint64 {
+	t := &vm.triggers[vm.CSR[csrTselect]]
+	switch csr {
+	case csrTdata1:
+		if t.typ() == trigNone {
+			return trigDisabled << trigTypeShift
+		}
+		return t.tdata1
+	case csrTdata2:
+		return t.tdata2
+	case csrTinfo:
+		return 1<<24 | 1<<trigIcount | 1<<trigItrigger | 1<<trigMcontrol6 | 1<<trigDisabled // version 1.0
+	}
+	return 0 // tdata3: no context matching
+}
+
+// writeTrigger sets the value of a trigger CSR.
+func (vm *VM) writeTrigger(csr, v uint64) {
+	if csr == csrTselect {
+		// Unsupported values are ignored. This is how debuggers
+		// discover the number of triggers.
+		if v < numTriggers {
+			vm.CSR[csrTselect] = v
+		}
+		return
+	}
+	t := &vm.triggers[vm.CSR[csrTselect]]
+	switch csr {
+	case csrTdata1:
+		// Debug Mode isn't implemented, so dmode is always zero.
+		switch typ := v >> trigTypeShift; typ {
+		case trigMcontrol6:
+			t.tdata1 = typ<<trigTypeShift | v&mc6Writable
+			if a := v >> mc6ActionShift & 0xf; a > actionDebugMode {
+				t.tdata1 &^= 0xf << mc6ActionShift
+			}
+		case trigIcount:
+			t.tdata1 = typ<<trigTypeShift | v&icountWritable
+		case trigItrigger:
+			t.tdata1 = typ<<trigTypeShift | v&itriggerWritable
+		default:
+			t.tdata1 = trigDisabled << trigTypeShift
+		}
+	case csrTdata2:
+		t.tdata2 = v
+	}
+}
+
+// privEnabled reports whether the trigger described by tdata1 is enabled in
+// the privilege mode.
+func privEnabled(tdata1 uint64, priv int, m, s, u uint64) bool {
+	switch priv {
+	case PrivM:
+		return tdata1&m != 0
+	case PrivS:
+		return tdata1&s != 0
+	default:
+		return tdata1&u != 0
+	}
+}
+
+// Phases in which load/store/execute triggers are evaluated.
+const (
+	phaseAll  = iota // address and data are known
+	phaseAddr        // only the address is known (loads before the access)
+	phaseData        // the loaded data is known (loads after the access)
+)
+
+// memTriggers evaluates mcontrol6 triggers for an instruction fetch
+// (kind == mc6Execute), load (mc6Load) or store (mc6Store) of size bytes at
+// addr. For fetches data is the instruction; for loads and stores it's the
+// accessed value.
+//
+// Loads are evaluated twice: triggers matching the address fire before the
+// access and triggers matching the data fire after the access, but before the
+// destination register is written.
+func (vm *VM) memTriggers(kind, addr uint64, size int, data uint64, phase int) error {
+	if !vm.anyTriggers() {
+		return nil
+	}
+	for i := 0; i < numTriggers; i++ {
+		// Triggers with chain set fire only together with the next
+		// trigger. The last trigger in the chain decides on the action.
+		first, match, usesData := i, true, false
+		for ; ; i++ {
+			t := &vm.triggers[i]
+			usesData = usesData || t.tdata1&mc6Select != 0
+			match = match && vm.mcontrol6Match(t, kind, addr, size, data, phase)
+			if t.typ() != trigMcontrol6 || t.tdata1&mc6Chain == 0 || i == numTriggers-1 {
+				break
+			}
+		}
+		if !match || (phase == phaseData && !usesData) {
+			continue
+		}
+		for j := first; j <= i; j++ {
+			vm.triggers[j].tdata1 |= mc6Hit0
+		}
+		return vm.fire(i, vm.triggers[i].tdata1>>mc6ActionShift&0xf, addr)
+	}
+	return nil
+}
+
+func (vm *VM) mcontrol6Match(t *trigger, kind, addr uint64, size int, data uint64, phase int) bool {
+	d := t.tdata1
+	if t.typ() != trigMcontrol6 || d&kind == 0 || !privEnabled(d, vm.Priv, mc6M, mc6S, mc6U) {
+		return false
+	}
+	if sz := d >> mc6SizeShift & 7; sz != 0 && sz != sizeCode(size) {
+		return false
+	}
+	v := addr
+	if d&mc6Select != 0 {
+		if phase == phaseAddr {
+			return false
+		}
+		v = data
+	}
+	return matchValue(d>>mc6MatchShift&0xf, t.tdata2, v)
+}
+
+// sizeCode returns the mcontrol6.size encoding for accesses of n bytes.
+func sizeCode(n int) uint64 {
+	switch n {
+	case 1:
+		return 1
+	case 2:
+		return 2
+	case 4:
+		return 3
+	case 8:
+		return 5
+	}
+	return 0
+}
+
+// matchValue compares v with tdata2 as specified by mcontrol6.match.
+func matchValue(match, tdata2, v uint64) bool {
+	switch match {
+	case 0: // equal
+		return v == tdata2
+	case 1: // NAPOT
+		mask := tdata2 ^ (tdata2 + 1)
+		return v&^mask == tdata2&^mask
+	case 2: // greater than or equal
+		return v >= tdata2
+	case 3: // less than
+		return v < tdata2
+	case 4: // lower half, masked
+		return uint32(v)&uint32(tdata2>>32) == uint32(tdata2)
+	case 5: // upper half, masked
+		return uint32(v>>32)&uint32(tdata2>>32) == uint32(tdata2)
+	case 8, 9, 12, 13: // negated versions of the above
+		return !matchValue(match-8, tdata2, v)
+	}
+	return false
+}
+
+// icountTriggers is called after an instruction retires in privilege mode
+// priv. icount triggers fire when their count drops to zero, before the next
+// instruction executes.
+func (vm *VM) icountTriggers(priv int) error {
+	if !vm.anyTriggers() {
+		return nil
+	}
+	for i := range vm.triggers {
+		t := &vm.triggers[i]
+		if t.typ() != trigIcount || !privEnabled(t.tdata1, priv, icountM, icountS, icountU) {
+			continue
+		}
+		count := t.tdata1 & icountCountMask >> icountCountShift
+		if count == 0 {
+			continue
+		}
+		count--
+		t.tdata1 = t.tdata1&^icountCountMask | count<<icountCountShift
+		if count == 0 {
+			t.tdata1 |= icountHit
+			if err := vm.fire(i, t.tdata1&0x3f, 0); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// interruptTriggers is called after the interrupt was taken from privilege
+// mode priv.
+func (vm *VM) interruptTriggers(code uint64, priv int) error {
+	if !vm.anyTriggers() {
+		return nil
+	}
+	for i := range vm.triggers {
+		t := &vm.triggers[i]
+		if t.typ() != trigItrigger || t.tdata2&(1<<code) == 0 || !privEnabled(t.tdata1, priv, itriggerM, itriggerS, itriggerU) {
+			continue
+		}
+		t.tdata1 |= itriggerHit
+		return vm.fire(i, t.tdata1&0x3f, 0)
+	}
+	return nil
+}
+
+// fire performs the action of the trigger. It reports the trigger to
+// VM.TriggerHook first. If the hook asks to stop, fire returns triggerErr and
+// the action isn't performed.
+func (vm *VM) fire(trigger int, action, tval uint64) error {
+	if vm.TriggerHook != nil && vm.TriggerHook(vm, trigger) {
+		return triggerErr
+	}
+	if action == actionBreakpoint {
+		return &exception{cause: causeBreakpoint, tval: tval}
+	}
+	return nil
+}
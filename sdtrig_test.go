@@ -0,0 +1,167 @@
+// Copyright 2019 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import "testing"
+
+const (
+	trapHandler = 0x40
+	nop         = 0x00000013 // addi zero, zero, 0
+	swX2X1      = 0x0020a023 // sw x2, 0(x1)
+)
+
+// newTrapVM returns a VM executing nops with a trap handler (more nops)
+// installed at trapHandler.
+func newTrapVM(t *testing.T) *VM {
+	vm := NewVM(&Prog{MemSize: 0x80})
+	for i := 0; i < len(vm.Mem); i += 4 {
+		copy(vm.Mem[i:], asBytes(nop))
+	}
+	vm.CSR[csrMtvec] = trapHandler
+	return vm
+}
+
+func setTrigger(t *testing.T, vm *VM, i int, tdata1, tdata2 uint64) {
+	t.Helper()
+	for _, w := range []struct{ csr, v uint64 }{
+		{csrTselect, uint64(i)},
+		{csrTdata1, tdata1},
+		{csrTdata2, tdata2},
+	} {
+		if err := vm.writeCSR(w.csr, w.v); err != nil {
+			t.Fatalf("writeCSR(%#x, %#x) failed: %v", w.csr, w.v, err)
+		}
+	}
+}
+
+func wantTrap(t *testing.T, vm *VM, cause, epc, tval uint64) {
+	t.Helper()
+	if vm.PC != trapHandler {
+		t.Errorf("PC = %#x; want %#x (the trap handler)", vm.PC, trapHandler)
+	}
+	if got := vm.CSR[csrMcause]; got != cause {
+		t.Errorf("mcause = %#x; want %#x", got, cause)
+	}
+	if got := vm.CSR[csrMepc]; got != epc {
+		t.Errorf("mepc = %#x; want %#x", got, epc)
+	}
+	if got := vm.CSR[csrMtval]; got != tval {
+		t.Errorf("mtval = %#x; want %#x", got, tval)
+	}
+}
+
+func TestTriggerExecute(t *testing.T) {
+	vm := newTrapVM(t)
+	setTrigger(t, vm, 1, trigMcontrol6<<trigTypeShift|mc6M|mc6Execute, 0x8)
+	if err := vm.Run(3); err != nil {
+		t.Fatalf("Run failed: %v", err)
+	}
+	wantTrap(t, vm, causeBreakpoint, 0x8, 0x8)
+	if got := vm.CSR[RDINSTRET]; got != 2 {
+		t.Errorf("instret = %d; want 2 (the instruction at 0x8 didn't retire)", got)
+	}
+	vm.writeCSR(csrTselect, 1)
+	if got, _ := vm.readCSR(csrTdata1); got&mc6Hit0 == 0 {
+		t.Errorf("tdata1 = %#x; want hit0 set", got)
+	}
+}
+
+func TestTriggerStoreData(t *testing.T) {
+	vm := newTrapVM(t)
+	copy(vm.Mem[0x4:], asBytes(swX2X1))
+	vm.Reg[1], vm.Reg[2] = 0x70, 0x1234
+	// Match stores of 0x1234 (any address) and of 4 bytes only.
+	setTrigger(t, vm, 0, trigMcontrol6<<trigTypeShift|mc6M|mc6Store|mc6Select|3<<mc6SizeShift, 0x1234)
+	var hits []int
+	vm.TriggerHook = func(vm *VM, trigger int) bool {
+		hits = append(hits, trigger)
+		return true
+	}
+	err := vm.Run(3)
+	if !IsTrigger(err) {
+		t.Fatalf("Run => %v; want the trigger to stop the VM", err)
+	}
+	if vm.PC != 0x4 {
+		t.Errorf("PC = %#x; want 0x4 (the store)", vm.PC)
+	}
+	if got := vm.Memory(0x70); got&0xffffffff != nop {
+		t.Errorf("memory at 0x70 = %#x; want unchanged", got)
+	}
+	if len(hits) != 1 || hits[0] != 0 {
+		t.Errorf("hook called for triggers %v; want [0]", hits)
+	}
+}
+
+func TestTriggerChain(t *testing.T) {
+	vm := newTrapVM(t)
+	// Fire on execution in [0x8, 0x10).
+	setTrigger(t, vm, 2, trigMcontrol6<<trigTypeShift|mc6M|mc6Execute|mc6Chain|2<<mc6MatchShift, 0x8)
+	setTrigger(t, vm, 3, trigMcontrol6<<trigTypeShift|mc6M|mc6Execute|3<<mc6MatchShift, 0x10)
+	if err := vm.Run(3); err != nil {
+		t.Fatalf("Run failed: %v", err)
+	}
+	wantTrap(t, vm, causeBreakpoint, 0x8, 0x8)
+}
+
+func TestTriggerIcount(t *testing.T) {
+	vm := newTrapVM(t)
+	setTrigger(t, vm, 0, trigIcount<<trigTypeShift|icountM|2<<icountCountShift, 0)
+	if err := vm.Run(2); err != nil {
+		t.Fatalf("Run failed: %v", err)
+	}
+	wantTrap(t, vm, causeBreakpoint, 0x8, 0)
+}
+
+func TestTriggerInterrupt(t *testing.T) {
+	vm := newTrapVM(t)
+	setTrigger(t, vm, 0, trigItrigger<<trigTypeShift|itriggerM, 1<<7)
+	vm.CSR[csrMIE] = mipMTIP
+	vm.CSR[csrMstatus] = mstatusMIE
+	vm.PC = 0x10
+	vm.setMIP(mipMTIP, true)
+	if err := vm.Run(1); err != nil {
+		t.Fatalf("Run failed: %v", err)
+	}
+	// The breakpoint is taken on the first instruction of the interrupt
+	// handler.
+	if got := vm.CSR[csrMepc]; got != trapHandler {
+		t.Errorf("mepc = %#x; want %#x", got, trapHandler)
+	}
+	if got := vm.CSR[csrMcause]; got != causeBreakpoint {
+		t.Errorf("mcause = %#x; want %#x", got, causeBreakpoint)
+	}
+}
+
+func TestMatchValue(t *testing.T) {
+	for _, tt := range []struct {
+		match, tdata2, v uint64
+		want             bool
+	}{
+		{match: 0, tdata2: 0x10, v: 0x10, want: true},
+		{match: 0, tdata2: 0x10, v: 0x11, want: false},
+		{match: 1, tdata2: 0x1007, v: 0x100f, want: true}, // NAPOT 0x1000-0x100f
+		{match: 1, tdata2: 0x1007, v: 0x1010, want: false},
+		{match: 2, tdata2: 0x10, v: 0x10, want: true},
+		{match: 3, tdata2: 0x10, v: 0x10, want: false},
+		{match: 4, tdata2: 0x0000ff0000001200, v: 0xabcd12ff, want: true},
+		{match: 5, tdata2: 0xffff0000abcd0000, v: 0xabcd12ff00000000, want: true},
+		{match: 8, tdata2: 0x10, v: 0x10, want: false},
+		{match: 9, tdata2: 0x1007, v: 0x1010, want: true},
+	} {
+		if got := matchValue(tt.match, tt.tdata2, tt.v); got != tt.want {
+			t.Errorf("matchValue(%d, %#x, %#x) = %v; want %v", tt.match, tt.tdata2, tt.v, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,520 @@
+// Copyright 2019 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// The instructions surrounding the EBREAK of a semihosting call.
+//
+// RISC-V Semihosting v0.2; Chapter 2
+const (
+	semihostingEntry  = 0x01f01013 // slli x0, x0, 0x1f
+	semihostingEbreak = 0x00100073
+	semihostingExit   = 0x40705013 // srai x0, x0, 7
+)
+
+// Semihosting operations, passed in a0.
+//
+// Semihosting for AArch32 and AArch64, Release 2.0; Chapter 6
+const (
+	sysOpen         = 0x01
+	sysClose        = 0x02
+	sysWriteC       = 0x03
+	sysWrite0       = 0x04
+	sysWrite        = 0x05
+	sysRead         = 0x06
+	sysReadC        = 0x07
+	sysIsError      = 0x08
+	sysIsTTY        = 0x09
+	sysSeek         = 0x0A
+	sysFlen         = 0x0C
+	sysTmpnam       = 0x0D
+	sysRemove       = 0x0E
+	sysRename       = 0x0F
+	sysClock        = 0x10
+	sysTime         = 0x11
+	sysSystem       = 0x12
+	sysErrno        = 0x13
+	sysGetCmdline   = 0x15
+	sysHeapinfo     = 0x16
+	sysExit         = 0x18
+	sysExitExtended = 0x20
+	sysElapsed      = 0x30
+	sysTickfreq     = 0x31
+)
+
+// adpStoppedApplicationExit is the reason of SYS_EXIT reporting that the
+// program finished; the subcode is its exit status. Other reasons end the
+// program with status 1.
+const adpStoppedApplicationExit = 0x20026
+
+// Values of errno returned by SYS_ERRNO. They're the same as on Linux and
+// newlib, whatever the host is.
+const (
+	semihostingEPERM  = 1
+	semihostingENOENT = 2
+	semihostingEIO    = 5
+	semihostingEBADF  = 9
+	semihostingEACCES = 13
+	semihostingEEXIST = 17
+	semihostingEINVAL = 22
+)
+
+// Handles of the console, opened with the special name ":tt".
+const (
+	semihostingStdin = iota + 1
+	semihostingStdout
+	semihostingStderr
+	semihostingFirstFile
+)
+
+// Semihosting implements the ARM-compatible semihosting calls made with the
+// RISC-V semihosting sequence. It's installed in VM.Semihosting.
+//
+// File operations are confined to a host directory: names are relative to it
+// even if they start with a slash, they can't leave it with "..", and symbolic
+// links aren't followed. Like P9Server, this assumes that the host doesn't
+// modify the directory concurrently. SYS_SYSTEM is refused.
+type Semihosting struct {
+	root    string // "" disables file operations
+	cmdline string
+	in      io.Reader
+	out     io.Writer
+	errOut  io.Writer
+	files   map[uint64]*os.File
+	next    uint64 // handle of the next opened file
+	errno   uint64 // set by failed operations; returned by SYS_ERRNO
+}
+
+// NewSemihosting returns a semihosting implementation whose file operations
+// are confined to the host directory root; an empty root disables them. The
+// console reads from in and writes to out and errOut. SYS_GET_CMDLINE returns
+// cmdline.
+func NewSemihosting(root, cmdline string, in io.Reader, out, errOut io.Writer) *Semihosting {
+	return &Semihosting{
+		root:    root,
+		cmdline: cmdline,
+		in:      in,
+		out:     out,
+		errOut:  errOut,
+		files:   map[uint64]*os.File{},
+		next:    semihostingFirstFile,
+	}
+}
+
+// isSemihostingCall reports whether the EBREAK being executed is surrounded by
+// the semihosting sequence. All three instructions must be uncompressed.
+func (vm *VM) isSemihostingCall(in *Instruction) bool {
+	if in.in != semihostingEbreak {
+		return false
+	}
+	word := func(pc uint64) uint64 {
+		b, err := vm.fetch(pc)
+		if err != nil || len(b) < 4 {
+			return 0
+		}
+		return uint64(binary.LittleEndian.Uint32(b))
+	}
+	return word(vm.PC-4) == semihostingEntry && word(vm.PC+4) == semihostingExit
+}
+
+// call performs the operation selected by a0 with the argument in a1, which
+// usually points to a block of 64-bit fields, and returns the result in a0.
+func (s *Semihosting) call(vm *VM) error {
+	op, arg := vm.Reg[regNums["a0"]], vm.Reg[regNums["a1"]]
+	// field returns the i-th field of the argument block.
+	field := func(i uint64) (uint64, error) { return vm.loadVirt(arg+8*i, 8) }
+	var fields [4]uint64
+	for i, n := 0, semihostingFields[op]; i < n; i++ {
+		v, err := field(uint64(i))
+		if err != nil {
+			return err
+		}
+		fields[i] = v
+	}
+	r, err := s.do(vm, op, arg, fields)
+	if err != nil {
+		return err
+	}
+	vm.Reg[regNums["a0"]] = r
+	return nil
+}
+
+// semihostingFields is the number of fields of the argument block of the
+// operations.
+var semihostingFields = map[uint64]int{
+	sysOpen:         3,
+	sysClose:        1,
+	sysWrite:        3,
+	sysRead:         3,
+	sysIsError:      1,
+	sysIsTTY:        1,
+	sysSeek:         2,
+	sysFlen:         1,
+	sysTmpnam:       3,
+	sysRemove:       2,
+	sysRename:       4,
+	sysSystem:       2,
+	sysGetCmdline:   2,
+	sysHeapinfo:     1,
+	sysExit:         2,
+	sysExitExtended: 2,
+}
+
+// fail records the error for SYS_ERRNO and returns -1.
+func (s *Semihosting) fail(errno uint64) (uint64, error) {
+	s.errno = errno
+	return ^uint64(0), nil
+}
+
+// failErr records the errno matching the host error and returns -1.
+func (s *Semihosting) failErr(err error) (uint64, error) {
+	switch {
+	case os.IsNotExist(err):
+		return s.fail(semihostingENOENT)
+	case os.IsExist(err):
+		return s.fail(semihostingEEXIST)
+	case os.IsPermission(err):
+		return s.fail(semihostingEACCES)
+	}
+	return s.fail(semihostingEIO)
+}
+
+func (s *Semihosting) do(vm *VM, op, arg uint64, f [4]uint64) (uint64, error) {
+	switch op {
+	case sysOpen:
+		name, err := readGuestString(vm, f[0], f[2])
+		if err != nil {
+			return 0, err
+		}
+		return s.open(name, f[1])
+	case sysClose:
+		if f[0] < semihostingFirstFile {
+			return 0, nil // the console stays open
+		}
+		file, ok := s.files[f[0]]
+		if !ok {
+			return s.fail(semihostingEBADF)
+		}
+		delete(s.files, f[0])
+		if err := file.Close(); err != nil {
+			return s.failErr(err)
+		}
+		return 0, nil
+	case sysWriteC:
+		b, err := readGuest(vm, arg, 1)
+		if err != nil {
+			return 0, err
+		}
+		s.out.Write(b)
+		return 0, nil
+	case sysWrite0:
+		str, err := readGuestString(vm, arg, 0)
+		if err != nil {
+			return 0, err
+		}
+		io.WriteString(s.out, str)
+		return 0, nil
+	case sysWrite:
+		w := s.writer(f[0])
+		if w == nil {
+			s.errno = semihostingEBADF
+			return f[2], nil
+		}
+		if f[2] > vm.memSize() {
+			return s.fail(semihostingEINVAL)
+		}
+		b, err := readGuest(vm, f[1], f[2])
+		if err != nil {
+			return 0, err
+		}
+		n, err := w.Write(b)
+		if err != nil {
+			s.failErr(err)
+		}
+		return f[2] - uint64(n), nil
+	case sysRead:
+		r := s.reader(f[0])
+		if r == nil {
+			s.errno = semihostingEBADF
+			return f[2], nil
+		}
+		if f[2] > vm.memSize() {
+			return s.fail(semihostingEINVAL)
+		}
+		b := make([]byte, f[2])
+		var n int
+		var err error
+		if f[0] == semihostingStdin {
+			n, err = r.Read(b) // the console returns what's available
+		} else {
+			n, err = io.ReadFull(r, b)
+		}
+		if err != nil && err != io.EOF && err != io.ErrUnexpectedEOF {
+			s.failErr(err)
+		}
+		if err := writeGuest(vm, f[1], b[:n]); err != nil {
+			return 0, err
+		}
+		return f[2] - uint64(n), nil
+	case sysReadC:
+		var b [1]byte
+		if s.in == nil {
+			return s.fail(semihostingEIO)
+		}
+		if _, err := io.ReadFull(s.in, b[:]); err != nil {
+			return s.failErr(err)
+		}
+		return uint64(b[0]), nil
+	case sysIsError:
+		if int64(f[0]) < 0 {
+			return 1, nil
+		}
+		return 0, nil
+	case sysIsTTY:
+		if f[0] < semihostingFirstFile && f[0] > 0 {
+			return 1, nil
+		}
+		if _, ok := s.files[f[0]]; !ok {
+			return s.fail(semihostingEBADF)
+		}
+		return 0, nil
+	case sysSeek:
+		file, ok := s.files[f[0]]
+		if !ok {
+			return s.fail(semihostingEBADF)
+		}
+		if _, err := file.Seek(int64(f[1]), io.SeekStart); err != nil {
+			return s.fail(semihostingEINVAL)
+		}
+		return 0, nil
+	case sysFlen:
+		file, ok := s.files[f[0]]
+		if !ok {
+			return s.fail(semihostingEBADF)
+		}
+		fi, err := file.Stat()
+		if err != nil {
+			return s.failErr(err)
+		}
+		return uint64(fi.Size()), nil
+	case sysTmpnam:
+		name := fmt.Sprintf("tmp%03d\x00", f[1]&0xff)
+		if uint64(len(name)) > f[2] {
+			return s.fail(semihostingEINVAL)
+		}
+		return 0, writeGuest(vm, f[0], []byte(name))
+	case sysRemove:
+		name, err := readGuestString(vm, f[0], f[1])
+		if err != nil {
+			return 0, err
+		}
+		p, err := s.hostPath(name)
+		if err == nil {
+			err = os.Remove(p)
+		}
+		if err != nil {
+			s.failErr(err)
+			return s.errno, nil
+		}
+		return 0, nil
+	case sysRename:
+		from, err := readGuestString(vm, f[0], f[1])
+		if err != nil {
+			return 0, err
+		}
+		to, err := readGuestString(vm, f[2], f[3])
+		if err != nil {
+			return 0, err
+		}
+		p, err := s.hostPath(from)
+		q, err2 := s.hostPath(to)
+		if err == nil {
+			err = err2
+		}
+		if err == nil {
+			err = os.Rename(p, q)
+		}
+		if err != nil {
+			s.failErr(err)
+			return s.errno, nil
+		}
+		return 0, nil
+	case sysClock:
+		// Centiseconds since the program started, in emulated time.
+		return vm.CSR[RDTIME] / (timebaseFreq / 100), nil
+	case sysTime:
+		return uint64(time.Now().Unix()), nil
+	case sysSystem:
+		return s.fail(semihostingEPERM)
+	case sysErrno:
+		return s.errno, nil
+	case sysGetCmdline:
+		b := append([]byte(s.cmdline), 0)
+		if uint64(len(b)) > f[1] {
+			return s.fail(semihostingEINVAL)
+		}
+		if err := writeGuest(vm, f[0], b); err != nil {
+			return 0, err
+		}
+		return 0, vm.storeVirt(arg+8, 8, uint64(len(s.cmdline)))
+	case sysHeapinfo:
+		// Zeros tell the C library to use its own heap and stack
+		// limits.
+		for i := uint64(0); i < 4; i++ {
+			if err := vm.storeVirt(f[0]+8*i, 8, 0); err != nil {
+				return 0, err
+			}
+		}
+		return 0, nil
+	case sysExit, sysExitExtended:
+		if f[0] != adpStoppedApplicationExit {
+			return 0, &ExitError{Code: 1}
+		}
+		return 0, &ExitError{Code: int(int32(f[1]))}
+	case sysElapsed:
+		return 0, vm.storeVirt(arg, 8, vm.CSR[RDTIME])
+	case sysTickfreq:
+		return timebaseFreq, nil
+	}
+	return 0, fmt.Errorf("unsupported semihosting operation %#x", op)
+}
+
+// open opens the file with the mode of fopen encoded as a number: r, rb, r+,
+// r+b, w, wb, w+, w+b, a, ab, a+ or a+b. The name ":tt" selects the console.
+func (s *Semihosting) open(name string, mode uint64) (uint64, error) {
+	if mode > 11 {
+		return s.fail(semihostingEINVAL)
+	}
+	if name == ":tt" {
+		return semihostingStdin + mode/4, nil
+	}
+	flag := []int{os.O_RDONLY, os.O_WRONLY | os.O_CREATE | os.O_TRUNC, os.O_WRONLY | os.O_CREATE | os.O_APPEND}[mode/4]
+	if mode&2 != 0 {
+		flag = flag&^os.O_WRONLY | os.O_RDWR
+	}
+	p, err := s.hostPath(name)
+	if err != nil {
+		return s.failErr(err)
+	}
+	file, err := os.OpenFile(p, flag, 0644)
+	if err != nil {
+		return s.failErr(err)
+	}
+	h := s.next
+	s.next++
+	s.files[h] = file
+	return h, nil
+}
+
+// hostPath returns the path of the file in the host directory. Symbolic links
+// are refused.
+func (s *Semihosting) hostPath(name string) (string, error) {
+	if s.root == "" || strings.ContainsRune(name, 0) || filepath.Separator != '/' && strings.ContainsRune(name, filepath.Separator) {
+		return "", os.ErrPermission
+	}
+	p := s.root
+	for _, c := range strings.Split(path.Clean("/" + name)[1:], "/") {
+		if c == "" {
+			continue
+		}
+		p = filepath.Join(p, c)
+		// Missing files are reported by the operation.
+		if fi, err := os.Lstat(p); err == nil && fi.Mode()&os.ModeSymlink != 0 {
+			return "", os.ErrPermission
+		}
+	}
+	return p, nil
+}
+
+func (s *Semihosting) writer(h uint64) io.Writer {
+	switch h {
+	case semihostingStdout:
+		return s.out
+	case semihostingStderr:
+		return s.errOut
+	}
+	if f, ok := s.files[h]; ok {
+		return f
+	}
+	return nil
+}
+
+func (s *Semihosting) reader(h uint64) io.Reader {
+	if h == semihostingStdin {
+		return s.in
+	}
+	if f, ok := s.files[h]; ok {
+		return f
+	}
+	return nil
+}
+
+// maxGuestString limits the length of strings passed by the guest.
+const maxGuestString = 4096
+
+// readGuest returns n bytes at the virtual address addr. Callers must make sure
+// that n isn't larger than the memory.
+func readGuest(vm *VM, addr, n uint64) ([]byte, error) {
+	b := make([]byte, n)
+	for i := range b {
+		v, err := vm.loadVirt(addr+uint64(i), 1)
+		if err != nil {
+			return nil, err
+		}
+		b[i] = byte(v)
+	}
+	return b, nil
+}
+
+// readGuestString returns the string of n bytes at the virtual address addr or,
+// if n is 0, the NUL-terminated string there.
+func readGuestString(vm *VM, addr, n uint64) (string, error) {
+	if n > maxGuestString {
+		return "", fmt.Errorf("string at %#x is longer than %d bytes", addr, maxGuestString)
+	}
+	if n != 0 {
+		b, err := readGuest(vm, addr, n)
+		return string(b), err
+	}
+	var b []byte
+	for len(b) < maxGuestString {
+		v, err := vm.loadVirt(addr+uint64(len(b)), 1)
+		if err != nil || v == 0 {
+			return string(b), err
+		}
+		b = append(b, byte(v))
+	}
+	return "", fmt.Errorf("string at %#x is longer than %d bytes", addr, maxGuestString)
+}
+
+// writeGuest stores b at the virtual address addr.
+func writeGuest(vm *VM, addr uint64, b []byte) error {
+	for i, c := range b {
+		if err := vm.storeVirt(addr+uint64(i), 1, uint64(c)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
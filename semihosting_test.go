@@ -0,0 +1,265 @@
+// Copyright 2019 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// Addresses used by the semihosting tests: the argument block, strings and a
+// buffer.
+const (
+	shBlock  = 0x800
+	shString = 0x900
+	shBuf    = 0xa00
+)
+
+// newSemihostingVM returns a VM executing the semihosting sequence at address
+// 0, with file operations confined to root. The console reads "xy".
+func newSemihostingVM(t *testing.T, root string) (*VM, *bytes.Buffer) {
+	vm := NewVM(&Prog{MemSize: 0x1000})
+	for i, in := range []uint64{semihostingEntry, semihostingEbreak, semihostingExit} {
+		copy(vm.Mem[4*i:], asBytes(in))
+	}
+	var out bytes.Buffer
+	vm.Semihosting = NewSemihosting(root, "prog a b", strings.NewReader("xy"), &out, ioutil.Discard)
+	return vm, &out
+}
+
+// callSemihosting performs the operation with the argument block holding the fields
+// and returns the result.
+func callSemihosting(t *testing.T, vm *VM, op uint64, fields ...uint64) uint64 {
+	t.Helper()
+	for i, f := range fields {
+		vm.write(shBlock+8*uint64(i), 8, f)
+	}
+	vm.PC = 0
+	vm.Reg[regNums["a0"]], vm.Reg[regNums["a1"]] = op, shBlock
+	if err := vm.Run(3); err != nil {
+		t.Fatalf("operation %#x failed: %v", op, err)
+	}
+	if vm.PC != 12 {
+		t.Fatalf("operation %#x: PC = %#x; want 0xc", op, vm.PC)
+	}
+	return vm.Reg[regNums["a0"]]
+}
+
+// putString stores the string at shString and returns its address and length.
+func putString(vm *VM, s string) (uint64, uint64) {
+	copy(vm.Mem[shString:], s+"\x00")
+	return shString, uint64(len(s))
+}
+
+func TestSemihostingConsole(t *testing.T) {
+	vm, out := newSemihostingVM(t, "")
+	putString(vm, "hello\n")
+	vm.PC = 0
+	vm.Reg[regNums["a0"]], vm.Reg[regNums["a1"]] = sysWrite0, shString
+	if err := vm.Run(3); err != nil {
+		t.Fatalf("SYS_WRITE0 failed: %v", err)
+	}
+	name, n := putString(vm, ":tt")
+	if h := callSemihosting(t, vm, sysOpen, name, 4, n); h != semihostingStdout {
+		t.Errorf("SYS_OPEN(:tt, w) = %d; want %d", h, semihostingStdout)
+	}
+	copy(vm.Mem[shBuf:], "abc")
+	if got := callSemihosting(t, vm, sysWrite, semihostingStdout, shBuf, 3); got != 0 {
+		t.Errorf("SYS_WRITE returned %d; want 0", got)
+	}
+	if got, want := out.String(), "hello\nabc"; got != want {
+		t.Errorf("output = %q; want %q", got, want)
+	}
+
+	for _, tt := range []struct {
+		desc   string
+		op     uint64
+		fields []uint64
+		want   uint64
+	}{
+		{"SYS_READC", sysReadC, nil, 'x'},
+		{"SYS_ISTTY", sysIsTTY, []uint64{semihostingStdin}, 1},
+		{"SYS_ISERROR", sysIsError, []uint64{u64(-1)}, 1},
+		{"SYS_OPEN without a directory", sysOpen, []uint64{shString, 0, 1}, u64(-1)},
+		{"SYS_ERRNO", sysErrno, nil, semihostingEACCES},
+		{"SYS_SYSTEM", sysSystem, []uint64{shString, 1}, u64(-1)},
+		{"SYS_WRITE of 2^64-1 bytes", sysWrite, []uint64{semihostingStdout, shBuf, u64(-1)}, u64(-1)},
+		{"SYS_READ of 2^64-1 bytes", sysRead, []uint64{semihostingStdin, shBuf, u64(-1)}, u64(-1)},
+		{"SYS_ERRNO after a huge read", sysErrno, nil, semihostingEINVAL},
+		{"SYS_TICKFREQ", sysTickfreq, nil, timebaseFreq},
+	} {
+		if got := callSemihosting(t, vm, tt.op, tt.fields...); got != tt.want {
+			t.Errorf("%s = %#x; want %#x", tt.desc, got, tt.want)
+		}
+	}
+
+	if got := callSemihosting(t, vm, sysGetCmdline, shBuf, 0x100); got != 0 {
+		t.Errorf("SYS_GET_CMDLINE returned %d; want 0", got)
+	}
+	if got, _ := vm.read(shBlock+8, 8); got != 8 || string(vm.Mem[shBuf:shBuf+9]) != "prog a b\x00" {
+		t.Errorf("SYS_GET_CMDLINE wrote %q, length %d; want \"prog a b\", 8", vm.Mem[shBuf:shBuf+9], got)
+	}
+	vm.CSR[RDTIME] = 12345678
+	if got := callSemihosting(t, vm, sysClock); got != 123 {
+		t.Errorf("SYS_CLOCK = %d; want 123", got)
+	}
+}
+
+func TestSemihostingFiles(t *testing.T) {
+	root, err := ioutil.TempDir("", "semihosting")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(root)
+	vm, _ := newSemihostingVM(t, root)
+
+	// Names are relative to the root even if they're absolute.
+	name, n := putString(vm, "/f.txt")
+	h := callSemihosting(t, vm, sysOpen, name, 4, n) // "w"
+	if h < semihostingFirstFile || int64(h) < 0 {
+		t.Fatalf("SYS_OPEN(f.txt, w) = %d", int64(h))
+	}
+	copy(vm.Mem[shBuf:], "data")
+	if got := callSemihosting(t, vm, sysWrite, h, shBuf, 4); got != 0 {
+		t.Errorf("SYS_WRITE returned %d; want 0", got)
+	}
+	if got := callSemihosting(t, vm, sysClose, h); got != 0 {
+		t.Errorf("SYS_CLOSE returned %d; want 0", got)
+	}
+	if b, err := ioutil.ReadFile(filepath.Join(root, "f.txt")); err != nil || string(b) != "data" {
+		t.Errorf("f.txt holds %q, %v; want \"data\"", b, err)
+	}
+
+	name, n = putString(vm, "f.txt")
+	h = callSemihosting(t, vm, sysOpen, name, 1, n) // "rb"
+	for _, tt := range []struct {
+		desc   string
+		op     uint64
+		fields []uint64
+		want   uint64
+	}{
+		{"SYS_FLEN", sysFlen, []uint64{h}, 4},
+		{"SYS_ISTTY", sysIsTTY, []uint64{h}, 0},
+		{"SYS_SEEK", sysSeek, []uint64{h, 1}, 0},
+		// The result is the number of bytes that weren't read.
+		{"SYS_READ", sysRead, []uint64{h, shBuf, 8}, 5},
+		{"SYS_READ at EOF", sysRead, []uint64{h, shBuf + 3, 8}, 8},
+		{"SYS_CLOSE", sysClose, []uint64{h}, 0},
+		{"SYS_CLOSE twice", sysClose, []uint64{h}, u64(-1)},
+		{"SYS_ERRNO", sysErrno, nil, semihostingEBADF},
+	} {
+		if got := callSemihosting(t, vm, tt.op, tt.fields...); got != tt.want {
+			t.Errorf("%s = %#x; want %#x", tt.desc, got, tt.want)
+		}
+	}
+	if got := string(vm.Mem[shBuf : shBuf+3]); got != "ata" {
+		t.Errorf("SYS_READ read %q; want \"ata\"", got)
+	}
+
+	copy(vm.Mem[shString:], "f.txt\x00g.txt\x00")
+	if got := callSemihosting(t, vm, sysRename, shString, 5, shString+6, 5); got != 0 {
+		t.Errorf("SYS_RENAME returned %d; want 0", got)
+	}
+	if got := callSemihosting(t, vm, sysRemove, shString+6, 5); got != 0 {
+		t.Errorf("SYS_REMOVE returned %d; want 0", got)
+	}
+	if got := callSemihosting(t, vm, sysRemove, shString+6, 5); got != semihostingENOENT {
+		t.Errorf("SYS_REMOVE of a missing file returned %d; want ENOENT", got)
+	}
+}
+
+func TestSemihostingSandbox(t *testing.T) {
+	dir, err := ioutil.TempDir("", "semihosting")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	root, outside := filepath.Join(dir, "root"), filepath.Join(dir, "outside")
+	for _, d := range []string{root, outside} {
+		if err := os.Mkdir(d, 0755); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := ioutil.WriteFile(filepath.Join(outside, "secret"), []byte("secret"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Symlink(outside, filepath.Join(root, "link")); err != nil {
+		t.Skipf("can't create a symbolic link: %v", err)
+	}
+	for _, tt := range []struct {
+		name      string
+		wantErrno uint64
+	}{
+		{"../outside/secret", semihostingENOENT},
+		{"/../../outside/secret", semihostingENOENT},
+		{"link/secret", semihostingEACCES},
+		{"link", semihostingEACCES},
+	} {
+		vm, _ := newSemihostingVM(t, root)
+		name, n := putString(vm, tt.name)
+		if h := callSemihosting(t, vm, sysOpen, name, 0, n); h != u64(-1) {
+			t.Errorf("SYS_OPEN(%s) = %d; want -1", tt.name, h)
+		}
+		if got := callSemihosting(t, vm, sysErrno); got != tt.wantErrno {
+			t.Errorf("SYS_OPEN(%s): errno = %d; want %d", tt.name, got, tt.wantErrno)
+		}
+	}
+}
+
+func TestSemihostingExit(t *testing.T) {
+	for _, tt := range []struct {
+		op       uint64
+		reason   uint64
+		subcode  uint64
+		wantCode int
+	}{
+		{sysExit, adpStoppedApplicationExit, 0, 0},
+		{sysExitExtended, adpStoppedApplicationExit, 3, 3},
+		{sysExit, 0x20023, 0, 1}, // ADP_Stopped_RunTimeErrorUnknown
+	} {
+		vm, _ := newSemihostingVM(t, "")
+		vm.write(shBlock, 8, tt.reason)
+		vm.write(shBlock+8, 8, tt.subcode)
+		vm.Reg[regNums["a0"]], vm.Reg[regNums["a1"]] = tt.op, shBlock
+		err := vm.Run(3)
+		if e, ok := err.(*ExitError); !ok || e.Code != tt.wantCode {
+			t.Errorf("exit(%#x, %d): Run returned %v; want exit status %d", tt.reason, tt.subcode, err, tt.wantCode)
+		}
+	}
+}
+
+func TestEbreakWithoutSemihosting(t *testing.T) {
+	// EBREAK does nothing unless it's a semihosting call.
+	for _, code := range [][]uint64{
+		{nop, semihostingEbreak, semihostingExit},
+		{semihostingEntry, semihostingEbreak, nop},
+	} {
+		vm, _ := newSemihostingVM(t, "")
+		for i, in := range code {
+			copy(vm.Mem[4*i:], asBytes(in))
+		}
+		vm.Reg[regNums["a0"]] = sysExit
+		if err := vm.Run(3); err != nil {
+			t.Errorf("%#x: Run failed: %v", code, err)
+		}
+		if vm.Reg[regNums["a0"]] != sysExit {
+			t.Errorf("%#x: a0 = %#x; want it unchanged", code, vm.Reg[regNums["a0"]])
+		}
+	}
+}
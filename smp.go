@@ -0,0 +1,166 @@
+// Copyright 2019 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"fmt"
+	"strings"
+)
+
+// defaultQuantum is the number of instructions a hart executes before the
+// scheduler switches to the next hart.
+const defaultQuantum = 1000
+
+// NewHarts returns the harts of a machine with n harts: boot, which becomes
+// hart 0, followed by n-1 new harts sharing its memory and bus. The new harts
+// start at boot's PC in its privilege level, with the same debug, misaligned
+// access and semihosting settings. The mhartid CSR of every hart holds its
+// index.
+//
+// Devices connected to the harts (CLINT, PLIC, AIA, SBI) must be created with
+// all of them, after NewHarts.
+func NewHarts(boot *VM, n int) []*VM {
+	if boot.Bus == nil {
+		boot.Bus = &Bus{}
+	}
+	harts := []*VM{boot}
+	for i := 1; i < n; i++ {
+		h := &VM{
+			PC:          boot.PC,
+			Priv:        boot.Priv,
+			Mem:         boot.Mem,
+			Bus:         boot.Bus,
+			Debug:       boot.Debug,
+			Misaligned:  boot.Misaligned,
+			Semihosting: boot.Semihosting,
+		}
+		h.CSR[csrMisa] = boot.CSR[csrMisa]
+		h.CSR[csrMstatus] = boot.CSR[csrMstatus]
+		h.CSR[csrMhartid] = uint64(i)
+		harts = append(harts, h)
+	}
+	if n > 1 {
+		for _, h := range harts {
+			h.harts = harts
+		}
+	}
+	return harts
+}
+
+// Harts returns all harts of the machine vm belongs to, in the order of their
+// IDs.
+func (vm *VM) Harts() []*VM {
+	if vm.harts == nil {
+		return []*VM{vm}
+	}
+	return vm.harts
+}
+
+// Scheduler runs the harts of a machine on a single goroutine. The harts
+// take turns executing Quantum instructions each, in the order of their IDs,
+// so runs are reproducible. The time counters of the harts advance together:
+// when all harts are idle, their clocks are warped to the earliest timer
+// deadline of any hart.
+//
+// If Parallel is set, every hart runs on its own goroutine instead, which
+// scales with the number of host cores, but runs aren't reproducible. See
+// runParallel for the details.
+type Scheduler struct {
+	Harts    []*VM
+	Quantum  int // 0 means defaultQuantum
+	Parallel bool
+}
+
+// NewScheduler returns a scheduler running the harts of the machine vm belongs
+// to.
+func NewScheduler(vm *VM, quantum int, parallel bool) *Scheduler {
+	return &Scheduler{Harts: vm.Harts(), Quantum: quantum, Parallel: parallel}
+}
+
+// Run executes n instructions on every hart. Errors of a hart stop all harts.
+func (s *Scheduler) Run(n int) error {
+	if len(s.Harts) == 1 {
+		return s.Harts[0].Run(n)
+	}
+	q := s.Quantum
+	if q <= 0 {
+		q = defaultQuantum
+	}
+	if s.Parallel {
+		return s.runParallel(n, q)
+	}
+	for n > 0 {
+		if s.warp() {
+			n--
+			continue
+		}
+		k := q
+		if k > n {
+			k = n
+		}
+		for i, h := range s.Harts {
+			err := h.Run(k)
+			if IsExit(err) || IsTrigger(err) {
+				return err
+			}
+			if err != nil {
+				return fmt.Errorf("hart %d: %v", i, err)
+			}
+		}
+		n -= k
+	}
+	return nil
+}
+
+// warp advances the clocks of all harts to the earliest timer deadline if all
+// harts are idle, like VM.idle does for a single hart. It returns false if a
+// hart isn't idle or there's no deadline.
+func (s *Scheduler) warp() bool {
+	var deadline uint64
+	ok := false
+	for _, h := range s.Harts {
+		if h.stopped {
+			continue
+		}
+		if !h.waiting || h.pendingInterrupts() != 0 {
+			return false
+		}
+		if d, dok := h.nextDeadline(); dok && (!ok || d < deadline) {
+			deadline, ok = d, true
+		}
+	}
+	if !ok {
+		return false
+	}
+	for _, h := range s.Harts {
+		h.Steps++
+		h.CSR[RDCYCLE]++
+		if deadline > h.CSR[RDTIME] {
+			h.tick(deadline - h.CSR[RDTIME])
+		} else {
+			h.tick(1)
+		}
+	}
+	return true
+}
+
+// String returns the debug output of all harts.
+func (s *Scheduler) String() string {
+	var b strings.Builder
+	for _, h := range s.Harts {
+		b.WriteString(h.String())
+	}
+	return b.String()
+}
@@ -0,0 +1,164 @@
+// Copyright 2019 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+)
+
+const (
+	csrrMhartidT0 = 0xf14022f3 // csrr t0, mhartid
+	amoaddT1T2A2  = 0x0076332f // amoadd.d t1, t2, (a2)
+	addT1T1A3     = 0x00d30333 // add t1, t1, a3
+	sdT0T1        = 0x00533023 // sd t0, 0(t1)
+	jMinus12      = 0xff5ff06f // j -12
+	lrT1A2        = 0x1006332f // lr.d t1, (a2)
+	scT3T2A2      = 0x18763e2f // sc.d t3, t2, (a2)
+)
+
+// newSMPTest returns the harts of a machine with n harts executing the code at
+// address 0.
+func newSMPTest(t *testing.T, n int, code ...uint64) []*VM {
+	vm := NewVM(&Prog{MemSize: 0x1000})
+	for i, in := range code {
+		copy(vm.Mem[4*i:], asBytes(in))
+	}
+	harts := NewHarts(vm, n)
+	if len(harts) != n {
+		t.Fatalf("NewHarts(%d) returned %d harts", n, len(harts))
+	}
+	return harts
+}
+
+func TestNewHarts(t *testing.T) {
+	harts := newSMPTest(t, 3)
+	for i, h := range harts {
+		if got := h.CSR[csrMhartid]; got != uint64(i) {
+			t.Errorf("hart %d: mhartid = %d", i, got)
+		}
+		if got := h.Harts(); len(got) != 3 || got[i] != h {
+			t.Errorf("hart %d: Harts() = %v; want all 3 harts", i, got)
+		}
+		if h.Bus != harts[0].Bus || h.Priv != PrivM || h.CSR[csrMisa] != misaDefault {
+			t.Errorf("hart %d: bus, priv, misa = %p, %d, %#x; want %p, %d, %#x", i, h.Bus, h.Priv, h.CSR[csrMisa], harts[0].Bus, PrivM, uint64(misaDefault))
+		}
+	}
+	harts[2].write(0x100, 8, 0x1234)
+	if got, _ := harts[0].read(0x100, 8); got != 0x1234 {
+		t.Errorf("hart 0 reads %#x written by hart 2; want 0x1234", got)
+	}
+	if s := fmt.Sprint(harts[1]); !strings.Contains(s, "Hart:  1\n") {
+		t.Errorf("debug output of hart 1 doesn't show its ID:\n%s", s)
+	}
+	if got := NewVM(&Prog{}).Harts(); len(got) != 1 {
+		t.Errorf("Harts() of a single VM returned %d harts; want 1", len(got))
+	}
+}
+
+func TestSchedulerRoundRobin(t *testing.T) {
+	const (
+		counter = 0x800
+		log     = 0x900
+	)
+	for _, tt := range []struct {
+		quantum int
+		want    string // hart IDs in the order they're appended to the log
+	}{
+		// Every iteration of the loop takes 4 instructions; csrr takes
+		// the place of the jump in the first one.
+		{1, "0 1 0 1"},
+		{4, "0 1 0 1"},
+		{8, "0 0 1 1"},
+		{100, "0 0 1 1"},
+	} {
+		harts := newSMPTest(t, 2, csrrMhartidT0, amoaddT1T2A2, addT1T1A3, sdT0T1, jMinus12)
+		for _, h := range harts {
+			h.Reg[regNums["t2"]], h.Reg[regNums["a2"]], h.Reg[regNums["a3"]] = 8, counter, log
+		}
+		s := &Scheduler{Harts: harts, Quantum: tt.quantum}
+		if err := s.Run(8); err != nil {
+			t.Fatalf("quantum %d: Run failed: %v", tt.quantum, err)
+		}
+		var got []string
+		n, _ := harts[0].read(counter, 8)
+		for i := uint64(0); i < n; i += 8 {
+			id, _ := harts[0].read(log+i, 8)
+			got = append(got, fmt.Sprint(id))
+		}
+		if strings.Join(got, " ") != tt.want {
+			t.Errorf("quantum %d: log = %v; want %s", tt.quantum, got, tt.want)
+		}
+		for i, h := range harts {
+			if h.Steps != 8 || h.CSR[RDTIME] != 8 {
+				t.Errorf("quantum %d: hart %d executed %d steps at time %d; want 8 and 8", tt.quantum, i, h.Steps, h.CSR[RDTIME])
+			}
+		}
+	}
+}
+
+func TestSchedulerReservations(t *testing.T) {
+	// Both harts execute LR before either executes SC. The first SC
+	// succeeds and clears the reservation of the other hart.
+	harts := newSMPTest(t, 2, lrT1A2, scT3T2A2)
+	for _, h := range harts {
+		h.Reg[regNums["t2"]], h.Reg[regNums["a2"]] = 1+h.CSR[csrMhartid], 0x800
+	}
+	s := &Scheduler{Harts: harts, Quantum: 1}
+	if err := s.Run(2); err != nil {
+		t.Fatalf("Run failed: %v", err)
+	}
+	if got0, got1 := harts[0].Reg[regNums["t3"]], harts[1].Reg[regNums["t3"]]; got0 != 0 || got1 != 1 {
+		t.Errorf("SC results = %d, %d; want 0 (success), 1 (failure)", got0, got1)
+	}
+	if got, _ := harts[0].read(0x800, 8); got != 1 {
+		t.Errorf("memory = %d; want 1 stored by hart 0", got)
+	}
+}
+
+func TestSchedulerIdle(t *testing.T) {
+	const wfiInstr = 0x10500073
+	harts := newSMPTest(t, 2, wfiInstr, nop)
+	NewCLINT(harts...)
+	harts[0].mtimecmp, harts[1].mtimecmp = 100, 50
+	for _, h := range harts {
+		h.CSR[csrMIE] = mipMTIP
+	}
+	s := &Scheduler{Harts: harts, Quantum: 1}
+	// Both harts wait after the first round. Time warps to the earlier
+	// deadline in the second one, which wakes hart 1 only.
+	if err := s.Run(2); err != nil {
+		t.Fatalf("Run failed: %v", err)
+	}
+	for i, h := range harts {
+		if h.CSR[RDTIME] != 50 || h.Steps != 2 {
+			t.Errorf("hart %d: time, steps = %d, %d; want 50, 2", i, h.CSR[RDTIME], h.Steps)
+		}
+	}
+	if harts[0].pendingInterrupts() != 0 || harts[1].pendingInterrupts() != mipMTIP {
+		t.Errorf("pending interrupts = %#x, %#x; want 0, MTIP", harts[0].pendingInterrupts(), harts[1].pendingInterrupts())
+	}
+	// Hart 1 runs and hart 0 keeps waiting.
+	if err := s.Run(1); err != nil {
+		t.Fatalf("Run failed: %v", err)
+	}
+	if !harts[0].waiting || harts[1].waiting || harts[1].PC != 8 {
+		t.Errorf("waiting = %v, %v, hart 1 PC = %#x; want true, false, 0x8", harts[0].waiting, harts[1].waiting, harts[1].PC)
+	}
+	if harts[0].CSR[RDTIME] != 51 || harts[1].CSR[RDTIME] != 51 {
+		t.Errorf("time = %d, %d; want 51", harts[0].CSR[RDTIME], harts[1].CSR[RDTIME])
+	}
+}
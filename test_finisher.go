@@ -0,0 +1,56 @@
+// Copyright 2019 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import "fmt"
+
+// Commands of the SiFive test finisher, written to the low 16 bits of its only
+// register. The status code of a failure is in the high 16 bits. See QEMU's
+// hw/misc/sifive_test.c.
+const (
+	finisherFail  = 0x3333
+	finisherPass  = 0x5555
+	finisherReset = 0x7777
+
+	// TestFinisherSize is the size of the test finisher's address space.
+	TestFinisherSize = 0x1000
+)
+
+// TestFinisher is the SiFive test device. Bare-metal programs write to it to
+// power off or reset the machine. The store that does it fails with an
+// *ExitError which ends VM.Run. It implements the Device interface.
+type TestFinisher struct{}
+
+// Load implements the Device interface.
+func (TestFinisher) Load(offset uint64, size int) (uint64, error) {
+	return 0, nil
+}
+
+// Store implements the Device interface.
+func (TestFinisher) Store(offset uint64, size int, v uint64) error {
+	if size != 4 || offset != 0 {
+		return fmt.Errorf("test finisher: unsupported %d-byte store at offset %#x", size, offset)
+	}
+	code := int(v >> 16 & 0xffff)
+	switch v & 0xffff {
+	case finisherFail:
+		return &ExitError{Code: code}
+	case finisherPass:
+		return &ExitError{}
+	case finisherReset:
+		return &ExitError{Reset: true}
+	}
+	return nil
+}
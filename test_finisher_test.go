@@ -0,0 +1,49 @@
+// Copyright 2019 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestTestFinisher(t *testing.T) {
+	const finisherAddr = 0x100000
+	for _, tt := range []struct {
+		v    uint64
+		want *ExitError // nil if the program keeps running
+	}{
+		{v: finisherPass, want: &ExitError{}},
+		{v: 3<<16 | finisherFail, want: &ExitError{Code: 3}},
+		{v: finisherReset, want: &ExitError{Reset: true}},
+		{v: 0x1234},
+	} {
+		vm := newTrapVM(t)
+		vm.Bus = &Bus{}
+		vm.Bus.Map(finisherAddr, TestFinisherSize, TestFinisher{})
+		copy(vm.Mem, asBytes(swX2X1))
+		vm.Reg[1], vm.Reg[2] = finisherAddr, tt.v
+		err := vm.Run(2)
+		if tt.want == nil {
+			if err != nil || vm.PC != 8 {
+				t.Errorf("store of %#x: Run() = %v, PC = %#x; want nil, 0x8", tt.v, err, vm.PC)
+			}
+			continue
+		}
+		if !IsExit(err) || !reflect.DeepEqual(err, tt.want) {
+			t.Errorf("store of %#x: Run() = %v; want %v", tt.v, err, tt.want)
+		}
+	}
+}
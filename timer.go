@@ -0,0 +1,97 @@
+// Copyright 2019 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+// tick advances the time counter (the time CSR read by RDTIME) by n and updates
+// timer interrupts that depend on it. The VM advances time by one tick per
+// executed instruction.
+//
+// When the VM is connected to a CLINT, the machine timer interrupt (mip.MTIP)
+// is pending whenever time >= mtimecmp. When menvcfg.STCE is set, the
+// supervisor timer interrupt (mip.STIP) is pending whenever time >= stimecmp
+// (the Sstc extension). When henvcfg.STCE is set too, the virtual supervisor
+// timer interrupt (mip.VSTIP) is pending whenever time + htimedelta >=
+// vstimecmp.
+func (vm *VM) tick(n uint64) {
+	vm.CSR[RDTIME] += n
+	if vm.clint != nil {
+		vm.setMIP(mipMTIP, vm.CSR[RDTIME] >= vm.mtimecmp)
+	}
+	if vm.CSR[csrMenvcfg]&menvcfgSTCE != 0 {
+		vm.setMIP(mipSTIP, vm.CSR[RDTIME] >= vm.CSR[csrStimecmp])
+		if vm.CSR[csrHenvcfg]&menvcfgSTCE != 0 {
+			vm.setMIP(mipVSTIP, vm.CSR[RDTIME]+vm.CSR[csrHtimedelta] >= vm.CSR[csrVstimecmp])
+		}
+	}
+}
+
+// nextDeadline returns the earliest future time at which an enabled timer
+// interrupt becomes pending. ok is false if there's no such time.
+func (vm *VM) nextDeadline() (deadline uint64, ok bool) {
+	now, mie := vm.CSR[RDTIME], vm.CSR[csrMIE]
+	add := func(t uint64) {
+		if t > now && (!ok || t < deadline) {
+			deadline, ok = t, true
+		}
+	}
+	if vm.clint != nil && mie&mipMTIP != 0 {
+		add(vm.mtimecmp)
+	}
+	if vm.CSR[csrMenvcfg]&menvcfgSTCE != 0 && mie&mipSTIP != 0 {
+		add(vm.CSR[csrStimecmp])
+	}
+	if vm.CSR[csrMenvcfg]&vm.CSR[csrHenvcfg]&menvcfgSTCE != 0 && mie&mipVSTIP != 0 {
+		add(vm.CSR[csrVstimecmp] - vm.CSR[csrHtimedelta])
+	}
+	return deadline, ok
+}
+
+// wfi stalls the hart until an interrupt is pending. The instruction retires
+// immediately; Run doesn't execute further instructions while the hart waits.
+// Below M-mode it raises an illegal-instruction exception if mstatus.TW is
+// set: the time limit for it to complete is zero. Otherwise, in VU-mode, and
+// in VS-mode if hstatus.VTW is set, it raises a virtual-instruction exception.
+//
+// riscv-privileged-v1.10; Chapter 3.2.3; Page 41; Chapter 3.1.16; Page 29
+func wfi(vm *VM, in *Instruction) (flags, error) {
+	if vm.Priv < PrivM && vm.CSR[csrMstatus]&mstatusTW != 0 {
+		return illegal(in)
+	}
+	if vm.Virt && (vm.Priv == PrivU || vm.CSR[csrHstatus]&hstatusVTW != 0) {
+		return flags{}, virtualInstr(in)
+	}
+	if vm.pendingInterrupts() == 0 {
+		vm.waiting = true
+	}
+	return flags{}, nil
+}
+
+// idle is called by Run instead of executing an instruction while the hart
+// waits for an interrupt. Nothing but a timer can change the state of an idle
+// hart, so instead of spinning idle warps the clock to the next timer deadline.
+// Without a deadline time advances by one tick, which lets interrupts raised by
+// devices on other goroutines wake the hart.
+//
+// The clocks of the harts of a multiprocessor machine advance together, so
+// their idle harts don't warp; the Scheduler does when all harts are idle.
+func (vm *VM) idle() {
+	vm.Steps++
+	vm.CSR[RDCYCLE]++
+	if d, ok := vm.nextDeadline(); ok && vm.harts == nil {
+		vm.tick(d - vm.CSR[RDTIME])
+		return
+	}
+	vm.tick(1)
+}
@@ -0,0 +1,123 @@
+// Copyright 2019 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import "testing"
+
+func TestSstc(t *testing.T) {
+	vm := NewVM(&Prog{MemSize: 64})
+	for i := 0; i < len(vm.Mem); i += 4 {
+		copy(vm.Mem[i:], asBytes(0x00000013)) // nop
+	}
+	vm.CSR[csrStimecmp] = 5
+	if err := vm.Run(5); err != nil {
+		t.Fatalf("Run failed: %v", err)
+	}
+	if got := vm.CSR[csrMIP]; got != 0 {
+		t.Errorf("mip = %#x; want 0 (STCE is disabled)", got)
+	}
+
+	if err := vm.writeCSR(csrMenvcfg, menvcfgSTCE); err != nil {
+		t.Fatalf("Can't enable Sstc: %v", err)
+	}
+	if got := vm.CSR[csrMIP]; got != mipSTIP {
+		t.Errorf("mip = %#x; want STIP (time is 5)", got)
+	}
+	if err := vm.writeCSR(csrMIP, 0); err != nil {
+		t.Fatalf("Can't write mip: %v", err)
+	}
+	if got := vm.CSR[csrMIP]; got != mipSTIP {
+		t.Errorf("mip = %#x; want STIP (STIP is read-only with Sstc)", got)
+	}
+
+	if err := vm.writeCSR(csrStimecmp, 8); err != nil {
+		t.Fatalf("Can't write stimecmp: %v", err)
+	}
+	for time := uint64(5); time < 8; time++ {
+		if got := vm.CSR[csrMIP]; got != 0 {
+			t.Errorf("time %d: mip = %#x; want 0", time, got)
+		}
+		if err := vm.Run(1); err != nil {
+			t.Fatalf("Run failed: %v", err)
+		}
+	}
+	if got := vm.CSR[csrMIP]; got != mipSTIP {
+		t.Errorf("time 8: mip = %#x; want STIP", got)
+	}
+
+	// rdtime a0
+	in := &Instruction{fn: csrrs, rd: 10, imm: RDTIME}
+	if _, err := csrrs(vm, in); err != nil {
+		t.Fatalf("rdtime failed: %v", err)
+	}
+	if got := vm.Reg[10]; got != 8 {
+		t.Errorf("rdtime = %d; want 8", got)
+	}
+}
+
+func TestSstcDisabled(t *testing.T) {
+	const trapHandler = 0x40
+	for _, tt := range []struct {
+		desc     string
+		instr    uint64
+		priv     int
+		menvcfg  uint64
+		wantTrap bool
+	}{
+		{"csrr t0, stimecmp in S-mode", 0x14d022f3, PrivS, 0, true},
+		{"csrw stimecmp, t0 in S-mode", 0x14d29073, PrivS, 0, true},
+		{"csrw stimecmp, t0 in S-mode with STCE", 0x14d29073, PrivS, menvcfgSTCE, false},
+		{"csrw stimecmp, t0 in M-mode", 0x14d29073, PrivM, 0, false},
+	} {
+		vm := NewVM(&Prog{MemSize: 0x80})
+		copy(vm.Mem, asBytes(tt.instr))
+		vm.CSR[csrMtvec], vm.CSR[csrMenvcfg] = trapHandler, tt.menvcfg
+		vm.Priv = tt.priv
+		vm.Reg[regNums["t0"]] = 100
+		if err := vm.Run(1); err != nil {
+			t.Fatalf("%s: Run failed: %v", tt.desc, err)
+		}
+		if trapped := vm.PC == trapHandler && vm.CSR[csrMcause] == causeIllegalInstr; trapped != tt.wantTrap {
+			t.Errorf("%s: PC, mcause = %#x, %d; want an illegal-instruction exception: %v", tt.desc, vm.PC, vm.CSR[csrMcause], tt.wantTrap)
+		}
+	}
+
+	// Without STCE, STIP is written by software and doesn't follow
+	// stimecmp.
+	vm := NewVM(&Prog{MemSize: 0x80})
+	for i := 0; i < len(vm.Mem); i += 4 {
+		copy(vm.Mem[i:], asBytes(0x00000013)) // nop
+	}
+	vm.CSR[csrStimecmp] = 100
+	if err := vm.writeCSR(csrMIP, mipSTIP); err != nil {
+		t.Fatalf("Can't write mip: %v", err)
+	}
+	if err := vm.Run(5); err != nil {
+		t.Fatalf("Run failed: %v", err)
+	}
+	if got := vm.CSR[csrMIP]; got != mipSTIP {
+		t.Errorf("mip = %#x; want STIP set by software", got)
+	}
+	vm.CSR[csrStimecmp] = 0
+	if err := vm.writeCSR(csrMIP, 0); err != nil {
+		t.Fatalf("Can't write mip: %v", err)
+	}
+	if err := vm.Run(5); err != nil {
+		t.Fatalf("Run failed: %v", err)
+	}
+	if got := vm.CSR[csrMIP]; got != 0 {
+		t.Errorf("mip = %#x; want STIP cleared by software", got)
+	}
+}
@@ -0,0 +1,367 @@
+// Copyright 2019 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import "fmt"
+
+// Privilege levels.
+//
+// riscv-privileged-v1.10; Table 1.1; Page 2
+const (
+	PrivU = 0 // User/Application
+	PrivS = 1 // Supervisor
+	PrivM = 3 // Machine
+)
+
+// Exception codes (mcause values with the interrupt bit clear).
+//
+// riscv-privileged-v1.10; Table 3.6; Page 35
+const (
+	causeInstrMisaligned  = 0
+	causeInstrAccessFault = 1
+	causeIllegalInstr     = 2
+	causeBreakpoint       = 3
+	causeLoadMisaligned   = 4
+	causeLoadAccessFault  = 5
+	causeStoreMisaligned  = 6
+	causeStoreAccessFault = 7
+	causeECallU           = 8
+	causeECallS           = 9
+	causeECallM           = 11
+)
+
+// causeInterrupt is set in mcause when the trap was caused by an interrupt.
+const causeInterrupt = 1 << 63
+
+// Trap-handling CSR addresses.
+//
+// riscv-privileged-v1.10; Tables 2.2-2.5; Pages 8-10
+const (
+	csrSstatus  = 0x100
+	csrSie      = 0x104
+	csrStvec    = 0x105
+	csrSscratch = 0x140
+	csrSepc     = 0x141
+	csrScause   = 0x142
+	csrStval    = 0x143
+	csrSip      = 0x144
+	csrSatp     = 0x180
+	csrMstatus  = 0x300
+	csrMedeleg  = 0x302
+	csrMideleg  = 0x303
+	csrMtvec    = 0x305
+	csrMepc     = 0x341
+	csrMcause   = 0x342
+	csrMtval    = 0x343
+)
+
+// Bits of the mstatus CSR.
+//
+// riscv-privileged-v1.10; Figure 3.7; Page 20
+const (
+	mstatusSIE   = 1 << 1
+	mstatusMIE   = 1 << 3
+	mstatusSPIE  = 1 << 5
+	mstatusMPIE  = 1 << 7
+	mstatusSPP   = 1 << 8
+	mstatusMPP   = 3 << 11
+	mstatusShift = 11 // position of MPP
+	mstatusSUM   = 1 << 18
+	mstatusMXR   = 1 << 19
+	mstatusTVM   = 1 << 20 // trap satp, hgatp, SFENCE.VMA and HFENCE.GVMA in HS-mode
+	mstatusTW    = 1 << 21 // trap WFI below M-mode
+	mstatusTSR   = 1 << 22 // trap SRET in HS-mode
+
+	// sstatusMask selects the bits of mstatus visible in sstatus.
+	//
+	// riscv-privileged-v1.10; Figure 4.2; Page 54
+	sstatusMask = mstatusSIE | mstatusSPIE | mstatusSPP | 3<<13 | 3<<15 | mstatusSUM | mstatusMXR | 1<<63
+)
+
+// Writable bits of the medeleg and mideleg CSRs. Environment calls from M-mode
+// and M-level interrupts can't be delegated. VS-level interrupts are always
+// delegated (see midelegVS).
+const (
+	medelegMask = 0xffff&^(1<<causeECallM) | 0xf<<causeInstrGuestPageFault
+	midelegMask = mipSSIP | mipSTIP | mipSEIP
+)
+
+// exception is returned by functions executing instructions when the
+// instruction raises a synchronous exception. Run delivers it to the trap
+// handler.
+type exception struct {
+	cause uint64 // exception code
+	tval  uint64 // value written to mtval
+	gpa   uint64 // guest physical address of a guest-page fault shifted right by 2; written to mtval2 or htval
+	gva   bool   // whether tval is a guest virtual address
+}
+
+func (e *exception) Error() string {
+	return fmt.Sprintf("exception %d (tval %#x)", e.cause, e.tval)
+}
+
+// trap transfers control to the trap handler of the exception or interrupt
+// cause; see raise.
+func (vm *VM) trap(cause, tval uint64) error {
+	return vm.raise(&exception{cause: cause, tval: tval})
+}
+
+// raise transfers control to the machine-mode trap handler or, if the trap is
+// delegated and the hart doesn't run in M-mode, to the supervisor-mode trap
+// handler. Traps delegated further with hedeleg or hideleg while the hart runs
+// in VS-mode or VU-mode go to the VS-mode handler; other traps leave the
+// virtualization mode. raise returns an error if the program hasn't installed
+// a machine-mode handler (mtvec is zero), which is the case for programs that
+// rely on the emulator to implement their environment.
+//
+// riscv-privileged-v1.10; Chapter 3.1.7, 3.1.8, 3.1.15-3.1.20;
+// riscv-privileged-20211203; Chapter 8.6
+func (vm *VM) raise(e *exception) error {
+	cause, code := e.cause, e.cause&^causeInterrupt
+	deleg, hdeleg := vm.CSR[csrMedeleg], vm.CSR[csrHedeleg]
+	if cause&causeInterrupt != 0 {
+		deleg, hdeleg = vm.CSR[csrMideleg]|midelegVS, vm.CSR[csrHideleg]
+	}
+	switch code {
+	case causeInstrMisaligned, causeLoadMisaligned, causeStoreMisaligned:
+		e.gva = e.gva || vm.Virt
+	}
+	if vm.Priv <= PrivS && code < 64 && deleg&(1<<code) != 0 {
+		if vm.Virt && hdeleg&(1<<code) != 0 {
+			if cause&causeInterrupt != 0 {
+				// VS-level interrupts are supervisor interrupts
+				// in VS-mode.
+				cause--
+			}
+			vm.strap(cause, e, true)
+		} else {
+			vm.strap(cause, e, false)
+		}
+		return nil
+	}
+	tvec := vm.CSR[csrMtvec]
+	if tvec == 0 {
+		if cause&causeInterrupt != 0 {
+			return fmt.Errorf("interrupt %d at %#x: no trap handler installed", code, vm.PC)
+		}
+		return fmt.Errorf("exception %d (tval %#x) at %#x: no trap handler installed", cause, e.tval, vm.PC)
+	}
+	vm.CSR[csrMepc] = vm.PC
+	vm.CSR[csrMcause] = cause
+	vm.CSR[csrMtval] = e.tval
+	vm.CSR[csrMtval2] = e.gpa
+	vm.CSR[csrMtinst] = 0
+	s := vm.CSR[csrMstatus] &^ (mstatusMPIE | mstatusMPP | mstatusMPV | mstatusGVA)
+	if s&mstatusMIE != 0 {
+		s |= mstatusMPIE
+	}
+	s |= uint64(vm.Priv) << mstatusShift
+	if vm.Virt {
+		s |= mstatusMPV
+	}
+	if e.gva {
+		s |= mstatusGVA
+	}
+	vm.CSR[csrMstatus] = s &^ mstatusMIE
+	vm.Priv, vm.Virt = PrivM, false
+	vm.PC = tvec &^ 3
+	if tvec&3 == 1 && cause&causeInterrupt != 0 {
+		// Vectored mode.
+		vm.PC += 4 * code
+	}
+	return nil
+}
+
+// strap transfers control to the supervisor-mode trap handler: the VS-mode
+// handler, which uses the virtual supervisor CSRs, if virt is set, otherwise
+// the HS-mode handler.
+//
+// riscv-privileged-v1.10; Chapter 4.1; riscv-privileged-20211203; Chapter 8.6.4
+func (vm *VM) strap(cause uint64, e *exception, virt bool) {
+	var vs uint64 // offset of the virtual supervisor CSRs
+	if virt {
+		vs = csrVsstatus - csrSstatus
+	}
+	vm.CSR[csrSepc+vs] = vm.PC
+	vm.CSR[csrScause+vs] = cause
+	vm.CSR[csrStval+vs] = e.tval
+	status := &vm.CSR[csrMstatus]
+	if virt {
+		status = &vm.CSR[csrVsstatus]
+	}
+	s := *status &^ (mstatusSPIE | mstatusSPP)
+	if s&mstatusSIE != 0 {
+		s |= mstatusSPIE
+	}
+	if vm.Priv == PrivS {
+		s |= mstatusSPP
+	}
+	*status = s &^ mstatusSIE
+	if !virt {
+		h := vm.CSR[csrHstatus] &^ (hstatusSPV | hstatusGVA)
+		if vm.Virt {
+			h = h&^hstatusSPVP | hstatusSPV
+			if vm.Priv == PrivS {
+				h |= hstatusSPVP
+			}
+		}
+		if e.gva {
+			h |= hstatusGVA
+		}
+		vm.CSR[csrHstatus] = h
+		vm.CSR[csrHtval] = e.gpa
+		vm.CSR[csrHtinst] = 0
+	}
+	vm.Priv, vm.Virt = PrivS, virt
+	tvec := vm.CSR[csrStvec+vs]
+	vm.PC = tvec &^ 3
+	if tvec&3 == 1 && cause&causeInterrupt != 0 {
+		vm.PC += 4 * (cause &^ causeInterrupt)
+	}
+}
+
+// ecallCause returns the exception code of environment calls from the current
+// privilege level.
+func (vm *VM) ecallCause() uint64 {
+	if vm.Virt && vm.Priv == PrivS {
+		return causeECallVS
+	}
+	return causeECallU + uint64(vm.Priv)
+}
+
+// interruptOrder lists interrupts in the order of decreasing priority.
+//
+// riscv-privileged-v1.10; Chapter 3.1.14; Page 30; riscv-privileged-20211203;
+// Chapter 8.4.3; Page 121
+var interruptOrder = [...]uint64{11, 3, 7, 9, 1, 5, 10, 2, 6}
+
+// interrupt takes the highest-priority pending and enabled interrupt, if
+// there's one and interrupts are globally enabled for the privilege level
+// that handles it. Interrupts handled by M-mode (not delegated) are enabled in
+// lower privilege levels regardless of mstatus.MIE; delegated interrupts are
+// never taken in M-mode. Likewise, interrupts handled by HS-mode are enabled
+// in VS-mode and VU-mode, and interrupts delegated to VS-mode are only taken
+// in VS-mode and VU-mode.
+//
+// riscv-privileged-v1.10; Chapter 3.1.14; Page 30
+func (vm *VM) interrupt() error {
+	pending := vm.pendingInterrupts()
+	if pending == 0 {
+		return nil
+	}
+	s, deleg, hdeleg := vm.CSR[csrMstatus], vm.CSR[csrMideleg]|midelegVS, vm.CSR[csrHideleg]
+	mEnabled := vm.Priv < PrivM || s&mstatusMIE != 0
+	hsEnabled := vm.Virt || vm.Priv < PrivS || vm.Priv == PrivS && s&mstatusSIE != 0
+	vsEnabled := vm.Virt && (vm.Priv < PrivS || vm.CSR[csrVsstatus]&mstatusSIE != 0)
+	for _, code := range interruptOrder {
+		bit := uint64(1) << code
+		if pending&bit == 0 {
+			continue
+		}
+		enabled := vsEnabled
+		if deleg&bit == 0 {
+			enabled = mEnabled
+		} else if hdeleg&bit == 0 {
+			enabled = hsEnabled
+		}
+		if !enabled {
+			continue
+		}
+		priv := vm.Priv
+		if err := vm.trap(causeInterrupt|code, 0); err != nil {
+			return err
+		}
+		err := vm.interruptTriggers(code, priv)
+		if e, ok := err.(*exception); ok {
+			return vm.raise(e)
+		}
+		return err
+	}
+	return nil
+}
+
+// pendingInterrupts returns the interrupts that are both pending and enabled.
+func (vm *VM) pendingInterrupts() uint64 {
+	mip, _ := vm.readCSR(csrMIP)
+	return mip & vm.CSR[csrMIE]
+}
+
+// mret returns from a machine-mode trap handler.
+func mret(vm *VM, in *Instruction) (flags, error) {
+	if vm.Priv != PrivM {
+		return flags{}, &exception{cause: causeIllegalInstr, tval: in.in}
+	}
+	s := vm.CSR[csrMstatus]
+	vm.Priv = int(s & mstatusMPP >> mstatusShift)
+	vm.Virt = vm.Priv != PrivM && s&mstatusMPV != 0
+	if vm.Priv != PrivM {
+		s &^= mstatusMPRV
+	}
+	s &^= mstatusMIE | mstatusMPP | mstatusMPV
+	if s&mstatusMPIE != 0 {
+		s |= mstatusMIE
+	}
+	vm.CSR[csrMstatus] = s | mstatusMPIE
+	vm.PC = vm.CSR[csrMepc]
+	return flags{updatedPC: true}, nil
+}
+
+// sret returns from a supervisor-mode trap handler. In HS-mode, it enters the
+// virtualization mode in hstatus.SPV; in VS-mode, it uses vsstatus and vsepc
+// and stays in the virtualization mode. mstatus.TSR traps it in HS-mode, like
+// hstatus.VTSR does in VS-mode.
+//
+// riscv-privileged-v1.10; Chapter 3.2.2; Page 40; riscv-privileged-20211203;
+// Chapter 8.6.4; Page 129
+func sret(vm *VM, in *Instruction) (flags, error) {
+	switch {
+	case vm.Virt && (vm.Priv < PrivS || vm.CSR[csrHstatus]&hstatusVTSR != 0):
+		return flags{}, virtualInstr(in)
+	case vm.Priv < PrivS, !vm.Virt && vm.Priv == PrivS && vm.CSR[csrMstatus]&mstatusTSR != 0:
+		return flags{}, &exception{cause: causeIllegalInstr, tval: in.in}
+	}
+	status, epc, virt := csrMstatus, csrSepc, vm.CSR[csrHstatus]&hstatusSPV != 0
+	if vm.Virt {
+		status, epc, virt = csrVsstatus, csrVsepc, true
+	}
+	s := vm.CSR[status]
+	vm.Priv = PrivU
+	if s&mstatusSPP != 0 {
+		vm.Priv = PrivS
+	}
+	s &^= mstatusSIE | mstatusSPP
+	if s&mstatusSPIE != 0 {
+		s |= mstatusSIE
+	}
+	vm.CSR[status] = s | mstatusSPIE
+	vm.CSR[csrMstatus] &^= mstatusMPRV
+	vm.Virt = virt
+	vm.PC = vm.CSR[epc]
+	return flags{updatedPC: true}, nil
+}
+
+// sfenceVMA orders stores to the page tables with subsequent translations. It
+// flushes the whole TLB regardless of the address and ASID. mstatus.TVM traps
+// it in HS-mode, like hstatus.VTVM does in VS-mode.
+func sfenceVMA(vm *VM, in *Instruction) (flags, error) {
+	switch {
+	case vm.Virt && (vm.Priv < PrivS || vm.CSR[csrHstatus]&hstatusVTVM != 0):
+		return flags{}, virtualInstr(in)
+	case vm.Priv < PrivS, !vm.Virt && vm.Priv == PrivS && vm.CSR[csrMstatus]&mstatusTVM != 0:
+		return flags{}, &exception{cause: causeIllegalInstr, tval: in.in}
+	}
+	vm.flushTLB()
+	return flags{}, nil
+}
@@ -0,0 +1,245 @@
+// Copyright 2019 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import "testing"
+
+const (
+	sretInstr  = 0x10200073
+	strapEntry = 0x60 // stvec in tests
+)
+
+func TestDelegatedTrap(t *testing.T) {
+	for _, tt := range []struct {
+		priv     int
+		wantPriv int
+		wantPC   uint64
+	}{
+		{priv: PrivU, wantPriv: PrivS, wantPC: strapEntry},
+		{priv: PrivS, wantPriv: PrivS, wantPC: strapEntry},
+		// Traps taken in M-mode are never delegated.
+		{priv: PrivM, wantPriv: PrivM, wantPC: trapHandler},
+	} {
+		vm := newTrapVM(t)
+		vm.CSR[csrStvec] = strapEntry
+		vm.writeCSR(csrMedeleg, 1<<causeIllegalInstr)
+		vm.CSR[csrMstatus] = mstatusSIE
+		vm.Priv, vm.PC = tt.priv, 0x8
+		if err := vm.trap(causeIllegalInstr, 0x1234); err != nil {
+			t.Fatalf("trap failed: %v", err)
+		}
+		if vm.Priv != tt.wantPriv || vm.PC != tt.wantPC {
+			t.Errorf("trap from %d: priv, PC = %d, %#x; want %d, %#x", tt.priv, vm.Priv, vm.PC, tt.wantPriv, tt.wantPC)
+		}
+		if tt.wantPriv != PrivS {
+			continue
+		}
+		if vm.CSR[csrSepc] != 0x8 || vm.CSR[csrScause] != causeIllegalInstr || vm.CSR[csrStval] != 0x1234 {
+			t.Errorf("sepc, scause, stval = %#x, %d, %#x; want 0x8, %d, 0x1234", vm.CSR[csrSepc], vm.CSR[csrScause], vm.CSR[csrStval], causeIllegalInstr)
+		}
+		wantStatus := uint64(mstatusSPIE)
+		if tt.priv == PrivS {
+			wantStatus |= mstatusSPP
+		}
+		if got, _ := vm.readCSR(csrSstatus); got != wantStatus {
+			t.Errorf("sstatus = %#x; want %#x", got, wantStatus)
+		}
+
+		// SRET returns to the interrupted privilege level.
+		copy(vm.Mem[strapEntry:], asBytes(sretInstr))
+		if err := vm.Run(1); err != nil {
+			t.Fatalf("Run failed: %v", err)
+		}
+		if vm.Priv != tt.priv || vm.PC != 0x8 {
+			t.Errorf("after SRET: priv, PC = %d, %#x; want %d, 0x8", vm.Priv, vm.PC, tt.priv)
+		}
+		if got, _ := vm.readCSR(csrSstatus); got != mstatusSIE|mstatusSPIE {
+			t.Errorf("sstatus after SRET = %#x; want SIE|SPIE", got)
+		}
+	}
+}
+
+func TestSRETInUserMode(t *testing.T) {
+	vm := newTrapVM(t)
+	copy(vm.Mem, asBytes(sretInstr))
+	vm.Priv = PrivU
+	if err := vm.Run(1); err != nil {
+		t.Fatalf("Run failed: %v", err)
+	}
+	if vm.PC != trapHandler || vm.CSR[csrMcause] != causeIllegalInstr {
+		t.Errorf("PC, mcause = %#x, %d; want %#x, %d", vm.PC, vm.CSR[csrMcause], trapHandler, causeIllegalInstr)
+	}
+}
+
+func TestCSRPrivilege(t *testing.T) {
+	for _, tt := range []struct {
+		desc     string
+		instr    uint64
+		priv     int
+		wantTrap bool
+	}{
+		{"csrr t0, mstatus in M-mode", 0x300022f3, PrivM, false},
+		{"csrr t0, mstatus in S-mode", 0x300022f3, PrivS, true},
+		{"csrw mtvec, t0 in U-mode", 0x30529073, PrivU, true},
+		{"csrr t0, sstatus in S-mode", 0x100022f3, PrivS, false},
+		{"csrw sstatus, t0 in U-mode", 0x10029073, PrivU, true},
+		{"csrr t0, satp in U-mode", 0x180022f3, PrivU, true},
+		{"rdcycle t0 in U-mode", 0xc00022f3, PrivU, false},
+		{"csrw cycle, t0 in M-mode", 0xc0029073, PrivM, true},
+		{"csrwi time, 1 in M-mode", 0xc010d073, PrivM, true},
+		{"csrw mhartid, t0 in M-mode", 0xf1429073, PrivM, true},
+	} {
+		vm := newTrapVM(t)
+		copy(vm.Mem, asBytes(tt.instr))
+		vm.Priv = tt.priv
+		vm.Reg[regNums["t0"]] = 0x40
+		if err := vm.Run(1); err != nil {
+			t.Fatalf("%s: Run failed: %v", tt.desc, err)
+		}
+		if trapped := vm.PC == trapHandler && vm.CSR[csrMcause] == causeIllegalInstr; trapped != tt.wantTrap {
+			t.Errorf("%s: PC, mcause = %#x, %d; want an illegal-instruction exception: %v", tt.desc, vm.PC, vm.CSR[csrMcause], tt.wantTrap)
+		}
+		if tt.wantTrap && vm.CSR[csrMtval] != tt.instr {
+			t.Errorf("%s: mtval = %#x; want the instruction", tt.desc, vm.CSR[csrMtval])
+		}
+	}
+}
+
+func TestDelegatedInterrupt(t *testing.T) {
+	for _, tt := range []struct {
+		desc    string
+		priv    int
+		mstatus uint64
+		wantPC  uint64 // after one step
+	}{
+		{desc: "U-mode", priv: PrivU, wantPC: strapEntry + 4},
+		{desc: "S-mode with SIE", priv: PrivS, mstatus: mstatusSIE, wantPC: strapEntry + 4},
+		{desc: "S-mode without SIE", priv: PrivS, wantPC: 4},
+		// Delegated interrupts aren't taken in M-mode, even with MIE.
+		{desc: "M-mode", priv: PrivM, mstatus: mstatusMIE | mstatusSIE, wantPC: 4},
+	} {
+		vm := newTrapVM(t)
+		vm.CSR[csrStvec] = strapEntry
+		vm.writeCSR(csrMideleg, mipSTIP)
+		vm.writeCSR(csrSie, mipSTIP)
+		vm.CSR[csrMstatus] = tt.mstatus
+		vm.Priv = tt.priv
+		vm.setMIP(mipSTIP, true)
+		if err := vm.Run(1); err != nil {
+			t.Fatalf("%s: Run failed: %v", tt.desc, err)
+		}
+		if vm.PC != tt.wantPC {
+			t.Errorf("%s: PC = %#x; want %#x", tt.desc, vm.PC, tt.wantPC)
+		}
+		if got, _ := vm.readCSR(csrSip); got != mipSTIP {
+			t.Errorf("%s: sip = %#x; want STIP", tt.desc, got)
+		}
+	}
+}
+
+func TestDelegationCSRs(t *testing.T) {
+	vm := newTrapVM(t)
+	vm.writeCSR(csrMedeleg, ^uint64(0))
+	vm.writeCSR(csrMideleg, ^uint64(0))
+	if got := vm.CSR[csrMedeleg]; got&(1<<causeECallM) != 0 {
+		t.Errorf("medeleg = %#x; ECALL from M-mode can't be delegated", got)
+	}
+	if got := vm.CSR[csrMideleg]; got != mipSSIP|mipSTIP|mipSEIP {
+		t.Errorf("mideleg = %#x; want SSIP|STIP|SEIP", got)
+	}
+	// sie and sip are restricted to delegated interrupts.
+	vm.writeCSR(csrMideleg, mipSSIP)
+	vm.writeCSR(csrMIE, mipMTIP)
+	vm.writeCSR(csrSie, ^uint64(0))
+	if got := vm.CSR[csrMIE]; got != mipMTIP|mipSSIP {
+		t.Errorf("mie = %#x; want MTIP|SSIP", got)
+	}
+	vm.writeCSR(csrSip, ^uint64(0))
+	if got, _ := vm.readCSR(csrMIP); got != mipSSIP {
+		t.Errorf("mip = %#x; want SSIP", got)
+	}
+}
+
+func TestIllegalInstrTrap(t *testing.T) {
+	for _, tt := range []struct {
+		in       uint64
+		wantTval uint64
+	}{
+		{0xffffffff, 0xffffffff},
+		{0x0000, 0}, // an illegal compressed instruction
+	} {
+		vm := newTrapVM(t)
+		copy(vm.Mem, asBytes(tt.in))
+		if err := vm.Run(1); err != nil {
+			t.Fatalf("%#x: Run failed: %v", tt.in, err)
+		}
+		if vm.PC != trapHandler || vm.CSR[csrMcause] != causeIllegalInstr || vm.CSR[csrMtval] != tt.wantTval {
+			t.Errorf("%#x: PC, mcause, mtval = %#x, %d, %#x; want %#x, %d, %#x", tt.in, vm.PC, vm.CSR[csrMcause], vm.CSR[csrMtval], trapHandler, causeIllegalInstr, tt.wantTval)
+		}
+	}
+}
+
+func TestECallTrap(t *testing.T) {
+	for _, priv := range []int{PrivU, PrivS, PrivM} {
+		vm := newTrapVM(t)
+		copy(vm.Mem, asBytes(ecallInstr))
+		vm.Priv = priv
+		if err := vm.Run(1); err != nil {
+			t.Fatalf("priv %d: Run failed: %v", priv, err)
+		}
+		if want := uint64(causeECallU + priv); vm.PC != trapHandler || vm.CSR[csrMcause] != want {
+			t.Errorf("priv %d: PC, mcause = %#x, %d; want %#x, %d", priv, vm.PC, vm.CSR[csrMcause], trapHandler, want)
+		}
+	}
+}
+
+func TestTrapVirtualMemoryWFIAndSRET(t *testing.T) {
+	for _, tt := range []struct {
+		desc      string
+		instr     uint64
+		priv      int
+		virt      bool
+		mstatus   uint64
+		wantCause uint64 // if non-zero, the instruction traps to M-mode
+	}{
+		{desc: "csrw satp, t0 in S-mode", instr: 0x18029073, priv: PrivS},
+		{desc: "csrw satp, t0 in S-mode with TVM", instr: 0x18029073, priv: PrivS, mstatus: mstatusTVM, wantCause: causeIllegalInstr},
+		{desc: "csrw satp, t0 in M-mode with TVM", instr: 0x18029073, priv: PrivM, mstatus: mstatusTVM},
+		{desc: "csrw satp, t0 in VS-mode with TVM", instr: 0x18029073, priv: PrivS, virt: true, mstatus: mstatusTVM},
+		{desc: "csrr t0, hgatp in HS-mode with TVM", instr: 0x680022f3, priv: PrivS, mstatus: mstatusTVM, wantCause: causeIllegalInstr},
+		{desc: "sfence.vma in S-mode with TVM", instr: 0x12000073, priv: PrivS, mstatus: mstatusTVM, wantCause: causeIllegalInstr},
+		{desc: "sfence.vma in VS-mode with TVM", instr: 0x12000073, priv: PrivS, virt: true, mstatus: mstatusTVM},
+		{desc: "hfence.gvma in HS-mode with TVM", instr: hfenceGVMA, priv: PrivS, mstatus: mstatusTVM, wantCause: causeIllegalInstr},
+		{desc: "hfence.vvma in HS-mode with TVM", instr: 0x22000073, priv: PrivS, mstatus: mstatusTVM},
+		{desc: "wfi in S-mode", instr: 0x10500073, priv: PrivS},
+		{desc: "wfi in S-mode with TW", instr: 0x10500073, priv: PrivS, mstatus: mstatusTW, wantCause: causeIllegalInstr},
+		{desc: "wfi in VS-mode with TW", instr: 0x10500073, priv: PrivS, virt: true, mstatus: mstatusTW, wantCause: causeIllegalInstr},
+		{desc: "wfi in M-mode with TW", instr: 0x10500073, priv: PrivM, mstatus: mstatusTW},
+		{desc: "sret in S-mode with TSR", instr: sretInstr, priv: PrivS, mstatus: mstatusTSR, wantCause: causeIllegalInstr},
+		{desc: "sret in VS-mode with TSR", instr: sretInstr, priv: PrivS, virt: true, mstatus: mstatusTSR},
+		{desc: "sret in M-mode with TSR", instr: sretInstr, priv: PrivM, mstatus: mstatusTSR},
+	} {
+		vm := newTrapVM(t)
+		copy(vm.Mem, asBytes(tt.instr))
+		vm.Priv, vm.Virt = tt.priv, tt.virt
+		vm.CSR[csrMstatus] |= tt.mstatus
+		if err := vm.Run(1); err != nil {
+			t.Fatalf("%s: Run failed: %v", tt.desc, err)
+		}
+		if trapped := vm.PC == trapHandler; trapped != (tt.wantCause != 0) || trapped && (vm.CSR[csrMcause] != tt.wantCause || vm.CSR[csrMtval] != tt.instr) {
+			t.Errorf("%s: PC, mcause, mtval = %#x, %d, %#x; want a trap: %v (cause %d)", tt.desc, vm.PC, vm.CSR[csrMcause], vm.CSR[csrMtval], tt.wantCause != 0, tt.wantCause)
+		}
+	}
+}
@@ -0,0 +1,267 @@
+// Copyright 2019 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"fmt"
+	"io"
+	"sync"
+)
+
+// UART registers (one byte each). See the TI PC16550D datasheet.
+const (
+	uartRBR = 0 // receiver buffer (read); transmitter holding register (write)
+	uartIER = 1 // interrupt enable
+	uartIIR = 2 // interrupt identification (read); FIFO control (write)
+	uartLCR = 3 // line control
+	uartMCR = 4 // modem control
+	uartLSR = 5 // line status
+	uartMSR = 6 // modem status
+	uartSCR = 7 // scratch
+
+	// UARTSize is the size of the UART's address space.
+	UARTSize = 0x100
+
+	// uartFIFOSize is the size of the receive FIFO.
+	uartFIFOSize = 16
+)
+
+// Bits of the UART registers.
+const (
+	ierRDA  = 1 << 0 // received data available interrupt
+	ierTHRE = 1 << 1 // transmitter holding register empty interrupt
+
+	iirNone    = 0x1 // no interrupt pending
+	iirTHRE    = 0x2
+	iirRDA     = 0x4
+	iirTimeout = 0xC
+	iirFIFO    = 0xC0 // FIFOs enabled
+
+	fcrEnable  = 1 << 0
+	fcrClearRx = 1 << 1
+	fcrTrigger = 3 << 6
+
+	lcrDLAB = 1 << 7 // divisor latch access
+
+	mcrLoop = 1 << 4
+
+	lsrDR   = 1 << 0 // data ready
+	lsrTHRE = 1 << 5 // transmitter holding register empty
+	lsrTEMT = 1 << 6 // transmitter empty
+
+	msrDefault = 0xB0 // CTS, DSR and DCD asserted
+)
+
+// uartTrigger maps FCR trigger level bits to the number of bytes in the
+// receive FIFO that trigger the received data available interrupt.
+var uartTrigger = [...]int{1, 4, 8, 14}
+
+// UART is an NS16550A-compatible serial port. It implements the Device
+// interface. Transmitted bytes are written to an io.Writer immediately, so the
+// transmitter is always empty. Received bytes come from Receive or from a
+// reader passed to Input.
+//
+// The character timeout isn't emulated: when the receive FIFO holds fewer
+// bytes than the trigger level, the timeout interrupt is reported right away.
+type UART struct {
+	mu       sync.Mutex
+	notFull  *sync.Cond // signaled when bytes are removed from rx
+	out      io.Writer
+	irq      InterruptLine // may be nil
+	rx       []byte        // receive FIFO
+	ier      byte
+	fcr      byte
+	lcr      byte
+	mcr      byte
+	scr      byte
+	dll, dlm byte
+	thre     bool // THRE interrupt pending
+}
+
+// NewUART returns a UART that writes transmitted bytes to out and signals
+// interrupts on irq. irq may be nil.
+func NewUART(out io.Writer, irq InterruptLine) *UART {
+	u := &UART{out: out, irq: irq}
+	u.notFull = sync.NewCond(&u.mu)
+	return u
+}
+
+// Receive puts bytes into the receive FIFO, as if they arrived on the serial
+// line. It returns the number of bytes that fit into the FIFO.
+func (u *UART) Receive(b []byte) int {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	n := 0
+	for ; n < len(b) && len(u.rx) < u.fifoSize(); n++ {
+		u.rx = append(u.rx, b[n])
+	}
+	u.update()
+	return n
+}
+
+// Input starts a goroutine that feeds bytes read from r to the receive FIFO.
+// It waits for the guest to drain the FIFO when it's full, so no input is
+// lost. r is typically os.Stdin or a reader with scripted input.
+func (u *UART) Input(r io.Reader) {
+	go func() {
+		buf := make([]byte, uartFIFOSize)
+		for {
+			n, err := r.Read(buf)
+			for b := buf[:n]; len(b) > 0; {
+				u.mu.Lock()
+				for len(u.rx) >= u.fifoSize() {
+					u.notFull.Wait()
+				}
+				u.mu.Unlock()
+				b = b[u.Receive(b):]
+			}
+			if err != nil {
+				return
+			}
+		}
+	}()
+}
+
+func (u *UART) fifoSize() int {
+	if u.fcr&fcrEnable == 0 {
+		return 1
+	}
+	return uartFIFOSize
+}
+
+// iir returns the highest priority pending interrupt.
+func (u *UART) iir() byte {
+	var id byte = iirNone
+	switch {
+	case u.ier&ierRDA != 0 && len(u.rx) > 0:
+		id = iirRDA
+		if u.fcr&fcrEnable != 0 && len(u.rx) < uartTrigger[u.fcr>>6] {
+			id = iirTimeout
+		}
+	case u.ier&ierTHRE != 0 && u.thre:
+		id = iirTHRE
+	}
+	if u.fcr&fcrEnable != 0 {
+		id |= iirFIFO
+	}
+	return id
+}
+
+// update sets the level of the interrupt line. It must be called with mu held.
+func (u *UART) update() {
+	if u.irq != nil {
+		u.irq.SetLevel(u.iir()&iirNone == 0)
+	}
+}
+
+// Load implements the Device interface.
+func (u *UART) Load(offset uint64, size int) (uint64, error) {
+	if size != 1 {
+		return 0, fmt.Errorf("UART: unsupported %d-byte load at offset %#x", size, offset)
+	}
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	var v byte
+	switch offset {
+	case uartRBR:
+		if u.lcr&lcrDLAB != 0 {
+			v = u.dll
+			break
+		}
+		if len(u.rx) > 0 {
+			v = u.rx[0]
+			u.rx = u.rx[1:]
+			u.notFull.Broadcast()
+		}
+	case uartIER:
+		v = u.ier
+		if u.lcr&lcrDLAB != 0 {
+			v = u.dlm
+		}
+	case uartIIR:
+		v = u.iir()
+		if v&0xf == iirTHRE {
+			// Reading IIR clears the THRE interrupt.
+			u.thre = false
+		}
+	case uartLCR:
+		v = u.lcr
+	case uartMCR:
+		v = u.mcr
+	case uartLSR:
+		v = lsrTHRE | lsrTEMT
+		if len(u.rx) > 0 {
+			v |= lsrDR
+		}
+	case uartMSR:
+		v = msrDefault
+	case uartSCR:
+		v = u.scr
+	}
+	u.update()
+	return uint64(v), nil
+}
+
+// Store implements the Device interface.
+func (u *UART) Store(offset uint64, size int, v uint64) error {
+	if size != 1 {
+		return fmt.Errorf("UART: unsupported %d-byte store at offset %#x", size, offset)
+	}
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	defer u.update()
+	b := byte(v)
+	switch offset {
+	case uartRBR:
+		if u.lcr&lcrDLAB != 0 {
+			u.dll = b
+			return nil
+		}
+		// The byte is sent immediately, so THR is empty again.
+		u.thre = true
+		if u.mcr&mcrLoop != 0 {
+			if len(u.rx) < u.fifoSize() {
+				u.rx = append(u.rx, b)
+			}
+			return nil
+		}
+		if _, err := u.out.Write([]byte{b}); err != nil {
+			return fmt.Errorf("UART: can't write output: %v", err)
+		}
+	case uartIER:
+		if u.lcr&lcrDLAB != 0 {
+			u.dlm = b
+			return nil
+		}
+		if b&ierTHRE != 0 && u.ier&ierTHRE == 0 {
+			// Enabling the interrupt while THR is empty triggers it.
+			u.thre = true
+		}
+		u.ier = b & 0xf
+	case uartIIR:
+		if (b^u.fcr)&fcrEnable != 0 || b&fcrClearRx != 0 {
+			u.rx = nil
+			u.notFull.Broadcast()
+		}
+		u.fcr = b & (fcrEnable | fcrTrigger)
+	case uartLCR:
+		u.lcr = b
+	case uartMCR:
+		u.mcr = b & 0x1f
+	case uartSCR:
+		u.scr = b
+	}
+	return nil
+}
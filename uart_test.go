@@ -0,0 +1,150 @@
+// Copyright 2019 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+	"time"
+)
+
+// testLine is an InterruptLine that records its level.
+type testLine bool
+
+func (l *testLine) SetLevel(high bool) { *l = testLine(high) }
+
+func uartLoad(t *testing.T, u *UART, reg uint64) byte {
+	t.Helper()
+	v, err := u.Load(reg, 1)
+	if err != nil {
+		t.Fatalf("Load(%d) failed: %v", reg, err)
+	}
+	return byte(v)
+}
+
+func uartStore(t *testing.T, u *UART, reg uint64, v byte) {
+	t.Helper()
+	if err := u.Store(reg, 1, uint64(v)); err != nil {
+		t.Fatalf("Store(%d, %#x) failed: %v", reg, v, err)
+	}
+}
+
+func TestUARTTransmit(t *testing.T) {
+	var out bytes.Buffer
+	var irq testLine
+	u := NewUART(&out, &irq)
+	for _, b := range []byte("hi\n") {
+		if got := uartLoad(t, u, uartLSR); got&lsrTHRE == 0 {
+			t.Errorf("LSR = %#x; want THRE set", got)
+		}
+		uartStore(t, u, uartRBR, b)
+	}
+	if got := out.String(); got != "hi\n" {
+		t.Errorf("output = %q; want %q", got, "hi\n")
+	}
+	if irq {
+		t.Errorf("interrupt pending with interrupts disabled")
+	}
+
+	uartStore(t, u, uartIER, ierTHRE)
+	if !irq {
+		t.Errorf("no interrupt after enabling the THRE interrupt")
+	}
+	if got := uartLoad(t, u, uartIIR); got != iirTHRE {
+		t.Errorf("IIR = %#x; want %#x", got, iirTHRE)
+	}
+	if irq {
+		t.Errorf("interrupt pending after reading IIR")
+	}
+	if got := uartLoad(t, u, uartIIR); got != iirNone {
+		t.Errorf("IIR = %#x; want %#x", got, iirNone)
+	}
+
+	// The divisor latch shadows RBR/THR and IER.
+	uartStore(t, u, uartLCR, lcrDLAB|3)
+	uartStore(t, u, uartRBR, 0x12)
+	uartStore(t, u, uartIER, 0x34)
+	uartStore(t, u, uartLCR, 3)
+	if got := out.String(); got != "hi\n" {
+		t.Errorf("output = %q; want %q (divisor writes aren't output)", got, "hi\n")
+	}
+	if got := uartLoad(t, u, uartIER); got != ierTHRE {
+		t.Errorf("IER = %#x; want %#x", got, ierTHRE)
+	}
+}
+
+func TestUARTReceive(t *testing.T) {
+	var irq testLine
+	u := NewUART(&bytes.Buffer{}, &irq)
+	uartStore(t, u, uartIIR, fcrEnable|fcrClearRx|1<<6) // trigger level: 4 bytes
+	uartStore(t, u, uartIER, ierRDA)
+
+	if got := uartLoad(t, u, uartLSR); got&lsrDR != 0 {
+		t.Errorf("LSR = %#x; want DR clear", got)
+	}
+	if n := u.Receive([]byte("ab")); n != 2 {
+		t.Errorf("Receive accepted %d bytes; want 2", n)
+	}
+	if !irq {
+		t.Errorf("no interrupt after receiving data")
+	}
+	if got := uartLoad(t, u, uartIIR); got != iirFIFO|iirTimeout {
+		t.Errorf("IIR = %#x; want %#x", got, iirFIFO|iirTimeout)
+	}
+	u.Receive([]byte("cdefghijklmnopqrstuvwxyz"))
+	if got := uartLoad(t, u, uartIIR); got != iirFIFO|iirRDA {
+		t.Errorf("IIR = %#x; want %#x", got, iirFIFO|iirRDA)
+	}
+	var got []byte
+	for uartLoad(t, u, uartLSR)&lsrDR != 0 {
+		got = append(got, uartLoad(t, u, uartRBR))
+	}
+	if want := "abcdefghijklmnop"; string(got) != want {
+		t.Errorf("received %q; want %q (FIFO holds 16 bytes)", got, want)
+	}
+	if irq {
+		t.Errorf("interrupt pending after draining the FIFO")
+	}
+}
+
+func TestUARTInput(t *testing.T) {
+	u := NewUART(&bytes.Buffer{}, nil)
+	uartStore(t, u, uartIIR, fcrEnable)
+	want := strings.Repeat("scripted input\n", 5)
+	u.Input(strings.NewReader(want))
+	var got []byte
+	for deadline := time.Now().Add(10 * time.Second); len(got) < len(want) && time.Now().Before(deadline); {
+		if uartLoad(t, u, uartLSR)&lsrDR != 0 {
+			got = append(got, uartLoad(t, u, uartRBR))
+		}
+	}
+	if string(got) != want {
+		t.Errorf("received %q; want %q", got, want)
+	}
+}
+
+func TestUARTLoopback(t *testing.T) {
+	var out bytes.Buffer
+	u := NewUART(&out, nil)
+	uartStore(t, u, uartMCR, mcrLoop)
+	uartStore(t, u, uartRBR, 'x')
+	if got := uartLoad(t, u, uartRBR); got != 'x' {
+		t.Errorf("RBR = %q; want 'x'", got)
+	}
+	if out.Len() != 0 {
+		t.Errorf("output = %q; want nothing in loopback mode", out.String())
+	}
+}
@@ -0,0 +1,552 @@
+// Copyright 2019 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"encoding/binary"
+	"fmt"
+	"sync"
+)
+
+// This file implements the virtio-mmio transport (version 2) with split
+// virtqueues. See "Virtual I/O Device (VIRTIO) Version 1.1"; Chapters 2 and
+// 4.2.
+
+// virtio-mmio registers.
+//
+// virtio-v1.1; Chapter 4.2.2
+const (
+	virtioMagic             = 0x000
+	virtioVersion           = 0x004
+	virtioDeviceID          = 0x008
+	virtioVendorID          = 0x00c
+	virtioDeviceFeatures    = 0x010
+	virtioDeviceFeaturesSel = 0x014
+	virtioDriverFeatures    = 0x020
+	virtioDriverFeaturesSel = 0x024
+	virtioQueueSel          = 0x030
+	virtioQueueNumMax       = 0x034
+	virtioQueueNum          = 0x038
+	virtioQueueReady        = 0x044
+	virtioQueueNotify       = 0x050
+	virtioInterruptStatus   = 0x060
+	virtioInterruptACK      = 0x064
+	virtioStatus            = 0x070
+	virtioQueueDescLow      = 0x080
+	virtioQueueDescHigh     = 0x084
+	virtioQueueDriverLow    = 0x090
+	virtioQueueDriverHigh   = 0x094
+	virtioQueueDeviceLow    = 0x0a0
+	virtioQueueDeviceHigh   = 0x0a4
+	virtioConfigGeneration  = 0x0fc
+	virtioConfig            = 0x100
+
+	// VirtioMMIOSize is the size of the address space of a virtio-mmio
+	// device.
+	VirtioMMIOSize = 0x200
+
+	virtioMagicValue = 0x74726976 // "virt"
+	virtioVendor     = 0x554d4551 // "QEMU"; what Linux and firmware expect
+	virtioQueueMax   = 256        // maximum number of descriptors per queue
+)
+
+// Virtio device IDs.
+//
+// virtio-v1.1; Chapter 5
+const (
+	virtioNet     = 1
+	virtioBlock   = 2
+	virtioConsole = 3
+	virtioRNG     = 4
+	virtio9P      = 9
+)
+
+// Feature bits common to all devices.
+const (
+	virtioFVersion1 = 1 << 32
+)
+
+// Bits of the device status register.
+//
+// virtio-v1.1; Chapter 2.1
+const (
+	virtioStatusDriverOK   = 4
+	virtioStatusNeedsReset = 64
+)
+
+// Bits of the interrupt status register.
+const (
+	virtioInterruptUsed   = 1 << 0 // a used buffer was returned
+	virtioInterruptConfig = 1 << 1 // the configuration changed
+)
+
+// Split virtqueue layout.
+//
+// virtio-v1.1; Chapter 2.6
+const (
+	virtqDescFNext         = 1
+	virtqDescFWrite        = 2
+	virtqAvailFNoInterrupt = 1
+
+	virtqDescSize       = 16 // size of a descriptor table entry
+	virtqUsedElemSize   = 8  // size of a used ring entry
+	virtqRingHeaderSize = 4  // size of flags and idx of the rings
+)
+
+// VirtioDevice is a device behind the virtio-mmio transport.
+type VirtioDevice interface {
+	// ID returns the virtio device ID.
+	ID() uint32
+	// Features returns the device-specific feature bits offered to the
+	// driver. The transport adds VIRTIO_F_VERSION_1.
+	Features() uint64
+	// NumQueues returns the number of virtqueues.
+	NumQueues() int
+	// Config returns the device configuration space.
+	Config() []byte
+	// Notify is called when the driver notifies the device that there are
+	// new buffers in the queue. Errors mean that the driver passed invalid
+	// buffers; the transport then sets DEVICE_NEEDS_RESET.
+	Notify(q *Virtqueue) error
+	// Reset is called when the driver resets the device.
+	Reset()
+}
+
+// virtioAttacher is implemented by devices that use the transport on their
+// own, e.g. to fill receive queues when host data arrives.
+type virtioAttacher interface {
+	Attach(t *VirtioMMIO)
+}
+
+// VirtioMMIO is the virtio-mmio transport. It implements the Device interface.
+// DMA goes to the main memory of the VM.
+type VirtioMMIO struct {
+	mu             sync.Mutex
+	vm             *VM
+	dev            VirtioDevice
+	irq            InterruptLine // may be nil
+	status         uint32
+	deviceFeatSel  uint32
+	driverFeatSel  uint32
+	driverFeatures uint64
+	queueSel       uint32
+	queues         []*Virtqueue
+	intStatus      uint32
+	generation     uint32
+}
+
+// NewVirtioMMIO returns a virtio-mmio transport for the device. The device
+// accesses the memory of vm and signals interrupts on irq. irq may be nil.
+func NewVirtioMMIO(vm *VM, dev VirtioDevice, irq InterruptLine) *VirtioMMIO {
+	t := &VirtioMMIO{vm: vm, dev: dev, irq: irq}
+	for i := 0; i < dev.NumQueues(); i++ {
+		t.queues = append(t.queues, &Virtqueue{t: t, Index: i})
+	}
+	if a, ok := dev.(virtioAttacher); ok {
+		a.Attach(t)
+	}
+	return t
+}
+
+// Queue returns the i-th virtqueue of the device.
+func (t *VirtioMMIO) Queue(i int) *Virtqueue {
+	return t.queues[i]
+}
+
+// Negotiated reports whether the driver accepted the given feature bits.
+func (t *VirtioMMIO) Negotiated(features uint64) bool {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return t.driverFeatures&features == features
+}
+
+// ConfigChanged notifies the driver that the configuration space changed.
+func (t *VirtioMMIO) ConfigChanged() {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.generation++
+	t.interrupt(virtioInterruptConfig)
+}
+
+// Defer calls f on a hart between two instructions (see Bus.Defer). Devices
+// receiving data from the host on their own goroutines use it to fill receive
+// buffers. If f fails, the device needs a reset.
+func (t *VirtioMMIO) Defer(f func() error) {
+	t.vm.Bus.Defer(func() {
+		if err := f(); err != nil {
+			t.NeedsReset()
+		}
+	})
+}
+
+// NeedsReset marks the device as broken, e.g. when the driver passes invalid
+// buffers to a device processing them in the background.
+func (t *VirtioMMIO) NeedsReset() {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.status |= virtioStatusNeedsReset
+	t.interrupt(virtioInterruptConfig)
+}
+
+// interrupt sets the given bits of the interrupt status register. It must be
+// called with mu held.
+func (t *VirtioMMIO) interrupt(bits uint32) {
+	t.intStatus |= bits
+	t.updateIRQ()
+}
+
+func (t *VirtioMMIO) updateIRQ() {
+	if t.irq != nil {
+		t.irq.SetLevel(t.intStatus != 0)
+	}
+}
+
+func (t *VirtioMMIO) reset() {
+	t.status = 0
+	t.deviceFeatSel, t.driverFeatSel, t.driverFeatures = 0, 0, 0
+	t.queueSel = 0
+	for _, q := range t.queues {
+		*q = Virtqueue{t: t, Index: q.Index}
+	}
+	t.intStatus = 0
+	t.updateIRQ()
+}
+
+// Load implements the Device interface.
+func (t *VirtioMMIO) Load(offset uint64, size int) (uint64, error) {
+	if offset >= virtioConfig {
+		return t.loadConfig(offset-virtioConfig, size)
+	}
+	if size != 4 || offset%4 != 0 {
+		return 0, fmt.Errorf("virtio-mmio: unsupported %d-byte load at offset %#x", size, offset)
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	q := t.selected()
+	var v uint32
+	switch offset {
+	case virtioMagic:
+		v = virtioMagicValue
+	case virtioVersion:
+		v = 2
+	case virtioDeviceID:
+		v = t.dev.ID()
+	case virtioVendorID:
+		v = virtioVendor
+	case virtioDeviceFeatures:
+		if t.deviceFeatSel < 2 {
+			v = uint32((t.dev.Features() | virtioFVersion1) >> (32 * t.deviceFeatSel))
+		}
+	case virtioQueueNumMax:
+		if q != nil {
+			v = virtioQueueMax
+		}
+	case virtioQueueReady:
+		if q != nil && q.ready {
+			v = 1
+		}
+	case virtioInterruptStatus:
+		v = t.intStatus
+	case virtioStatus:
+		v = t.status
+	case virtioConfigGeneration:
+		v = t.generation
+	}
+	return uint64(v), nil
+}
+
+// Store implements the Device interface.
+func (t *VirtioMMIO) Store(offset uint64, size int, v uint64) error {
+	if offset >= virtioConfig {
+		// The configuration space is read-only for the devices we
+		// emulate.
+		return nil
+	}
+	if size != 4 || offset%4 != 0 {
+		return fmt.Errorf("virtio-mmio: unsupported %d-byte store at offset %#x", size, offset)
+	}
+	t.mu.Lock()
+	q := t.selected()
+	w := uint32(v)
+	switch offset {
+	case virtioDeviceFeaturesSel:
+		t.deviceFeatSel = w
+	case virtioDriverFeatures:
+		if t.driverFeatSel < 2 {
+			sh := 32 * t.driverFeatSel
+			t.driverFeatures = t.driverFeatures&^(0xffffffff<<sh) | uint64(w)<<sh
+		}
+	case virtioDriverFeaturesSel:
+		t.driverFeatSel = w
+	case virtioQueueSel:
+		t.queueSel = w
+	case virtioQueueNum:
+		if q != nil && w <= virtioQueueMax {
+			q.size = w
+		}
+	case virtioQueueReady:
+		if q != nil {
+			q.ready = w&1 != 0
+		}
+	case virtioQueueNotify:
+		t.mu.Unlock()
+		if int(w) >= len(t.queues) {
+			return nil
+		}
+		if err := t.dev.Notify(t.queues[w]); err != nil {
+			// The driver passed invalid buffers; it has to reset
+			// the device.
+			t.NeedsReset()
+		}
+		return nil
+	case virtioInterruptACK:
+		t.intStatus &^= w
+		t.updateIRQ()
+	case virtioStatus:
+		if w == 0 {
+			t.reset()
+			t.mu.Unlock()
+			t.dev.Reset()
+			return nil
+		}
+		t.status = w
+	case virtioQueueDescLow, virtioQueueDescHigh:
+		if q != nil {
+			q.desc = setHalf(q.desc, offset == virtioQueueDescHigh, w)
+		}
+	case virtioQueueDriverLow, virtioQueueDriverHigh:
+		if q != nil {
+			q.avail = setHalf(q.avail, offset == virtioQueueDriverHigh, w)
+		}
+	case virtioQueueDeviceLow, virtioQueueDeviceHigh:
+		if q != nil {
+			q.used = setHalf(q.used, offset == virtioQueueDeviceHigh, w)
+		}
+	}
+	t.mu.Unlock()
+	return nil
+}
+
+// selected returns the queue selected with QueueSel or nil if there's no such
+// queue.
+func (t *VirtioMMIO) selected() *Virtqueue {
+	if int(t.queueSel) >= len(t.queues) {
+		return nil
+	}
+	return t.queues[t.queueSel]
+}
+
+func (t *VirtioMMIO) loadConfig(offset uint64, size int) (uint64, error) {
+	cfg := t.dev.Config()
+	var v uint64
+	for i := 0; i < size; i++ {
+		if off := offset + uint64(i); off < uint64(len(cfg)) {
+			v |= uint64(cfg[off]) << (8 * uint(i))
+		}
+	}
+	return v, nil
+}
+
+// setHalf sets the low (high == false) or high 32 bits of v to w.
+func setHalf(v uint64, high bool, w uint32) uint64 {
+	if high {
+		return v&0xffffffff | uint64(w)<<32
+	}
+	return v&^0xffffffff | uint64(w)
+}
+
+// Virtqueue is a split virtqueue.
+//
+// virtio-v1.1; Chapter 2.6
+type Virtqueue struct {
+	t     *VirtioMMIO
+	Index int // index of the queue within the device
+
+	size              uint32
+	ready             bool
+	desc, avail, used uint64 // guest physical addresses of the rings
+	lastAvail         uint16 // next index of the available ring to process
+	usedIdx           uint16
+}
+
+// VirtqChain is a chain of descriptors made available by the driver. Device
+// readable buffers precede device writable buffers.
+type VirtqChain struct {
+	q    *Virtqueue
+	head uint16
+	bufs []virtqBuf
+}
+
+type virtqBuf struct {
+	addr  uint64
+	len   uint32
+	write bool
+}
+
+// Pop returns the next chain made available by the driver. ok is false if
+// there's none, the queue isn't ready or the device needs a reset. Malformed
+// chains (invalid indices, loops, buffers outside memory) are errors.
+func (q *Virtqueue) Pop() (c *VirtqChain, ok bool, err error) {
+	q.t.mu.Lock()
+	defer q.t.mu.Unlock()
+	if !q.ready || q.size == 0 || q.t.status&(virtioStatusDriverOK|virtioStatusNeedsReset) != virtioStatusDriverOK {
+		return nil, false, nil
+	}
+	vm := q.t.vm
+	idx, err := q.load16(q.avail + 2)
+	if err != nil {
+		return nil, false, err
+	}
+	if idx == q.lastAvail {
+		return nil, false, nil
+	}
+	head, err := q.load16(q.avail + virtqRingHeaderSize + 2*uint64(uint32(q.lastAvail)%q.size))
+	if err != nil {
+		return nil, false, err
+	}
+	q.lastAvail++
+	c = &VirtqChain{q: q, head: uint16(head)}
+	var d [virtqDescSize]byte
+	total, mem := uint64(0), vm.memSize()
+	for i, n := uint64(head), 0; ; n++ {
+		if i >= uint64(q.size) || n >= int(q.size) {
+			return nil, false, fmt.Errorf("queue %d: invalid descriptor chain at head %d", q.Index, head)
+		}
+		if err := vm.readBytes(q.desc+i*virtqDescSize, d[:]); err != nil {
+			return nil, false, err
+		}
+		flags := binary.LittleEndian.Uint16(d[12:])
+		b := virtqBuf{
+			addr:  binary.LittleEndian.Uint64(d[0:]),
+			len:   binary.LittleEndian.Uint32(d[8:]),
+			write: flags&virtqDescFWrite != 0,
+		}
+		total += uint64(b.len)
+		if _, err := vm.memSlice(b.addr, uint64(b.len)); err != nil || total > mem {
+			return nil, false, fmt.Errorf("queue %d: buffer outside memory in chain at head %d", q.Index, head)
+		}
+		if !b.write && len(c.bufs) > 0 && c.bufs[len(c.bufs)-1].write {
+			return nil, false, fmt.Errorf("queue %d: readable descriptor after writable in chain at head %d", q.Index, head)
+		}
+		c.bufs = append(c.bufs, b)
+		if flags&virtqDescFNext == 0 {
+			break
+		}
+		i = uint64(binary.LittleEndian.Uint16(d[14:]))
+	}
+	return c, true, nil
+}
+
+// Push returns the chain to the driver, reporting that n bytes were written
+// to its writable buffers, and interrupts the driver unless it asked not to.
+func (q *Virtqueue) Push(c *VirtqChain, n int) error {
+	q.t.mu.Lock()
+	defer q.t.mu.Unlock()
+	if !q.ready || q.size == 0 {
+		// The device was reset in the meantime.
+		return nil
+	}
+	vm := q.t.vm
+	var e [virtqUsedElemSize]byte
+	binary.LittleEndian.PutUint32(e[0:], uint32(c.head))
+	binary.LittleEndian.PutUint32(e[4:], uint32(n))
+	if err := vm.writeBytes(q.used+virtqRingHeaderSize+virtqUsedElemSize*uint64(uint32(q.usedIdx)%q.size), e[:]); err != nil {
+		return err
+	}
+	q.usedIdx++
+	if err := q.store16(q.used+2, q.usedIdx); err != nil {
+		return err
+	}
+	flags, err := q.load16(q.avail)
+	if err != nil {
+		return err
+	}
+	if flags&virtqAvailFNoInterrupt == 0 {
+		q.t.interrupt(virtioInterruptUsed)
+	}
+	return nil
+}
+
+// load16 and store16 access 16-bit fields of the rings, which must be in
+// memory.
+func (q *Virtqueue) load16(addr uint64) (uint16, error) {
+	var b [2]byte
+	err := q.t.vm.readBytes(addr, b[:])
+	return binary.LittleEndian.Uint16(b[:]), err
+}
+
+func (q *Virtqueue) store16(addr uint64, v uint16) error {
+	var b [2]byte
+	binary.LittleEndian.PutUint16(b[:], v)
+	return q.t.vm.writeBytes(addr, b[:])
+}
+
+// ReadLen returns the total size of the device readable buffers.
+func (c *VirtqChain) ReadLen() int {
+	n := 0
+	for _, b := range c.bufs {
+		if !b.write {
+			n += int(b.len)
+		}
+	}
+	return n
+}
+
+// WriteLen returns the total size of the device writable buffers.
+func (c *VirtqChain) WriteLen() int {
+	n := 0
+	for _, b := range c.bufs {
+		if b.write {
+			n += int(b.len)
+		}
+	}
+	return n
+}
+
+// Read returns the contents of the device readable buffers.
+func (c *VirtqChain) Read() ([]byte, error) {
+	out := make([]byte, 0, c.ReadLen())
+	for _, b := range c.bufs {
+		if b.write {
+			break
+		}
+		buf := make([]byte, b.len)
+		if err := c.q.t.vm.readBytes(b.addr, buf); err != nil {
+			return nil, err
+		}
+		out = append(out, buf...)
+	}
+	return out, nil
+}
+
+// Write copies p to the device writable buffers. It returns the number of
+// bytes copied, which is less than len(p) if the buffers are too small.
+func (c *VirtqChain) Write(p []byte) (int, error) {
+	n := 0
+	for _, b := range c.bufs {
+		if !b.write || n == len(p) {
+			continue
+		}
+		m := int(b.len)
+		if m > len(p)-n {
+			m = len(p) - n
+		}
+		if err := c.q.t.vm.writeBytes(b.addr, p[n:n+m]); err != nil {
+			return n, err
+		}
+		n += m
+	}
+	return n, nil
+}
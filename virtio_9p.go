@@ -0,0 +1,85 @@
+// Copyright 2019 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"encoding/binary"
+	"fmt"
+)
+
+// virtio-9p feature bits. The device isn't described in the virtio
+// specification; see QEMU's hw/9pfs/virtio-9p-device.c.
+const (
+	virtio9PMountTag = 1 << 0
+)
+
+// Virtio9P shares a host directory with the guest using 9P2000.L. Linux mounts
+// it with:
+//
+//	mount -t 9p -o trans=virtio,version=9p2000.L TAG /mnt
+//
+// It implements the VirtioDevice interface.
+type Virtio9P struct {
+	srv    *P9Server
+	config []byte
+}
+
+// NewVirtio9P returns a device serving srv under the mount tag.
+func NewVirtio9P(tag string, srv *P9Server) *Virtio9P {
+	config := make([]byte, 2, 2+len(tag))
+	binary.LittleEndian.PutUint16(config, uint16(len(tag)))
+	return &Virtio9P{srv: srv, config: append(config, tag...)}
+}
+
+// ID implements the VirtioDevice interface.
+func (v *Virtio9P) ID() uint32 { return virtio9P }
+
+// Features implements the VirtioDevice interface.
+func (v *Virtio9P) Features() uint64 { return virtio9PMountTag }
+
+// NumQueues implements the VirtioDevice interface.
+func (v *Virtio9P) NumQueues() int { return 1 }
+
+// Config implements the VirtioDevice interface.
+func (v *Virtio9P) Config() []byte { return v.config }
+
+// Reset implements the VirtioDevice interface.
+func (v *Virtio9P) Reset() {}
+
+// Notify implements the VirtioDevice interface. Requests are processed
+// synchronously.
+func (v *Virtio9P) Notify(q *Virtqueue) error {
+	for {
+		c, ok, err := q.Pop()
+		if err != nil || !ok {
+			return err
+		}
+		req, err := c.Read()
+		if err != nil {
+			return err
+		}
+		resp := v.srv.Handle(req)
+		if len(resp) > c.WriteLen() {
+			return fmt.Errorf("virtio-9p: %d-byte response doesn't fit into %d bytes", len(resp), c.WriteLen())
+		}
+		n, err := c.Write(resp)
+		if err != nil {
+			return err
+		}
+		if err := q.Push(c, n); err != nil {
+			return err
+		}
+	}
+}
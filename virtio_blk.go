@@ -0,0 +1,224 @@
+// Copyright 2019 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+	"os"
+)
+
+// virtio-blk feature bits.
+//
+// virtio-v1.1; Chapter 5.2.3
+const (
+	virtioBlkFSegMax  = 1 << 2
+	virtioBlkFRO      = 1 << 5
+	virtioBlkFFlush   = 1 << 9
+	virtioBlkFDiscard = 1 << 13
+)
+
+// virtio-blk request types and statuses.
+//
+// virtio-v1.1; Chapter 5.2.6
+const (
+	virtioBlkTIn      = 0
+	virtioBlkTOut     = 1
+	virtioBlkTFlush   = 4
+	virtioBlkTGetID   = 8
+	virtioBlkTDiscard = 11
+
+	virtioBlkSOK     = 0
+	virtioBlkSIOErr  = 1
+	virtioBlkSUnsupp = 2
+
+	virtioBlkSectorSize  = 512
+	virtioBlkHeaderSize  = 16 // type, reserved, sector
+	virtioBlkDiscardSize = 16 // sector, num_sectors, flags
+	virtioBlkIDSize      = 20
+	virtioBlkSegMax      = virtioQueueMax - 2 // minus header and status
+	virtioBlkMaxDiscard  = 1 << 22            // sectors per discard segment
+)
+
+// BlockImage is the storage backing a virtio-blk device. *os.File implements
+// it.
+type BlockImage interface {
+	io.ReaderAt
+	io.WriterAt
+	Sync() error
+}
+
+// VirtioBlk is a virtio block device. It implements the VirtioDevice
+// interface.
+type VirtioBlk struct {
+	img      BlockImage
+	size     int64 // in bytes
+	readOnly bool
+	id       string
+	config   []byte
+}
+
+// NewVirtioBlk returns a block device backed by the first size bytes of img.
+// The capacity is rounded down to whole sectors. Writes and discards fail
+// when readOnly is set.
+func NewVirtioBlk(img BlockImage, size int64, readOnly bool, id string) *VirtioBlk {
+	b := &VirtioBlk{img: img, size: size &^ (virtioBlkSectorSize - 1), readOnly: readOnly, id: id}
+	// virtio-v1.1; Chapter 5.2.4
+	b.config = make([]byte, 56)
+	binary.LittleEndian.PutUint64(b.config[0:], uint64(b.size/virtioBlkSectorSize)) // capacity
+	binary.LittleEndian.PutUint32(b.config[12:], virtioBlkSegMax)                   // seg_max
+	binary.LittleEndian.PutUint32(b.config[36:], virtioBlkMaxDiscard)               // max_discard_sectors
+	binary.LittleEndian.PutUint32(b.config[40:], 1)                                 // max_discard_seg
+	binary.LittleEndian.PutUint32(b.config[44:], 1)                                 // discard_sector_alignment
+	return b
+}
+
+// OpenVirtioBlk returns a block device backed by the image file at path.
+func OpenVirtioBlk(path string, readOnly bool) (*VirtioBlk, error) {
+	flag := os.O_RDWR
+	if readOnly {
+		flag = os.O_RDONLY
+	}
+	f, err := os.OpenFile(path, flag, 0)
+	if err != nil {
+		return nil, err
+	}
+	fi, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+	return NewVirtioBlk(f, fi.Size(), readOnly, path), nil
+}
+
+// ID implements the VirtioDevice interface.
+func (b *VirtioBlk) ID() uint32 { return virtioBlock }
+
+// Features implements the VirtioDevice interface.
+func (b *VirtioBlk) Features() uint64 {
+	f := uint64(virtioBlkFSegMax | virtioBlkFFlush | virtioBlkFDiscard)
+	if b.readOnly {
+		f |= virtioBlkFRO
+	}
+	return f
+}
+
+// NumQueues implements the VirtioDevice interface.
+func (b *VirtioBlk) NumQueues() int { return 1 }
+
+// Config implements the VirtioDevice interface.
+func (b *VirtioBlk) Config() []byte { return b.config }
+
+// Reset implements the VirtioDevice interface.
+func (b *VirtioBlk) Reset() {}
+
+// Notify implements the VirtioDevice interface. Requests are processed
+// synchronously.
+func (b *VirtioBlk) Notify(q *Virtqueue) error {
+	for {
+		c, ok, err := q.Pop()
+		if err != nil || !ok {
+			return err
+		}
+		n, err := b.handle(c)
+		if err != nil {
+			return err
+		}
+		if err := q.Push(c, n); err != nil {
+			return err
+		}
+	}
+}
+
+// handle processes a single request and returns the number of bytes written to
+// the driver's buffers. The returned error is non-nil only if the request is
+// malformed; I/O errors are reported to the driver.
+func (b *VirtioBlk) handle(c *VirtqChain) (int, error) {
+	in, err := c.Read()
+	if err != nil {
+		return 0, err
+	}
+	if len(in) < virtioBlkHeaderSize || c.WriteLen() < 1 {
+		return 0, fmt.Errorf("virtio-blk: malformed request (%d bytes in, %d bytes out)", len(in), c.WriteLen())
+	}
+	typ := binary.LittleEndian.Uint32(in[0:])
+	off := int64(binary.LittleEndian.Uint64(in[8:])) * virtioBlkSectorSize
+	data := in[virtioBlkHeaderSize:]
+	var out []byte // data for the driver
+	status := byte(virtioBlkSOK)
+	switch typ {
+	case virtioBlkTIn:
+		out = make([]byte, c.WriteLen()-1)
+		if !b.inRange(off, len(out)) {
+			status = virtioBlkSIOErr
+		} else if _, err := b.img.ReadAt(out, off); err != nil {
+			status = virtioBlkSIOErr
+		}
+	case virtioBlkTOut:
+		if b.readOnly || !b.inRange(off, len(data)) {
+			status = virtioBlkSIOErr
+		} else if _, err := b.img.WriteAt(data, off); err != nil {
+			status = virtioBlkSIOErr
+		}
+	case virtioBlkTFlush:
+		if !b.readOnly && b.img.Sync() != nil {
+			status = virtioBlkSIOErr
+		}
+	case virtioBlkTGetID:
+		out = make([]byte, virtioBlkIDSize)
+		copy(out, b.id)
+	case virtioBlkTDiscard:
+		status = b.discard(data)
+	default:
+		status = virtioBlkSUnsupp
+	}
+	// The status is the last byte of the writable buffers.
+	resp := make([]byte, c.WriteLen())
+	copy(resp, out)
+	resp[len(resp)-1] = status
+	return c.Write(resp)
+}
+
+// inRange reports whether n bytes at off are within the device.
+func (b *VirtioBlk) inRange(off int64, n int) bool {
+	return off >= 0 && off+int64(n) <= b.size && off+int64(n) >= off
+}
+
+// discard handles a discard request with the given segments. Discarded sectors
+// are zeroed.
+func (b *VirtioBlk) discard(segs []byte) byte {
+	if b.readOnly {
+		return virtioBlkSIOErr
+	}
+	for ; len(segs) >= virtioBlkDiscardSize; segs = segs[virtioBlkDiscardSize:] {
+		off := int64(binary.LittleEndian.Uint64(segs[0:])) * virtioBlkSectorSize
+		n := int64(binary.LittleEndian.Uint32(segs[8:])) * virtioBlkSectorSize
+		if n > virtioBlkMaxDiscard*virtioBlkSectorSize || !b.inRange(off, int(n)) {
+			return virtioBlkSIOErr
+		}
+		zero := make([]byte, 64<<10)
+		for ; n > 0; n -= int64(len(zero)) {
+			if n < int64(len(zero)) {
+				zero = zero[:n]
+			}
+			if _, err := b.img.WriteAt(zero, off); err != nil {
+				return virtioBlkSIOErr
+			}
+			off += int64(len(zero))
+		}
+	}
+	return virtioBlkSOK
+}
@@ -0,0 +1,326 @@
+// Copyright 2019 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+	"sync"
+)
+
+// virtio-console feature bits.
+//
+// virtio-v1.1; Chapter 5.3.3
+const (
+	virtioConsoleFMultiport = 1 << 1
+)
+
+// Control queue events.
+//
+// virtio-v1.1; Chapter 5.3.6.2
+const (
+	virtioConsoleDeviceReady = 0
+	virtioConsoleDeviceAdd   = 1
+	virtioConsolePortReady   = 3
+	virtioConsoleConsolePort = 4
+	virtioConsolePortOpen    = 6
+	virtioConsolePortName    = 7
+
+	virtioConsoleCtrlSize = 8 // id, event, value
+
+	// virtioConsoleInputMax is the number of bytes of input per port
+	// buffered while the guest doesn't provide receive buffers.
+	virtioConsoleInputMax = 4096
+)
+
+// Queue indices of the control queues. Port 0 uses queues 0 and 1; port i > 0
+// uses queues 2*(i+1) and 2*(i+1)+1.
+const (
+	virtioConsoleCtrlRx = 2
+	virtioConsoleCtrlTx = 3
+)
+
+// ConsolePort is a port of a virtio console: a bidirectional channel between
+// the guest and the host.
+type ConsolePort struct {
+	// Name identifies the port in the guest (/sys/class/virtio-ports/*/name).
+	// It's optional.
+	Name string
+	// In provides data sent to the guest. It may be nil.
+	In io.Reader
+	// Out receives data sent by the guest. It may be nil, in which case
+	// the data is discarded.
+	Out io.Writer
+}
+
+// VirtioConsole is a virtio console with the multiport feature. Port 0 is the
+// console (hvc0 on Linux); the other ports appear as /dev/vportNpM. It
+// implements the VirtioDevice interface.
+type VirtioConsole struct {
+	mu     sync.Mutex
+	space  *sync.Cond // signaled when input is copied to the guest
+	t      *VirtioMMIO
+	ports  []*ConsolePort
+	open   []bool   // per port; whether the guest opened the port
+	in     [][]byte // per port; input waiting for receive buffers
+	ctrl   [][]byte // control messages waiting for buffers from the driver
+	config []byte
+}
+
+// NewVirtioConsole returns a console with the given ports. There must be at
+// least one port.
+func NewVirtioConsole(ports ...*ConsolePort) *VirtioConsole {
+	if len(ports) == 0 {
+		panic("virtio console needs at least one port")
+	}
+	c := &VirtioConsole{ports: ports, open: make([]bool, len(ports)), in: make([][]byte, len(ports))}
+	c.space = sync.NewCond(&c.mu)
+	// virtio-v1.1; Chapter 5.3.4
+	c.config = make([]byte, 12)
+	binary.LittleEndian.PutUint32(c.config[4:], uint32(len(ports))) // max_nr_ports
+	return c
+}
+
+// ID implements the VirtioDevice interface.
+func (c *VirtioConsole) ID() uint32 { return virtioConsole }
+
+// Features implements the VirtioDevice interface.
+func (c *VirtioConsole) Features() uint64 { return virtioConsoleFMultiport }
+
+// NumQueues implements the VirtioDevice interface.
+func (c *VirtioConsole) NumQueues() int { return 2 * (len(c.ports) + 1) }
+
+// Config implements the VirtioDevice interface.
+func (c *VirtioConsole) Config() []byte { return c.config }
+
+// Reset implements the VirtioDevice interface.
+func (c *VirtioConsole) Reset() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.ctrl = nil
+	for i := range c.open {
+		c.open[i] = false
+	}
+}
+
+// Attach implements the virtioAttacher interface. It starts goroutines that
+// read input of the ports.
+func (c *VirtioConsole) Attach(t *VirtioMMIO) {
+	c.t = t
+	for i, p := range c.ports {
+		if p.In != nil {
+			go c.input(i, p.In)
+		}
+	}
+}
+
+// rxQueue returns the index of the receive queue of the port. The transmit
+// queue follows it.
+func rxQueue(port int) int {
+	if port == 0 {
+		return 0
+	}
+	return 2 * (port + 1)
+}
+
+// Notify implements the VirtioDevice interface.
+func (c *VirtioConsole) Notify(q *Virtqueue) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	switch {
+	case q.Index == virtioConsoleCtrlRx:
+		return c.flushControl()
+	case q.Index == virtioConsoleCtrlTx:
+		return c.control(q)
+	case q.Index%2 == 0:
+		return c.fill()
+	}
+	port := q.Index/2 - 1
+	if q.Index == 1 {
+		port = 0
+	}
+	return c.transmit(q, port)
+}
+
+// transmit forwards data sent by the guest to the port.
+func (c *VirtioConsole) transmit(q *Virtqueue, port int) error {
+	p := c.ports[port]
+	for {
+		ch, ok, err := q.Pop()
+		if err != nil || !ok {
+			return err
+		}
+		b, err := ch.Read()
+		if err != nil {
+			return err
+		}
+		if p.Out != nil {
+			if _, err := p.Out.Write(b); err != nil {
+				return fmt.Errorf("virtio-console: can't write output of port %d: %v", port, err)
+			}
+		}
+		if err := q.Push(ch, 0); err != nil {
+			return err
+		}
+	}
+}
+
+// control handles control messages sent by the driver.
+func (c *VirtioConsole) control(q *Virtqueue) error {
+	for {
+		ch, ok, err := q.Pop()
+		if err != nil {
+			return err
+		}
+		if !ok {
+			if err := c.flushControl(); err != nil {
+				return err
+			}
+			// Ports may have been opened.
+			return c.fill()
+		}
+		m, err := ch.Read()
+		if err != nil {
+			return err
+		}
+		if err := q.Push(ch, 0); err != nil {
+			return err
+		}
+		if len(m) < virtioConsoleCtrlSize {
+			continue
+		}
+		id := binary.LittleEndian.Uint32(m)
+		event := binary.LittleEndian.Uint16(m[4:])
+		value := binary.LittleEndian.Uint16(m[6:])
+		switch event {
+		case virtioConsoleDeviceReady:
+			if value != 1 {
+				break
+			}
+			for i := range c.ports {
+				c.send(uint32(i), virtioConsoleDeviceAdd, 0, "")
+			}
+		case virtioConsolePortReady:
+			if value != 1 || int(id) >= len(c.ports) {
+				break
+			}
+			if id == 0 {
+				c.send(id, virtioConsoleConsolePort, 1, "")
+			}
+			if name := c.ports[id].Name; name != "" {
+				c.send(id, virtioConsolePortName, 1, name)
+			}
+			// The host side of every port is always connected.
+			c.send(id, virtioConsolePortOpen, 1, "")
+		case virtioConsolePortOpen:
+			if int(id) < len(c.ports) {
+				c.open[id] = value == 1
+			}
+		}
+	}
+}
+
+// send queues a control message for the driver. Messages are delivered by
+// flushControl.
+func (c *VirtioConsole) send(id uint32, event, value uint16, name string) {
+	m := make([]byte, virtioConsoleCtrlSize, virtioConsoleCtrlSize+len(name))
+	binary.LittleEndian.PutUint32(m, id)
+	binary.LittleEndian.PutUint16(m[4:], event)
+	binary.LittleEndian.PutUint16(m[6:], value)
+	c.ctrl = append(c.ctrl, append(m, name...))
+}
+
+// flushControl delivers queued control messages while the driver provides
+// buffers for them.
+func (c *VirtioConsole) flushControl() error {
+	q := c.t.Queue(virtioConsoleCtrlRx)
+	for len(c.ctrl) > 0 {
+		ch, ok, err := q.Pop()
+		if err != nil || !ok {
+			return err
+		}
+		n, err := ch.Write(c.ctrl[0])
+		if err != nil {
+			return err
+		}
+		if err := q.Push(ch, n); err != nil {
+			return err
+		}
+		c.ctrl = c.ctrl[1:]
+	}
+	return nil
+}
+
+// input reads data from r and queues it for the guest. The data is copied to
+// the receive queue of the port on a hart (see fill), once the guest opens the
+// port and provides buffers.
+func (c *VirtioConsole) input(port int, r io.Reader) {
+	buf := make([]byte, 4096)
+	for {
+		n, err := r.Read(buf)
+		if n > 0 {
+			c.mu.Lock()
+			for len(c.in[port]) >= virtioConsoleInputMax {
+				c.space.Wait()
+			}
+			c.in[port] = append(c.in[port], buf[:n]...)
+			c.mu.Unlock()
+			c.t.Defer(c.deliver)
+		}
+		if err != nil {
+			return
+		}
+	}
+}
+
+// deliver copies queued input to the receive buffers of the ports.
+func (c *VirtioConsole) deliver() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.fill()
+}
+
+// fill copies queued input to the receive buffers of the open ports. It must
+// be called with mu held.
+func (c *VirtioConsole) fill() error {
+	for port := range c.ports {
+		if port != 0 && !c.open[port] {
+			continue
+		}
+		q := c.t.Queue(rxQueue(port))
+		for len(c.in[port]) > 0 {
+			ch, ok, err := q.Pop()
+			if err != nil {
+				return err
+			}
+			if !ok {
+				break
+			}
+			n, err := ch.Write(c.in[port])
+			if err != nil {
+				return err
+			}
+			if err := q.Push(ch, n); err != nil {
+				return err
+			}
+			if c.in[port] = c.in[port][n:]; len(c.in[port]) == 0 {
+				c.in[port] = nil
+			}
+			c.space.Broadcast()
+		}
+	}
+	return nil
+}
@@ -0,0 +1,133 @@
+// Copyright 2019 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func ctrlMsg(id uint32, event, value uint16) *testBuf {
+	m := make([]byte, virtioConsoleCtrlSize)
+	binary.LittleEndian.PutUint32(m, id)
+	binary.LittleEndian.PutUint16(m[4:], event)
+	binary.LittleEndian.PutUint16(m[6:], value)
+	return &testBuf{data: m}
+}
+
+func TestVirtioConsole(t *testing.T) {
+	var out0, out1 bytes.Buffer
+	pr, pw := io.Pipe()
+	d := newVirtioDriver(t, NewVirtioConsole(
+		&ConsolePort{Out: &out0},
+		&ConsolePort{Name: "log", In: pr, Out: &out1},
+	))
+	if d.features&virtioConsoleFMultiport == 0 {
+		t.Fatalf("features = %#x; want VIRTIO_CONSOLE_F_MULTIPORT", d.features)
+	}
+	if got := d.config(4, 4); got != 2 {
+		t.Errorf("max_nr_ports = %d; want 2", got)
+	}
+
+	var ctrl []*testBuf
+	for i := 0; i < 4; i++ {
+		b := &testBuf{write: true, n: 16}
+		d.submit(virtioConsoleCtrlRx, b)
+		ctrl = append(ctrl, b)
+	}
+	// recv returns the next control message sent by the device.
+	recv := func() (id uint32, event, value uint16, name string) {
+		t.Helper()
+		b := ctrl[0]
+		ctrl = ctrl[1:]
+		_, n, ok := d.pop(virtioConsoleCtrlRx)
+		if !ok {
+			t.Fatalf("no control message")
+		}
+		m := d.bytes(b)[:n]
+		d.submit(virtioConsoleCtrlRx, b) // reuse the buffer
+		ctrl = append(ctrl, b)
+		return binary.LittleEndian.Uint32(m), binary.LittleEndian.Uint16(m[4:]), binary.LittleEndian.Uint16(m[6:]), string(m[virtioConsoleCtrlSize:])
+	}
+
+	d.submit(virtioConsoleCtrlTx, ctrlMsg(0, virtioConsoleDeviceReady, 1))
+	for port := uint32(0); port < 2; port++ {
+		if id, event, _, _ := recv(); id != port || event != virtioConsoleDeviceAdd {
+			t.Errorf("got event %d for port %d; want DEVICE_ADD for port %d", event, id, port)
+		}
+	}
+
+	d.submit(virtioConsoleCtrlTx, ctrlMsg(0, virtioConsolePortReady, 1))
+	if id, event, value, _ := recv(); id != 0 || event != virtioConsoleConsolePort || value != 1 {
+		t.Errorf("got event %d (value %d) for port %d; want CONSOLE_PORT for port 0", event, value, id)
+	}
+	if id, event, value, _ := recv(); id != 0 || event != virtioConsolePortOpen || value != 1 {
+		t.Errorf("got event %d (value %d) for port %d; want PORT_OPEN for port 0", event, value, id)
+	}
+	d.submit(virtioConsoleCtrlTx, ctrlMsg(1, virtioConsolePortReady, 1))
+	if id, event, _, name := recv(); id != 1 || event != virtioConsolePortName || name != "log" {
+		t.Errorf("got event %d (name %q) for port %d; want PORT_NAME \"log\" for port 1", event, name, id)
+	}
+	if id, event, value, _ := recv(); id != 1 || event != virtioConsolePortOpen || value != 1 {
+		t.Errorf("got event %d (value %d) for port %d; want PORT_OPEN for port 1", event, value, id)
+	}
+
+	// Output.
+	head := d.submit(1, &testBuf{data: []byte("console\n")})
+	d.mustPop(1, head)
+	head = d.submit(rxQueue(1)+1, &testBuf{data: []byte("log line\n")})
+	d.mustPop(rxQueue(1)+1, head)
+	if got := out0.String(); got != "console\n" {
+		t.Errorf("port 0 output = %q; want %q", got, "console\n")
+	}
+	if got := out1.String(); got != "log line\n" {
+		t.Errorf("port 1 output = %q; want %q", got, "log line\n")
+	}
+
+	// Input is delivered once the guest opens the port.
+	rx := &testBuf{write: true, n: 64}
+	head = d.add(rxQueue(1), rx)
+	go pw.Write([]byte("ping"))
+	d.submit(virtioConsoleCtrlTx, ctrlMsg(1, virtioConsolePortOpen, 1))
+	d.wait(rxQueue(1))
+	if n := d.mustPop(rxQueue(1), head); string(d.bytes(rx)[:n]) != "ping" {
+		t.Errorf("input = %q; want %q", d.bytes(rx)[:n], "ping")
+	}
+}
+
+func TestVirtioConsoleQueuedInput(t *testing.T) {
+	// Input arriving before the driver provides receive buffers is queued
+	// and copied to the first buffer the driver adds.
+	d := newVirtioDriver(t, NewVirtioConsole(&ConsolePort{In: strings.NewReader("early")}))
+	for deadline := time.Now().Add(10 * time.Second); atomic.LoadInt32(&d.vm.Bus.pending) == 0; time.Sleep(time.Millisecond) {
+		if time.Now().After(deadline) {
+			t.Fatalf("no input after 10s")
+		}
+	}
+	d.vm.runDeferred()
+	if _, _, ok := d.pop(0); ok {
+		t.Fatalf("input delivered without receive buffers")
+	}
+	rx := &testBuf{write: true, n: 64}
+	head := d.submit(0, rx)
+	if n := d.mustPop(0, head); string(d.bytes(rx)[:n]) != "early" {
+		t.Errorf("input = %q; want %q", d.bytes(rx)[:n], "early")
+	}
+}
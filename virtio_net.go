@@ -0,0 +1,303 @@
+// Copyright 2019 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"sync"
+)
+
+// virtio-net feature bits.
+//
+// virtio-v1.1; Chapter 5.1.3
+const (
+	virtioNetFMAC    = 1 << 5
+	virtioNetFStatus = 1 << 16
+
+	virtioNetSLinkUp = 1
+
+	virtioNetHeaderSize = 12 // struct virtio_net_hdr with VIRTIO_F_VERSION_1
+	virtioNetRx         = 0  // receive queue index
+	virtioNetTx         = 1  // transmit queue index
+
+	// virtioNetRxMax is the number of received frames buffered while the
+	// guest doesn't provide receive buffers.
+	virtioNetRxMax = 64
+)
+
+// NetBackend carries Ethernet frames between a virtio-net device and its
+// peer.
+type NetBackend interface {
+	// Send transmits a frame sent by the guest. Frames that can't be
+	// delivered, e.g. because the peer isn't there, may be dropped
+	// silently. Errors are fatal for the device.
+	Send(frame []byte) error
+	// Receive blocks until a frame for the guest arrives. It returns
+	// io.EOF when no more frames will arrive.
+	Receive() ([]byte, error)
+}
+
+// VirtioNet is a virtio network card. It implements the VirtioDevice
+// interface.
+type VirtioNet struct {
+	mu      sync.Mutex
+	space   *sync.Cond // signaled when received frames are copied to the guest
+	frames  [][]byte   // received frames waiting for receive buffers
+	t       *VirtioMMIO
+	backend NetBackend
+	capture *PcapWriter // may be nil
+	config  []byte
+}
+
+// NewVirtioNet returns a network card with the given MAC address connected
+// to the backend. If capture isn't nil, all frames are written to it.
+func NewVirtioNet(mac net.HardwareAddr, backend NetBackend, capture *PcapWriter) *VirtioNet {
+	n := &VirtioNet{backend: backend, capture: capture}
+	n.space = sync.NewCond(&n.mu)
+	// virtio-v1.1; Chapter 5.1.4
+	n.config = make([]byte, 8)
+	copy(n.config, mac)
+	n.config[6] = virtioNetSLinkUp
+	return n
+}
+
+// ID implements the VirtioDevice interface.
+func (n *VirtioNet) ID() uint32 { return virtioNet }
+
+// Features implements the VirtioDevice interface.
+func (n *VirtioNet) Features() uint64 { return virtioNetFMAC | virtioNetFStatus }
+
+// NumQueues implements the VirtioDevice interface.
+func (n *VirtioNet) NumQueues() int { return 2 }
+
+// Config implements the VirtioDevice interface.
+func (n *VirtioNet) Config() []byte { return n.config }
+
+// Reset implements the VirtioDevice interface. It drops the received frames
+// that weren't copied to the guest yet.
+func (n *VirtioNet) Reset() {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	n.frames = nil
+	n.space.Broadcast()
+}
+
+// Attach implements the virtioAttacher interface. It starts the goroutine
+// receiving frames from the backend.
+func (n *VirtioNet) Attach(t *VirtioMMIO) {
+	n.t = t
+	go n.receive()
+}
+
+// Notify implements the VirtioDevice interface.
+func (n *VirtioNet) Notify(q *Virtqueue) error {
+	if q.Index == virtioNetRx {
+		return n.deliver()
+	}
+	for {
+		c, ok, err := q.Pop()
+		if err != nil || !ok {
+			return err
+		}
+		b, err := c.Read()
+		if err != nil {
+			return err
+		}
+		if len(b) < virtioNetHeaderSize {
+			return fmt.Errorf("virtio-net: %d-byte packet is shorter than the header", len(b))
+		}
+		frame := b[virtioNetHeaderSize:]
+		if n.capture != nil {
+			if err := n.capture.WriteFrame(frame); err != nil {
+				return fmt.Errorf("virtio-net: can't capture frame: %v", err)
+			}
+		}
+		if err := n.backend.Send(frame); err != nil {
+			return fmt.Errorf("virtio-net: %v", err)
+		}
+		if err := q.Push(c, 0); err != nil {
+			return err
+		}
+	}
+}
+
+// receive queues frames from the backend for the guest. The frames are copied
+// to receive buffers on a hart (see deliver).
+func (n *VirtioNet) receive() {
+	for {
+		frame, err := n.backend.Receive()
+		if err != nil {
+			return
+		}
+		if n.capture != nil {
+			// Capture errors are reported when the guest transmits.
+			n.capture.WriteFrame(frame)
+		}
+		n.mu.Lock()
+		for len(n.frames) >= virtioNetRxMax {
+			n.space.Wait()
+		}
+		n.frames = append(n.frames, frame)
+		n.mu.Unlock()
+		n.t.Defer(n.deliver)
+	}
+}
+
+// deliver copies received frames to the receive buffers provided by the
+// driver. Frames that don't fit into the receive buffer are dropped.
+func (n *VirtioNet) deliver() error {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	q := n.t.Queue(virtioNetRx)
+	for len(n.frames) > 0 {
+		c, ok, err := q.Pop()
+		if err != nil || !ok {
+			return err
+		}
+		frame := n.frames[0]
+		m := 0
+		if c.WriteLen() >= virtioNetHeaderSize+len(frame) {
+			b := make([]byte, virtioNetHeaderSize, virtioNetHeaderSize+len(frame))
+			b[10] = 1 // num_buffers
+			if m, err = c.Write(append(b, frame...)); err != nil {
+				return err
+			}
+		}
+		if err := q.Push(c, m); err != nil {
+			return err
+		}
+		n.frames = n.frames[1:]
+		n.space.Broadcast()
+	}
+	return nil
+}
+
+// errNetClosed is returned by NetPeer.Send after the pair was closed.
+var errNetClosed = errors.New("network peer closed")
+
+// NetPeer is one end of an in-process link between two NetBackend users,
+// e.g. a virtio-net device and a Go test acting as the other host. It
+// implements NetBackend.
+type NetPeer struct {
+	in   <-chan []byte
+	out  chan<- []byte
+	done chan struct{}
+	once *sync.Once
+}
+
+// netPeerQueue is the number of frames buffered in each direction. Further
+// frames are dropped, as by a congested link.
+const netPeerQueue = 64
+
+// NewNetPair returns the two ends of an in-process link.
+func NewNetPair() (*NetPeer, *NetPeer) {
+	a, b := make(chan []byte, netPeerQueue), make(chan []byte, netPeerQueue)
+	done, once := make(chan struct{}), &sync.Once{}
+	return &NetPeer{in: a, out: b, done: done, once: once}, &NetPeer{in: b, out: a, done: done, once: once}
+}
+
+// Send implements the NetBackend interface.
+func (p *NetPeer) Send(frame []byte) error {
+	f := append([]byte(nil), frame...)
+	select {
+	case <-p.done:
+		return errNetClosed
+	case p.out <- f:
+	default: // the queue is full
+	}
+	return nil
+}
+
+// Receive implements the NetBackend interface.
+func (p *NetPeer) Receive() ([]byte, error) {
+	select {
+	case f := <-p.in:
+		return f, nil
+	case <-p.done:
+		return nil, io.EOF
+	}
+}
+
+// Close closes both ends of the link.
+func (p *NetPeer) Close() {
+	p.once.Do(func() { close(p.done) })
+}
+
+// UnixNet is a NetBackend that exchanges frames with another emulator
+// instance over a pair of Unix datagram sockets. Each instance binds its own
+// socket and sends to the socket of the peer.
+type UnixNet struct {
+	conn *net.UnixConn
+	peer *net.UnixAddr
+}
+
+// NewUnixNet binds the socket at local and sends frames to the socket at
+// peer. The peer may start later; frames sent before it does are dropped.
+func NewUnixNet(local, peer string) (*UnixNet, error) {
+	conn, err := net.ListenUnixgram("unixgram", &net.UnixAddr{Name: local, Net: "unixgram"})
+	if err != nil {
+		return nil, err
+	}
+	return &UnixNet{conn: conn, peer: &net.UnixAddr{Name: peer, Net: "unixgram"}}, nil
+}
+
+// Send implements the NetBackend interface.
+func (u *UnixNet) Send(frame []byte) error {
+	// Errors mean that the peer isn't listening; drop the frame.
+	u.conn.WriteToUnix(frame, u.peer)
+	return nil
+}
+
+// Receive implements the NetBackend interface.
+func (u *UnixNet) Receive() ([]byte, error) {
+	b := make([]byte, pcapSnapLen)
+	n, _, err := u.conn.ReadFromUnix(b)
+	if err != nil {
+		return nil, io.EOF
+	}
+	return b[:n], nil
+}
+
+// Close closes the socket.
+func (u *UnixNet) Close() error {
+	return u.conn.Close()
+}
+
+// PcapReplay is a NetBackend that delivers the frames of a pcap file to the
+// guest, as fast as the guest accepts them. Frames sent by the guest are
+// dropped.
+type PcapReplay struct {
+	r *PcapReader
+}
+
+// NewPcapReplay returns a backend replaying frames from the pcap file r.
+func NewPcapReplay(r io.Reader) (*PcapReplay, error) {
+	p, err := NewPcapReader(r)
+	if err != nil {
+		return nil, err
+	}
+	return &PcapReplay{r: p}, nil
+}
+
+// Send implements the NetBackend interface.
+func (p *PcapReplay) Send(frame []byte) error { return nil }
+
+// Receive implements the NetBackend interface.
+func (p *PcapReplay) Receive() ([]byte, error) {
+	return p.r.ReadFrame()
+}
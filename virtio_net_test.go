@@ -0,0 +1,172 @@
+// Copyright 2019 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bytes"
+	"io"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+var testMAC = net.HardwareAddr{0x52, 0x54, 0, 0x12, 0x34, 0x56}
+
+// testFrame returns an Ethernet frame with the given payload.
+func testFrame(payload string) []byte {
+	f := append([]byte{}, testMAC...)
+	f = append(f, 0x52, 0x54, 0, 0, 0, 1, 0x88, 0xb5) // local experimental ethertype
+	return append(f, payload...)
+}
+
+// netTx sends the frame from the guest.
+func netTx(d *virtioDriver, frame []byte) {
+	d.t.Helper()
+	head := d.submit(virtioNetTx, &testBuf{data: append(make([]byte, virtioNetHeaderSize), frame...)})
+	d.mustPop(virtioNetTx, head)
+}
+
+// netRx returns the next frame received by the guest.
+func netRx(d *virtioDriver) []byte {
+	d.t.Helper()
+	b := &testBuf{write: true, n: 1526}
+	head := d.submit(virtioNetRx, b)
+	d.wait(virtioNetRx)
+	n := d.mustPop(virtioNetRx, head)
+	if n < virtioNetHeaderSize {
+		d.t.Fatalf("received %d bytes; want at least the header", n)
+	}
+	return append([]byte(nil), d.bytes(b)[virtioNetHeaderSize:n]...)
+}
+
+func TestVirtioNet(t *testing.T) {
+	guest, host := NewNetPair()
+	defer host.Close()
+	var capture bytes.Buffer
+	pw, err := NewPcapWriter(&capture)
+	if err != nil {
+		t.Fatalf("NewPcapWriter failed: %v", err)
+	}
+	d := newVirtioDriver(t, NewVirtioNet(testMAC, guest, pw))
+	for i := range testMAC {
+		if got := byte(d.config(uint64(i), 1)); got != testMAC[i] {
+			t.Errorf("mac[%d] = %#x; want %#x", i, got, testMAC[i])
+		}
+	}
+
+	out := testFrame("from guest")
+	netTx(d, out)
+	got, err := host.Receive()
+	if err != nil {
+		t.Fatalf("host.Receive failed: %v", err)
+	}
+	if !bytes.Equal(got, out) {
+		t.Errorf("host received %x; want %x", got, out)
+	}
+
+	in := testFrame("from host")
+	if err := host.Send(in); err != nil {
+		t.Fatalf("host.Send failed: %v", err)
+	}
+	if got := netRx(d); !bytes.Equal(got, in) {
+		t.Errorf("guest received %x; want %x", got, in)
+	}
+
+	r, err := NewPcapReader(bytes.NewReader(capture.Bytes()))
+	if err != nil {
+		t.Fatalf("NewPcapReader failed: %v", err)
+	}
+	for _, want := range [][]byte{out, in} {
+		got, err := r.ReadFrame()
+		if err != nil {
+			t.Fatalf("ReadFrame failed: %v", err)
+		}
+		if !bytes.Equal(got, want) {
+			t.Errorf("captured %x; want %x", got, want)
+		}
+	}
+	if _, err := r.ReadFrame(); err != io.EOF {
+		t.Errorf("ReadFrame at the end = %v; want io.EOF", err)
+	}
+}
+
+func TestVirtioNetPcapReplay(t *testing.T) {
+	var file bytes.Buffer
+	pw, err := NewPcapWriter(&file)
+	if err != nil {
+		t.Fatalf("NewPcapWriter failed: %v", err)
+	}
+	frames := [][]byte{testFrame("one"), testFrame("two")}
+	for _, f := range frames {
+		pw.WriteFrame(f)
+	}
+	b, err := NewPcapReplay(&file)
+	if err != nil {
+		t.Fatalf("NewPcapReplay failed: %v", err)
+	}
+	d := newVirtioDriver(t, NewVirtioNet(testMAC, b, nil))
+	for _, want := range frames {
+		if got := netRx(d); !bytes.Equal(got, want) {
+			t.Errorf("guest received %x; want %x", got, want)
+		}
+	}
+}
+
+func TestUnixNet(t *testing.T) {
+	dir, err := ioutil.TempDir("", "unixnet")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	a, b := filepath.Join(dir, "a"), filepath.Join(dir, "b")
+	na, err := NewUnixNet(a, b)
+	if err != nil {
+		t.Fatalf("NewUnixNet(a) failed: %v", err)
+	}
+	defer na.Close()
+	// b isn't listening yet; the frame is dropped.
+	if err := na.Send(testFrame("lost")); err != nil {
+		t.Errorf("Send to a missing peer failed: %v", err)
+	}
+	nb, err := NewUnixNet(b, a)
+	if err != nil {
+		t.Fatalf("NewUnixNet(b) failed: %v", err)
+	}
+	defer nb.Close()
+
+	d := newVirtioDriver(t, NewVirtioNet(testMAC, nb, nil))
+	want := testFrame("hello")
+	na.Send(want)
+	if got := netRx(d); !bytes.Equal(got, want) {
+		t.Errorf("guest received %x; want %x", got, want)
+	}
+	netTx(d, want)
+	done := make(chan []byte)
+	go func() {
+		f, _ := na.Receive()
+		done <- f
+	}()
+	select {
+	case got := <-done:
+		if !bytes.Equal(got, want) {
+			t.Errorf("peer received %x; want %x", got, want)
+		}
+	case <-time.After(10 * time.Second):
+		t.Errorf("peer received nothing after 10s")
+	}
+}
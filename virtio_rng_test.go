@@ -0,0 +1,42 @@
+// Copyright 2019 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestVirtioRNG(t *testing.T) {
+	read := func(seed int64) []byte {
+		d := newVirtioDriver(t, NewVirtioRNG(NewSeededRNG(seed)))
+		var got []byte
+		for _, n := range []int{16, 100} {
+			buf := &testBuf{write: true, n: n}
+			if written := d.mustPop(0, d.submit(0, buf)); written != n {
+				t.Errorf("device wrote %d bytes; want %d", written, n)
+			}
+			got = append(got, d.bytes(buf)...)
+		}
+		return got
+	}
+	a, b, c := read(1), read(1), read(2)
+	if !bytes.Equal(a, b) {
+		t.Errorf("same seed produced different bytes:\n%x\n%x", a, b)
+	}
+	if bytes.Equal(a, c) {
+		t.Errorf("different seeds produced the same bytes: %x", a)
+	}
+}
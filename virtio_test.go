@@ -0,0 +1,393 @@
+// Copyright 2019 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"testing"
+	"time"
+)
+
+const (
+	virtioTestAddr  = 0x10001000
+	virtioTestQSize = 16
+	virtioTestRings = 0x10000 // 0x2000 bytes of rings per queue
+	virtioTestBufs  = 0x40000 // buffers are allocated from here
+)
+
+// virtioDriver is a minimal virtio-mmio driver used to test devices.
+type virtioDriver struct {
+	t        *testing.T
+	vm       *VM
+	irq      testLine
+	mmio     *VirtioMMIO
+	features uint64
+	next     uint64   // next free buffer address
+	avail    []uint16 // per queue; next available ring index
+	used     []uint16 // per queue; next used ring index to check
+}
+
+// testBuf is a buffer of a descriptor chain. Writable buffers have size n;
+// readable buffers contain data.
+type testBuf struct {
+	data  []byte
+	write bool
+	n     int
+	addr  uint64 // set by submit
+}
+
+func newVirtioDriver(t *testing.T, dev VirtioDevice) *virtioDriver {
+	t.Helper()
+	d := &virtioDriver{t: t, vm: NewVM(&Prog{MemSize: 1 << 20}), next: virtioTestBufs}
+	d.vm.Bus = &Bus{}
+	d.mmio = NewVirtioMMIO(d.vm, dev, &d.irq)
+	if err := d.vm.Bus.Map(virtioTestAddr, VirtioMMIOSize, d.mmio); err != nil {
+		t.Fatalf("Can't map the device: %v", err)
+	}
+	if got := d.load(virtioMagic); got != virtioMagicValue {
+		t.Fatalf("magic = %#x; want %#x", got, virtioMagicValue)
+	}
+	if got := d.load(virtioVersion); got != 2 {
+		t.Fatalf("version = %d; want 2", got)
+	}
+	if got, want := d.load(virtioDeviceID), dev.ID(); got != want {
+		t.Fatalf("device ID = %d; want %d", got, want)
+	}
+	d.store(virtioStatus, 1|2) // ACKNOWLEDGE, DRIVER
+	for sel := uint32(0); sel < 2; sel++ {
+		d.store(virtioDeviceFeaturesSel, sel)
+		d.features |= uint64(d.load(virtioDeviceFeatures)) << (32 * sel)
+	}
+	if d.features&virtioFVersion1 == 0 {
+		t.Fatalf("device features = %#x; want VIRTIO_F_VERSION_1", d.features)
+	}
+	for sel := uint32(0); sel < 2; sel++ {
+		d.store(virtioDriverFeaturesSel, sel)
+		d.store(virtioDriverFeatures, uint32(d.features>>(32*sel)))
+	}
+	d.store(virtioStatus, 1|2|8) // FEATURES_OK
+	for q := 0; q < dev.NumQueues(); q++ {
+		rings := uint64(virtioTestRings + 0x2000*q)
+		d.store(virtioQueueSel, uint32(q))
+		if max := d.load(virtioQueueNumMax); max < virtioTestQSize {
+			t.Fatalf("queue %d: QueueNumMax = %d; want at least %d", q, max, virtioTestQSize)
+		}
+		d.store(virtioQueueNum, virtioTestQSize)
+		d.store(virtioQueueDescLow, uint32(rings))
+		d.store(virtioQueueDriverLow, uint32(rings+0x1000))
+		d.store(virtioQueueDeviceLow, uint32(rings+0x1800))
+		d.store(virtioQueueReady, 1)
+		d.avail = append(d.avail, 0)
+		d.used = append(d.used, 0)
+	}
+	d.store(virtioStatus, 1|2|8|virtioStatusDriverOK)
+	return d
+}
+
+func (d *virtioDriver) load(reg uint64) uint32 {
+	d.t.Helper()
+	v, err := d.vm.read(virtioTestAddr+reg, 4)
+	if err != nil {
+		d.t.Fatalf("Can't read register %#x: %v", reg, err)
+	}
+	return uint32(v)
+}
+
+func (d *virtioDriver) store(reg uint64, v uint32) {
+	d.t.Helper()
+	if err := d.vm.write(virtioTestAddr+reg, 4, uint64(v)); err != nil {
+		d.t.Fatalf("Can't write %#x to register %#x: %v", v, reg, err)
+	}
+}
+
+// config returns size bytes of the configuration space at offset.
+func (d *virtioDriver) config(offset uint64, size int) uint64 {
+	d.t.Helper()
+	v, err := d.vm.read(virtioTestAddr+virtioConfig+offset, size)
+	if err != nil {
+		d.t.Fatalf("Can't read the configuration space at %#x: %v", offset, err)
+	}
+	return v
+}
+
+// add makes the chain of buffers available in queue q without notifying the
+// device. It returns the head descriptor.
+func (d *virtioDriver) add(q int, bufs ...*testBuf) uint16 {
+	rings := uint64(virtioTestRings + 0x2000*q)
+	head := d.avail[q] * 4 % virtioTestQSize // 4 descriptors per chain
+	for i, b := range bufs {
+		n := len(b.data)
+		if b.write {
+			n = b.n
+		}
+		b.addr = d.next
+		d.next += uint64(n+7) &^ 7
+		copy(d.vm.Mem[b.addr:], b.data)
+		var desc [virtqDescSize]byte
+		binary.LittleEndian.PutUint64(desc[0:], b.addr)
+		binary.LittleEndian.PutUint32(desc[8:], uint32(n))
+		var flags uint16
+		if b.write {
+			flags |= virtqDescFWrite
+		}
+		if i < len(bufs)-1 {
+			flags |= virtqDescFNext
+			binary.LittleEndian.PutUint16(desc[14:], head+uint16(i)+1)
+		}
+		binary.LittleEndian.PutUint16(desc[12:], flags)
+		copy(d.vm.Mem[rings+uint64(head+uint16(i))*virtqDescSize:], desc[:])
+	}
+	avail := rings + 0x1000
+	binary.LittleEndian.PutUint16(d.vm.Mem[avail+virtqRingHeaderSize+2*uint64(d.avail[q]%virtioTestQSize):], head)
+	d.avail[q]++
+	binary.LittleEndian.PutUint16(d.vm.Mem[avail+2:], d.avail[q])
+	return head
+}
+
+// submit makes the chain of buffers available in queue q and notifies the
+// device.
+func (d *virtioDriver) submit(q int, bufs ...*testBuf) uint16 {
+	d.t.Helper()
+	head := d.add(q, bufs...)
+	d.store(virtioQueueNotify, uint32(q))
+	return head
+}
+
+// pop returns the next used element of queue q.
+func (d *virtioDriver) pop(q int) (id uint16, n int, ok bool) {
+	used := uint64(virtioTestRings+0x2000*q) + 0x1800
+	if binary.LittleEndian.Uint16(d.vm.Mem[used+2:]) == d.used[q] {
+		return 0, 0, false
+	}
+	e := d.vm.Mem[used+virtqRingHeaderSize+virtqUsedElemSize*uint64(d.used[q]%virtioTestQSize):]
+	d.used[q]++
+	return uint16(binary.LittleEndian.Uint32(e)), int(binary.LittleEndian.Uint32(e[4:])), true
+}
+
+// mustPop returns the number of bytes written to the next used chain of queue
+// q, which must have the given head.
+func (d *virtioDriver) mustPop(q int, head uint16) int {
+	d.t.Helper()
+	id, n, ok := d.pop(q)
+	if !ok {
+		d.t.Fatalf("queue %d: no used buffers", q)
+	}
+	if id != head {
+		d.t.Fatalf("queue %d: used chain %d; want %d", q, id, head)
+	}
+	return n
+}
+
+// wait waits until the device returns a chain to queue q, for data received
+// on another goroutine. Like a hart, it calls the functions the device queued
+// with Bus.Defer.
+func (d *virtioDriver) wait(q int) {
+	d.t.Helper()
+	used := uint64(virtioTestRings+0x2000*q) + 0x1800
+	for deadline := time.Now().Add(10 * time.Second); ; time.Sleep(time.Millisecond) {
+		d.vm.runDeferred()
+		if binary.LittleEndian.Uint16(d.vm.Mem[used+2:]) != d.used[q] {
+			return
+		}
+		if time.Now().After(deadline) {
+			d.t.Fatalf("queue %d: no used buffers after 10s", q)
+		}
+	}
+}
+
+// bytes returns the contents of the buffer.
+func (d *virtioDriver) bytes(b *testBuf) []byte {
+	return d.vm.Mem[b.addr : b.addr+uint64(b.n)]
+}
+
+// ack acknowledges all interrupts.
+func (d *virtioDriver) ack() {
+	d.store(virtioInterruptACK, d.load(virtioInterruptStatus))
+}
+
+// memImage is a BlockImage in memory.
+type memImage struct {
+	b      []byte
+	synced bool
+}
+
+func (m *memImage) ReadAt(p []byte, off int64) (int, error) {
+	return copy(p, m.b[off:]), nil
+}
+
+func (m *memImage) WriteAt(p []byte, off int64) (int, error) {
+	m.synced = false
+	return copy(m.b[off:], p), nil
+}
+
+func (m *memImage) Sync() error {
+	m.synced = true
+	return nil
+}
+
+func blkHeader(typ uint32, sector uint64) *testBuf {
+	h := make([]byte, virtioBlkHeaderSize)
+	binary.LittleEndian.PutUint32(h, typ)
+	binary.LittleEndian.PutUint64(h[8:], sector)
+	return &testBuf{data: h}
+}
+
+func TestVirtioBlk(t *testing.T) {
+	img := &memImage{b: make([]byte, 8*virtioBlkSectorSize)}
+	for i := range img.b {
+		img.b[i] = byte(i / virtioBlkSectorSize)
+	}
+	d := newVirtioDriver(t, NewVirtioBlk(img, int64(len(img.b)), false, "disk0"))
+	if got := d.config(0, 8); got != 8 {
+		t.Errorf("capacity = %d; want 8", got)
+	}
+	if d.features&virtioBlkFRO != 0 {
+		t.Errorf("features = %#x; want VIRTIO_BLK_F_RO clear", d.features)
+	}
+
+	// Read sectors 2 and 3.
+	data, status := &testBuf{write: true, n: 2 * virtioBlkSectorSize}, &testBuf{write: true, n: 1}
+	head := d.submit(0, blkHeader(virtioBlkTIn, 2), data, status)
+	if !d.irq {
+		t.Errorf("no interrupt after the request completed")
+	}
+	if n := d.mustPop(0, head); n != 2*virtioBlkSectorSize+1 {
+		t.Errorf("used length = %d; want %d", n, 2*virtioBlkSectorSize+1)
+	}
+	if got := d.bytes(status)[0]; got != virtioBlkSOK {
+		t.Errorf("status = %d; want OK", got)
+	}
+	if want := img.b[2*virtioBlkSectorSize : 4*virtioBlkSectorSize]; !bytes.Equal(d.bytes(data), want) {
+		t.Errorf("read data differs from the image")
+	}
+	d.ack()
+	if d.irq {
+		t.Errorf("interrupt pending after ack")
+	}
+
+	// Write sector 7 and flush.
+	w := bytes.Repeat([]byte{0xaa}, virtioBlkSectorSize)
+	status = &testBuf{write: true, n: 1}
+	head = d.submit(0, blkHeader(virtioBlkTOut, 7), &testBuf{data: w}, status)
+	d.mustPop(0, head)
+	if got := d.bytes(status)[0]; got != virtioBlkSOK {
+		t.Errorf("write status = %d; want OK", got)
+	}
+	if !bytes.Equal(img.b[7*virtioBlkSectorSize:], w) {
+		t.Errorf("the write didn't reach the image")
+	}
+	status = &testBuf{write: true, n: 1}
+	head = d.submit(0, blkHeader(virtioBlkTFlush, 0), status)
+	d.mustPop(0, head)
+	if got := d.bytes(status)[0]; got != virtioBlkSOK || !img.synced {
+		t.Errorf("flush status = %d, synced = %v; want OK, true", got, img.synced)
+	}
+
+	// Discard sectors 1-2.
+	seg := make([]byte, virtioBlkDiscardSize)
+	binary.LittleEndian.PutUint64(seg, 1)
+	binary.LittleEndian.PutUint32(seg[8:], 2)
+	status = &testBuf{write: true, n: 1}
+	head = d.submit(0, blkHeader(virtioBlkTDiscard, 0), &testBuf{data: seg}, status)
+	d.mustPop(0, head)
+	if got := d.bytes(status)[0]; got != virtioBlkSOK {
+		t.Errorf("discard status = %d; want OK", got)
+	}
+	if !bytes.Equal(img.b[virtioBlkSectorSize:3*virtioBlkSectorSize], make([]byte, 2*virtioBlkSectorSize)) {
+		t.Errorf("discarded sectors aren't zero")
+	}
+
+	// Out of range reads fail.
+	status = &testBuf{write: true, n: 1}
+	head = d.submit(0, blkHeader(virtioBlkTIn, 8), &testBuf{write: true, n: virtioBlkSectorSize}, status)
+	d.mustPop(0, head)
+	if got := d.bytes(status)[0]; got != virtioBlkSIOErr {
+		t.Errorf("out of range read status = %d; want IOERR", got)
+	}
+
+	id := &testBuf{write: true, n: virtioBlkIDSize}
+	status = &testBuf{write: true, n: 1}
+	head = d.submit(0, blkHeader(virtioBlkTGetID, 0), id, status)
+	d.mustPop(0, head)
+	if got := string(bytes.TrimRight(d.bytes(id), "\x00")); got != "disk0" {
+		t.Errorf("ID = %q; want %q", got, "disk0")
+	}
+
+	// Reset clears the queues.
+	d.store(virtioStatus, 0)
+	d.store(virtioQueueSel, 0)
+	if got := d.load(virtioQueueReady); got != 0 {
+		t.Errorf("QueueReady after reset = %d; want 0", got)
+	}
+}
+
+func TestVirtioBlkReadOnly(t *testing.T) {
+	img := &memImage{b: make([]byte, 4*virtioBlkSectorSize)}
+	d := newVirtioDriver(t, NewVirtioBlk(img, int64(len(img.b)), true, ""))
+	if d.features&virtioBlkFRO == 0 {
+		t.Errorf("features = %#x; want VIRTIO_BLK_F_RO", d.features)
+	}
+	status := &testBuf{write: true, n: 1}
+	head := d.submit(0, blkHeader(virtioBlkTOut, 0), &testBuf{data: bytes.Repeat([]byte{1}, virtioBlkSectorSize)}, status)
+	d.mustPop(0, head)
+	if got := d.bytes(status)[0]; got != virtioBlkSIOErr {
+		t.Errorf("write status = %d; want IOERR", got)
+	}
+	if !bytes.Equal(img.b, make([]byte, len(img.b))) {
+		t.Errorf("read-only image was modified")
+	}
+}
+
+func TestVirtioMalformedChain(t *testing.T) {
+	for _, tt := range []struct {
+		desc    string
+		corrupt func(desc []byte, head uint16) // desc holds the descriptors of the chain
+	}{
+		{"loop", func(desc []byte, head uint16) {
+			binary.LittleEndian.PutUint16(desc[virtqDescSize+12:], virtqDescFWrite|virtqDescFNext)
+			binary.LittleEndian.PutUint16(desc[virtqDescSize+14:], head)
+		}},
+		{"invalid index", func(desc []byte, head uint16) {
+			binary.LittleEndian.PutUint16(desc[virtqDescSize+12:], virtqDescFWrite|virtqDescFNext)
+			binary.LittleEndian.PutUint16(desc[virtqDescSize+14:], 100)
+		}},
+		{"buffer outside memory", func(desc []byte, head uint16) {
+			binary.LittleEndian.PutUint64(desc[0:], 1<<40)
+		}},
+		{"huge buffer", func(desc []byte, head uint16) {
+			binary.LittleEndian.PutUint32(desc[virtqDescSize+8:], 0xffffffff)
+		}},
+	} {
+		d := newVirtioDriver(t, NewVirtioBlk(&memImage{b: make([]byte, 4096)}, 4096, false, ""))
+		head := d.add(0, blkHeader(virtioBlkTGetID, 0), &testBuf{write: true, n: virtioBlkIDSize + 1})
+		tt.corrupt(d.vm.Mem[virtioTestRings+uint64(head)*virtqDescSize:], head)
+		// The notification doesn't fail; the device needs a reset.
+		d.store(virtioQueueNotify, 0)
+		if got := d.load(virtioStatus); got&virtioStatusNeedsReset == 0 {
+			t.Errorf("%s: status = %#x; want DEVICE_NEEDS_RESET", tt.desc, got)
+		}
+		if got := d.load(virtioInterruptStatus); got != virtioInterruptConfig || !d.irq {
+			t.Errorf("%s: interrupt status = %#x, irq = %v; want a configuration change interrupt", tt.desc, got, d.irq)
+		}
+		if _, _, ok := d.pop(0); ok {
+			t.Errorf("%s: the device returned the malformed chain", tt.desc)
+		}
+		d.store(virtioStatus, 0)
+		if got := d.load(virtioStatus); got != 0 || d.irq {
+			t.Errorf("%s: status = %#x, irq = %v after reset; want 0, false", tt.desc, got, d.irq)
+		}
+	}
+}
@@ -17,6 +17,7 @@ package main
 import (
 	"fmt"
 	"strings"
+	"sync"
 	"text/tabwriter"
 	"text/template"
 )
@@ -28,10 +29,14 @@ const (
 	Zero = 0 // Hard-wired zero register.
 )
 
+// Addresses of the user-level counter CSRs read by the RDCYCLE, RDTIME and
+// RDINSTRET pseudo-instructions.
+//
+// riscv-privileged-v1.10; Table 2.2; Page 8
 const (
-	RDCYCLE   = 1
-	RDTIME    = 2
-	RDINSTRET = 3
+	RDCYCLE   = 0xC00
+	RDTIME    = 0xC01
+	RDINSTRET = 0xC02
 )
 
 // Debug is a set of flags that control the debugging state of the VM: what
@@ -57,13 +62,51 @@ type Prog struct {
 // VM executes RISC-V programs by emulating the ISA.
 type VM struct {
 	Reg       [32]uint64
-	CSR       [1 << 11]uint64
+	FReg      [32]uint64 // Floating-point registers; single-precision values are NaN-boxed.
+	CSR       [1 << 12]uint64
 	PC        uint64
+	Priv      int  // Current privilege level: PrivU, PrivS or PrivM.
+	Virt      bool // Virtualization mode: with Priv, VS-mode or VU-mode (see hyp.go).
 	Steps     int
 	Mem       []byte
+	Bus       *Bus   // Memory-mapped devices; may be nil.
+	IMSIC     *IMSIC // Incoming MSI controller (AIA); may be nil.
+	SBI       *SBI   // Built-in SBI firmware; nil means ECALL uses the pk ABI.
 	Debug     Debug
 	LastInstr *Instruction
 	LastPC    uint64
+
+	// TriggerHook, if not nil, is called when a debug trigger fires. If it
+	// returns true, Run stops before the trigger's action is performed and
+	// returns an error for which IsTrigger is true.
+	TriggerHook func(vm *VM, trigger int) bool
+
+	// Misaligned determines how misaligned loads, stores and jumps are
+	// handled. Misaligned accesses performed under the MisalignedWarn
+	// policy are appended to MisalignedAccesses.
+	Misaligned         MisalignedPolicy
+	MisalignedAccesses []MisalignedAccess
+
+	// Semihosting, if not nil, handles semihosting calls. Otherwise EBREAK
+	// does nothing.
+	Semihosting *Semihosting
+
+	triggers [numTriggers]trigger
+	tlb      [tlbSize]tlbEntry
+
+	reserved    bool   // whether LR registered a reservation
+	reservation uint64 // physical address reserved by LR
+	lrValue     uint64 // value loaded by LR; see sc
+	lrSize      int    // size of the value loaded by LR
+
+	harts     []*VM         // all harts of the machine, including this one; nil if there's one hart
+	world     *sync.RWMutex // read-locked while the hart runs in parallel mode; see stopTheWorld
+	exclusive bool          // whether the hart stopped the world
+
+	clint    *CLINT // drives mip.MTIP; may be nil
+	mtimecmp uint64 // CLINT's mtimecmp register of this hart
+	waiting  bool   // executed WFI and waits for an interrupt
+	stopped  bool   // stopped with the SBI HSM extension
 }
 
 // whether to print argc, argv, envp at startup
@@ -75,9 +118,12 @@ const debugInitialStack = false
 // when VM's memory is setup based on Spike's memory).
 func NewVM(p *Prog) *VM {
 	vm := &VM{
-		PC:  p.Start,
-		Mem: make([]byte, p.MemSize),
+		PC:   p.Start,
+		Priv: PrivM,
+		Mem:  make([]byte, p.MemSize),
 	}
+	vm.CSR[csrMisa] = misaDefault
+	vm.CSR[csrMstatus] = fsInitial << mstatusFSShift // the FPU is usable without firmware
 
 	if p.Argv == nil && p.Env == nil {
 		return vm
@@ -101,9 +147,12 @@ func NewVM(p *Prog) *VM {
 	}
 	memSize += uint64(1+len(p.Env)+1+len(p.Argv)+1) * 8
 	vm = &VM{
-		PC:  p.Start,
-		Mem: make([]byte, memSize),
+		PC:   p.Start,
+		Priv: PrivM,
+		Mem:  make([]byte, memSize),
 	}
+	vm.CSR[csrMisa] = misaDefault
+	vm.CSR[csrMstatus] = fsInitial << mstatusFSShift // the FPU is usable without firmware
 	vm.Reg[SP] = memSize
 
 	// Initialize the stack.
@@ -190,6 +239,9 @@ func (vm VM) String() string {
 		"PC":    vm.LastPC,
 		"Steps": vm.Steps,
 	}
+	if vm.harts != nil {
+		data["Hart"] = fmt.Sprint(vm.CSR[csrMhartid])
+	}
 	if vm.Debug&DebugInstr != 0 {
 		data["Instr"] = vm.LastInstr
 	}
@@ -261,7 +313,8 @@ func (vm VM) String() string {
 }
 
 var dbgTmpl = template.Must(template.New("").Parse(`=========== {{.Name}} VM ============
-Steps: {{.Steps}}
+{{with .Hart}}Hart:  {{.}}
+{{end}}Steps: {{.Steps}}
 PC:    {{printf "%#x" .PC}} ({{.PC}})
 {{with .Instr}}INSTR: {{.}}
 {{end}}{{with .Regs}}
@@ -275,15 +328,59 @@ RDINSTRET: {{.RDINSTRET}}
 [ MEMORY ]
 {{.}}{{end}}`))
 
-// Run executes n instructions.
+// Run executes n instructions. Before every instruction, it calls functions
+// queued by devices with Bus.Defer.
 func (vm *VM) Run(n int) error {
 	for i := 0; i < n; i++ {
-		// We support only instructions of size 2 and 4.
-		end := int(vm.PC + 4)
-		if end > len(vm.Mem) {
-			end = len(vm.Mem)
+		vm.runDeferred()
+		if vm.stopped {
+			vm.idle()
+			continue
+		}
+		if err := vm.interrupt(); IsTrigger(err) {
+			return err
+		} else if err != nil {
+			return fmt.Errorf("run(%d of %d): %v", i+1, n, err)
+		}
+		if vm.waiting {
+			if vm.pendingInterrupts() == 0 {
+				vm.idle()
+				continue
+			}
+			vm.waiting = false
+		}
+		code, err := vm.fetch(vm.PC)
+		if e, ok := err.(*exception); ok {
+			if err := vm.raise(e); err != nil {
+				return fmt.Errorf("run(%d of %d): %v", i+1, n, err)
+			}
+			vm.Steps++
+			vm.CSR[RDCYCLE]++
+			vm.tick(1)
+			continue
+		}
+		if err != nil {
+			return fmt.Errorf("run(%d of %d): %v", i+1, n, err)
+		}
+		in, size, err := Decode(vm.PC, code)
+		if err != nil && (vm.Priv != PrivM || vm.CSR[csrMtvec] != 0) {
+			// Programs with a trap handler get illegal-instruction
+			// exceptions instead.
+			var bits uint64
+			for j := len(code) - 1; j >= 0; j-- {
+				bits = bits<<8 | uint64(code[j])
+			}
+			if s, ok := decodeSize(code); ok && s < len(code) {
+				bits &= 1<<(8*uint(s)) - 1
+			}
+			if err := vm.trap(causeIllegalInstr, bits); err != nil {
+				return fmt.Errorf("run(%d of %d): %v", i+1, n, err)
+			}
+			vm.Steps++
+			vm.CSR[RDCYCLE]++
+			vm.tick(1)
+			continue
 		}
-		in, size, err := Decode(vm.PC, vm.Mem[vm.PC:end])
 		if err != nil {
 			return fmt.Errorf("run(%d %d): %v", i+1, n, err)
 		}
@@ -295,20 +392,44 @@ func (vm *VM) Run(n int) error {
 		if in.fn == nil {
 			return fmt.Errorf("nil instructions after %d steps at %#x: %s", vm.Steps, vm.PC, in)
 		}
-		out, err := in.fn(vm, in)
-		if IsExit(err) {
+		priv := vm.Priv
+		out, err := flags{}, vm.memTriggers(mc6Execute, vm.PC, size, in.in, phaseAll)
+		if err == nil {
+			out, err = in.fn(vm, in)
+		}
+		if IsExit(err) || IsTrigger(err) {
 			return err
 		}
+		if e, ok := err.(*exception); ok {
+			// The instruction didn't retire.
+			if err := vm.raise(e); err != nil {
+				return fmt.Errorf("run(%d of %d): %v", i+1, n, err)
+			}
+			vm.Steps++
+			vm.CSR[RDCYCLE]++
+			vm.tick(1)
+			continue
+		}
 		if err != nil {
 			return fmt.Errorf("run(%d of %d): %v", i+1, n, err)
 		}
 		vm.Steps++
-		if !out.updatedRDINSTRET {
-			vm.CSR[RDINSTRET]++
-		}
+		vm.CSR[RDINSTRET]++
+		vm.CSR[RDCYCLE]++
+		vm.tick(1)
 		if !out.updatedPC {
 			vm.PC += uint64(size)
 		}
+		err = vm.icountTriggers(priv)
+		if e, ok := err.(*exception); ok {
+			err = vm.raise(e)
+		}
+		if IsTrigger(err) {
+			return err
+		}
+		if err != nil {
+			return fmt.Errorf("run(%d of %d): %v", i+1, n, err)
+		}
 	}
 	return nil
 }
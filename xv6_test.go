@@ -0,0 +1,253 @@
+// Copyright 2019 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bytes"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// xv6Steps is the number of instructions after which TestXV6 gives up.
+// usertests executes a few billion instructions.
+const xv6Steps = 50e9
+
+// TestXV6 boots xv6-riscv on the virt machine and runs usertests from its
+// shell. The kernel and the file system image are built by xv6's Makefile; the
+// test is skipped unless XV6_KERNEL and XV6_FS point at them:
+//
+//	XV6_KERNEL=xv6-riscv/kernel/kernel XV6_FS=xv6-riscv/fs.img go test -run XV6 -timeout 2h
+//
+// Neither is in the tree, so the test is skipped by default. TestVirtPayload
+// runs the same path through the machine on every test run: M-mode hands over
+// to S-mode with Sv39 on, and a virtio interrupt arrives through the PLIC.
+func TestXV6(t *testing.T) {
+	kernel, fs := os.Getenv("XV6_KERNEL"), os.Getenv("XV6_FS")
+	if kernel == "" || fs == "" {
+		t.Skip("XV6_KERNEL and XV6_FS aren't set")
+	}
+	if testing.Short() {
+		t.Skip("usertests take minutes")
+	}
+	// usertests modify the file system, so they run on a copy.
+	img, err := ioutil.ReadFile(fs)
+	if err != nil {
+		t.Fatal(err)
+	}
+	dir, err := ioutil.TempDir("", "xv6")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	fsCopy := filepath.Join(dir, "fs.img")
+	if err := ioutil.WriteFile(fsCopy, img, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	c, ok := MachineProfile("virt")
+	if !ok {
+		t.Fatal("there's no virt machine profile")
+	}
+	c.Devices = append(c.Devices, DeviceConfig{Type: "virtio-blk", Base: virtioAddr, IRQ: virtioIRQ, Path: fsCopy})
+	var out bytes.Buffer
+	vm, err := c.NewVM(&out)
+	if err != nil {
+		t.Fatalf("NewVM() failed: %v", err)
+	}
+	kimg, err := vm.Load(LoadSpec{Path: kernel})
+	if err != nil {
+		t.Fatalf("Load(%q) failed: %v", kernel, err)
+	}
+	vm.PC = kimg.Entry
+	var uart *UART
+	for _, r := range vm.Bus.regions {
+		if u, ok := r.dev.(*UART); ok {
+			uart = u
+		}
+	}
+
+	// The command is typed once the shell prints its first prompt.
+	input := []byte("usertests -q\n")
+	typed := false
+	const chunk = 1e6
+	for vm.Steps < xv6Steps {
+		if err := vm.Run(chunk); err != nil {
+			t.Fatalf("Run failed after %d steps: %v\n%s", vm.Steps, err, out.String())
+		}
+		s := out.String()
+		switch {
+		case strings.Contains(s, "ALL TESTS PASSED"):
+			return
+		case strings.Contains(s, "SOME TESTS FAILED"), strings.Contains(s, "panic:"):
+			t.Fatalf("usertests failed:\n%s", s)
+		}
+		if !typed && strings.Contains(s, "$ ") {
+			input = input[uart.Receive(input):]
+			typed = len(input) == 0
+		}
+	}
+	t.Fatalf("usertests didn't finish in %d steps:\n%s", uint64(xv6Steps), out.String())
+}
+
+// Addresses used by virtPayload in the RAM of the virt machine.
+const (
+	virtRAM       = 0x80000000
+	virtPageTable = 0x80001000 // root table with two gigapages
+	virtDesc      = 0x80002000 // descriptor table of the entropy device
+	virtAvail     = 0x80002100
+	virtUsed      = 0x80002200
+	virtBuf       = 0x80003000
+	virtBufLen    = 16
+)
+
+// virtPayload is a tiny program for the virt machine, in the way xv6 starts.
+// M-mode code enables source 1 (the first virtio-mmio slot) for the S-mode
+// context of hart 0 on the PLIC, delegates supervisor external interrupts,
+// turns on Sv39 with the root table at virtPageTable and enters S-mode. There
+// it sets up the queue of the entropy device in the first slot, notifies it
+// and waits. The trap handler saves scause in s1, claims the interrupt into
+// s2, acknowledges it on the device, completes it and passes with the test
+// finisher. Built with llvm-mc -triple=riscv64.
+var virtPayload = []uint64{
+	0x0c0002b7, // lui t0, 0xc000
+	0x00100313, // li t1, 1
+	0x0062a223, // sw t1, 4(t0)  # priority of source 1
+	0x0c0022b7, // lui t0, 0xc002
+	0x0802829b, // addiw t0, t0, 0x80
+	0x00200313, // li t1, 2
+	0x0062a023, // sw t1, 0(t0)  # enable source 1 for context 1
+	0x20000293, // li t0, 0x200  # SEIP
+	0x30329073, // csrw mideleg, t0
+	0x10429073, // csrw sie, t0
+	0x00000297, // auipc t0, 0
+	0x0b828293, // addi t0, t0, 0xb8  # strap
+	0x10529073, // csrw stvec, t0
+	0xfff00293, // li t0, -1
+	0x02c29293, // slli t0, t0, 44
+	0x00128293, // addi t0, t0, 1
+	0x01329293, // slli t0, t0, 19
+	0x00128293, // addi t0, t0, 1  # Sv39, virtPageTable
+	0x18029073, // csrw satp, t0
+	0x000012b7, // lui t0, 1
+	0x8002829b, // addiw t0, t0, -0x800  # MPP = S
+	0x3002a073, // csrs mstatus, t0
+	0x00000297, // auipc t0, 0
+	0x01028293, // addi t0, t0, 0x10  # smain
+	0x34129073, // csrw mepc, t0
+	0x30200073, // mret
+	// smain:
+	0x10016073, // csrsi sstatus, 2  # SIE
+	0x10001437, // lui s0, 0x10001  # virtio-mmio slot 0
+	0x00300293, // li t0, 3
+	0x06542823, // sw t0, 0x70(s0)  # Status = ACKNOWLEDGE|DRIVER
+	0x00100293, // li t0, 1
+	0x02542223, // sw t0, 0x24(s0)  # DriverFeaturesSel
+	0x02542023, // sw t0, 0x20(s0)  # DriverFeatures = VERSION_1
+	0x00b00293, // li t0, 11
+	0x06542823, // sw t0, 0x70(s0)  # Status |= FEATURES_OK
+	0x02042823, // sw zero, 0x30(s0)  # QueueSel
+	0x00800293, // li t0, 8
+	0x02542c23, // sw t0, 0x38(s0)  # QueueNum
+	0x400012b7, // lui t0, 0x40001
+	0x00129293, // slli t0, t0, 1
+	0x08542023, // sw t0, 0x80(s0)  # QueueDescLow = virtDesc
+	0x400012b7, // lui t0, 0x40001
+	0x00129293, // slli t0, t0, 1
+	0x10028293, // addi t0, t0, 0x100
+	0x08542823, // sw t0, 0x90(s0)  # QueueDriverLow = virtAvail
+	0x400012b7, // lui t0, 0x40001
+	0x00129293, // slli t0, t0, 1
+	0x20028293, // addi t0, t0, 0x200
+	0x0a542023, // sw t0, 0xa0(s0)  # QueueDeviceLow = virtUsed
+	0x00100293, // li t0, 1
+	0x04542223, // sw t0, 0x44(s0)  # QueueReady
+	0x00f00293, // li t0, 15
+	0x06542823, // sw t0, 0x70(s0)  # Status |= DRIVER_OK
+	0x04042823, // sw zero, 0x50(s0)  # QueueNotify
+	0x10500073, // wfi
+	0xffdff06f, // j -4
+	// strap:
+	0x142024f3, // csrr s1, scause
+	0x0c2012b7, // lui t0, 0xc201
+	0x0042829b, // addiw t0, t0, 4
+	0x0002a903, // lw s2, 0(t0)  # claim for context 1
+	0x06042303, // lw t1, 0x60(s0)  # InterruptStatus
+	0x06642223, // sw t1, 0x64(s0)  # InterruptACK
+	0x0122a023, // sw s2, 0(t0)  # complete
+	0x001002b7, // lui t0, 0x100  # test finisher
+	0x00005337, // lui t1, 5
+	0x5553031b, // addiw t1, t1, 0x555
+	0x0062a023, // sw t1, 0(t0)
+}
+
+func TestVirtPayload(t *testing.T) {
+	c, ok := MachineProfile("virt")
+	if !ok {
+		t.Fatal("there's no virt machine profile")
+	}
+	seed := int64(1)
+	c.Devices = append(c.Devices, DeviceConfig{Type: "virtio-rng", Base: virtioAddr, IRQ: virtioIRQ, Seed: &seed})
+	vm, err := c.NewVM(ioutil.Discard)
+	if err != nil {
+		t.Fatalf("NewVM() failed: %v", err)
+	}
+	const rwx = pteV | pteR | pteW | pteX | pteA | pteD
+	for _, w := range []struct {
+		addr uint64
+		size int
+		v    uint64
+	}{
+		{virtPageTable, 8, pte(0, rwx&^pteX)}, // devices
+		{virtPageTable + 2*8, 8, pte(virtRAM, rwx)},
+		{virtDesc, 8, virtBuf},
+		{virtDesc + 8, 4, virtBufLen},
+		{virtDesc + 12, 2, virtqDescFWrite},
+		{virtAvail + 2, 2, 1}, // idx; the ring holds descriptor 0
+	} {
+		if err := vm.write(w.addr, w.size, w.v); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for i, in := range virtPayload {
+		if err := vm.write(virtRAM+4*uint64(i), 4, in); err != nil {
+			t.Fatal(err)
+		}
+	}
+	vm.PC = virtRAM
+
+	if err := vm.Run(1000); !reflect.DeepEqual(err, &ExitError{}) {
+		t.Fatalf("Run() = %v; want the test finisher to pass\n%v", err, vm)
+	}
+	if vm.Priv != PrivS || vm.CSR[csrSatp]>>satpModeShift != satpModeSv39 {
+		t.Errorf("priv, satp = %d, %#x; want S-mode with Sv39", vm.Priv, vm.CSR[csrSatp])
+	}
+	if scause, claim := vm.Reg[regNums["s1"]], vm.Reg[regNums["s2"]]; scause != causeInterrupt|9 || claim != virtioIRQ {
+		t.Errorf("scause, claimed source = %#x, %d; want a supervisor external interrupt from source %d", scause, claim, virtioIRQ)
+	}
+	if idx, _ := vm.read(virtUsed+2, 2); idx != 1 {
+		t.Errorf("used idx = %d; want 1", idx)
+	}
+	want := make([]byte, virtBufLen)
+	io.ReadFull(NewSeededRNG(seed), want)
+	got := make([]byte, virtBufLen)
+	if err := vm.readBytes(virtBuf, got); err != nil || !bytes.Equal(got, want) {
+		t.Errorf("buffer = %x, %v; want %x", got, err, want)
+	}
+}